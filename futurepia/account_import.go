@@ -0,0 +1,110 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/blocktree/go-owcrypt"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//ImportedAccount 从WIF导入的链上账户
+//Account和Address可保存到openwallet的资产账户和地址中，PrivateKey需由调用方妥善保存
+type ImportedAccount struct {
+	Account    *openwallet.AssetsAccount
+	Address    *openwallet.Address
+	PrivateKey []byte
+	Compressed bool //导入的WIF是否为压缩格式
+}
+
+//ImportWIFAccount 用官方钱包导出的WIF私钥导入已注册的链上账户，私钥同时加入KeyRing
+//导入的密钥不属于HD钱包，资产账户没有衍生路径，AccountID由公钥计算
+func (wm *WalletManager) ImportWIFAccount(alias, wif string) (*ImportedAccount, error) {
+
+	if err := ValidateAccountName(alias); err != nil {
+		return nil, fmt.Errorf("invalid account name %s: %v", alias, err)
+	}
+
+	priv, compressed, err := DecodeWIF(wif)
+	if err != nil {
+		return nil, err
+	}
+
+	imported, err := wm.importAccount(alias, priv)
+	if err != nil {
+		return nil, err
+	}
+	imported.Compressed = compressed
+	return imported, nil
+}
+
+//importAccount 查询私钥在账户链上权限中的角色，生成资产账户和地址并把私钥加入KeyRing
+func (wm *WalletManager) importAccount(alias string, priv []byte) (*ImportedAccount, error) {
+
+	pub, ret := owcrypt.GenPubkey(priv, wm.CurveType())
+	if ret != owcrypt.SUCCESS {
+		return nil, fmt.Errorf("generate public key failed")
+	}
+	pub = owcrypt.PointCompress(pub, wm.CurveType())
+
+	address, err := wm.DecoderV2.AddressEncode(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	authority, err := wm.Api.GetAccountAuthority(alias)
+	if err != nil {
+		return nil, fmt.Errorf("query account %s failed, unexpected error: %v", alias, err)
+	}
+	role := authority.roleOf(address)
+	if role == "" {
+		return nil, fmt.Errorf("key %s is not an authority of account %s", address, alias)
+	}
+
+	pubHex := hex.EncodeToString(pub)
+	account := &openwallet.AssetsAccount{
+		Alias:     alias,
+		AccountID: openwallet.GenAccountIDByHex(pubHex),
+		PublicKey: pubHex,
+		OwnerKeys: []string{pubHex},
+		Required:  1,
+		Symbol:    wm.Symbol(),
+	}
+
+	addr := &openwallet.Address{
+		AccountID:   account.AccountID,
+		Address:     address,
+		PublicKey:   pubHex,
+		Alias:       alias,
+		Symbol:      wm.Symbol(),
+		CreatedTime: time.Now().Unix(),
+	}
+	err = SetAddressRole(addr, role)
+	if err != nil {
+		return nil, err
+	}
+
+	wm.KeyRing.Add(address, priv)
+
+	return &ImportedAccount{
+		Account:    account,
+		Address:    addr,
+		PrivateKey: priv,
+	}, nil
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestImportWIFAccount(t *testing.T) {
+	node := newFakeNode(t, 10)
+	node.setBalance("alice", "1.00000000 PIA")
+	node.setAuthority("alice", map[string]string{RoleOwner: "FPA6MRyAjQq8ud7hVNYcfnVPJqcVpscN5So8BhtHuGYqET5GDW5CV"})
+	node.setBalance("bob", "1.00000000 PIA")
+	wm, _, _ := testScanWalletManager(t, node)
+
+	const wif = "5KQwrPbwdL6PhXujxW37FSSQZ1JiwsST4cqQzDeyXtP79zkvFD3"
+	imported, err := wm.ImportWIFAccount("alice", wif)
+	if err != nil {
+		t.Fatalf("import account failed: %v", err)
+	}
+
+	if imported.Address.Address != "FPA6MRyAjQq8ud7hVNYcfnVPJqcVpscN5So8BhtHuGYqET5GDW5CV" {
+		t.Errorf("unexpected address: %s", imported.Address.Address)
+	}
+	if imported.Account.Alias != "alice" || imported.Account.AccountID == "" || imported.Account.AccountID != imported.Address.AccountID {
+		t.Errorf("unexpected account: %+v", imported.Account)
+	}
+	if role := AddressRole(imported.Address); role != RoleOwner {
+		t.Errorf("expected owner role, got %s", role)
+	}
+	if _, ok := wm.KeyRing.Get(imported.Address.Address); !ok {
+		t.Errorf("expected key added to key ring")
+	}
+	if imported.Compressed {
+		t.Errorf("expected uncompressed wif")
+	}
+	priv, _, _ := DecodeWIF(wif)
+	if !bytes.Equal(imported.PrivateKey, priv) {
+		t.Errorf("unexpected private key: %x", imported.PrivateKey)
+	}
+
+	if _, err := wm.ImportWIFAccount("carol", wif); err == nil {
+		t.Errorf("expected unregistered account error")
+	}
+	if _, err := wm.ImportWIFAccount("bob", wif); err == nil {
+		t.Errorf("expected key not in account authority error")
+	}
+	if _, err := wm.ImportWIFAccount("Alice", wif); err == nil {
+		t.Errorf("expected invalid account name error")
+	}
+	if _, err := wm.ImportWIFAccount("alice", wif[:len(wif)-1]+"4"); err == nil {
+		t.Errorf("expected invalid wif error")
+	}
+}
@@ -16,7 +16,16 @@
 package futurepia
 
 import (
+	"fmt"
+
 	"github.com/blocktree/go-owcdrivers/addressEncoder"
+	"github.com/blocktree/go-owcrypt"
+)
+
+const (
+	privateKeyLength      = 32 //私钥长度
+	wifUncompressedLength = 37 //未压缩WIF解码后长度，版本号+私钥+校验码
+	wifCompressedLength   = 38 //压缩WIF解码后长度，版本号+私钥+压缩标志+校验码
 )
 
 var (
@@ -35,18 +44,24 @@ func NewAddressDecoder(wm *WalletManager) *addressDecoder {
 	return &decoder
 }
 
-//PrivateKeyToWIF 私钥转WIF
+//PrivateKeyToWIF 私钥转WIF，与官方钱包一致使用未压缩格式
 func (decoder *addressDecoder) PrivateKeyToWIF(priv []byte, isTestnet bool) (string, error) {
-	return "", nil
+	return EncodeWIF(priv, false)
+}
+
+//PrivateKeyToCompressedWIF 私钥转压缩格式WIF
+func (decoder *addressDecoder) PrivateKeyToCompressedWIF(priv []byte) (string, error) {
+	return EncodeWIF(priv, true)
 }
 
 //PublicKeyToAddress 公钥转地址
 func (decoder *addressDecoder) PublicKeyToAddress(pub []byte, isTestnet bool) (string, error) {
-	PIAPublicKeyPrefixCompat       := decoder.wm.Config.AddressPrefix
-	PIA_mainnetPublic               := addressEncoder.AddressType{"eos", addressEncoder.BTCAlphabet, "ripemd160", "", 33, []byte(PIAPublicKeyPrefixCompat), nil}
+	return EncodePublicKey(pub, decoder.wm.Config.AddressPrefix), nil
+}
 
-	address := addressEncoder.AddressEncode(pub, PIA_mainnetPublic)
-	return address, nil
+//AddressToPublicKey 地址转公钥，返回33字节压缩公钥
+func (decoder *addressDecoder) AddressToPublicKey(address string, isTestnet bool) ([]byte, error) {
+	return DecodePublicKey(address, decoder.wm.Config.AddressPrefix)
 }
 
 //RedeemScriptToAddress 多重签名赎回脚本转地址
@@ -54,11 +69,64 @@ func (decoder *addressDecoder) RedeemScriptToAddress(pubs [][]byte, required uin
 	return "", nil
 }
 
-//WIFToPrivateKey WIF转私钥
+//WIFToPrivateKey WIF转私钥，支持压缩和未压缩格式
 func (decoder *addressDecoder) WIFToPrivateKey(wif string, isTestnet bool) ([]byte, error) {
-	priv, err := addressEncoder.AddressDecode(wif, PIA_mainnetPrivateWIF)
+	priv, _, err := DecodeWIF(wif)
 	if err != nil {
 		return nil, err
 	}
 	return priv, nil
 }
+
+//EncodeWIF 私钥编码为WIF，compressed为true时追加压缩标志
+func EncodeWIF(priv []byte, compressed bool) (string, error) {
+	if err := checkPrivateKey(priv); err != nil {
+		return "", err
+	}
+	wifType := PIA_mainnetPrivateWIF
+	if compressed {
+		wifType = PIA_mainnetPrivateWIFCompressed
+	}
+	return addressEncoder.AddressEncode(priv, wifType), nil
+}
+
+//DecodeWIF 解析WIF，校验版本号和校验码，返回私钥及是否为压缩格式
+func DecodeWIF(wif string) ([]byte, bool, error) {
+	data, err := addressEncoder.Base58Decode(wif, addressEncoder.NewBase58Alphabet(addressEncoder.BTCAlphabet))
+	if err != nil {
+		return nil, false, fmt.Errorf("wif is not base58 encoded")
+	}
+
+	var (
+		wifType    addressEncoder.AddressType
+		compressed bool
+	)
+	switch len(data) {
+	case wifUncompressedLength:
+		wifType = PIA_mainnetPrivateWIF
+	case wifCompressedLength:
+		wifType, compressed = PIA_mainnetPrivateWIFCompressed, true
+	default:
+		return nil, false, fmt.Errorf("wif length is invalid")
+	}
+
+	priv, err := addressEncoder.AddressDecode(wif, wifType)
+	if err != nil {
+		return nil, false, fmt.Errorf("wif checksum or version is invalid")
+	}
+	if err := checkPrivateKey(priv); err != nil {
+		return nil, false, err
+	}
+	return priv, compressed, nil
+}
+
+//checkPrivateKey 校验私钥长度及是否在曲线阶范围内
+func checkPrivateKey(priv []byte) error {
+	if len(priv) != privateKeyLength {
+		return fmt.Errorf("private key length must be %d", privateKeyLength)
+	}
+	if _, ret := owcrypt.GenPubkey(priv, CurveType); ret != owcrypt.SUCCESS {
+		return fmt.Errorf("private key is out of range")
+	}
+	return nil
+}
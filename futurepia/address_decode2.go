@@ -1,14 +1,28 @@
 package futurepia
 
 import (
+	"bytes"
+	"fmt"
+	"strings"
+
 	"github.com/blocktree/go-owcdrivers/addressEncoder"
+	"github.com/blocktree/go-owcrypt"
 	"github.com/blocktree/openwallet/v2/openwallet"
 )
 
-var (
-	Default = AddressDecoderV2{}
+const (
+	defaultAddressPrefix = "FPA" //公钥默认前缀
+
+	minAccountNameLength = 3  //账户名最短长度
+	maxAccountNameLength = 16 //账户名最长长度
+	publicKeyLength      = 33 //压缩公钥长度
+	publicKeyChecksumLen = 4  //公钥校验码长度，ripemd160的前4字节
 )
 
+//Default 未绑定钱包管理者的地址解码器
+//Deprecated: 前缀按网络配置，使用NewAddressDecoder2创建，Default固定使用主网前缀
+var Default = AddressDecoderV2{}
+
 //AddressDecoderV2
 type AddressDecoderV2 struct {
 	*openwallet.AddressDecoderV2Base
@@ -21,20 +35,123 @@ func NewAddressDecoder2(wm *WalletManager) *AddressDecoderV2 {
 	return &decoder
 }
 
+//addressPrefix 配置的公钥前缀，未绑定钱包管理者时使用主网前缀
+func (dec *AddressDecoderV2) addressPrefix() string {
+	if dec.wm == nil {
+		return defaultAddressPrefix
+	}
+	return dec.wm.Config.AddressPrefix
+}
+
 //AddressEncode 地址编码
 func (dec *AddressDecoderV2) AddressEncode(hash []byte, opts ...interface{}) (string, error) {
-	PIAPublicKeyPrefixCompat := dec.wm.Config.AddressPrefix
-	PIA_mainnetPublic := addressEncoder.AddressType{"eos", addressEncoder.BTCAlphabet, "ripemd160", "", 33, []byte(PIAPublicKeyPrefixCompat), nil}
-	address := addressEncoder.AddressEncode(hash, PIA_mainnetPublic)
-	return address, nil
+	return EncodePublicKey(hash, dec.addressPrefix()), nil
 }
 
-// AddressVerify 地址校验
+//EncodePublicKey 压缩公钥编码为带前缀的地址
+func EncodePublicKey(pubKey []byte, prefix string) string {
+	publicKeyType := addressEncoder.AddressType{
+		EncodeType:   "eos",
+		Alphabet:     addressEncoder.BTCAlphabet,
+		ChecksumType: "ripemd160",
+		HashLen:      publicKeyLength,
+		Prefix:       []byte(prefix),
+	}
+	//编码时校验码追加在输入之后，复制一份避免写入调用方切片的剩余容量
+	key := make([]byte, len(pubKey), len(pubKey)+publicKeyChecksumLen)
+	copy(key, pubKey)
+	return addressEncoder.AddressEncode(key, publicKeyType)
+}
+
+//AddressDecode 地址解码，校验配置的前缀和校验码，返回33字节压缩公钥
+func (dec *AddressDecoderV2) AddressDecode(addr string, opts ...interface{}) ([]byte, error) {
+	return DecodePublicKey(addr, dec.addressPrefix())
+}
+
+// AddressVerify 地址校验，账户名按命名规则、公钥按前缀、base58和校验码离线校验
+// 配置VerifyAccountOnChain时账户名还需已在链上注册
 func (dec *AddressDecoderV2) AddressVerify(address string, opts ...interface{}) bool {
-	_, err := dec.wm.Api.GetBalance(address, dec.wm.Config.FeeString)
-	if err == nil {
+	if _, err := DecodePublicKey(address, dec.addressPrefix()); err == nil {
 		return true
-	} else {
+	}
+
+	if err := ValidateAccountName(address); err != nil {
+		return false
+	}
+
+	if dec.wm == nil || !dec.wm.Config.VerifyAccountOnChain {
+		return true
+	}
+
+	exists, err := dec.wm.Api.AccountExists(address)
+	if err != nil {
+		dec.wm.Log.Std.Error("verify account %s on chain failed, unexpected error: %v", address, err)
 		return false
 	}
+	return exists
+}
+
+//ValidateAccountName 按链上规则校验账户名
+//长度3到16，以.分段，每段至少3个字符，以小写字母开头、小写字母或数字结尾，
+//只包含小写字母、数字和-，且不能有连续的-
+func ValidateAccountName(name string) error {
+
+	if len(name) < minAccountNameLength || len(name) > maxAccountNameLength {
+		return fmt.Errorf("account name length must be between %d and %d", minAccountNameLength, maxAccountNameLength)
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if len(label) < minAccountNameLength {
+			return fmt.Errorf("each account name segment must be at least %d characters", minAccountNameLength)
+		}
+		if label[0] < 'a' || label[0] > 'z' {
+			return fmt.Errorf("each account name segment must start with a lowercase letter")
+		}
+		last := label[len(label)-1]
+		if !(last >= 'a' && last <= 'z') && !(last >= '0' && last <= '9') {
+			return fmt.Errorf("each account name segment must end with a lowercase letter or digit")
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			switch {
+			case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			case c == '-':
+				if label[i-1] == '-' {
+					return fmt.Errorf("account name segment can not contain consecutive dashes")
+				}
+			default:
+				return fmt.Errorf("account name can only contain lowercase letters, digits, dashes and dots")
+			}
+		}
+	}
+
+	return nil
+}
+
+//DecodePublicKey 解析带前缀的公钥，校验base58编码、ripemd160校验码和曲线上的点，返回33字节压缩公钥
+func DecodePublicKey(pubKey, prefix string) ([]byte, error) {
+
+	if prefix == "" || !strings.HasPrefix(pubKey, prefix) {
+		return nil, fmt.Errorf("public key should start with %q", prefix)
+	}
+
+	data, err := addressEncoder.Base58Decode(pubKey[len(prefix):], addressEncoder.NewBase58Alphabet(addressEncoder.BTCAlphabet))
+	if err != nil {
+		return nil, fmt.Errorf("public key is not base58 encoded")
+	}
+	if len(data) != publicKeyLength+publicKeyChecksumLen {
+		return nil, fmt.Errorf("public key length is invalid")
+	}
+
+	key, checksum := data[:publicKeyLength], data[publicKeyLength:]
+	digest := owcrypt.Hash(key, 0, owcrypt.HASH_ALG_RIPEMD160)
+	if !bytes.Equal(digest[:publicKeyChecksumLen], checksum) {
+		return nil, fmt.Errorf("public key checksum mismatch")
+	}
+
+	if (key[0] != 0x02 && key[0] != 0x03) || owcrypt.PointDecompress(key, CurveType) == nil {
+		return nil, fmt.Errorf("public key is not a valid point")
+	}
+
+	return key, nil
 }
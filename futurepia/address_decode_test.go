@@ -0,0 +1,256 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/blocktree/go-owcrypt"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+)
+
+func testPublicKey(t *testing.T, seed byte) []byte {
+	priv := bytes.Repeat([]byte{seed}, 32)
+	pub, ret := owcrypt.GenPubkey(priv, CurveType)
+	if ret != owcrypt.SUCCESS {
+		t.Fatalf("generate public key failed")
+	}
+	return owcrypt.PointCompress(pub, CurveType)
+}
+
+func TestValidateAccountName(t *testing.T) {
+	valid := []string{"bob", "alice", "a1-b2", "abc.def", "exchange-01", "abcdefghijklmnop", "ab0.cd1.ef2"}
+	for _, name := range valid {
+		if err := ValidateAccountName(name); err != nil {
+			t.Errorf("expected %q valid, got %v", name, err)
+		}
+	}
+
+	invalid := []string{"", "ab", "abcdefghijklmnopq", "Alice", "1abc", "abc-", "ab--c", "abc.de", "abc..def", ".abc", "ab_c", "abc def"}
+	for _, name := range invalid {
+		if err := ValidateAccountName(name); err == nil {
+			t.Errorf("expected %q invalid", name)
+		}
+	}
+}
+
+func TestDecodePublicKey(t *testing.T) {
+	wm := testNewWalletManager()
+	key := testPublicKey(t, 1)
+
+	address, err := wm.DecoderV2.AddressEncode(key)
+	if err != nil || !strings.HasPrefix(address, "FPA") {
+		t.Fatalf("unexpected address: %s, err: %v", address, err)
+	}
+
+	decoded, err := DecodePublicKey(address, "FPA")
+	if err != nil || !bytes.Equal(decoded, key) {
+		t.Fatalf("unexpected decoded key: %x, err: %v", decoded, err)
+	}
+
+	//修改一个字符导致校验码不一致
+	last := address[len(address)-1]
+	replaced := byte('2')
+	if last == replaced {
+		replaced = '3'
+	}
+	tampered := address[:len(address)-1] + string(replaced)
+
+	invalid := map[string]string{
+		"prefix":   "EOS" + address[3:],
+		"checksum": tampered,
+		"base58":   address[:10] + "0OIl" + address[14:],
+		"length":   address[:len(address)-3],
+	}
+	for name, pubKey := range invalid {
+		if _, err := DecodePublicKey(pubKey, "FPA"); err == nil {
+			t.Errorf("expected %s error for %s", name, pubKey)
+		}
+	}
+}
+
+func TestAddressVerifyOffline(t *testing.T) {
+	wm := testNewWalletManager()
+	//节点不可用时也能离线校验
+	wm.Api.BaseURL = "http://127.0.0.1:1"
+
+	address, _ := wm.DecoderV2.AddressEncode(testPublicKey(t, 2))
+	for _, valid := range []string{"bob", "exchange.pia", address} {
+		if !wm.DecoderV2.AddressVerify(valid) {
+			t.Errorf("expected %s valid", valid)
+		}
+	}
+	for _, invalid := range []string{"Bob", "ab", address[:len(address)-1] + "x"} {
+		if wm.DecoderV2.AddressVerify(invalid) {
+			t.Errorf("expected %s invalid", invalid)
+		}
+	}
+}
+
+func TestAddressVerifyOnChain(t *testing.T) {
+	node := newFakeNode(t, 10)
+	node.setBalance("alice", "1.00000000 PIA")
+	wm, _, _ := testScanWalletManager(t, node)
+	wm.Config.VerifyAccountOnChain = true
+
+	if !wm.DecoderV2.AddressVerify("alice") {
+		t.Errorf("expected registered account valid")
+	}
+	if wm.DecoderV2.AddressVerify("carol") {
+		t.Errorf("expected unregistered account invalid")
+	}
+	//公钥不查询链上
+	address, _ := wm.DecoderV2.AddressEncode(testPublicKey(t, 3))
+	if !wm.DecoderV2.AddressVerify(address) {
+		t.Errorf("expected public key valid")
+	}
+	if n := node.callCount("get_accounts"); n != 2 {
+		t.Errorf("expected 2 account lookups, got %d", n)
+	}
+
+	node.server.Close()
+	if wm.DecoderV2.AddressVerify("bob") {
+		t.Errorf("expected account invalid when node is unavailable")
+	}
+}
+
+func TestAddressDecode(t *testing.T) {
+	wm := testNewWalletManager()
+	key := testPublicKey(t, 4)
+
+	address, _ := wm.DecoderV2.AddressEncode(key)
+	decoded, err := wm.DecoderV2.AddressDecode(address)
+	if err != nil || !bytes.Equal(decoded, key) {
+		t.Fatalf("unexpected decoded key: %x, err: %v", decoded, err)
+	}
+
+	decoded, err = NewAddressDecoder(wm).AddressToPublicKey(address, false)
+	if err != nil || !bytes.Equal(decoded, key) {
+		t.Fatalf("unexpected decoded key: %x, err: %v", decoded, err)
+	}
+
+	//已废弃的Default使用主网前缀
+	if defaultAddress, _ := Default.AddressEncode(key); defaultAddress != address || !Default.AddressVerify(address) {
+		t.Errorf("unexpected default address: %s", defaultAddress)
+	}
+
+	//前缀与配置不一致
+	wm.Config.AddressPrefix = "TST"
+	if _, err := wm.DecoderV2.AddressDecode(address); err == nil {
+		t.Errorf("expected prefix error")
+	}
+}
+
+func TestVerifyRawTransactionSigningKey(t *testing.T) {
+	wm := testNewWalletManager()
+
+	bin, err := eos.MarshalBinary(&TransConMain{})
+	if err != nil {
+		t.Fatalf("marshal transaction failed: %v", err)
+	}
+	hash := sha256.Sum256(bin)
+
+	priv := bytes.Repeat([]byte{5}, 32)
+	signature, v, ret := owcrypt.Signature(priv, nil, hash[:], CurveType)
+	if ret != owcrypt.SUCCESS {
+		t.Fatalf("sign failed")
+	}
+	signature = append(signature, v)
+
+	newRawTx := func(key []byte) *openwallet.RawTransaction {
+		address, _ := wm.DecoderV2.AddressEncode(key)
+		return &openwallet.RawTransaction{
+			RawHex: hex.EncodeToString(bin),
+			Signatures: map[string][]*openwallet.KeySignature{
+				"account": {{
+					EccType:   CurveType,
+					Address:   &openwallet.Address{Address: address},
+					Message:   hex.EncodeToString(hash[:]),
+					Signature: hex.EncodeToString(signature),
+				}},
+			},
+		}
+	}
+
+	rawTx := newRawTx(testPublicKey(t, 5))
+	if err := wm.TxDecoder.VerifyRawTransaction(nil, rawTx); err != nil {
+		t.Fatalf("expected signature valid, got %v", err)
+	}
+	if !rawTx.IsCompleted {
+		t.Errorf("expected transaction completed")
+	}
+
+	rawTx = newRawTx(testPublicKey(t, 6))
+	if err := wm.TxDecoder.VerifyRawTransaction(nil, rawTx); err == nil {
+		t.Errorf("expected signing key mismatch")
+	}
+}
+
+func TestWIF(t *testing.T) {
+	priv, _ := hex.DecodeString("d2653ff7cbb2d8ff129ac27ef5781ce68b2558c41a74af1f2ddca635cbeef07d")
+	const wif = "5KQwrPbwdL6PhXujxW37FSSQZ1JiwsST4cqQzDeyXtP79zkvFD3"
+
+	decoder := NewAddressDecoder(testNewWalletManager())
+	encoded, err := decoder.PrivateKeyToWIF(priv, false)
+	if err != nil || encoded != wif {
+		t.Fatalf("unexpected wif: %s, err: %v", encoded, err)
+	}
+
+	compressedWIF, err := decoder.PrivateKeyToCompressedWIF(priv)
+	if err != nil || compressedWIF == wif {
+		t.Fatalf("unexpected compressed wif: %s, err: %v", compressedWIF, err)
+	}
+
+	for _, c := range []struct {
+		wif        string
+		compressed bool
+	}{{wif, false}, {compressedWIF, true}} {
+		decoded, compressed, err := DecodeWIF(c.wif)
+		if err != nil || !bytes.Equal(decoded, priv) || compressed != c.compressed {
+			t.Errorf("unexpected decoded %s: %x, compressed: %v, err: %v", c.wif, decoded, compressed, err)
+		}
+		decoded, err = decoder.WIFToPrivateKey(c.wif, false)
+		if err != nil || !bytes.Equal(decoded, priv) {
+			t.Errorf("unexpected private key of %s: %x, err: %v", c.wif, decoded, err)
+		}
+	}
+
+	invalid := map[string]string{
+		"checksum": wif[:len(wif)-1] + "4",
+		"base58":   "0" + wif[1:],
+		"length":   wif[:len(wif)-2],
+		"version":  "",
+	}
+	invalid["version"], _ = EncodeWIF(priv, false)
+	invalid["version"] = "6" + invalid["version"][1:]
+	for name, value := range invalid {
+		if _, _, err := DecodeWIF(value); err == nil {
+			t.Errorf("expected %s error for %s", name, value)
+		}
+	}
+
+	if _, err := EncodeWIF(make([]byte, 32), false); err == nil {
+		t.Errorf("expected zero private key invalid")
+	}
+	if _, err := EncodeWIF(priv[:31], false); err == nil {
+		t.Errorf("expected short private key invalid")
+	}
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blocktree/go-owcdrivers/owkeychain"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const addressRoleKey = "role" //地址ExtParam中记录角色的字段
+
+//hdRoles 资产账户HD路径下衍生的角色，路径为{账户路径}/{角色分支}/{索引}
+//active使用分支0，与openwallet默认创建的地址一致，已有的地址都是active密钥
+//openwallet占用分支0和1（找零），其他角色使用分支2及以上，避免与openwallet创建的地址重合
+var hdRoles = []string{RoleActive, RoleOwner, RoleMemo}
+
+//HDRoles 资产账户HD路径下衍生的角色，返回副本
+func HDRoles() []string {
+	return append([]string(nil), hdRoles...)
+}
+
+//roleBranches 角色对应的HD分支
+var roleBranches = map[string]uint32{
+	RoleActive: 0,
+	RoleOwner:  3,
+	RoleMemo:   2,
+}
+
+//minRoleBranch 本包专用角色分支的起始值，更小的分支由openwallet创建
+const minRoleBranch = 2
+
+//operationRoles 操作需要的签名角色，未列出的操作使用active
+//交易单解码器只构建transfer，owner和memo仅用于衍生地址，供调用方自行签名account_update等操作或加解密备注
+var operationRoles = map[string]string{
+	"account_update":          RoleOwner,
+	"change_recovery_account": RoleOwner,
+	"memo":                    RoleMemo, //备注加解密
+}
+
+//RequiredRole 操作需要的签名角色，CreateRawTransaction按transfer选取active密钥
+func RequiredRole(operation string) string {
+	if role, ok := operationRoles[operation]; ok {
+		return role
+	}
+	return RoleActive
+}
+
+//RoleHDPath 角色密钥的HD路径
+func RoleHDPath(accountPath, role string, index uint64) (string, error) {
+	branch, ok := roleBranches[role]
+	if !ok {
+		return "", fmt.Errorf("role %s has no HD branch", role)
+	}
+	return fmt.Sprintf("%s/%d/%d", accountPath, branch, index), nil
+}
+
+//DeriveRoleAddress 从资产账户的扩展公钥衍生角色地址，角色记录在ExtParam中
+func (wm *WalletManager) DeriveRoleAddress(account *openwallet.AssetsAccount, role string, index uint64) (*openwallet.Address, error) {
+
+	hdPath, err := RoleHDPath(account.HDPath, role, index)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := owkeychain.OWDecode(account.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode account public key failed, err: %v", err)
+	}
+	key, err = key.GenPublicChild(roleBranches[role])
+	if err != nil {
+		return nil, err
+	}
+	key, err = key.GenPublicChild(uint32(index))
+	if err != nil {
+		return nil, err
+	}
+
+	pub := key.GetPublicKeyBytes()
+	address, err := wm.DecoderV2.AddressEncode(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := &openwallet.Address{
+		AccountID:   account.GetAccountID(),
+		Address:     address,
+		PublicKey:   hex.EncodeToString(pub),
+		Alias:       account.Alias,
+		Index:       index,
+		HDPath:      hdPath,
+		Symbol:      wm.Symbol(),
+		CreatedTime: time.Now().Unix(),
+	}
+	err = SetAddressRole(addr, role)
+	if err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+//DeriveRoleAddresses 衍生资产账户索引index的owner、active和memo地址
+func (wm *WalletManager) DeriveRoleAddresses(account *openwallet.AssetsAccount, index uint64) ([]*openwallet.Address, error) {
+	addresses := make([]*openwallet.Address, 0, len(hdRoles))
+	for _, role := range hdRoles {
+		addr, err := wm.DeriveRoleAddress(account, role, index)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, addr)
+	}
+	return addresses, nil
+}
+
+//SetAddressRole 把角色写入地址的ExtParam，保留其他字段
+func SetAddressRole(addr *openwallet.Address, role string) error {
+	if !isAccountRole(role) {
+		return fmt.Errorf("unknown account role: %s", role)
+	}
+	ext := make(map[string]interface{})
+	if addr.ExtParam != "" {
+		if err := json.Unmarshal([]byte(addr.ExtParam), &ext); err != nil {
+			return fmt.Errorf("address ext param is not a json object, err: %v", err)
+		}
+	}
+	ext[addressRoleKey] = role
+	data, err := json.Marshal(ext)
+	if err != nil {
+		return err
+	}
+	addr.ExtParam = string(data)
+	return nil
+}
+
+//AddressRole 地址的角色，优先读取ExtParam，没有记录时按HD路径的分支推断
+//只推断本包专用的分支，openwallet创建的地址和无法推断的地址视为active，与按角色区分之前的行为一致
+func AddressRole(addr *openwallet.Address) string {
+	if addr.ExtParam != "" {
+		var ext map[string]interface{}
+		if json.Unmarshal([]byte(addr.ExtParam), &ext) == nil {
+			if role, ok := ext[addressRoleKey].(string); ok && isAccountRole(role) {
+				return role
+			}
+		}
+	}
+
+	segments := strings.Split(addr.HDPath, "/")
+	if len(segments) >= 2 {
+		branch, err := strconv.ParseUint(segments[len(segments)-2], 10, 32)
+		if err == nil && branch >= minRoleBranch {
+			for role, b := range roleBranches {
+				if uint64(b) == branch {
+					return role
+				}
+			}
+		}
+	}
+	return RoleActive
+}
+
+//FilterRoleAddresses 筛选指定角色的地址
+func FilterRoleAddresses(addresses []*openwallet.Address, role string) []*openwallet.Address {
+	filtered := make([]*openwallet.Address, 0, len(addresses))
+	for _, addr := range addresses {
+		if AddressRole(addr) == role {
+			filtered = append(filtered, addr)
+		}
+	}
+	return filtered
+}
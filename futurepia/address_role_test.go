@@ -0,0 +1,176 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/blocktree/go-owcdrivers/owkeychain"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/shopspring/decimal"
+)
+
+const testAccountPath = "m/44'/88'/0'"
+
+var testSeed = bytes.Repeat([]byte{7}, 32)
+
+//testHDAccount 用固定种子创建HD资产账户
+func testHDAccount(t *testing.T, alias string) *openwallet.AssetsAccount {
+	key, err := owkeychain.DerivedPrivateKeyWithPath(testSeed, testAccountPath, CurveType)
+	if err != nil {
+		t.Fatalf("derive account key failed: %v", err)
+	}
+	return &openwallet.AssetsAccount{
+		Alias:     alias,
+		HDPath:    testAccountPath,
+		PublicKey: key.GetPublicKey().OWEncode(),
+		Symbol:    Symbol,
+	}
+}
+
+//testAddressWallet 只提供地址列表的钱包
+type testAddressWallet struct {
+	openwallet.WalletDAIBase
+	addresses []*openwallet.Address
+}
+
+func (w *testAddressWallet) GetAddressList(offset, limit int, cols ...interface{}) ([]*openwallet.Address, error) {
+	return w.addresses, nil
+}
+
+func TestRoleHDPath(t *testing.T) {
+	cases := map[string]string{
+		RoleActive: testAccountPath + "/0/5",
+		RoleOwner:  testAccountPath + "/3/5",
+		RoleMemo:   testAccountPath + "/2/5",
+	}
+	for role, want := range cases {
+		if path, err := RoleHDPath(testAccountPath, role, 5); err != nil || path != want {
+			t.Errorf("unexpected %s path: %s, err: %v", role, path, err)
+		}
+	}
+	if _, err := RoleHDPath(testAccountPath, RolePosting, 0); err == nil {
+		t.Errorf("expected posting has no HD branch")
+	}
+
+	if RequiredRole("transfer") != RoleActive || RequiredRole("account_update") != RoleOwner || RequiredRole("memo") != RoleMemo {
+		t.Errorf("unexpected operation roles")
+	}
+}
+
+func TestDeriveRoleAddresses(t *testing.T) {
+	wm := testNewWalletManager()
+	account := testHDAccount(t, "alice")
+
+	addresses, err := wm.DeriveRoleAddresses(account, 0)
+	if err != nil || len(addresses) != len(hdRoles) {
+		t.Fatalf("unexpected addresses: %d, err: %v", len(addresses), err)
+	}
+
+	seen := make(map[string]bool)
+	for i, addr := range addresses {
+		if role := AddressRole(addr); role != hdRoles[i] {
+			t.Errorf("expected role %s, got %s", hdRoles[i], role)
+		}
+		if addr.AccountID != account.AccountID || addr.Alias != "alice" {
+			t.Errorf("unexpected address owner: %+v", addr)
+		}
+		seen[addr.Address] = true
+
+		//私钥按同一路径衍生后公钥一致，签名时可找到对应私钥
+		key, err := owkeychain.DerivedPrivateKeyWithPath(testSeed, addr.HDPath, CurveType)
+		if err != nil {
+			t.Fatalf("derive private key failed: %v", err)
+		}
+		if hex.EncodeToString(key.GetPublicKeyBytes()) != addr.PublicKey {
+			t.Errorf("public key of %s does not match private key", addr.HDPath)
+		}
+		decoded, err := wm.DecoderV2.AddressDecode(addr.Address)
+		if err != nil || hex.EncodeToString(decoded) != addr.PublicKey {
+			t.Errorf("unexpected address %s, err: %v", addr.Address, err)
+		}
+	}
+	if len(seen) != len(hdRoles) {
+		t.Errorf("expected distinct role addresses")
+	}
+}
+
+func TestAddressRole(t *testing.T) {
+	addr := &openwallet.Address{ExtParam: `{"memo":"123"}`}
+	if err := SetAddressRole(addr, RoleOwner); err != nil {
+		t.Fatalf("set address role failed: %v", err)
+	}
+	if AddressRole(addr) != RoleOwner || !strings.Contains(addr.ExtParam, `"memo":"123"`) {
+		t.Errorf("unexpected ext param: %s", addr.ExtParam)
+	}
+	if err := SetAddressRole(addr, "admin"); err == nil {
+		t.Errorf("expected unknown role error")
+	}
+	if err := SetAddressRole(&openwallet.Address{ExtParam: "[1]"}, RoleOwner); err == nil {
+		t.Errorf("expected ext param error")
+	}
+
+	//没有记录角色的地址按HD路径推断，openwallet的找零分支仍是active
+	legacy := map[string]string{
+		testAccountPath + "/0/3": RoleActive,
+		testAccountPath + "/1/0": RoleActive,
+		testAccountPath + "/3/0": RoleOwner,
+		testAccountPath + "/2/0": RoleMemo,
+		"":                       RoleActive,
+	}
+	for path, want := range legacy {
+		if role := AddressRole(&openwallet.Address{HDPath: path}); role != want {
+			t.Errorf("expected %s for %q, got %s", want, path, role)
+		}
+	}
+}
+
+func TestCreateRawTransactionActiveSigners(t *testing.T) {
+	node := newFakeNode(t, 10)
+	wm, _, _ := testScanWalletManager(t, node)
+	account := testHDAccount(t, "alice")
+
+	addresses, err := wm.DeriveRoleAddresses(account, 0)
+	if err != nil {
+		t.Fatalf("derive role addresses failed: %v", err)
+	}
+	wrapper := &testAddressWallet{addresses: addresses}
+
+	rawTx := &openwallet.RawTransaction{
+		Account: account,
+		To:      map[string]string{"bob": "1"},
+	}
+	if err := wm.TxDecoder.(*TransactionDecoder).createRawTransaction(wrapper, rawTx, "alice", decimal.New(1, 0), "bob", ""); err != nil {
+		t.Fatalf("create raw transaction failed: %v", err)
+	}
+
+	signatures := rawTx.Signatures[account.AccountID]
+	if len(signatures) != 1 || signatures[0].Address.Address != addresses[0].Address {
+		t.Fatalf("expected only the active key to sign, got %d signatures", len(signatures))
+	}
+
+	wrapper.addresses = addresses[1:]
+	rawTx = &openwallet.RawTransaction{
+		Account: account,
+		To:      map[string]string{"bob": "1"},
+	}
+	if err := wm.TxDecoder.(*TransactionDecoder).createRawTransaction(wrapper, rawTx, "alice", decimal.New(1, 0), "bob", ""); err == nil {
+		t.Errorf("expected missing active key error")
+	}
+}
@@ -19,11 +19,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
 	"github.com/imroc/req"
 	"github.com/tidwall/gjson"
 )
@@ -31,9 +34,71 @@ import (
 type Client struct {
 	BaseURL   string
 	Debug     bool
+	//Deprecated: GetBalance的失败次数改为每次调用独立计数，不再使用该字段
 	ErrorTime int
-	lock      sync.Mutex
 	DelayTime int64
+	metrics   *adapterMetrics //RPC指标，nil时不记录
+
+	Cache              openwallet.ICacheManager //节点数据缓存，nil时不缓存
+	AccountCacheTTL    time.Duration            //账户是否存在和权限的缓存时间，余额不缓存，0为不缓存
+	BlockCacheTTL      time.Duration            //不可逆区块缓存时间，0为不缓存
+	PropertiesCacheTTL time.Duration            //链全局属性缓存时间，0为不缓存
+	lastIrreversible   int64                    //节点返回的最新不可逆高度，原子读写
+	operations         *OperationRegistry       //操作类型注册表，nil时使用默认注册表
+
+	requesterOnce sync.Once
+	requester     *req.Req //每个客户端独立的HTTP请求器，不共享req的全局实例
+}
+
+//httpRequester 首次使用时创建HTTP请求器，并发调用安全
+func (c *Client) httpRequester() *req.Req {
+	c.requesterOnce.Do(func() {
+		c.requester = req.New()
+		//提前创建底层http.Client，避免并发请求时延迟初始化
+		c.requester.Client()
+	})
+	return c.requester
+}
+
+const getBalanceMaxRetries = 3 //GetBalance请求失败后的最大重试次数
+
+const (
+	cacheKeyProperties = "rpc:properties"
+	cacheKeyBlock      = "rpc:block:"
+	cacheKeyAccount    = "rpc:account:"
+)
+
+//cacheGet 读取缓存的节点返回结果
+func (c *Client) cacheGet(key string, ttl time.Duration) (*gjson.Result, bool) {
+	if c.Cache == nil || ttl <= 0 {
+		return nil, false
+	}
+	raw, ok := c.Cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	s, ok := raw.(string)
+	if !ok {
+		return nil, false
+	}
+	result := gjson.Parse(s)
+	return &result, true
+}
+
+//cacheAdd 缓存节点返回的原始JSON，读取时重新解析，调用者修改返回的对象不影响缓存
+func (c *Client) cacheAdd(key string, result *gjson.Result, ttl time.Duration) {
+	if c.Cache == nil || ttl <= 0 {
+		return
+	}
+	c.Cache.Add(key, result.Raw, ttl)
+}
+
+//InvalidateAccount 删除账户信息缓存，账户余额变动后调用
+func (c *Client) InvalidateAccount(account string) {
+	if c.Cache == nil {
+		return
+	}
+	c.Cache.Remove(cacheKeyAccount + account)
 }
 
 type Response struct {
@@ -61,6 +126,8 @@ type ApiBlock struct {
 	Transactions      []*ApiTransaction   `json:"transactions"`
 	TransactionIds    []string            `json:"transaction_ids"`
 	LocalTransactions []*LocalTransaction `json:"-"`
+	Operations        []*BlockOperation   `json:"-"`
+	OperationReceipts []*OperationReceipt `json:"-"`
 }
 
 func (a *ApiBlock) GetRefBlockPrefix() uint32 {
@@ -70,6 +137,12 @@ func (a *ApiBlock) GetRefBlockPrefix() uint32 {
 
 func readUInt32LE(buf []byte, offset, byteLength int) uint32 {
 	var n uint32
+	if offset > len(buf) {
+		return 0
+	}
+	if offset+byteLength > len(buf) {
+		byteLength = len(buf) - offset
+	}
 	buf = buf[offset : offset+byteLength]
 	if len(buf) > 8 {
 		buf = buf[:8]
@@ -90,14 +163,29 @@ type ApiBalance struct {
 }
 
 type LocalTransaction struct {
-	From    string
-	To      string
-	Amount  string
-	CoinTag string
-	Memo    string
-	Type    string
-	TxId    string
-	Index   int
+	From     string
+	To       string
+	Amount   string
+	CoinTag  string
+	Memo     string
+	Type     string
+	TxId     string
+	Index    int
+	Virtual  bool //虚拟操作，只有收款方余额变动
+	Token    bool //代币转账，CoinTag为代币符号
+	FromOnly bool //只有付款方可用余额变动，如转入储蓄、质押
+	ToOnly   bool //只有收款方可用余额变动，如储蓄到期
+}
+
+//ApiOperation get_ops_in_block返回的操作
+type ApiOperation struct {
+	TrxId      string        `json:"trx_id"`
+	Block      int64         `json:"block"`
+	TrxInBlock int64         `json:"trx_in_block"`
+	OpInTrx    int64         `json:"op_in_trx"`
+	VirtualOp  int64         `json:"virtual_op"`
+	Timestamp  string        `json:"timestamp"`
+	Op         []interface{} `json:"op"`
 }
 
 //{"id":"8616b05f13cbedc1862435f18adfc89733c4025f","block_num":1565702,"trx_num":0,"expired":false}
@@ -116,10 +204,14 @@ func (this *Client) GetDynamicGlobal() (*ApiHeadBlock, error) {
 		"get_dynamic_global_properties",
 		[]interface{}{},
 	}
-	result, err := this.Call("call", 1, params)
-	if err != nil {
-		log.Errorf("GetDynamicGlobal number faield, err = %v \n", err)
-		return nil, err
+	result, cached := this.cacheGet(cacheKeyProperties, this.PropertiesCacheTTL)
+	if !cached {
+		var err error
+		result, err = this.Call("call", 1, params)
+		if err != nil {
+			log.Errorf("GetDynamicGlobal number faield, err = %v \n", err)
+			return nil, err
+		}
 	}
 
 	if result.Type != gjson.JSON {
@@ -128,43 +220,56 @@ func (this *Client) GetDynamicGlobal() (*ApiHeadBlock, error) {
 	}
 
 	var apiHeadBlock *ApiHeadBlock
-	err = json.Unmarshal([]byte(result.Raw), &apiHeadBlock)
+	err := json.Unmarshal([]byte(result.Raw), &apiHeadBlock)
 	if err != nil {
 		log.Errorf("decode json [%v] failed, err=%v", []byte(result.Raw), err)
 		return nil, err
 	}
+	if !cached && apiHeadBlock != nil {
+		this.cacheAdd(cacheKeyProperties, result, this.PropertiesCacheTTL)
+		atomic.StoreInt64(&this.lastIrreversible, apiHeadBlock.LastIrreversible)
+	}
 	return apiHeadBlock, nil
 }
 
 //根据高度获取区块
 func (this *Client) GetBalance(account ,feeString string) (*ApiBalance, error) {
-	time.Sleep(200 * time.Millisecond)
 	params := []interface{}{
 		"database_api",
 		"get_accounts",
 		[]interface{}{[]interface{}{account}},
 	}
 
-	result, err := this.Call("call", 1, params)
-	if err != nil {
+	//余额不缓存，入账后立即可见
+	time.Sleep(200 * time.Millisecond)
+	//失败次数按每次调用计数，区块预取等并发调用互不影响
+	var result *gjson.Result
+	var err error
+	for attempt := 1; ; attempt++ {
+		result, err = this.Call("call", 1, params)
+		if err == nil {
+			break
+		}
 		log.Errorf("get balance number faield,account = %s , err = %v \n", account, err)
-		this.ErrorTime++
-		if this.ErrorTime > 3 {
-			this.ErrorTime = 0
+		if attempt > getBalanceMaxRetries {
 			return nil, err
-		} else {
-			log.Errorf("reTry GetBalance")
-			time.Sleep(2 * time.Second)
-			return this.GetBalance(account,feeString)
 		}
+		log.Errorf("reTry GetBalance")
+		time.Sleep(2 * time.Second)
 	}
+
+	return parseApiBalance(result, feeString)
+}
+
+//parseApiBalance 解析get_accounts返回的第一个账户
+func parseApiBalance(result *gjson.Result, feeString string) (*ApiBalance, error) {
 	if result.Type != gjson.JSON {
 		log.Errorf("result of GetBalance type error")
 		return nil, errors.New("result of block number type error")
 	}
 
 	var apiBalances []*ApiBalance
-	err = json.Unmarshal([]byte(result.Raw), &apiBalances)
+	err := json.Unmarshal([]byte(result.Raw), &apiBalances)
 	if err != nil {
 		log.Errorf("GetBalance decode json [%v] failed, err=%v", []byte(result.Raw), err)
 		return nil, err
@@ -186,6 +291,77 @@ func (this *Client) GetBalance(account ,feeString string) (*ApiBalance, error) {
 	return balance, nil
 }
 
+//AccountExists 查询账户是否已在链上注册，节点请求失败时返回错误
+func (this *Client) AccountExists(account string) (bool, error) {
+	params := []interface{}{
+		"database_api",
+		"get_accounts",
+		[]interface{}{[]interface{}{account}},
+	}
+
+	result, cached := this.cacheGet(cacheKeyAccount+account, this.AccountCacheTTL)
+	if !cached {
+		var err error
+		result, err = this.Call("call", 1, params)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if !result.IsArray() {
+		return false, fmt.Errorf("result of get_accounts type error")
+	}
+	exists := len(result.Array()) > 0
+	if exists && !cached {
+		this.cacheAdd(cacheKeyAccount+account, result, this.AccountCacheTTL)
+	}
+	return exists, nil
+}
+
+//ApiAccountAuthority 账户各角色的权限
+type ApiAccountAuthority struct {
+	Name    string       `json:"name"`
+	Owner   Authority `json:"owner"`
+	Active  Authority `json:"active"`
+	Posting Authority `json:"posting"`
+	MemoKey string    `json:"memo_key"`
+}
+
+//GetAccountAuthority 查询账户的owner、active、posting权限和memo公钥
+func (this *Client) GetAccountAuthority(account string) (*ApiAccountAuthority, error) {
+	params := []interface{}{
+		"database_api",
+		"get_accounts",
+		[]interface{}{[]interface{}{account}},
+	}
+
+	result, cached := this.cacheGet(cacheKeyAccount+account, this.AccountCacheTTL)
+	if !cached {
+		var err error
+		result, err = this.Call("call", 1, params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !result.IsArray() {
+		return nil, fmt.Errorf("result of get_accounts type error")
+	}
+	if len(result.Array()) == 0 {
+		return nil, fmt.Errorf("account %s is not registered on chain", account)
+	}
+
+	var authority ApiAccountAuthority
+	err := json.Unmarshal([]byte(result.Array()[0].Raw), &authority)
+	if err != nil {
+		return nil, fmt.Errorf("decode account %s authority failed, err: %v", account, err)
+	}
+	if !cached {
+		this.cacheAdd(cacheKeyAccount+account, result, this.AccountCacheTTL)
+	}
+	return &authority, nil
+}
+
 //获取最新高度区块
 func (this *Client) getGetTopBlock() (*ApiBlock, error) {
 	apiHead, err := this.GetDynamicGlobal()
@@ -206,10 +382,15 @@ func (this *Client) GetGetBlock(block uint64) (*ApiBlock, error) {
 		"get_block",
 		[]interface{}{block},
 	}
-	result, err := this.Call("call", 1, params)
-	if err != nil {
-		log.Errorf("get block number faield, err = %v \n", err)
-		return nil, err
+	cacheKey := cacheKeyBlock + strconv.FormatUint(block, 10)
+	result, cached := this.cacheGet(cacheKey, this.BlockCacheTTL)
+	if !cached {
+		var err error
+		result, err = this.Call("call", 1, params)
+		if err != nil {
+			log.Errorf("get block number faield, err = %v \n", err)
+			return nil, err
+		}
 	}
 
 	if result.Type != gjson.JSON {
@@ -218,11 +399,15 @@ func (this *Client) GetGetBlock(block uint64) (*ApiBlock, error) {
 	}
 
 	var apiHeadBlock *ApiBlock
-	err = json.Unmarshal([]byte(result.Raw), &apiHeadBlock)
+	err := json.Unmarshal([]byte(result.Raw), &apiHeadBlock)
 	if err != nil {
 		log.Errorf("decode json [%v] failed, err=%v", []byte(result.Raw), err)
 		return nil, err
 	}
+	//只缓存不可逆区块，可逆区块可能被分叉替换
+	if !cached && apiHeadBlock != nil && int64(block) <= atomic.LoadInt64(&this.lastIrreversible) {
+		this.cacheAdd(cacheKey, result, this.BlockCacheTTL)
+	}
 	if apiHeadBlock != nil && apiHeadBlock.Height == 0 {
 		apiHeadBlock.Height = int64(block)
 	}
@@ -232,53 +417,107 @@ func (this *Client) GetGetBlock(block uint64) (*ApiBlock, error) {
 	tt, _ := time.ParseInLocation("2006-01-02T15:04:05", apiHeadBlock.TimestampStr, loc)
 	apiHeadBlock.Timestamp = tt.Unix()
 
-	trans := apiHeadBlock.Transactions
-	transactionIds := apiHeadBlock.TransactionIds
-	apiHeadBlock.LocalTransactions = make([]*LocalTransaction, 0)
-	if trans != nil && len(trans) > 0 && transactionIds != nil && len(transactionIds) > 0 {
-
-		for index, tran := range trans {
-			operations := tran.Operations
-			if operations != nil && len(operations) > 0 {
-
-				for i, opr := range operations {
-					operationsTemp := opr.([]interface{})
-					if operationsTemp == nil || len(operationsTemp) == 0 {
-						continue
-					}
-
-					localTransaction := &LocalTransaction{}
-					localTransaction.Type = operationsTemp[0].(string)
-					mapTemp := operationsTemp[1].(map[string]interface{})
-					if mapTemp != nil {
-						main, ok := mapTemp["amount"]
-						if !ok {
-							continue
-						}
-						amountList := strings.Split(main.(string), " ")
-						if len(amountList) != 2 {
-							continue
-						}
-						if mapTemp["from"] == nil || mapTemp["to"] == nil {
-							continue
-						}
-
-						localTransaction.CoinTag = amountList[1]
-						localTransaction.Amount = amountList[0]
-						localTransaction.From = mapTemp["from"].(string)
-						localTransaction.To = mapTemp["to"].(string)
-						localTransaction.Memo = mapTemp["memo"].(string)
-						localTransaction.TxId = transactionIds[index]
-						localTransaction.Index = i
-					}
-					apiHeadBlock.LocalTransactions = append(apiHeadBlock.LocalTransactions, localTransaction)
+	registry := this.operations
+	if registry == nil {
+		registry = defaultOperationRegistry
+	}
+
+	apiHeadBlock.Operations = make([]*BlockOperation, 0)
+	for index, tran := range apiHeadBlock.Transactions {
+		if tran == nil || index >= len(apiHeadBlock.TransactionIds) {
+			continue
+		}
+
+		for i, opr := range tran.Operations {
+			operation, err := registry.decodeOperation(opr)
+			if err != nil {
+				log.Warningf("block %d transaction %s operation %d: %v", block, apiHeadBlock.TransactionIds[index], i, err)
+				if operation == nil {
+					continue
 				}
 			}
+			operation.TxId = apiHeadBlock.TransactionIds[index]
+			operation.TxIndex = index
+			operation.OpIndex = i
+			apiHeadBlock.Operations = append(apiHeadBlock.Operations, operation)
 		}
 	}
+
+	//默认只提取转账，扫描器会按配置的handler重新处理
+	apiHeadBlock.LocalTransactions, apiHeadBlock.OperationReceipts = handleOperations(&DefaultOperationHandler{}, apiHeadBlock.Operations)
+
 	return apiHeadBlock, nil
 }
 
+//GetOpsInBlock 获取区块内的操作，onlyVirtual为true时只返回虚拟操作
+func (this *Client) GetOpsInBlock(block uint64, onlyVirtual bool) ([]*ApiOperation, error) {
+	params := []interface{}{
+		"database_api",
+		"get_ops_in_block",
+		[]interface{}{block, onlyVirtual},
+	}
+	result, err := this.Call("call", 1, params)
+	if err != nil {
+		log.Errorf("get ops in block faield, err = %v \n", err)
+		return nil, err
+	}
+
+	if !result.IsArray() {
+		log.Errorf("result of get ops in block type error")
+		return nil, errors.New("result of get ops in block type error")
+	}
+
+	var operations []*ApiOperation
+	err = json.Unmarshal([]byte(result.Raw), &operations)
+	if err != nil {
+		log.Errorf("decode json [%v] failed, err=%v", []byte(result.Raw), err)
+		return nil, err
+	}
+	return operations, nil
+}
+
+//ApiAccountHistory get_account_history返回的账户操作记录
+type ApiAccountHistory struct {
+	Sequence  int64 //账户内的操作序号
+	Operation *ApiOperation
+}
+
+//GetAccountHistory 获取账户序号[from-limit, from]区间的操作记录，from为-1时从最新记录开始
+func (this *Client) GetAccountHistory(account string, from int64, limit uint32) ([]*ApiAccountHistory, error) {
+	params := []interface{}{
+		"database_api",
+		"get_account_history",
+		[]interface{}{account, from, limit},
+	}
+	result, err := this.Call("call", 1, params)
+	if err != nil {
+		log.Errorf("get account history faield, err = %v \n", err)
+		return nil, err
+	}
+
+	if !result.IsArray() {
+		log.Errorf("result of get account history type error")
+		return nil, errors.New("result of get account history type error")
+	}
+
+	histories := make([]*ApiAccountHistory, 0)
+	for _, item := range result.Array() {
+		pair := item.Array()
+		if len(pair) != 2 {
+			return nil, errors.New("result of get account history format error")
+		}
+
+		var operation *ApiOperation
+		err = json.Unmarshal([]byte(pair[1].Raw), &operation)
+		if err != nil {
+			log.Errorf("decode json [%v] failed, err=%v", []byte(pair[1].Raw), err)
+			return nil, err
+		}
+		histories = append(histories, &ApiAccountHistory{Sequence: pair[0].Int(), Operation: operation})
+	}
+	return histories, nil
+}
+
 func (this *Client) PushTransaction(packedTx interface{}) (*ApiTransResult, error) {
 	params := []interface{}{
 		//appendOxToAddress(addr),
@@ -307,10 +546,12 @@ func (this *Client) PushTransaction(packedTx interface{}) (*ApiTransResult, erro
 	return apiTransResult, nil
 }
 
-func (c *Client) Call(method string, id int64, params []interface{}) (*gjson.Result, error) {
+func (c *Client) Call(method string, id int64, params []interface{}) (_ *gjson.Result, err error) {
 	time.Sleep(time.Duration(c.DelayTime) * time.Millisecond)
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	start := time.Now()
+	defer func() {
+		c.metrics.observeRPC(rpcMethodName(method, params), time.Since(start), err)
+	}()
 	authHeader := req.Header{
 		"Accept":       "application/json",
 		"Content-Type": "application/json",
@@ -325,7 +566,7 @@ func (c *Client) Call(method string, id int64, params []interface{}) (*gjson.Res
 		log.Debug("Start Request API...")
 	}
 
-	r, err := req.Post(c.BaseURL, req.BodyJSON(&body), authHeader)
+	r, err := c.httpRequester().Post(c.BaseURL, req.BodyJSON(&body), authHeader)
 
 	if c.Debug {
 		log.Debug("Request API Completed")
@@ -350,6 +591,16 @@ func (c *Client) Call(method string, id int64, params []interface{}) (*gjson.Res
 	return &result, nil
 }
 
+//rpcMethodName 指标中的方法名，call请求使用实际调用的api方法
+func rpcMethodName(method string, params []interface{}) string {
+	if method == "call" && len(params) >= 2 {
+		if name, ok := params[1].(string); ok {
+			return name
+		}
+	}
+	return method
+}
+
 //isError 是否报错
 func isError(result *gjson.Result) error {
 	var (
@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/shopspring/decimal"
+	"sync"
 	"time"
 
 	"github.com/blocktree/openwallet/v2/log"
@@ -34,11 +35,26 @@ const (
 type PIABlockScanner struct {
 	*openwallet.BlockScannerBase
 
-	CurrentBlockHeight   uint64         //当前区块高度
-	extractingCH         chan struct{}  //扫描工作令牌
-	wm                   *WalletManager //钱包管理者
-	IsScanMemPool        bool           //是否扫描交易池
-	RescanLastBlockCount uint64         //重扫上N个区块数量
+	CurrentBlockHeight   uint64           //当前区块高度
+	extractingCH         chan struct{}    //扫描工作令牌
+	wm                   *WalletManager   //钱包管理者
+	IsScanMemPool        bool             //是否跟踪已广播的未确认交易，节点没有交易池查询接口
+	RescanLastBlockCount uint64           //重扫上N个区块数量
+	metrics              scanMetrics      //扫描吞吐统计
+	reorgAlertFunc       ReorgAlertFunc   //分叉深度超限告警
+	retrier              *unscanRetrier   //未扫记录重试任务
+	operationHandler     OperationHandler //操作处理器，决定哪些操作被提取
+	broadcasts           *broadcastTracker //已广播的未确认交易
+	memoRouter           *MemoRouter      //充值备注路由
+	outbox               *deliveryOutbox  //持久化的待投递队列
+	webhook              *WebhookNotifier //按配置注册的webhook观测者
+	lifecycle            *scanLifecycle   //扫描任务的运行、暂停和停止
+	notifier             *blockNotifier   //区块通知队列
+	scanErrors           scanErrorLog     //最近一次扫描错误
+	status               *statusServer    //状态查询HTTP服务
+	local                *localBlockchain //未注入BlockchainDAI时使用的本地数据库
+	backfill             *backfillRunner  //区块区间补扫任务
+	history              *accountHistory  //账户历史补扫游标和已通知记录
 }
 
 //ExtractResult extract result
@@ -66,8 +82,18 @@ func NewPIABlockScanner(wm *WalletManager) *PIABlockScanner {
 
 	bs.extractingCH = make(chan struct{}, maxExtractingSize)
 	bs.wm = wm
+	bs.metrics.adapter = func() *adapterMetrics { return wm.metrics }
 	bs.IsScanMemPool = true
 	bs.RescanLastBlockCount = 0
+	bs.retrier = newUnscanRetrier()
+	bs.broadcasts = newBroadcastTracker()
+	bs.outbox = newDeliveryOutbox()
+	bs.lifecycle = newScanLifecycle()
+	bs.notifier = newBlockNotifier()
+	bs.status = newStatusServer()
+	bs.local = newLocalBlockchain()
+	bs.backfill = newBackfillRunner()
+	bs.history = newAccountHistory()
 	// set task
 	bs.SetTask(bs.ScanBlockTask)
 
@@ -92,9 +118,18 @@ func (bs *PIABlockScanner) ScanBlockTask() {
 	if currentHeight == 0 {
 		bs.wm.Log.Std.Info("No records found in local, get current block as the local!")
 
-		headBlock, err := bs.GetGlobalHeadBlock()
+		limitHeight, err := bs.GetScanLimitHeight()
 		if err != nil {
 			bs.wm.Log.Std.Info("get head block error, err=%v", err)
+			bs.recordScanError(0, err)
+			return
+		}
+
+		headBlock, err := bs.wm.Api.GetGetBlock(limitHeight)
+		if err != nil {
+			bs.wm.Log.Std.Info("get head block error, err=%v", err)
+			bs.recordScanError(limitHeight, err)
+			return
 		}
 
 		currentHash = headBlock.PreviousHash
@@ -102,178 +137,192 @@ func (bs *PIABlockScanner) ScanBlockTask() {
 	}
 
 	for {
-		if !bs.Scanning {
+		if !bs.isScanning() {
 			// stop scan
 			return
 		}
 
-		infoResp, err := bs.GetGlobalHeadBlock()
+		limitHeight, err := bs.GetScanLimitHeight()
 		if err != nil {
-			bs.wm.Log.Errorf("GetGlobalHeadBlock failed, err=%v", err)
+			bs.wm.Log.Errorf("GetScanLimitHeight failed, err=%v", err)
+			bs.recordScanError(uint64(currentHeight), err)
 			break
 		}
 
-		maxBlockHeight := uint32(infoResp.Height)
+		maxBlockHeight := uint32(limitHeight)
 
 		bs.wm.Log.Info("current block height:", currentHeight, " maxBlockHeight:", maxBlockHeight)
-		if currentHeight == maxBlockHeight {
+		if currentHeight >= maxBlockHeight {
 			bs.wm.Log.Std.Info("block scanner has scanned full chain data. Current height %d", maxBlockHeight)
 			break
 		}
 
-		// next block
-		currentHeight = currentHeight + 1
-
-		bs.wm.Log.Std.Info("block scanner scanning height: %d ...", currentHeight)
-		block, err := bs.wm.Api.GetGetBlock(uint64(currentHeight))
-
+		currentHeight, currentHash, err = bs.scanBlockRange(currentHeight, currentHash, maxBlockHeight)
 		if err != nil {
-			bs.wm.Log.Std.Info("block scanner can not get new block data by rpc; unexpected error: %v", err)
+			bs.recordScanError(uint64(currentHeight)+1, err)
 			break
 		}
-		hash := block.Hash
+	}
+}
 
-		if currentHash != block.PreviousHash {
-			bs.wm.Log.Std.Info("block has been fork on height: %d.", currentHeight)
-			bs.wm.Log.Std.Info("block height: %d local hash = %s ", currentHeight-1, currentHash)
-			bs.wm.Log.Std.Info("block height: %d mainnet hash = %s ", currentHeight-1, block.PreviousHash)
-			bs.wm.Log.Std.Info("delete recharge records on block height: %d.", currentHeight-1)
-
-			// get local fork bolck
-			forkBlock, _ := bs.GetLocalBlock(currentHeight - 1)
-			// delete last unscan block
-			bs.DeleteUnscanRecord(currentHeight - 1)
-			currentHeight = currentHeight - 2 // scan back to last 2 block
-			if currentHeight <= 0 {
-				currentHeight = 1
-			}
-			localBlock, err := bs.GetLocalBlock(currentHeight)
-			if err != nil {
-				bs.wm.Log.Std.Error("block scanner can not get local block; unexpected error: %v", err)
-				//get block from rpc
-				bs.wm.Log.Info("block scanner prev block height:", currentHeight)
-				curBlock, err := bs.wm.Api.GetGetBlock(uint64(currentHeight))
-				if err != nil {
-					bs.wm.Log.Std.Error("block scanner can not get prev block by rpc; unexpected error: %v", err)
-					break
-				}
-				currentHash = curBlock.Hash
-			} else {
-				//重置当前区块的hash
-				currentHash = localBlock.Hash
-			}
-			bs.wm.Log.Std.Info("rescan block on height: %d, hash: %s .", currentHeight, currentHash)
+//scanBlockRange 通过预取流水线扫描(currentHeight, maxBlockHeight]区间的区块
+//区块并发抓取，按高度顺序校验hash链、提取交易和通知，发生分叉时回滚并返回新的扫描起点
+func (bs *PIABlockScanner) scanBlockRange(currentHeight uint32, currentHash string, maxBlockHeight uint32) (uint32, string, error) {
 
-			//重新记录一个新扫描起点
-			bs.SaveLocalBlockHead(currentHeight, currentHash)
+	prefetcher := newBlockPrefetcher(
+		bs.fetchBlock,
+		uint64(currentHeight)+1,
+		uint64(maxBlockHeight),
+		bs.wm.Config.PrefetchWorkers,
+		bs.wm.Config.PrefetchDepth)
+	defer prefetcher.Stop()
 
-			if forkBlock != nil {
-				//通知分叉区块给观测者，异步处理
-				bs.forkBlockNotify(forkBlock)
-			}
+	start := time.Now()
+	defer func() {
+		bs.metrics.addScanTime(time.Since(start))
+	}()
 
-		} else {
-			err := bs.BatchExtractTransactions(uint64(currentHeight), currentHash, block.Timestamp, block.LocalTransactions)
-			if err != nil {
-				bs.wm.Log.Std.Error("block scanner ran BatchExtractTransactions occured unexpected error: %v", err)
-			}
+	for {
+		if !bs.isScanning() {
+			// stop scan
+			return currentHeight, currentHash, nil
+		}
+
+		//待投递记录过多时不再推进，等待观测者恢复
+		if bs.outboxSaturated() {
+			return currentHeight, currentHash, nil
+		}
+
+		fetched, ok := prefetcher.Next()
+		if !ok {
+			return currentHeight, currentHash, nil
+		}
+
+		bs.wm.Log.Std.Info("block scanner scanning height: %d ...", fetched.height)
+
+		if fetched.err != nil {
+			bs.wm.Log.Std.Info("block scanner can not get new block data by rpc; unexpected error: %v", fetched.err)
+			return currentHeight, currentHash, fetched.err
+		}
+
+		block := fetched.block
+
+		if currentHash != block.PreviousHash {
+			return bs.rollbackForkBlock(uint32(fetched.height), currentHash, block)
+		}
 
-			//重置当前区块的hash
-			currentHash = hash
-			//保存本地新高度
-			bs.SaveLocalBlockHead(currentHeight, currentHash)
-			bs.SaveLocalBlock(ParseBlock(block,bs.wm.Symbol()))
-			//通知新区块给观测者，异步处理
-			bs.newBlockNotify(block)
+		err := bs.extractBlock(block)
+		if err != nil {
+			bs.wm.Log.Std.Error("block scanner ran extractBlock occured unexpected error: %v", err)
+			bs.recordScanError(fetched.height, err)
 		}
+		bs.metrics.addScanned(len(block.LocalTransactions))
+
+		//本地区块和新高度在同一事务中保存，失败时不推进高度，下次从当前高度重扫
+		err = bs.saveScannedBlock(ParseBlock(block, bs.wm.Symbol()))
+		if err != nil {
+			bs.wm.Log.Std.Error("block scanner save block: %d failed, unexpected error: %v", fetched.height, err)
+			return currentHeight, currentHash, err
+		}
+
+		// next block
+		currentHeight = uint32(fetched.height)
+		//重置当前区块的hash
+		currentHash = block.Hash
+		//通知新区块给观测者，异步处理
+		bs.newBlockNotify(block)
 	}
 }
 
+//fetchBlock 获取指定高度区块，并记录抓取统计
+func (bs *PIABlockScanner) fetchBlock(height uint64) (*ApiBlock, error) {
+	start := time.Now()
+	block, err := bs.getBlockWithVirtualOps(height)
+	bs.metrics.addFetch(time.Since(start), err)
+	return block, err
+}
+
+//getBlockWithVirtualOps 获取区块，开启虚拟操作扫描时合并影响余额的虚拟操作
+func (bs *PIABlockScanner) getBlockWithVirtualOps(height uint64) (*ApiBlock, error) {
+	block, err := bs.wm.Api.GetGetBlock(height)
+	if err != nil {
+		return nil, err
+	}
+
+	bs.handleBlockOperations(block)
+
+	if !bs.wm.Config.ScanVirtualOps {
+		return block, nil
+	}
+
+	operations, err := bs.wm.Api.GetOpsInBlock(height, true)
+	if err != nil {
+		return nil, err
+	}
+
+	block.LocalTransactions = append(block.LocalTransactions, parseVirtualOperations(height, operations)...)
+	return block, nil
+}
+
 //newBlockNotify 获得新区块后，通知给观测者
 func (bs *PIABlockScanner) forkBlockNotify(block *Block) {
 	header := block.BlockHeader
 	header.Fork = true
-	bs.NewBlockNotify(&header)
+	bs.notifier.push(bs, &header)
 }
 
 //newBlockNotify 获得新区块后，通知给观测者
 func (bs *PIABlockScanner) newBlockNotify(block *ApiBlock) {
 	header := ParseHeader(block,bs.wm.Symbol())
-	bs.NewBlockNotify(header)
+	bs.notifier.push(bs, header)
 }
 
 // BatchExtractTransactions 批量提取交易单
+//交易单并发提取，全部提取完成后按顺序通知，返回前不会遗留提取线程
 func (bs *PIABlockScanner) BatchExtractTransactions(blockHeight uint64, blockHash string, blockTime int64, transactions []*LocalTransaction) error {
 
-	var (
-		quit       = make(chan struct{})
-		done       = 0 //完成标记
-		failed     = 0
-		shouldDone = len(transactions) //需要完成的总数
-	)
-
 	if len(transactions) == 0 {
 		return nil
 	}
 
 	bs.wm.Log.Std.Info("block scanner ready extract transactions total: %d ", len(transactions))
 
-	//生产通道
-	producer := make(chan ExtractResult)
-	defer close(producer)
+	var (
+		wg      sync.WaitGroup
+		results = make([]ExtractResult, len(transactions))
+		failed  = 0
+	)
 
-	//消费通道
-	worker := make(chan ExtractResult)
-	defer close(worker)
+	//提取工作，extractingCH限制并发数
+	for i, tx := range transactions {
+		bs.extractingCH <- struct{}{}
+		wg.Add(1)
+		go func(i int, mTx *LocalTransaction) {
+			defer func() {
+				<-bs.extractingCH
+				wg.Done()
+			}()
+			results[i] = bs.ExtractTransaction(blockHeight, blockHash, blockTime, mTx, bs.ScanTargetFunc)
+		}(i, tx)
+	}
+	wg.Wait()
 
 	//保存工作
-	saveWork := func(height uint64, result chan ExtractResult) {
-		//回收创建的地址
-		for gets := range result {
-
-			if gets.Success {
-				notifyErr := bs.newExtractDataNotify(height, gets.extractData)
-				if notifyErr != nil {
-					failed++ //标记保存失败数
-					bs.wm.Log.Std.Info("newExtractDataNotify unexpected error: %v", notifyErr)
-				}
-			} else {
-				//记录未扫区块
-				unscanRecord := openwallet.NewUnscanRecord(height, "", "",bs.wm.Symbol())
-				bs.SaveUnscanRecord(unscanRecord)
+	for i, gets := range results {
+		if gets.Success {
+			notifyErr := bs.newExtractDataNotify(blockHeight, gets.extractData)
+			if notifyErr != nil {
 				failed++ //标记保存失败数
+				bs.wm.Log.Std.Info("newExtractDataNotify unexpected error: %v", notifyErr)
 			}
-			//累计完成的线程数
-			done++
-			if done == shouldDone {
-				close(quit) //关闭通道，等于给通道传入nil
-			}
-		}
-	}
-
-	//提取工作
-	extractWork := func(eblockHeight uint64, eBlockHash string, eBlockTime int64, mTransactions []*LocalTransaction, eProducer chan ExtractResult) {
-		for _, tx := range mTransactions {
-			bs.extractingCH <- struct{}{}
-			go func(mBlockHeight uint64, mTx *LocalTransaction, end chan struct{}, mProducer chan<- ExtractResult) {
-				//导出提出的交易
-				mProducer <- bs.ExtractTransaction(mBlockHeight, eBlockHash, eBlockTime, mTx, bs.ScanTargetFunc)
-				//释放
-				<-end
-
-			}(eblockHeight, tx, bs.extractingCH, eProducer)
+		} else {
+			//记录未扫区块
+			unscanRecord := openwallet.NewUnscanRecord(blockHeight, transactions[i].TxId, "", bs.wm.Symbol())
+			bs.SaveUnscanRecord(unscanRecord)
+			bs.metrics.addExtractFailure()
+			failed++ //标记保存失败数
 		}
 	}
-	/*	开启导出的线程	*/
-
-	//独立线程运行消费
-	go saveWork(blockHeight, worker)
-
-	//独立线程运行生产
-	go extractWork(blockHeight, blockHash, blockTime, transactions, producer)
-
-	//以下使用生产消费模式
-	bs.extractRuntime(producer, worker, quit)
 
 	if failed > 0 {
 		return fmt.Errorf("block scanner saveWork failed")
@@ -282,37 +331,13 @@ func (bs *PIABlockScanner) BatchExtractTransactions(blockHeight uint64, blockHas
 	return nil
 }
 
-//extractRuntime 提取运行时
-func (bs *PIABlockScanner) extractRuntime(producer chan ExtractResult, worker chan ExtractResult, quit chan struct{}) {
-
-	var (
-		values = make([]ExtractResult, 0)
-	)
-
-	for {
-		var activeWorker chan<- ExtractResult
-		var activeValue ExtractResult
-		//当数据队列有数据时，释放顶部，传输给消费者
-		if len(values) > 0 {
-			activeWorker = worker
-			activeValue = values[0]
-		}
-		select {
-		//生成者不断生成数据，插入到数据队列尾部
-		case pa := <-producer:
-			values = append(values, pa)
-		case <-quit:
-			//退出
-			return
-		case activeWorker <- activeValue:
-			values = values[1:]
-		}
-	}
-	//return
-}
-
 // ExtractTransaction 提取交易单
 func (bs *PIABlockScanner) ExtractTransaction(blockHeight uint64, blockHash string, blockTime int64, transaction *LocalTransaction, scanTargetFunc openwallet.BlockScanTargetFunc) ExtractResult {
+	return bs.extractTransaction(blockHeight, blockHash, blockTime, transaction, scanTargetFunc, true)
+}
+
+//extractTransaction 提取交易单，confirmed为false时是未确认交易，不记录无法路由的充值
+func (bs *PIABlockScanner) extractTransaction(blockHeight uint64, blockHash string, blockTime int64, transaction *LocalTransaction, scanTargetFunc openwallet.BlockScanTargetFunc, confirmed bool) ExtractResult {
 	var (
 		success = true
 		result  = ExtractResult{
@@ -324,8 +349,9 @@ func (bs *PIABlockScanner) ExtractTransaction(blockHeight uint64, blockHash stri
 		}
 	)
 
-	if transaction.CoinTag != bs.wm.Symbol() {
-		bs.wm.Log.Std.Debug("transaction not the  %s : %s",bs.wm.Symbol(), transaction.TxId, ":", transaction.CoinTag)
+	//代币转账按合约资产提取，其余只提取主币
+	if !transaction.Token && transaction.CoinTag != bs.wm.Config.FeeString {
+		bs.wm.Log.Std.Debug("transaction %s is not %s: %s", transaction.TxId, bs.wm.Config.FeeString, transaction.CoinTag)
 		return ExtractResult{Success: true}
 	}
 
@@ -335,35 +361,71 @@ func (bs *PIABlockScanner) ExtractTransaction(blockHeight uint64, blockHash stri
 		return ExtractResult{Success: true}
 	}
 
-	if transaction.Type == "transfer" {
-
-		if scanTargetFunc == nil {
-			bs.wm.Log.Std.Error("scanTargetFunc is not configurated")
-			return ExtractResult{Success: false}
-		}
+	//交易单由OperationHandler生成，均为余额变动
+	if scanTargetFunc == nil {
+		bs.wm.Log.Std.Error("scanTargetFunc is not configurated")
+		return ExtractResult{Success: false}
+	}
 
+	var (
+		accountID1 string
+		ok1        bool
+	)
+	var (
+		accountID2 string
+		ok2        bool
+	)
+	//虚拟操作和储蓄到期只增加接收者余额，不提取发送者
+	if !transaction.Virtual && !transaction.ToOnly {
 		//订阅地址为交易单中的发送者
-		accountID1, ok1 := scanTargetFunc(openwallet.ScanTarget{Alias: transaction.From, Symbol: bs.wm.Symbol(), BalanceModelType: openwallet.BalanceModelTypeAccount})
+		accountID1, ok1 = scanTargetFunc(openwallet.ScanTarget{Alias: transaction.From, Symbol: bs.wm.Symbol(), BalanceModelType: openwallet.BalanceModelTypeAccount})
+	}
+	//转入储蓄、质押只减少发送者余额，不提取接收者
+	if !transaction.FromOnly {
 		//订阅地址为交易单中的接收者
-		accountID2, ok2 := scanTargetFunc(openwallet.ScanTarget{Alias: transaction.To, Symbol: bs.wm.Symbol(), BalanceModelType: openwallet.BalanceModelTypeAccount})
-		if accountID1 == accountID2 && len(accountID1) > 0 && len(accountID2) > 0 {
-			bs.InitExtractResult(accountID1, transaction, &result, 0)
-		} else {
-			if ok1 {
-				bs.InitExtractResult(accountID1, transaction, &result, 1)
-			}
-
-			if ok2 {
-				bs.InitExtractResult(accountID2, transaction, &result, 2)
-			}
+		accountID2, ok2 = scanTargetFunc(openwallet.ScanTarget{Alias: transaction.To, Symbol: bs.wm.Symbol(), BalanceModelType: openwallet.BalanceModelTypeAccount})
+	}
+	if ok2 {
+		//共享充值账户按备注路由到子账户
+		accountID2 = bs.routeDeposit(blockHeight, transaction, accountID2, confirmed)
+	}
+	if accountID1 == accountID2 && len(accountID1) > 0 && len(accountID2) > 0 {
+		bs.InitExtractResult(accountID1, transaction, &result, 0)
+	} else {
+		if ok1 {
+			bs.InitExtractResult(accountID1, transaction, &result, 1)
 		}
 
+		if ok2 {
+			bs.InitExtractResult(accountID2, transaction, &result, 2)
+		}
 	}
+
 	result.Success = success
 	return result
 
 }
 
+//operationID 交易内操作的唯一标识，用于生成WxID和SID
+//普通交易的第一个操作保持原txid，与之前生成的记录兼容；虚拟操作可能与所属交易的操作同序号，单独区分
+func operationID(transaction *LocalTransaction) string {
+	if transaction.Virtual {
+		return fmt.Sprintf("%s_virtual_%d", transaction.TxId, transaction.Index)
+	}
+	if transaction.Index == 0 {
+		return transaction.TxId
+	}
+	return fmt.Sprintf("%s_%d", transaction.TxId, transaction.Index)
+}
+
+//operationSIDParams 生成TxInput/TxOutPut SID的txid和序号
+func operationSIDParams(transaction *LocalTransaction) (string, uint64) {
+	if transaction.Virtual {
+		return operationID(transaction), 0
+	}
+	return transaction.TxId, uint64(transaction.Index)
+}
+
 //InitExtractResult optType = 0: 输入输出提取，1: 输入提取，2：输出提取
 func (bs *PIABlockScanner) InitExtractResult(sourceKey string, localTransaction *LocalTransaction, result *ExtractResult, optType int64) {
 
@@ -396,7 +458,24 @@ func (bs *PIABlockScanner) InitExtractResult(sourceKey string, localTransaction
 		IsContract: false,
 		//ContractID: contractID,
 	}
-	//
+	//代币以代币符号作为合约地址，精度取金额的小数位数
+	if localTransaction.Token {
+		decimals = assetDecimals(amount)
+		contractID := openwallet.GenContractID(symbol, localTransaction.CoinTag)
+		coin = openwallet.Coin{
+			Symbol:     symbol,
+			IsContract: true,
+			ContractID: contractID,
+			Contract: openwallet.SmartContract{
+				ContractID: contractID,
+				Symbol:     symbol,
+				Address:    localTransaction.CoinTag,
+				Token:      localTransaction.CoinTag,
+				Name:       localTransaction.CoinTag,
+				Decimals:   uint64(decimals),
+			},
+		}
+	}
 
 	transx := &openwallet.Transaction{
 		Fees:        "0",
@@ -414,9 +493,24 @@ func (bs *PIABlockScanner) InitExtractResult(sourceKey string, localTransaction
 		Reason:      reason,
 	}
 
+	//虚拟操作可能没有资金来源账户
+	if localTransaction.From == "" {
+		transx.From = []string{}
+	}
+
 	transx.SetExtParam("memo", localTransaction.Memo)
+	if localTransaction.Virtual {
+		transx.TxAction = localTransaction.Type
+		transx.SetExtParam("virtual", true)
+	}
+	if localTransaction.FromOnly || localTransaction.ToOnly {
+		transx.TxAction = localTransaction.Type
+	}
 
-	wxID := openwallet.GenTransactionWxID(transx)
+	transx.SetExtParam("opIndex", localTransaction.Index)
+
+	//同一交易的多个操作分别生成WxID
+	wxID := openwallet.GenTransactionWxID2(operationID(localTransaction), coin.Symbol, coin.ContractID)
 	transx.WxID = wxID
 
 	txExtractData.Transaction = transx
@@ -441,7 +535,8 @@ func (bs *PIABlockScanner) extractTxInput(transaction *LocalTransaction, txExtra
 
 	//主网from交易转账信息，第一个TxInput
 	txInput := &openwallet.TxInput{}
-	txInput.Recharge.Sid = openwallet.GenTxInputSID(tx.TxID, bs.wm.Symbol(), coin.ContractID, uint64(0))
+	sidTxID, sidIndex := operationSIDParams(transaction)
+	txInput.Recharge.Sid = openwallet.GenTxInputSID(sidTxID, bs.wm.Symbol(), coin.ContractID, sidIndex)
 	txInput.Recharge.TxID = tx.TxID
 	txInput.Recharge.Address = transaction.From
 	txInput.Recharge.Coin = coin
@@ -451,7 +546,7 @@ func (bs *PIABlockScanner) extractTxInput(transaction *LocalTransaction, txExtra
 	//txInput.Recharge.Memo = data.Memo
 	txInput.Recharge.BlockHash = tx.BlockHash
 	txInput.Recharge.BlockHeight = tx.BlockHeight
-	txInput.Recharge.Index = 0 //账户模型填0
+	txInput.Recharge.Index = uint64(transaction.Index) //账户模型为操作在交易中的序号
 	txInput.Recharge.CreateAt = time.Now().Unix()
 	txExtractData.TxInputs = append(txExtractData.TxInputs, txInput)
 }
@@ -465,7 +560,8 @@ func (bs *PIABlockScanner) extractTxOutput(transaction *LocalTransaction, txExtr
 
 	//主网to交易转账信息,只有一个TxOutPut
 	txOutput := &openwallet.TxOutPut{}
-	txOutput.Recharge.Sid = openwallet.GenTxOutPutSID(tx.TxID, bs.wm.Symbol(), coin.ContractID, uint64(0))
+	sidTxID, sidIndex := operationSIDParams(transaction)
+	txOutput.Recharge.Sid = openwallet.GenTxOutPutSID(sidTxID, bs.wm.Symbol(), coin.ContractID, sidIndex)
 	txOutput.Recharge.TxID = tx.TxID
 	txOutput.Recharge.Address = transaction.To
 	txOutput.Recharge.Coin = coin
@@ -475,39 +571,81 @@ func (bs *PIABlockScanner) extractTxOutput(transaction *LocalTransaction, txExtr
 	//txOutput.Recharge.Memo = data.Memo
 	txOutput.Recharge.BlockHash = tx.BlockHash
 	txOutput.Recharge.BlockHeight = tx.BlockHeight
-	txOutput.Recharge.Index = 0 //账户模型填0
+	txOutput.Recharge.Index = uint64(transaction.Index) //账户模型为操作在交易中的序号
 	txOutput.Recharge.CreateAt = time.Now().Unix()
 	txExtractData.TxOutputs = append(txExtractData.TxOutputs, txOutput)
 }
 
-//newExtractDataNotify 发送通知
+//newExtractDataNotify 发送通知，直接通知失败的交易记录为未扫记录
 func (bs *PIABlockScanner) newExtractDataNotify(height uint64, extractData map[string][]*openwallet.TxExtractData) error {
+	return bs.notifyExtractData(height, extractData, true)
+}
+
+//notifyExtractData 发送通知，开启待投递队列时由队列负责投递和重试
+//未开启时直接通知观测者，recordUnscan为true时失败的交易记录为未扫记录
+func (bs *PIABlockScanner) notifyExtractData(height uint64, extractData map[string][]*openwallet.TxExtractData, recordUnscan bool) error {
+
+	//开启待投递队列时，记录持久化后由队列负责投递和重试
+	if bs.wm.Config.OutboxEnabled {
+		err := bs.enqueueOutbox(height, extractData)
+		if err == nil {
+			return nil
+		}
+		bs.wm.Log.Std.Error("block height: %d, enqueue outbox failed, unexpected error: %v", height, err)
+	}
+
+	failed := 0
+	now := time.Now().Unix()
+	deliveries := make([]*OutboxDelivery, 0)
 	for o := range bs.Observers {
 		for key, array := range extractData {
 			for _, item := range array {
 				err := o.BlockExtractDataNotify(key, item)
 				if err != nil {
+					failed++
+					bs.metrics.addNotifyError(NotifyKindExtract)
 					log.Error("BlockExtractDataNotify unexpected error:", err)
+					if !recordUnscan {
+						continue
+					}
 					//记录未扫区块
-					unscanRecord := openwallet.NewUnscanRecord(height, "", "ExtractData Notify failed.",bs.wm.Symbol())
+					unscanRecord := openwallet.NewUnscanRecord(height, item.Transaction.TxID, "ExtractData Notify failed.",bs.wm.Symbol())
 					err = bs.SaveUnscanRecord(unscanRecord)
 					if err != nil {
 						log.Std.Error("block height: %d, save unscan record failed. unexpected error: %v", height, err.Error())
 					}
 
+				} else if height > 0 {
+					//已确认交易记录为已通知，补扫时跳过
+					deliveries = append(deliveries, &OutboxDelivery{
+						ID:          outboxRecordID(observerKey(o), key, item.Transaction.WxID),
+						ObserverKey: observerKey(o),
+						BlockHeight: height,
+						DeliverTime: now,
+					})
 				}
 			}
 
 		}
 	}
 
+	if len(deliveries) > 0 {
+		if err := bs.saveOutboxDeliveries(deliveries); err != nil {
+			bs.wm.Log.Std.Error("block height: %d, save outbox deliveries failed, unexpected error: %v", height, err)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("block height: %d, %d extract data notify failed", height, failed)
+	}
+
 	return nil
 }
 
 //ScanBlock 扫描指定高度区块
 func (bs *PIABlockScanner) ScanBlock(height uint64) error {
 
-	block, err := bs.wm.Api.GetGetBlock(uint64(height))
+	block, err := bs.fetchBlock(height)
 	if err != nil {
 		bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", err)
 
@@ -518,16 +656,14 @@ func (bs *PIABlockScanner) ScanBlock(height uint64) error {
 		return err
 	}
 
-	bs.scanBlock(block)
-
-	return nil
+	return bs.scanBlock(block)
 }
 
 func (bs *PIABlockScanner) scanBlock(block *ApiBlock) error {
 
-	bs.wm.Log.Std.Info("block scanner scanning height: %d ...", block.Hash)
+	bs.wm.Log.Std.Info("block scanner scanning height: %d ...", block.Height)
 
-	err := bs.BatchExtractTransactions(uint64(block.Height), block.Hash, block.Timestamp, block.LocalTransactions)
+	err := bs.extractBlock(block)
 	if err != nil {
 		bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
 	}
@@ -535,7 +671,7 @@ func (bs *PIABlockScanner) scanBlock(block *ApiBlock) error {
 	//通知新区块给观测者，异步处理
 	bs.newBlockNotify(block)
 
-	return nil
+	return err
 }
 
 //SetRescanBlockHeight 重置区块链扫描高度
@@ -549,9 +685,8 @@ func (bs *PIABlockScanner) SetRescanBlockHeight(height uint64) error {
 		return err
 	}
 
-	bs.SaveLocalBlockHead(uint32(height-1), block.Hash)
-
-	return nil
+	//同时保存本地区块，回滚时可以找到起点
+	return bs.saveScannedBlock(ParseBlock(block, bs.wm.Symbol()))
 }
 
 // GetGlobalMaxBlockHeight GetGlobalMaxBlockHeight
@@ -0,0 +1,480 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	backfillFile = "backfill.db" //补扫任务数据库文件
+
+	BackfillStatusRunning   = "running"   //补扫中，重启后继续
+	BackfillStatusCompleted = "completed" //已完成
+	BackfillStatusFailed    = "failed"    //失败，可通过ResumeBackfill继续
+)
+
+//BackfillJob 区块区间补扫任务，与实时扫描并行执行
+type BackfillJob struct {
+	ID         string `storm:"id"`
+	Symbol     string
+	From       uint64   //起始高度
+	To         uint64   //结束高度，不超过创建时的已扫高度
+	Next       uint64   //下一个待扫高度，每扫完一个区块保存
+	Accounts   []string //只提取这些账户，为空时提取全部订阅账户
+	Observer   string   //只通知该投递标识的观测者，为空时通知全部观测者
+	Status     string
+	LastError  string //失败原因
+	Queued     int    //写入待投递队列的记录数，每个观测者一条记录计一次，观测者已确认或已在队列中的记录不计入
+	CreateTime int64
+	UpdateTime int64
+	FinishTime int64
+}
+
+//BackfillDoneFunc 补扫任务完成或失败的回调
+type BackfillDoneFunc func(job *BackfillJob)
+
+//backfillRunner 运行中的补扫任务
+type backfillRunner struct {
+	mu       sync.Mutex
+	db       *storm.DB
+	running  map[string]chan struct{} //任务ID对应的退出信号
+	wg       sync.WaitGroup
+	doneFunc BackfillDoneFunc
+}
+
+func newBackfillRunner() *backfillRunner {
+	return &backfillRunner{
+		running: make(map[string]chan struct{}),
+	}
+}
+
+//SetBackfillDoneFunc 设置补扫任务完成或失败的回调
+func (bs *PIABlockScanner) SetBackfillDoneFunc(f BackfillDoneFunc) {
+	bs.backfill.mu.Lock()
+	defer bs.backfill.mu.Unlock()
+	bs.backfill.doneFunc = f
+}
+
+//backfillDB 打开补扫任务数据库，调用者需持有backfill.mu
+func (bs *PIABlockScanner) backfillDB() (*storm.DB, error) {
+	if bs.backfill.db != nil {
+		return bs.backfill.db, nil
+	}
+
+	err := os.MkdirAll(bs.wm.Config.dbPath, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	db, err := storm.Open(filepath.Join(bs.wm.Config.dbPath, backfillFile))
+	if err != nil {
+		return nil, err
+	}
+	bs.backfill.db = db
+	return db, nil
+}
+
+//StartBackfill 创建补扫任务并在后台扫描[from, to]区间，只通知accounts相关的提取记录，为空时通知全部订阅账户
+//to超过已扫高度时截断到已扫高度，更高的区块由实时扫描通知
+//补扫的记录经待投递队列通知全部观测者，观测者已确认或已在队列中的记录跳过，投递失败的记录由队列重新投递，
+//只需补给某个观测者时使用StartObserverBackfill
+func (bs *PIABlockScanner) StartBackfill(from, to uint64, accounts ...string) (*BackfillJob, error) {
+	return bs.StartObserverBackfill("", from, to, accounts...)
+}
+
+//StartObserverBackfill 创建只通知一个观测者的补扫任务，observer为观测者的投递标识（OutboxKey或类型名）
+func (bs *PIABlockScanner) StartObserverBackfill(observer string, from, to uint64, accounts ...string) (*BackfillJob, error) {
+
+	if bs.ScanTargetFunc == nil {
+		return nil, fmt.Errorf("scanTargetFunc is not configurated")
+	}
+
+	if from == 0 || from > to {
+		return nil, fmt.Errorf("invalid backfill range [%d, %d]", from, to)
+	}
+
+	scanned := bs.GetScannedBlockHeight()
+	if scanned == 0 {
+		return nil, fmt.Errorf("block scanner has not scanned any block")
+	}
+	if to > scanned {
+		to = scanned
+	}
+	if from > to {
+		return nil, fmt.Errorf("backfill range starts after scanned height %d", scanned)
+	}
+
+	observers, err := bs.outboxObservers()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := observers[observer]; observer != "" && !ok {
+		return nil, fmt.Errorf("backfill observer %s is not registered", observer)
+	}
+
+	now := time.Now()
+	job := &BackfillJob{
+		ID:         fmt.Sprintf("%s_%d_%d_%d", bs.wm.Symbol(), from, to, now.UnixNano()),
+		Symbol:     bs.wm.Symbol(),
+		From:       from,
+		To:         to,
+		Next:       from,
+		Accounts:   accounts,
+		Observer:   observer,
+		Status:     BackfillStatusRunning,
+		CreateTime: now.Unix(),
+		UpdateTime: now.Unix(),
+	}
+
+	bs.backfill.mu.Lock()
+	defer bs.backfill.mu.Unlock()
+
+	db, err := bs.backfillDB()
+	if err != nil {
+		return nil, err
+	}
+	err = db.Save(job)
+	if err != nil {
+		return nil, err
+	}
+
+	created := *job
+	bs.runBackfillLocked(job)
+	return &created, nil
+}
+
+//ResumeBackfill 继续失败或已停止的补扫任务
+func (bs *PIABlockScanner) ResumeBackfill(id string) error {
+
+	bs.backfill.mu.Lock()
+	defer bs.backfill.mu.Unlock()
+
+	db, err := bs.backfillDB()
+	if err != nil {
+		return err
+	}
+
+	var job BackfillJob
+	err = db.One("ID", id, &job)
+	if err != nil {
+		return fmt.Errorf("backfill job %s not found, err: %v", id, err)
+	}
+	if job.Status == BackfillStatusCompleted {
+		return fmt.Errorf("backfill job %s has been completed", id)
+	}
+
+	job.Status = BackfillStatusRunning
+	job.LastError = ""
+	job.UpdateTime = time.Now().Unix()
+	err = db.Save(&job)
+	if err != nil {
+		return err
+	}
+
+	bs.runBackfillLocked(&job)
+	return nil
+}
+
+//GetBackfillJob 获取补扫任务
+func (bs *PIABlockScanner) GetBackfillJob(id string) (*BackfillJob, error) {
+
+	bs.backfill.mu.Lock()
+	defer bs.backfill.mu.Unlock()
+
+	db, err := bs.backfillDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var job BackfillJob
+	err = db.One("ID", id, &job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+//GetBackfillJobs 获取全部补扫任务，按创建时间排序
+func (bs *PIABlockScanner) GetBackfillJobs() ([]*BackfillJob, error) {
+
+	bs.backfill.mu.Lock()
+	defer bs.backfill.mu.Unlock()
+
+	db, err := bs.backfillDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*BackfillJob
+	err = db.All(&jobs)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreateTime < jobs[j].CreateTime
+	})
+	return jobs, nil
+}
+
+//resumeBackfills 继续上次停止时未完成的补扫任务
+func (bs *PIABlockScanner) resumeBackfills() {
+
+	bs.backfill.mu.Lock()
+	defer bs.backfill.mu.Unlock()
+
+	//没有补扫数据库时不创建
+	if bs.backfill.db == nil {
+		if _, err := os.Stat(filepath.Join(bs.wm.Config.dbPath, backfillFile)); err != nil {
+			return
+		}
+	}
+
+	db, err := bs.backfillDB()
+	if err != nil {
+		bs.wm.Log.Std.Error("open backfill db failed, unexpected error: %v", err)
+		return
+	}
+
+	var jobs []*BackfillJob
+	err = db.Find("Status", BackfillStatusRunning, &jobs)
+	if err != nil && err != storm.ErrNotFound {
+		bs.wm.Log.Std.Error("load backfill jobs failed, unexpected error: %v", err)
+		return
+	}
+	for _, job := range jobs {
+		bs.runBackfillLocked(job)
+	}
+}
+
+//stopBackfills 停止运行中的补扫任务，任务保持运行状态，下次启动扫描时继续
+func (bs *PIABlockScanner) stopBackfills() {
+
+	bs.backfill.mu.Lock()
+	for id, quit := range bs.backfill.running {
+		close(quit)
+		delete(bs.backfill.running, id)
+	}
+	bs.backfill.mu.Unlock()
+
+	bs.backfill.wg.Wait()
+
+	bs.backfill.mu.Lock()
+	defer bs.backfill.mu.Unlock()
+	if bs.backfill.db != nil && len(bs.backfill.running) == 0 {
+		bs.backfill.db.Close()
+		bs.backfill.db = nil
+	}
+}
+
+//runBackfillLocked 在后台运行补扫任务，调用者需持有backfill.mu
+func (bs *PIABlockScanner) runBackfillLocked(job *BackfillJob) {
+	if _, ok := bs.backfill.running[job.ID]; ok {
+		return
+	}
+	quit := make(chan struct{})
+	bs.backfill.running[job.ID] = quit
+	bs.backfill.wg.Add(1)
+	go bs.backfillLoop(job, quit)
+}
+
+func (bs *PIABlockScanner) backfillLoop(job *BackfillJob, quit chan struct{}) {
+	defer bs.backfill.wg.Done()
+
+	bs.wm.Log.Std.Info("backfill job %s scanning [%d, %d] from height: %d", job.ID, job.From, job.To, job.Next)
+
+	var err error
+	for job.Next <= job.To {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		err = bs.backfillBlock(job)
+		if err != nil {
+			break
+		}
+	}
+
+	bs.backfill.mu.Lock()
+	if bs.backfill.running[job.ID] != quit {
+		//任务已被停止
+		bs.backfill.mu.Unlock()
+		return
+	}
+	delete(bs.backfill.running, job.ID)
+
+	now := time.Now().Unix()
+	job.UpdateTime = now
+	if err != nil {
+		job.Status = BackfillStatusFailed
+		job.LastError = err.Error()
+		bs.wm.Log.Std.Error("backfill job %s failed at height: %d, unexpected error: %v", job.ID, job.Next, err)
+	} else {
+		job.Status = BackfillStatusCompleted
+		job.FinishTime = now
+		bs.wm.Log.Std.Info("backfill job %s completed, queued: %d", job.ID, job.Queued)
+	}
+
+	if db, dbErr := bs.backfillDB(); dbErr != nil {
+		bs.wm.Log.Std.Error("open backfill db failed, unexpected error: %v", dbErr)
+	} else if saveErr := db.Save(job); saveErr != nil {
+		bs.wm.Log.Std.Error("save backfill job %s failed, unexpected error: %v", job.ID, saveErr)
+	}
+	doneFunc := bs.backfill.doneFunc
+	bs.backfill.mu.Unlock()
+
+	if doneFunc != nil {
+		done := *job
+		doneFunc(&done)
+	}
+}
+
+//backfillBlock 提取job.Next区块中的交易，写入待投递队列后保存进度
+func (bs *PIABlockScanner) backfillBlock(job *BackfillJob) error {
+
+	height := job.Next
+	block, err := bs.fetchBlock(height)
+	if err != nil {
+		return err
+	}
+
+	scanTargetFunc := bs.ScanTargetFunc
+	if len(job.Accounts) > 0 {
+		targets := make(map[string]bool)
+		for _, account := range job.Accounts {
+			targets[account] = true
+		}
+		scanTargetFunc = func(target openwallet.ScanTarget) (string, bool) {
+			if !targets[target.Alias] {
+				return "", false
+			}
+			return bs.ScanTargetFunc(target)
+		}
+	}
+
+	extractData := make(map[string][]*openwallet.TxExtractData)
+	for _, tx := range block.LocalTransactions {
+
+		result := bs.ExtractTransaction(uint64(block.Height), block.Hash, block.Timestamp, tx, scanTargetFunc)
+		if !result.Success {
+			return fmt.Errorf("block height: %d, transaction: %s extract failed", height, tx.TxId)
+		}
+
+		for key, array := range result.extractData {
+			extractData[key] = append(extractData[key], array...)
+		}
+	}
+
+	queued := 0
+	if len(extractData) > 0 {
+		observers, err := bs.backfillObservers(job)
+		if err != nil {
+			return err
+		}
+		queued, err = bs.enqueueOutboxRecords(height, extractData, observers, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	bs.backfill.mu.Lock()
+	defer bs.backfill.mu.Unlock()
+
+	db, err := bs.backfillDB()
+	if err != nil {
+		return err
+	}
+	job.Queued += queued
+	job.Next = height + 1
+	job.UpdateTime = time.Now().Unix()
+	return db.Save(job)
+}
+
+//backfillObservers 补扫任务需要通知的观测者，按投递标识索引
+func (bs *PIABlockScanner) backfillObservers(job *BackfillJob) (map[string]openwallet.BlockScanNotificationObject, error) {
+	observers, err := bs.outboxObservers()
+	if err != nil {
+		return nil, err
+	}
+	if job.Observer == "" {
+		return observers, nil
+	}
+	o, ok := observers[job.Observer]
+	if !ok {
+		return nil, fmt.Errorf("backfill observer %s is not registered", job.Observer)
+	}
+	return map[string]openwallet.BlockScanNotificationObject{job.Observer: o}, nil
+}
+
+//backfillState 全部补扫任务，用于快照
+func (bs *PIABlockScanner) backfillState() ([]*BackfillJob, error) {
+
+	bs.backfill.mu.Lock()
+	defer bs.backfill.mu.Unlock()
+
+	//没有补扫数据库时不创建
+	if bs.backfill.db == nil {
+		if _, err := os.Stat(filepath.Join(bs.wm.Config.dbPath, backfillFile)); err != nil {
+			return nil, nil
+		}
+	}
+
+	db, err := bs.backfillDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*BackfillJob
+	err = db.All(&jobs)
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+//restoreBackfills 写入快照中的补扫任务，补扫中的任务在Run时继续
+func (bs *PIABlockScanner) restoreBackfills(jobs []*BackfillJob) error {
+
+	bs.backfill.mu.Lock()
+	defer bs.backfill.mu.Unlock()
+
+	db, err := bs.backfillDB()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, job := range jobs {
+		if err := tx.Save(job); err != nil {
+			return fmt.Errorf("save backfill job %s failed, err: %v", job.ID, err)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,302 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//failTxObserver 第一次收到指定交易时失败
+type failTxObserver struct {
+	testObserver
+	failTx string
+}
+
+func (o *failTxObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	if data.Transaction.TxID == o.failTx {
+		o.failTx = ""
+		o.mu.Unlock()
+		return fmt.Errorf("observer is down")
+	}
+	o.mu.Unlock()
+	return o.testObserver.BlockExtractDataNotify(sourceKey, data)
+}
+
+//keyedObserver 实现OutboxObserver，以指定的标识投递
+type keyedObserver struct {
+	testObserver
+	key string
+}
+
+func (o *keyedObserver) OutboxKey() string {
+	return o.key
+}
+
+func testBackfillWalletManager(t *testing.T, node *fakeNode, watched ...string) (*WalletManager, chan *BackfillJob) {
+	wm, _, observer := testScanWalletManager(t, node, watched...)
+	wm.Blockscanner.RemoveObserver(observer)
+
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		wm.Blockscanner.stopBackfills()
+		wm.Blockscanner.stopOutbox()
+		os.RemoveAll(dir)
+	})
+	wm.Config.dbPath = dir
+	wm.Config.OutboxRetryInterval = 20 * time.Millisecond
+
+	done := make(chan *BackfillJob, 10)
+	wm.Blockscanner.SetBackfillDoneFunc(func(job *BackfillJob) {
+		done <- job
+	})
+	return wm, done
+}
+
+func waitBackfill(t *testing.T, done chan *BackfillJob) *BackfillJob {
+	select {
+	case job := <-done:
+		return job
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for backfill job")
+		return nil
+	}
+}
+
+func TestBackfillRange(t *testing.T) {
+	node := newFakeNode(t, 40)
+	txid1 := node.addTransfer(12, "alice", "bob", "1.00000000 PIA", "")
+	node.addTransfer(18, "alice", "carol", "2.00000000 PIA", "")
+	txid2 := node.addTransfer(25, "alice", "bob", "3.00000000 PIA", "")
+	node.addTransfer(35, "alice", "bob", "4.00000000 PIA", "")
+
+	wm, done := testBackfillWalletManager(t, node, "bob", "carol")
+	node.setLocalHead(wm, 30)
+	bs := wm.Blockscanner
+	observer := &testObserver{}
+	bs.AddObserver(observer)
+
+	if _, err := bs.StartBackfill(20, 10); err == nil {
+		t.Errorf("expected invalid range rejected")
+	}
+
+	//超过已扫高度的区块由实时扫描通知
+	job, err := bs.StartBackfill(10, 40, "bob")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if job.To != 30 || job.Status != BackfillStatusRunning {
+		t.Errorf("unexpected job: %+v", job)
+	}
+
+	finished := waitBackfill(t, done)
+	if finished.ID != job.ID || finished.Status != BackfillStatusCompleted || finished.Next != 31 || finished.Queued != 2 {
+		t.Errorf("unexpected finished job: %+v", finished)
+	}
+
+	extracted := observer.extractedData()
+	if len(extracted) != 2 || extracted[0].Transaction.TxID != txid1 || extracted[1].Transaction.TxID != txid2 {
+		t.Fatalf("unexpected extracted data: %+v", extracted)
+	}
+
+	stored, err := bs.GetBackfillJob(job.ID)
+	if err != nil || stored.Status != BackfillStatusCompleted || stored.FinishTime == 0 {
+		t.Errorf("unexpected stored job: %+v, err: %v", stored, err)
+	}
+	if jobs, _ := bs.GetBackfillJobs(); len(jobs) != 1 {
+		t.Errorf("unexpected jobs: %+v", jobs)
+	}
+	if err := bs.ResumeBackfill(job.ID); err == nil {
+		t.Errorf("expected completed job not resumed")
+	}
+}
+
+func TestBackfillDedupe(t *testing.T) {
+	node := newFakeNode(t, 30)
+	txid1 := node.addTransfer(15, "alice", "bob", "1.00000000 PIA", "")
+	txid2 := node.addTransfer(15, "alice", "bob", "2.00000000 PIA", "")
+	txid3 := node.addTransfer(18, "alice", "bob", "3.00000000 PIA", "")
+
+	wm, done := testBackfillWalletManager(t, node, "bob")
+	node.setLocalHead(wm, 30)
+	bs := wm.Blockscanner
+	observer := &failTxObserver{failTx: txid2}
+	bs.AddObserver(observer)
+
+	//实时扫描已通知的记录不再补扫
+	if err := bs.ScanBlock(18); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	//观测者失败不影响补扫任务，记录保留在待投递队列
+	if _, err := bs.StartBackfill(10, 20); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	finished := waitBackfill(t, done)
+	if finished.Status != BackfillStatusCompleted || finished.Queued != 2 {
+		t.Fatalf("unexpected finished job: %+v", finished)
+	}
+	records, err := bs.GetOutboxRecords()
+	if err != nil || len(records) != 1 || records[0].Data.Transaction.TxID != txid2 {
+		t.Fatalf("unexpected outbox: %+v, err: %v", records, err)
+	}
+
+	//未开启待投递队列时也重新投递补扫写入的记录
+	time.Sleep(100 * time.Millisecond)
+	if pending, err := bs.RetryOutbox(); err != nil || pending != 0 {
+		t.Fatalf("expected outbox drained, pending: %d, err: %v", pending, err)
+	}
+	extracted := observer.extractedData()
+	if len(extracted) != 3 || extracted[0].Transaction.TxID != txid3 || extracted[1].Transaction.TxID != txid1 || extracted[2].Transaction.TxID != txid2 {
+		t.Fatalf("unexpected extracted data: %+v", extracted)
+	}
+
+	//任务完成后去重记录仍然保留，重复补扫不再通知
+	if _, err := bs.StartBackfill(10, 20); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if finished := waitBackfill(t, done); finished.Status != BackfillStatusCompleted || finished.Queued != 0 {
+		t.Errorf("unexpected finished job: %+v", finished)
+	}
+	if extracted := observer.extractedData(); len(extracted) != 3 {
+		t.Errorf("expected no new records, got %d", len(extracted))
+	}
+}
+
+func TestBackfillResumeOnRun(t *testing.T) {
+	node := newFakeNode(t, 30)
+	node.addTransfer(12, "alice", "bob", "1.00000000 PIA", "")
+	txid := node.addTransfer(18, "alice", "bob", "2.00000000 PIA", "")
+
+	wm, done := testBackfillWalletManager(t, node, "bob")
+	node.setLocalHead(wm, 30)
+	bs := wm.Blockscanner
+	observer := &testObserver{}
+	bs.AddObserver(observer)
+
+	//上次运行时扫到16后停止
+	db, err := storm.Open(filepath.Join(wm.Config.dbPath, backfillFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Save(&BackfillJob{ID: "job", Symbol: wm.Symbol(), From: 10, To: 20, Next: 16, Status: BackfillStatusRunning})
+	db.Close()
+
+	if err := bs.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer bs.Stop()
+
+	finished := waitBackfill(t, done)
+	if finished.ID != "job" || finished.Status != BackfillStatusCompleted {
+		t.Errorf("unexpected finished job: %+v", finished)
+	}
+	extracted := observer.extractedData()
+	if len(extracted) != 1 || extracted[0].Transaction.TxID != txid {
+		t.Errorf("unexpected extracted data: %+v", extracted)
+	}
+}
+
+func TestBackfillObservers(t *testing.T) {
+	node := newFakeNode(t, 30)
+	txid1 := node.addTransfer(15, "alice", "bob", "1.00000000 PIA", "")
+	txid2 := node.addTransfer(15, "alice", "bob", "2.00000000 PIA", "")
+
+	wm, done := testBackfillWalletManager(t, node, "bob")
+	node.setLocalHead(wm, 30)
+	bs := wm.Blockscanner
+	healthy := &testObserver{}
+	flaky := &failTxObserver{failTx: txid2}
+	bs.AddObserver(healthy)
+	bs.AddObserver(flaky)
+
+	//一个观测者失败时其他观测者照常收到，失败的记录由待投递队列重新投递
+	job, err := bs.StartBackfill(10, 20)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if finished := waitBackfill(t, done); finished.Status != BackfillStatusCompleted || finished.Queued != 4 {
+		t.Fatalf("unexpected finished job: %+v", finished)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if pending, err := bs.RetryOutbox(); err != nil || pending != 0 {
+		t.Fatalf("expected outbox drained, pending: %d, err: %v", pending, err)
+	}
+	if extracted := healthy.extractedData(); len(extracted) != 2 {
+		t.Errorf("expected 2 records on the healthy observer, got %d", len(extracted))
+	}
+	if extracted := flaky.extractedData(); len(extracted) != 2 || extracted[1].Transaction.TxID != txid2 {
+		t.Errorf("unexpected records on the flaky observer: %+v", extracted)
+	}
+
+	//只补给指定的观测者
+	if _, err := bs.StartObserverBackfill("unknown", 10, 20); err == nil {
+		t.Errorf("expected unknown observer rejected")
+	}
+	late := &keyedObserver{key: "late"}
+	bs.AddObserver(late)
+	job, err = bs.StartObserverBackfill("late", 10, 20)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if finished := waitBackfill(t, done); finished.Status != BackfillStatusCompleted || finished.Queued != 2 {
+		t.Errorf("unexpected finished job: %+v", finished)
+	}
+	if extracted := healthy.extractedData(); len(extracted) != 2 {
+		t.Errorf("expected no new records on the healthy observer, got %d", len(extracted))
+	}
+	if extracted := flaky.extractedData(); len(extracted) != 2 {
+		t.Errorf("expected no new records on the flaky observer, got %d", len(extracted))
+	}
+	if extracted := late.extractedData(); len(extracted) != 2 || extracted[0].Transaction.TxID != txid1 {
+		t.Errorf("unexpected records on the late observer: %+v", extracted)
+	}
+
+	//已确认的观测者重复补扫不再通知
+	if _, err := bs.StartObserverBackfill(observerKey(flaky), 10, 20); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if finished := waitBackfill(t, done); finished.Status != BackfillStatusCompleted || finished.Queued != 0 {
+		t.Errorf("unexpected finished job: %+v", finished)
+	}
+
+	//补扫任务包含在快照中
+	snapshot, err := bs.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(snapshot.BackfillJobs) != 3 || len(snapshot.OutboxDeliveries) != 6 {
+		t.Fatalf("unexpected snapshot, backfill jobs: %d, outbox deliveries: %d", len(snapshot.BackfillJobs), len(snapshot.OutboxDeliveries))
+	}
+	wm2, _ := testBackfillWalletManager(t, node, "bob")
+	if err := wm2.Blockscanner.RestoreSnapshot(snapshot); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if restored, err := wm2.Blockscanner.GetBackfillJob(job.ID); err != nil || restored.Observer != "late" {
+		t.Errorf("unexpected restored job: %+v, err: %v", restored, err)
+	}
+}
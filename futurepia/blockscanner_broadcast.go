@@ -0,0 +1,158 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	TxStatusPending = "2" //未确认，已广播但未打包进区块
+
+	pendingExpiredReason = "transaction expired"
+)
+
+//PendingTransaction 已广播、尚未打包的交易
+type PendingTransaction struct {
+	TxID         string              `json:"txid"`
+	Expiration   time.Time           `json:"expiration"` //过期时间，区块时间超过后未打包视为失败
+	SeenTime     time.Time           `json:"seenTime"`
+	Transactions []*LocalTransaction `json:"-"`
+}
+
+//broadcastTracker 跟踪已广播的未确认交易
+//节点不提供交易池查询接口，只能跟踪本钱包的广播，或外部通过AddPendingTransaction提交的交易；
+//其他钱包发起、尚未打包的入账不会提前通知，打包后由区块扫描正常提取
+type broadcastTracker struct {
+	mu      sync.Mutex
+	pending map[string]*PendingTransaction
+}
+
+func newBroadcastTracker() *broadcastTracker {
+	return &broadcastTracker{
+		pending: make(map[string]*PendingTransaction),
+	}
+}
+
+//AddPendingTransaction 记录一笔未确认交易，涉及订阅账户时以TxStatusPending状态通知观测者
+func (bs *PIABlockScanner) AddPendingTransaction(txid string, expiration time.Time, transactions []*LocalTransaction) {
+
+	if !bs.IsScanMemPool || txid == "" {
+		return
+	}
+
+	for _, tx := range transactions {
+		tx.TxId = txid
+	}
+
+	pending := &PendingTransaction{
+		TxID:         txid,
+		Expiration:   expiration,
+		SeenTime:     time.Now(),
+		Transactions: transactions,
+	}
+
+	bs.broadcasts.mu.Lock()
+	if _, exist := bs.broadcasts.pending[txid]; exist {
+		bs.broadcasts.mu.Unlock()
+		return
+	}
+	bs.broadcasts.pending[txid] = pending
+	bs.broadcasts.mu.Unlock()
+
+	bs.pendingExtractDataNotify(pending, TxStatusPending, "")
+}
+
+//GetPendingTransactions 返回未确认交易，按发现时间排序
+func (bs *PIABlockScanner) GetPendingTransactions() []*PendingTransaction {
+	bs.broadcasts.mu.Lock()
+	defer bs.broadcasts.mu.Unlock()
+
+	list := make([]*PendingTransaction, 0, len(bs.broadcasts.pending))
+	for _, pending := range bs.broadcasts.pending {
+		list = append(list, pending)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].SeenTime.Before(list[j].SeenTime)
+	})
+	return list
+}
+
+//reconcilePendingTransactions 区块扫描后对账：已打包的交易不再跟踪，由正常提取流程通知确认状态；
+//区块时间超过过期时间仍未打包的交易，以失败状态通知
+func (bs *PIABlockScanner) reconcilePendingTransactions(block *ApiBlock) {
+
+	bs.broadcasts.mu.Lock()
+	if len(bs.broadcasts.pending) == 0 {
+		bs.broadcasts.mu.Unlock()
+		return
+	}
+
+	for _, txid := range block.TransactionIds {
+		delete(bs.broadcasts.pending, txid)
+	}
+
+	blockTime := time.Unix(block.Timestamp, 0)
+	expired := make([]*PendingTransaction, 0)
+	for txid, pending := range bs.broadcasts.pending {
+		if !pending.Expiration.IsZero() && blockTime.After(pending.Expiration) {
+			expired = append(expired, pending)
+			delete(bs.broadcasts.pending, txid)
+		}
+	}
+	bs.broadcasts.mu.Unlock()
+
+	for _, pending := range expired {
+		bs.wm.Log.Std.Info("pending transaction: %s expired at block: %d", pending.TxID, block.Height)
+		bs.pendingExtractDataNotify(pending, openwallet.TxStatusFail, pendingExpiredReason)
+	}
+}
+
+//pendingExtractDataNotify 提取未确认交易并以指定状态通知观测者
+//开启待投递队列时与区块提取记录一样由队列投递，确认后的通知与未确认通知WxID相同，队列中只保留最新状态；
+//未开启时失败只记录日志，不产生未扫记录
+func (bs *PIABlockScanner) pendingExtractDataNotify(pending *PendingTransaction, status, reason string) {
+
+	extractData := make(map[string][]*openwallet.TxExtractData)
+	for _, tx := range pending.Transactions {
+
+		//未确认交易不记录无法路由的充值，打包后由区块提取记录
+		result := bs.extractTransaction(0, "", pending.SeenTime.Unix(), tx, bs.ScanTargetFunc, false)
+		if !result.Success {
+			continue
+		}
+
+		for key, array := range result.extractData {
+			for _, item := range array {
+				item.Transaction.Status = status
+				item.Transaction.Reason = reason
+			}
+			extractData[key] = append(extractData[key], array...)
+		}
+	}
+
+	if len(extractData) == 0 {
+		return
+	}
+
+	if err := bs.notifyExtractData(0, extractData, false); err != nil {
+		bs.wm.Log.Std.Error("pending transaction: %s notify failed, unexpected error: %v", pending.TxID, err)
+	}
+}
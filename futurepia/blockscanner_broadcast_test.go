@@ -0,0 +1,125 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+)
+
+func TestPendingTransactions(t *testing.T) {
+	node := newFakeNode(t, 20)
+	txid := node.addTransfer(12, "alice", "bob", "1.00000000 PIA", "")
+
+	wm, _, observer := testScanWalletManager(t, node, "bob")
+	bs := wm.Blockscanner
+
+	deposit := func() []*LocalTransaction {
+		return []*LocalTransaction{{From: "alice", To: "bob", Amount: "1.00000000", CoinTag: "PIA", Type: "transfer"}}
+	}
+
+	//区块12的时间之后才过期
+	bs.AddPendingTransaction(txid, time.Unix(1560000000+20*3, 0), deposit())
+	//区块13的时间之前已过期
+	bs.AddPendingTransaction("expired", time.Unix(1560000000+12*3, 0), deposit())
+	//重复广播只通知一次
+	bs.AddPendingTransaction(txid, time.Unix(1560000000+20*3, 0), deposit())
+
+	extracted := observer.extractedData()
+	if len(extracted) != 2 || extracted[0].Transaction.Status != TxStatusPending || extracted[0].Transaction.BlockHeight != 0 {
+		t.Fatalf("unexpected pending notifications: %+v", extracted)
+	}
+	if len(bs.GetPendingTransactions()) != 2 {
+		t.Fatalf("expected 2 pending transactions")
+	}
+
+	//打包后以成功状态通知，WxID与未确认通知一致
+	if err := bs.ScanBlock(12); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	extracted = observer.extractedData()
+	if len(extracted) != 3 || extracted[2].Transaction.Status != openwallet.TxStatusSuccess || extracted[2].Transaction.WxID != extracted[0].Transaction.WxID {
+		t.Fatalf("unexpected confirmed notification: %+v", extracted)
+	}
+	if pending := bs.GetPendingTransactions(); len(pending) != 1 || pending[0].TxID != "expired" {
+		t.Fatalf("unexpected pending transactions: %+v", pending)
+	}
+
+	//过期后以失败状态通知
+	if err := bs.ScanBlock(13); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	extracted = observer.extractedData()
+	if len(extracted) != 4 || extracted[3].Transaction.Status != openwallet.TxStatusFail || extracted[3].Transaction.Reason != pendingExpiredReason {
+		t.Fatalf("unexpected expired notification: %+v", extracted)
+	}
+	if len(bs.GetPendingTransactions()) != 0 {
+		t.Errorf("expected no tracked broadcasts")
+	}
+
+	//关闭后不跟踪
+	bs.IsScanMemPool = false
+	bs.AddPendingTransaction("other", time.Now(), deposit())
+	if len(bs.GetPendingTransactions()) != 0 {
+		t.Errorf("pending transaction tracked while tracking disabled")
+	}
+}
+
+func TestPendingTransfers(t *testing.T) {
+	asset, err := eos.NewAsset("1.50000000 PIA")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stx := &TransConMain{Operations: [][]*ParamData{{{From: "alice", To: "bob", Amount: asset, Memo: "m"}}}}
+
+	transfers := pendingTransfers(stx)
+	if len(transfers) != 1 || transfers[0].Amount != "1.50000000" || transfers[0].CoinTag != "PIA" || transfers[0].Memo != "m" {
+		t.Fatalf("unexpected transfers: %+v", transfers)
+	}
+}
+
+func TestPendingTransactionsOutbox(t *testing.T) {
+	node := newFakeNode(t, 20)
+	txid := node.addTransfer(12, "alice", "bob", "1.00000000 PIA", "")
+
+	wm, _, observer := testOutboxWalletManager(t, node, 1)
+	bs := wm.Blockscanner
+
+	//观测者失败时未确认通知留在待投递队列
+	bs.AddPendingTransaction(txid, time.Unix(1560000000+20*3, 0), []*LocalTransaction{
+		{From: "alice", To: "bob", Amount: "1.00000000", CoinTag: "PIA", Type: "transfer"},
+	})
+	records, err := bs.GetOutboxRecords()
+	if err != nil || len(records) != 1 || records[0].Data.Transaction.Status != TxStatusPending {
+		t.Fatalf("expected pending notification in outbox, got %+v, err: %v", records, err)
+	}
+
+	//打包后确认通知覆盖队列中的未确认通知
+	if err := bs.ScanBlock(12); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	records, _ = bs.GetOutboxRecords()
+	if len(records) != 0 {
+		t.Fatalf("expected outbox to be drained, got %d", len(records))
+	}
+	extracted := observer.extractedData()
+	if len(extracted) != 1 || extracted[0].Transaction.Status != openwallet.TxStatusSuccess {
+		t.Fatalf("expected only the confirmed notification, got %+v", extracted)
+	}
+}
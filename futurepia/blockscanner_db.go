@@ -16,27 +16,14 @@
 package futurepia
 
 import (
-	"fmt"
 	"github.com/blocktree/openwallet/v2/openwallet"
 )
 
 //SaveLocalBlockHead 记录区块高度和hash到本地
 func (bs *PIABlockScanner) SaveLocalBlockHead(blockHeight uint32, blockHash string) error {
-
-	//获取本地区块高度
-	//db, err := storm.Open(filepath.Join(bs.wm.Config.DBPath, bs.wm.Config.BlockchainFile))
-	//if err != nil {
-	//	return err
-	//}
-	//defer db.Close()
-	//
-	//db.Set(blockchainBucket, "blockHeight", &blockHeight)
-	//db.Set(blockchainBucket, "blockHash", &blockHash)
-
-	//return nil
-
-	if bs.BlockchainDAI == nil {
-		return fmt.Errorf("Blockchain DAI is not setup ")
+	dai, err := bs.blockchainDAI()
+	if err != nil {
+		return err
 	}
 
 	header := &openwallet.BlockHeader{
@@ -46,34 +33,17 @@ func (bs *PIABlockScanner) SaveLocalBlockHead(blockHeight uint32, blockHash stri
 		Symbol: bs.wm.Symbol(),
 	}
 
-	return bs.BlockchainDAI.SaveCurrentBlockHead(header)
+	return dai.SaveCurrentBlockHead(header)
 }
 
 //GetLocalBlockHead 获取本地记录的区块高度和hash
 func (bs *PIABlockScanner) GetLocalBlockHead() (uint32, string, error) {
-
-	//var (
-	//	blockHeight uint32
-	//	blockHash   string
-	//)
-
-	//获取本地区块高度
-	//db, err := storm.Open(filepath.Join(bs.wm.Config.DBPath, bs.wm.Config.BlockchainFile))
-	//if err != nil {
-	//	return 0, "", err
-	//}
-	//defer db.Close()
-	//
-	//db.Get(blockchainBucket, "blockHeight", &blockHeight)
-	//db.Get(blockchainBucket, "blockHash", &blockHash)
-
-	//return blockHeight, blockHash, nil
-
-	if bs.BlockchainDAI == nil {
-		return 0, "", fmt.Errorf("Blockchain DAI is not setup ")
+	dai, err := bs.blockchainDAI()
+	if err != nil {
+		return 0, "", err
 	}
 
-	header, err := bs.BlockchainDAI.GetCurrentBlockHead(bs.wm.Symbol())
+	header, err := dai.GetCurrentBlockHead(bs.wm.Symbol())
 	if err != nil {
 		return 0, "", err
 	}
@@ -83,19 +53,9 @@ func (bs *PIABlockScanner) GetLocalBlockHead() (uint32, string, error) {
 
 //SaveLocalBlock 记录本地新区块
 func (bs *PIABlockScanner) SaveLocalBlock(blockHeader *Block) error {
-
-	//db, err := storm.Open(filepath.Join(bs.wm.Config.DBPath, bs.wm.Config.BlockchainFile))
-	//if err != nil {
-	//	return err
-	//}
-	//defer db.Close()
-	//
-	//db.Save(blockHeader)
-	//
-	//return nil
-
-	if bs.BlockchainDAI == nil {
-		return fmt.Errorf("Blockchain DAI is not setup ")
+	dai, err := bs.blockchainDAI()
+	if err != nil {
+		return err
 	}
 
 	header := &openwallet.BlockHeader{
@@ -110,34 +70,46 @@ func (bs *PIABlockScanner) SaveLocalBlock(blockHeader *Block) error {
 		Symbol:            bs.wm.Symbol(),
 	}
 
-	return bs.BlockchainDAI.SaveLocalBlockHead(header)
+	return dai.SaveLocalBlockHead(header)
+}
+
+//ScannedBlockDAI 扫描进度的数据访问接口，在同一事务中保存本地区块和当前已扫区块头
+//注入的BlockchainDAI未实现该接口时先保存本地区块，再保存已扫区块头
+type ScannedBlockDAI interface {
+	SaveScannedBlock(header *openwallet.BlockHeader) error
+}
+
+//saveScannedBlock 保存已扫描的区块并推进已扫区块头，已扫区块头不会领先于本地区块
+func (bs *PIABlockScanner) saveScannedBlock(block *Block) error {
+	dai, err := bs.blockchainDAI()
+	if err != nil {
+		return err
+	}
+
+	header := block.BlockHeader
+	header.Height = uint64(block.Height)
+	header.Fork = block.Fork
+	header.Symbol = bs.wm.Symbol()
+
+	if scanned, ok := dai.(ScannedBlockDAI); ok {
+		return scanned.SaveScannedBlock(&header)
+	}
+
+	err = dai.SaveLocalBlockHead(&header)
+	if err != nil {
+		return err
+	}
+	return bs.SaveLocalBlockHead(block.Height, block.Hash)
 }
 
 //GetLocalBlock 获取本地区块数据
 func (bs *PIABlockScanner) GetLocalBlock(height uint32) (*Block, error) {
+	dai, err := bs.blockchainDAI()
+	if err != nil {
+		return nil, err
+	}
 
-	//var (
-	//	blockHeader Block
-	//)
-	//
-	//db, err := storm.Open(filepath.Join(bs.wm.Config.DBPath, bs.wm.Config.BlockchainFile))
-	//if err != nil {
-	//	return nil, err
-	//}
-	//defer db.Close()
-	//
-	//err = db.One("Height", height, &blockHeader)
-	//if err != nil {
-	//	return nil, err
-	//}
-	//
-	//return &blockHeader, nil
-
-	if bs.BlockchainDAI == nil {
-		return nil, fmt.Errorf("Blockchain DAI is not setup ")
-	}
-
-	header, err := bs.BlockchainDAI.GetLocalBlockHeadByHeight(uint64(height), bs.wm.Symbol())
+	header, err := dai.GetLocalBlockHeadByHeight(uint64(height), bs.wm.Symbol())
 	if err != nil {
 		return nil, err
 	}
@@ -153,42 +125,40 @@ func (bs *PIABlockScanner) GetLocalBlock(height uint32) (*Block, error) {
 
 //SaveUnscanRecord 保存交易记录到钱包数据库
 func (bs *PIABlockScanner) SaveUnscanRecord(record *openwallet.UnscanRecord) error {
-
-	//if record == nil {
-	//	return errors.New("the unscan record to save is nil")
-	//}
-	//
-	////获取本地区块高度
-	//db, err := storm.Open(filepath.Join(bs.wm.Config.DBPath, bs.wm.Config.BlockchainFile))
-	//if err != nil {
-	//	return err
-	//}
-	//defer db.Close()
-	//
-	//return db.Save(record)
-
-	if bs.BlockchainDAI == nil {
-		return fmt.Errorf("Blockchain DAI is not setup ")
+	dai, err := bs.blockchainDAI()
+	if err != nil {
+		return err
 	}
 
-	return bs.BlockchainDAI.SaveUnscanRecord(record)
+	return dai.SaveUnscanRecord(record)
 }
 
 //DeleteUnscanRecord 删除指定高度的未扫记录
 func (bs *PIABlockScanner) DeleteUnscanRecord(height uint32) error {
+	dai, err := bs.blockchainDAI()
+	if err != nil {
+		return err
+	}
+
+	return dai.DeleteUnscanRecordByHeight(uint64(height), bs.wm.Symbol())
+}
 
-	if bs.BlockchainDAI == nil {
-		return fmt.Errorf("Blockchain DAI is not setup ")
+//DeleteUnscanRecordByID 删除指定ID的未扫记录
+func (bs *PIABlockScanner) DeleteUnscanRecordByID(id string) error {
+	dai, err := bs.blockchainDAI()
+	if err != nil {
+		return err
 	}
 
-	return bs.BlockchainDAI.DeleteUnscanRecordByHeight(uint64(height), bs.wm.Symbol())
+	return dai.DeleteUnscanRecordByID(id, bs.wm.Symbol())
 }
 
+//GetUnscanRecords 获取未扫记录
 func (bs *PIABlockScanner) GetUnscanRecords() ([]*openwallet.UnscanRecord, error) {
-
-	if bs.BlockchainDAI == nil {
-		return nil, fmt.Errorf("Blockchain DAI is not setup ")
+	dai, err := bs.blockchainDAI()
+	if err != nil {
+		return nil, err
 	}
 
-	return bs.BlockchainDAI.GetUnscanRecords(bs.wm.Symbol())
+	return dai.GetUnscanRecords(bs.wm.Symbol())
 }
\ No newline at end of file
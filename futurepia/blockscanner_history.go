@@ -0,0 +1,345 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	defaultAccountHistoryLimit = 1000                 //每次获取的账户历史记录数
+	accountHistoryFile         = "account_history.db" //账户历史游标数据库文件
+)
+
+//AccountHistoryCursor 账户历史补扫游标
+type AccountHistoryCursor struct {
+	ID          string `storm:"id"` //symbol_account
+	Symbol      string
+	Account     string
+	Sequence    int64  //已处理的最后一条记录序号，-1表示从头开始
+	BlockHeight uint64 //已处理的最后一条记录所在区块
+	UpdateTime  int64
+}
+
+//accountHistory 账户历史数据库，首次使用时打开，关闭扫描器时关闭
+type accountHistory struct {
+	mu sync.Mutex
+	db *storm.DB
+}
+
+func newAccountHistory() *accountHistory {
+	return &accountHistory{}
+}
+
+func accountHistoryCursorID(symbol, account string) string {
+	return symbol + "_" + account
+}
+
+//openAccountHistoryDB 打开账户历史游标数据库，调用者需持有history.mu
+func (bs *PIABlockScanner) openAccountHistoryDB() (*storm.DB, error) {
+	if bs.history.db != nil {
+		return bs.history.db, nil
+	}
+
+	err := os.MkdirAll(bs.wm.Config.dbPath, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	db, err := storm.Open(filepath.Join(bs.wm.Config.dbPath, accountHistoryFile))
+	if err != nil {
+		return nil, err
+	}
+	bs.history.db = db
+	return db, nil
+}
+
+//closeAccountHistory 关闭账户历史游标数据库
+func (bs *PIABlockScanner) closeAccountHistory() {
+	bs.history.mu.Lock()
+	defer bs.history.mu.Unlock()
+	if bs.history.db != nil {
+		bs.history.db.Close()
+		bs.history.db = nil
+	}
+}
+
+//loadAccountHistoryCursor 读取账户游标，不存在时从头开始
+func (bs *PIABlockScanner) loadAccountHistoryCursor(db *storm.DB, account string) (*AccountHistoryCursor, error) {
+	var cursor AccountHistoryCursor
+	err := db.One("ID", accountHistoryCursorID(bs.wm.Symbol(), account), &cursor)
+	if err == storm.ErrNotFound {
+		return &AccountHistoryCursor{
+			ID:       accountHistoryCursorID(bs.wm.Symbol(), account),
+			Symbol:   bs.wm.Symbol(),
+			Account:  account,
+			Sequence: -1,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+//GetAccountHistoryCursor 获取账户历史补扫游标
+func (bs *PIABlockScanner) GetAccountHistoryCursor(account string) (*AccountHistoryCursor, error) {
+	bs.history.mu.Lock()
+	defer bs.history.mu.Unlock()
+
+	db, err := bs.openAccountHistoryDB()
+	if err != nil {
+		return nil, err
+	}
+
+	return bs.loadAccountHistoryCursor(db, account)
+}
+
+//SetAccountHistoryCursor 设置账户历史补扫的起点，从sequence之后的记录开始提取
+func (bs *PIABlockScanner) SetAccountHistoryCursor(account string, sequence int64) error {
+	bs.history.mu.Lock()
+	defer bs.history.mu.Unlock()
+
+	db, err := bs.openAccountHistoryDB()
+	if err != nil {
+		return err
+	}
+
+	cursor, err := bs.loadAccountHistoryCursor(db, account)
+	if err != nil {
+		return err
+	}
+	cursor.Sequence = sequence
+	cursor.UpdateTime = time.Now().Unix()
+	return db.Save(cursor)
+}
+
+//accountHistoryState 全部账户游标，用于快照
+func (bs *PIABlockScanner) accountHistoryState() ([]*AccountHistoryCursor, error) {
+	bs.history.mu.Lock()
+	defer bs.history.mu.Unlock()
+
+	//没有账户历史数据库时不创建
+	if bs.history.db == nil {
+		if _, err := os.Stat(filepath.Join(bs.wm.Config.dbPath, accountHistoryFile)); err != nil {
+			return nil, nil
+		}
+	}
+
+	db, err := bs.openAccountHistoryDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var cursors []*AccountHistoryCursor
+	err = db.All(&cursors)
+	if err != nil {
+		return nil, err
+	}
+	return cursors, nil
+}
+
+//restoreAccountHistory 写入快照中的账户游标
+func (bs *PIABlockScanner) restoreAccountHistory(cursors []*AccountHistoryCursor) error {
+	bs.history.mu.Lock()
+	defer bs.history.mu.Unlock()
+
+	db, err := bs.openAccountHistoryDB()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, cursor := range cursors {
+		if err := tx.Save(cursor); err != nil {
+			return fmt.Errorf("save account history cursor %s failed, err: %v", cursor.ID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+//accountHistoryRun 一次补扫的状态
+type accountHistoryRun struct {
+	targets     map[string]bool //补扫的账户
+	limitHeight uint64          //允许提取的最高区块
+	scanned     map[uint64]bool //已提取的区块
+}
+
+//ScanAccountHistory 通过账户历史接口补扫订阅账户
+//从各账户的游标开始读取操作记录，提取记录所在区块中与这些账户相关的交易，结果与区块扫描一致，
+//不会重复通知其他订阅账户；只提取扫描上限高度以内的记录，
+//记录经待投递队列通知，观测者已确认（包括实时扫描和区块补扫通知的）或已在队列中的记录跳过
+func (bs *PIABlockScanner) ScanAccountHistory(accounts ...string) error {
+
+	if len(accounts) == 0 {
+		return nil
+	}
+
+	limitHeight, err := bs.GetScanLimitHeight()
+	if err != nil {
+		return err
+	}
+
+	bs.history.mu.Lock()
+	defer bs.history.mu.Unlock()
+
+	db, err := bs.openAccountHistoryDB()
+	if err != nil {
+		return err
+	}
+
+	run := &accountHistoryRun{
+		targets:     make(map[string]bool),
+		limitHeight: limitHeight,
+		scanned:     make(map[uint64]bool),
+	}
+	for _, account := range accounts {
+		run.targets[account] = true
+	}
+
+	for _, account := range accounts {
+		err = bs.scanAccountHistory(db, account, run)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//scanAccountHistory 按页读取账户历史，每页处理完成后保存游标
+func (bs *PIABlockScanner) scanAccountHistory(db *storm.DB, account string, run *accountHistoryRun) error {
+
+	cursor, err := bs.loadAccountHistoryCursor(db, account)
+	if err != nil {
+		return err
+	}
+
+	for {
+		from := cursor.Sequence + defaultAccountHistoryLimit + 1
+		histories, err := bs.wm.Api.GetAccountHistory(account, from, defaultAccountHistoryLimit)
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(histories, func(i, j int) bool {
+			return histories[i].Sequence < histories[j].Sequence
+		})
+
+		var (
+			processed  = 0
+			reached    = false
+			extractErr error
+		)
+		for _, history := range histories {
+			if history.Sequence <= cursor.Sequence || history.Operation == nil {
+				continue
+			}
+
+			height := uint64(history.Operation.Block)
+			if height > run.limitHeight {
+				reached = true
+				break
+			}
+
+			if !run.scanned[height] {
+				extractErr = bs.extractHistoryBlock(height, run)
+				if extractErr != nil {
+					break
+				}
+				run.scanned[height] = true
+			}
+
+			cursor.Sequence = history.Sequence
+			cursor.BlockHeight = height
+			processed++
+		}
+
+		if processed > 0 {
+			cursor.UpdateTime = time.Now().Unix()
+			err = db.Save(cursor)
+			if err != nil {
+				return err
+			}
+		}
+
+		if extractErr != nil {
+			return fmt.Errorf("account: %s history extract failed at sequence: %d, err: %v", account, cursor.Sequence+1, extractErr)
+		}
+
+		if reached || len(histories) == 0 || histories[len(histories)-1].Sequence < from {
+			return nil
+		}
+	}
+}
+
+//extractHistoryBlock 提取区块中与补扫账户相关的交易，写入待投递队列
+func (bs *PIABlockScanner) extractHistoryBlock(height uint64, run *accountHistoryRun) error {
+
+	if bs.ScanTargetFunc == nil {
+		return fmt.Errorf("scanTargetFunc is not configurated")
+	}
+
+	block, err := bs.fetchBlock(height)
+	if err != nil {
+		return err
+	}
+
+	//只匹配补扫的账户，避免重复通知其他订阅账户
+	scanTargetFunc := func(target openwallet.ScanTarget) (string, bool) {
+		if !run.targets[target.Alias] {
+			return "", false
+		}
+		return bs.ScanTargetFunc(target)
+	}
+
+	extractData := make(map[string][]*openwallet.TxExtractData)
+	for _, tx := range block.LocalTransactions {
+
+		result := bs.ExtractTransaction(uint64(block.Height), block.Hash, block.Timestamp, tx, scanTargetFunc)
+		if !result.Success {
+			return fmt.Errorf("block height: %d, transaction: %s extract failed", height, tx.TxId)
+		}
+
+		for key, array := range result.extractData {
+			extractData[key] = append(extractData[key], array...)
+		}
+	}
+
+	if len(extractData) == 0 {
+		return nil
+	}
+
+	//与区块补扫一样按观测者去重，投递失败的记录由待投递队列重新投递
+	observers, err := bs.outboxObservers()
+	if err != nil {
+		return err
+	}
+	_, err = bs.enqueueOutboxRecords(height, extractData, observers, true)
+	return err
+}
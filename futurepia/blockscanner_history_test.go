@@ -0,0 +1,140 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestScanAccountHistory(t *testing.T) {
+	node := newFakeNode(t, 40)
+	node.addTransfer(5, "alice", "bob", "1.00000000 PIA", "")
+	node.addTransfer(9, "bob", "carol", "2.00000000 PIA", "")
+	node.addTransfer(9, "dave", "erin", "3.00000000 PIA", "")
+	node.addTransfer(12, "alice", "carol", "4.00000000 PIA", "")
+	node.addTransfer(35, "alice", "bob", "5.00000000 PIA", "")
+
+	wm, _, observer := testScanWalletManager(t, node, "bob", "carol", "alice")
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wm.Config.dbPath = dir
+	//35以上的区块未达到确认数
+	wm.Config.ScanConfirmations = 10
+	bs := wm.Blockscanner
+
+	//只补扫bob和carol，alice不被重复通知
+	if err := bs.ScanAccountHistory("bob", "carol"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	//区块9的转账双方分属不同账户，各提取一条
+	extracted := observer.extractedData()
+	if len(extracted) != 4 {
+		t.Fatalf("expected 4 extracted records, got %d", len(extracted))
+	}
+	for i, amount := range []string{"1.00000000", "2.00000000", "2.00000000", "4.00000000"} {
+		if extracted[i].Transaction.Amount != amount {
+			t.Errorf("record %d: expected amount %s, got %s", i, amount, extracted[i].Transaction.Amount)
+		}
+	}
+	observer.mu.Lock()
+	for _, key := range observer.keys {
+		if key == "account-alice" {
+			t.Errorf("account not in backfill was notified")
+		}
+	}
+	observer.mu.Unlock()
+	if node.callCount("get_block") != 3 {
+		t.Errorf("expected 3 blocks fetched, got %d", node.callCount("get_block"))
+	}
+
+	cursor, err := bs.GetAccountHistoryCursor("bob")
+	if err != nil || cursor.Sequence != 1 || cursor.BlockHeight != 9 {
+		t.Fatalf("unexpected cursor: %+v, err: %v", cursor, err)
+	}
+
+	//游标之后的记录达到确认数后才提取
+	node.addBlocks(10)
+	if err := bs.ScanAccountHistory("bob", "carol"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	extracted = observer.extractedData()
+	if len(extracted) != 5 || extracted[4].Transaction.Amount != "5.00000000" {
+		t.Fatalf("expected new transfer extracted, got %d", len(extracted))
+	}
+
+	//已通知的记录持久化，重新打开数据库并重置游标后不会重复通知
+	bs.closeAccountHistory()
+	if err := bs.SetAccountHistoryCursor("bob", -1); err != nil {
+		t.Fatal(err)
+	}
+	calls := node.callCount("get_block")
+	if err := bs.ScanAccountHistory("bob"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if node.callCount("get_block") == calls {
+		t.Errorf("expected blocks to be fetched again after cursor reset")
+	}
+	if len(observer.extractedData()) != 5 {
+		t.Errorf("expected delivered records not to be notified again")
+	}
+
+	//实时扫描已通知的记录，补扫时同样跳过
+	node.addTransfer(38, "carol", "bob", "6.00000000 PIA", "")
+	if err := bs.ScanBlock(38); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(observer.extractedData()) != 7 {
+		t.Fatalf("expected 2 records from the live scanner, got %d", len(observer.extractedData())-5)
+	}
+	if err := bs.ScanAccountHistory("bob", "carol"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(observer.extractedData()) != 7 {
+		t.Errorf("expected records delivered by the live scanner not to be notified again")
+	}
+}
+
+func TestScanAccountHistoryOutbox(t *testing.T) {
+	node := newFakeNode(t, 20)
+	node.addTransfer(5, "alice", "bob", "1.00000000 PIA", "")
+
+	wm, _, observer := testOutboxWalletManager(t, node, 1)
+	bs := wm.Blockscanner
+	defer bs.closeAccountHistory()
+
+	//观测者失败时记录留在待投递队列，补扫视为已通知
+	if err := bs.ScanAccountHistory("bob"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	records, err := bs.GetOutboxRecords()
+	if err != nil || len(records) != 1 || records[0].BlockHeight != 5 {
+		t.Fatalf("expected history record in outbox, got %+v, err: %v", records, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if pending, _ := bs.RetryOutbox(); pending != 0 {
+		t.Fatalf("expected outbox to be drained, got %d", pending)
+	}
+	if len(observer.extractedData()) != 1 {
+		t.Errorf("expected history record to be delivered by outbox")
+	}
+}
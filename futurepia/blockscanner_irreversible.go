@@ -0,0 +1,90 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+//IrreversibleStatus 链头与不可逆区块的状态
+type IrreversibleStatus struct {
+	HeadHeight         uint64 `json:"headHeight"`         //链上最新高度
+	IrreversibleHeight uint64 `json:"irreversibleHeight"` //最新不可逆高度
+	Gap                uint64 `json:"gap"`                //最新高度与不可逆高度的差距
+	ScanLimitHeight    uint64 `json:"scanLimitHeight"`    //当前模式下允许扫描的最高高度
+	ScannedHeight      uint64 `json:"scannedHeight"`      //本地已扫高度
+	SafeMode           bool   `json:"safeMode"`           //是否只扫描不可逆或已确认的区块
+}
+
+//IsSafeScanMode 是否只扫描不可逆区块或满足确认数的区块，此模式下不会产生分叉通知
+func (bs *PIABlockScanner) IsSafeScanMode() bool {
+	return bs.wm.Config.ScanIrreversibleOnly || bs.wm.Config.ScanConfirmations > 0
+}
+
+//scanLimitHeight 根据扫描模式计算允许扫描的最高高度
+func (bs *PIABlockScanner) scanLimitHeight(head *ApiHeadBlock) uint64 {
+
+	if head.Height <= 1 {
+		return 0
+	}
+
+	//默认扫描到最新高度的上一个区块
+	limit := uint64(head.Height - 1)
+
+	if bs.wm.Config.ScanIrreversibleOnly && uint64(head.LastIrreversible) < limit {
+		limit = uint64(head.LastIrreversible)
+	}
+
+	confirmations := bs.wm.Config.ScanConfirmations
+	if confirmations > 0 {
+		if uint64(head.Height) <= confirmations {
+			return 0
+		}
+		if uint64(head.Height)-confirmations < limit {
+			limit = uint64(head.Height) - confirmations
+		}
+	}
+
+	return limit
+}
+
+//GetScanLimitHeight 获取当前扫描模式下允许扫描的最高高度
+func (bs *PIABlockScanner) GetScanLimitHeight() (uint64, error) {
+	head, err := bs.wm.Api.GetDynamicGlobal()
+	if err != nil {
+		return 0, err
+	}
+	return bs.scanLimitHeight(head), nil
+}
+
+//GetIrreversibleStatus 获取链头与不可逆区块的差距
+func (bs *PIABlockScanner) GetIrreversibleStatus() (*IrreversibleStatus, error) {
+
+	head, err := bs.wm.Api.GetDynamicGlobal()
+	if err != nil {
+		return nil, err
+	}
+
+	status := &IrreversibleStatus{
+		HeadHeight:         uint64(head.Height),
+		IrreversibleHeight: uint64(head.LastIrreversible),
+		ScanLimitHeight:    bs.scanLimitHeight(head),
+		ScannedHeight:      bs.GetScannedBlockHeight(),
+		SafeMode:           bs.IsSafeScanMode(),
+	}
+
+	if status.HeadHeight > status.IrreversibleHeight {
+		status.Gap = status.HeadHeight - status.IrreversibleHeight
+	}
+
+	return status, nil
+}
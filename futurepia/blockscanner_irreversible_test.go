@@ -0,0 +1,119 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScanLimitHeight(t *testing.T) {
+	wm := NewWalletManager()
+	bs := wm.Blockscanner
+	head := &ApiHeadBlock{Height: 100, LastIrreversible: 80}
+
+	if limit := bs.scanLimitHeight(head); limit != 99 {
+		t.Errorf("head mode: expected 99, got %d", limit)
+	}
+
+	wm.Config.ScanIrreversibleOnly = true
+	if limit := bs.scanLimitHeight(head); limit != 80 {
+		t.Errorf("irreversible mode: expected 80, got %d", limit)
+	}
+
+	wm.Config.ScanIrreversibleOnly = false
+	wm.Config.ScanConfirmations = 10
+	if limit := bs.scanLimitHeight(head); limit != 90 {
+		t.Errorf("confirmations mode: expected 90, got %d", limit)
+	}
+
+	//两种限制同时配置时取更低的高度
+	wm.Config.ScanIrreversibleOnly = true
+	if limit := bs.scanLimitHeight(head); limit != 80 {
+		t.Errorf("combined mode: expected 80, got %d", limit)
+	}
+
+	wm.Config.ScanConfirmations = 200
+	if limit := bs.scanLimitHeight(head); limit != 0 {
+		t.Errorf("expected 0 when confirmations exceed head, got %d", limit)
+	}
+}
+
+func TestScanBlockTaskIrreversibleOnly(t *testing.T) {
+	node := newFakeNode(t, 50)
+	node.irreversible = 30
+
+	wm, dai, observer := testScanWalletManager(t, node)
+	wm.Config.ScanIrreversibleOnly = true
+	node.setLocalHead(wm, 10)
+
+	bs := wm.Blockscanner
+	bs.setScanning(true)
+	bs.ScanBlockTask()
+
+	head, _ := dai.GetCurrentBlockHead(wm.Symbol())
+	if head.Height != 30 {
+		t.Errorf("expected scanner to stop at irreversible height 30, got %d", head.Height)
+	}
+
+	status, err := bs.GetIrreversibleStatus()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.HeadHeight != 50 || status.IrreversibleHeight != 30 || status.Gap != 20 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	if status.ScanLimitHeight != 30 || status.ScannedHeight != 30 || !status.SafeMode {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	//分支替换了已扫区块，安全模式下不通知分叉
+	node.reorg(30, "fork")
+	node.mu.Lock()
+	node.irreversible = 45
+	node.mu.Unlock()
+	bs.ScanBlockTask()
+
+	observer.waitHeaders(t, 20)
+	time.Sleep(50 * time.Millisecond)
+	for _, header := range observer.blockHeaders() {
+		if header.Fork {
+			t.Fatalf("unexpected fork notification on height %d", header.Height)
+		}
+	}
+	head, _ = dai.GetCurrentBlockHead(wm.Symbol())
+	if head.Height != 45 {
+		t.Errorf("expected local head 45, got %d", head.Height)
+	}
+}
+
+func TestScanBlockTaskConfirmations(t *testing.T) {
+	node := newFakeNode(t, 50)
+	node.irreversible = 10
+
+	wm, dai, _ := testScanWalletManager(t, node)
+	wm.Config.ScanConfirmations = 5
+	node.setLocalHead(wm, 20)
+
+	bs := wm.Blockscanner
+	bs.setScanning(true)
+	bs.ScanBlockTask()
+
+	head, _ := dai.GetCurrentBlockHead(wm.Symbol())
+	if head.Height != 45 {
+		t.Errorf("expected local head 45, got %d", head.Height)
+	}
+}
@@ -0,0 +1,385 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const blockNotifyQueueSize = 1024 //区块通知队列长度，队列满时扫描等待观测者
+
+//scanLifecycle 扫描任务的运行状态
+//扫描器自行驱动定时任务，暂停和停止时可以等待正在扫描的区块处理完成
+type scanLifecycle struct {
+	mu       sync.Mutex
+	scanning int32         //扫描中标记，原子读写，扫描循环据此在区块边界退出
+	paused   bool          //暂停中，定时任务不再触发扫描
+	halted   bool          //分叉深度超限被挂起，需要人工调用Resume恢复
+	quit     chan struct{} //关闭后定时任务退出
+	done     chan struct{} //定时任务退出后关闭
+	stopping chan struct{} //正在进行的停止，完成后关闭，期间不能重新运行
+	taskMu   sync.Mutex    //一次扫描任务持有，等待它即等待正在处理的区块
+}
+
+func newScanLifecycle() *scanLifecycle {
+	return &scanLifecycle{}
+}
+
+//blockNotifier 按顺序异步通知新区块的队列
+type blockNotifier struct {
+	sendMu  sync.Mutex //入队和关闭队列互斥
+	mu      sync.Mutex
+	headers chan *openwallet.BlockHeader
+	done    chan struct{}
+	pending int           //已入队未通知完成的区块数
+	idle    chan struct{} //pending归零时关闭，有区块入队时重新创建
+}
+
+func newBlockNotifier() *blockNotifier {
+	n := &blockNotifier{idle: make(chan struct{})}
+	close(n.idle)
+	return n
+}
+
+//isScanning 扫描循环是否继续
+func (bs *PIABlockScanner) isScanning() bool {
+	return atomic.LoadInt32(&bs.lifecycle.scanning) == 1
+}
+
+//setScanning 设置扫描标记，同时保持BlockScannerBase.Scanning一致
+func (bs *PIABlockScanner) setScanning(scanning bool) {
+	var v int32
+	if scanning {
+		v = 1
+	}
+	atomic.StoreInt32(&bs.lifecycle.scanning, v)
+	bs.Scanning = scanning
+}
+
+//isRunning 扫描任务是否已启动，暂停中也算已启动
+func (bs *PIABlockScanner) isRunning() bool {
+	bs.lifecycle.mu.Lock()
+	defer bs.lifecycle.mu.Unlock()
+	return bs.lifecycle.quit != nil
+}
+
+//Run 运行扫描，同时启动未扫记录的重试、待投递记录的重新投递任务、未完成的补扫任务和状态服务
+func (bs *PIABlockScanner) Run() error {
+
+	if bs.IsClose() {
+		return fmt.Errorf("block scanner has been closed")
+	}
+
+	if bs.ScanAddressFunc == nil {
+		return fmt.Errorf("BlockScanAddressFunc is not set up")
+	}
+
+	lc := bs.lifecycle
+	lc.mu.Lock()
+	if lc.stopping != nil {
+		lc.mu.Unlock()
+		return fmt.Errorf("block scanner stop is still in progress")
+	}
+	if lc.quit != nil {
+		lc.mu.Unlock()
+		bs.wm.Log.Std.Warning("block scanner is running... ")
+		return nil
+	}
+	if err := bs.startStatusServer(); err != nil {
+		lc.mu.Unlock()
+		return err
+	}
+	lc.quit = make(chan struct{})
+	lc.done = make(chan struct{})
+	lc.paused = false
+	lc.halted = false
+	bs.setScanning(true)
+	go bs.scanLoop(lc.quit, lc.done)
+	lc.mu.Unlock()
+
+	bs.startUnscanRetry()
+	bs.startOutbox()
+	bs.resumeBackfills()
+	return nil
+}
+
+//Pause 暂停扫描，等待正在处理的区块完成后返回，已保存的区块头即为恢复的起点
+func (bs *PIABlockScanner) Pause() error {
+
+	if bs.IsClose() {
+		return fmt.Errorf("block scanner has been closed")
+	}
+
+	lc := bs.lifecycle
+	lc.mu.Lock()
+	lc.paused = true
+	bs.setScanning(false)
+	lc.mu.Unlock()
+
+	bs.stopUnscanRetry()
+	bs.stopOutbox()
+	bs.stopBackfills()
+
+	//等待正在执行的扫描任务退出，已扫描区块的通知完成
+	lc.taskMu.Lock()
+	lc.taskMu.Unlock()
+	bs.notifier.flush()
+	return nil
+}
+
+//Resume 从暂停的区块头继续扫描，也用于分叉深度超限挂起后的人工恢复
+func (bs *PIABlockScanner) Resume() error {
+
+	if bs.IsClose() {
+		return fmt.Errorf("block scanner has been closed")
+	}
+
+	lc := bs.lifecycle
+	lc.mu.Lock()
+	if lc.stopping != nil {
+		lc.mu.Unlock()
+		return fmt.Errorf("block scanner stop is still in progress")
+	}
+	if lc.quit == nil {
+		lc.mu.Unlock()
+		return fmt.Errorf("block scanner is not running")
+	}
+	lc.paused = false
+	lc.halted = false
+	bs.setScanning(true)
+	lc.mu.Unlock()
+
+	bs.startUnscanRetry()
+	bs.startOutbox()
+	bs.resumeBackfills()
+	return nil
+}
+
+//Restart 继续扫描，同Resume
+func (bs *PIABlockScanner) Restart() error {
+	return bs.Resume()
+}
+
+//Stop 停止扫描及未扫记录的重试、待投递记录的重新投递和补扫任务，等待正在处理的区块和通知完成
+//openwallet.BlockScanner接口要求Stop() error，需要期限时使用StopContext
+func (bs *PIABlockScanner) Stop() error {
+	return bs.StopContext(context.Background())
+}
+
+//StopContext 在ctx期限内停止扫描
+//扫描在区块边界退出，正在处理的区块会完成提取、通知和保存区块头；
+//ctx到期时返回包装了ctx.Err()的错误，剩余工作在后台完成，完成前Run和Resume返回错误，
+//再次调用Stop或StopContext会等待同一次停止完成
+func (bs *PIABlockScanner) StopContext(ctx context.Context) error {
+
+	if bs.IsClose() {
+		return fmt.Errorf("block scanner has been closed")
+	}
+
+	lc := bs.lifecycle
+	lc.mu.Lock()
+	stopped := lc.stopping
+	if stopped == nil {
+		quit, done := lc.quit, lc.done
+		lc.quit, lc.done = nil, nil
+		lc.paused = false
+		bs.setScanning(false)
+
+		stopped = make(chan struct{})
+		lc.stopping = stopped
+		go func() {
+			if quit != nil {
+				close(quit)
+				<-done
+			}
+			bs.stopUnscanRetry()
+			bs.stopOutbox()
+			bs.stopBackfills()
+			bs.notifier.close()
+			bs.stopStatusServer()
+
+			lc.mu.Lock()
+			lc.stopping = nil
+			lc.mu.Unlock()
+			close(stopped)
+		}()
+	}
+	lc.mu.Unlock()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("block scanner stop is still in progress: %w", ctx.Err())
+	}
+}
+
+//CloseBlockScanner 停止扫描并等待正在处理的区块完成后关闭扫描器
+func (bs *PIABlockScanner) CloseBlockScanner() error {
+	if bs.IsClose() {
+		return nil
+	}
+	bs.Stop()
+	if bs.webhook != nil {
+		bs.webhook.Close()
+	}
+	bs.closeAccountHistory()
+	bs.closeLocalBlockchain()
+	return bs.BlockScannerBase.CloseBlockScanner()
+}
+
+//scanLoop 定时执行扫描任务，直到quit关闭
+func (bs *PIABlockScanner) scanLoop(quit, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(bs.PeriodOfTask)
+	defer ticker.Stop()
+
+	for {
+		bs.runScanTask(quit)
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//runScanTask 执行一次扫描任务，暂停中不执行
+func (bs *PIABlockScanner) runScanTask(quit chan struct{}) {
+	lc := bs.lifecycle
+	lc.taskMu.Lock()
+	defer lc.taskMu.Unlock()
+
+	lc.mu.Lock()
+	paused := lc.paused
+	lc.mu.Unlock()
+
+	select {
+	case <-quit:
+		return
+	default:
+	}
+
+	if paused || !bs.isScanning() {
+		return
+	}
+	bs.ScanBlockTask()
+}
+
+//push 区块头入队，通知协程未运行时启动
+func (n *blockNotifier) push(bs *PIABlockScanner, header *openwallet.BlockHeader) {
+	n.sendMu.Lock()
+	defer n.sendMu.Unlock()
+
+	n.mu.Lock()
+	if n.headers == nil {
+		n.headers = make(chan *openwallet.BlockHeader, blockNotifyQueueSize)
+		n.done = make(chan struct{})
+		go bs.blockNotifyLoop(n.headers, n.done)
+	}
+	if n.pending == 0 {
+		n.idle = make(chan struct{})
+	}
+	n.pending++
+	headers := n.headers
+	n.mu.Unlock()
+
+	headers <- header
+}
+
+//backlog 等待通知的区块数
+func (n *blockNotifier) backlog() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.pending
+}
+
+//notified 一个区块通知完成
+func (n *blockNotifier) notified() {
+	n.mu.Lock()
+	n.pending--
+	if n.pending == 0 {
+		close(n.idle)
+	}
+	n.mu.Unlock()
+}
+
+//flush 等待已入队的区块全部通知完成
+func (n *blockNotifier) flush() {
+	n.flushContext(context.Background())
+}
+
+//flushContext 在ctx期限内等待已入队的区块全部通知完成
+func (n *blockNotifier) flushContext(ctx context.Context) error {
+	for {
+		n.mu.Lock()
+		pending, idle := n.pending, n.idle
+		n.mu.Unlock()
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//close 等待已入队的区块通知完成后退出通知协程，之后入队会重新启动
+func (n *blockNotifier) close() {
+	n.flush()
+
+	n.sendMu.Lock()
+	n.mu.Lock()
+	headers, done := n.headers, n.done
+	n.headers, n.done = nil, nil
+	n.mu.Unlock()
+	if headers != nil {
+		close(headers)
+	}
+	n.sendMu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+//blockNotifyLoop 按入队顺序通知观测者
+func (bs *PIABlockScanner) blockNotifyLoop(headers chan *openwallet.BlockHeader, done chan struct{}) {
+	defer close(done)
+	for header := range headers {
+		for o := range bs.Observers {
+			if err := o.BlockScanNotify(header); err != nil {
+				bs.metrics.addNotifyError(NotifyKindBlock)
+				bs.wm.Log.Std.Error("BlockScanNotify unexpected error: %v", err)
+			}
+		}
+		bs.notifier.notified()
+	}
+}
+
+//FlushBlockNotify 等待已扫描区块的通知全部完成，ctx到期时返回ctx.Err()
+func (bs *PIABlockScanner) FlushBlockNotify(ctx context.Context) error {
+	return bs.notifier.flushContext(ctx)
+}
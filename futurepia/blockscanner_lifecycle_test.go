@@ -0,0 +1,255 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//goroutineSnapshot 当前协程的id和调用栈
+func goroutineSnapshot() map[string]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+
+	stacks := make(map[string]string)
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		header := strings.SplitN(stack, " [", 2)[0]
+		stacks[header] = stack
+	}
+	return stacks
+}
+
+//verifyNoLeaks 检查before之后启动的本包协程是否都已退出，类似goleak.VerifyNone
+func verifyNoLeaks(t *testing.T, before map[string]string) {
+	t.Helper()
+
+	var leaked []string
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		leaked = leaked[:0]
+		for id, stack := range goroutineSnapshot() {
+			if _, exist := before[id]; exist {
+				continue
+			}
+			if !strings.Contains(stack, "futurepia.") || strings.Contains(stack, "futurepia.Test") {
+				continue
+			}
+			leaked = append(leaked, stack)
+		}
+		if len(leaked) == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(leaked) > 0 {
+		t.Fatalf("found %d leaked goroutines:\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+	}
+}
+
+//waitLocalHead 等待本地区块头达到指定高度
+func waitLocalHead(t *testing.T, dai *memBlockchainDAI, symbol string, height uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if head, err := dai.GetCurrentBlockHead(symbol); err == nil && head.Height >= height {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("local head did not reach %d", height)
+}
+
+//blockingObserver 区块通知阻塞直到release关闭
+type blockingObserver struct {
+	testObserver
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (o *blockingObserver) BlockScanNotify(header *openwallet.BlockHeader) error {
+	o.once.Do(func() { close(o.entered) })
+	<-o.release
+	return o.testObserver.BlockScanNotify(header)
+}
+
+func TestScannerPauseResumeStop(t *testing.T) {
+	node := newFakeNode(t, 30)
+	node.addTransfer(15, "alice", "bob", "1.00000000 PIA", "")
+
+	wm, dai, observer := testScanWalletManager(t, node, "bob")
+	node.setLocalHead(wm, 10)
+	bs := wm.Blockscanner
+	bs.PeriodOfTask = 20 * time.Millisecond
+
+	before := goroutineSnapshot()
+
+	if err := bs.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitLocalHead(t, dai, wm.Symbol(), 29)
+
+	if err := bs.Pause(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	//暂停返回时已扫描区块的通知已完成
+	if headers := observer.blockHeaders(); len(headers) != 19 {
+		t.Fatalf("expected 19 block notifications after pause, got %d", len(headers))
+	}
+
+	node.addBlocks(5)
+	time.Sleep(100 * time.Millisecond)
+	if head, _ := dai.GetCurrentBlockHead(wm.Symbol()); head.Height != 29 {
+		t.Fatalf("scanner advanced while paused, head %d", head.Height)
+	}
+
+	if err := bs.Resume(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitLocalHead(t, dai, wm.Symbol(), 34)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := bs.StopContext(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	headers := observer.blockHeaders()
+	if len(headers) != 24 {
+		t.Fatalf("expected 24 block notifications after stop, got %d", len(headers))
+	}
+	for i, header := range headers {
+		if header.Height != uint64(11+i) {
+			t.Fatalf("block notify out of order: index %d height %d", i, header.Height)
+		}
+	}
+	if len(observer.extractedData()) != 1 {
+		t.Errorf("expected 1 extracted transaction, got %d", len(observer.extractedData()))
+	}
+	if bs.Scanning {
+		t.Errorf("expected scanner to be stopped")
+	}
+
+	verifyNoLeaks(t, before)
+
+	//停止后可以重新运行
+	if err := bs.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := bs.Stop(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verifyNoLeaks(t, before)
+}
+
+func TestScannerStopContextDeadline(t *testing.T) {
+	node := newFakeNode(t, 20)
+
+	wm, dai, _ := testScanWalletManager(t, node)
+	node.setLocalHead(wm, 10)
+	bs := wm.Blockscanner
+	bs.PeriodOfTask = 20 * time.Millisecond
+
+	observer := &blockingObserver{entered: make(chan struct{}), release: make(chan struct{})}
+	bs.AddObserver(observer)
+
+	before := goroutineSnapshot()
+
+	if err := bs.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-observer.entered
+
+	//观测者阻塞，通知无法在期限内完成
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := bs.StopContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	//停止完成前不能重新运行
+	if err := bs.Run(); err == nil {
+		t.Fatalf("expected run to fail while stopping")
+	}
+	if err := bs.Resume(); err == nil {
+		t.Fatalf("expected resume to fail while stopping")
+	}
+
+	//扫描在区块边界退出，区块头已保存
+	head, err := dai.GetCurrentBlockHead(wm.Symbol())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if head.Height < 11 {
+		t.Errorf("expected local head saved, got %d", head.Height)
+	}
+
+	close(observer.release)
+	if err := bs.Stop(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if headers := observer.blockHeaders(); uint64(len(headers)) != head.Height-10 {
+		t.Errorf("expected %d block notifications, got %d", head.Height-10, len(headers))
+	}
+
+	verifyNoLeaks(t, before)
+}
+
+func TestBatchExtractTransactionsNoLeak(t *testing.T) {
+	node := newFakeNode(t, 20)
+	wm, _, observer := testScanWalletManager(t, node, "bob")
+	bs := wm.Blockscanner
+
+	transactions := make([]*LocalTransaction, 0)
+	for i := 0; i < 50; i++ {
+		transactions = append(transactions, &LocalTransaction{
+			TxId:    node.blockHash(uint64(i)),
+			Index:   i,
+			From:    "alice",
+			To:      "bob",
+			Amount:  "0.10000000",
+			CoinTag: "PIA",
+			Type:    "transfer",
+		})
+	}
+
+	before := goroutineSnapshot()
+
+	if err := bs.BatchExtractTransactions(15, node.blockHash(15), time.Now().Unix(), transactions); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(observer.extractedData()) != 50 {
+		t.Fatalf("expected 50 extracted transactions, got %d", len(observer.extractedData()))
+	}
+
+	verifyNoLeaks(t, before)
+}
@@ -0,0 +1,453 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	currentBlockHeaderKey  = "current_block_header" //当前已扫区块头
+	localBlockBucket       = "block"                //本地区块头，按高度保存
+	defaultLocalBlockCache = 1000                   //默认保留的本地区块数
+)
+
+//LocalBlockchainDAI 基于storm的区块链数据访问接口，未注入BlockchainDAI时扫描器使用它保存状态
+//每个币种的数据保存在独立的节点中
+type LocalBlockchainDAI struct {
+	mu          sync.Mutex
+	db          *storm.DB
+	blockCaches map[string]uint64 //每个币种保留的本地区块数
+}
+
+//NewLocalBlockchainDAI 打开本地区块链数据库
+func NewLocalBlockchainDAI(dbFile string) (*LocalBlockchainDAI, error) {
+	db, err := storm.Open(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalBlockchainDAI{
+		db:          db,
+		blockCaches: make(map[string]uint64),
+	}, nil
+}
+
+//Close 关闭数据库
+func (dai *LocalBlockchainDAI) Close() error {
+	return dai.db.Close()
+}
+
+func (dai *LocalBlockchainDAI) node(symbol string) storm.Node {
+	return dai.db.From(symbol)
+}
+
+//SaveCurrentBlockHead 保存当前已扫区块头
+func (dai *LocalBlockchainDAI) SaveCurrentBlockHead(header *openwallet.BlockHeader) error {
+	if header == nil {
+		return fmt.Errorf("the block header to save is nil")
+	}
+	return dai.node(header.Symbol).Set(blockchainBucket, currentBlockHeaderKey, header)
+}
+
+//GetCurrentBlockHead 获取当前已扫区块头，未保存过时返回高度为0的区块头
+func (dai *LocalBlockchainDAI) GetCurrentBlockHead(symbol string) (*openwallet.BlockHeader, error) {
+	var header openwallet.BlockHeader
+	err := dai.node(symbol).Get(blockchainBucket, currentBlockHeaderKey, &header)
+	if err == storm.ErrNotFound {
+		return &openwallet.BlockHeader{Symbol: symbol}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+//SaveLocalBlockHead 保存本地区块头，超出缓存数量的旧区块被删除
+func (dai *LocalBlockchainDAI) SaveLocalBlockHead(header *openwallet.BlockHeader) error {
+	if header == nil {
+		return fmt.Errorf("the block header to save is nil")
+	}
+
+	node := dai.node(header.Symbol)
+	tx, err := node.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = dai.saveLocalBlock(tx, header)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//SaveScannedBlock 在同一事务中保存本地区块头和当前已扫区块头，两者不会不一致
+func (dai *LocalBlockchainDAI) SaveScannedBlock(header *openwallet.BlockHeader) error {
+	if header == nil {
+		return fmt.Errorf("the block header to save is nil")
+	}
+
+	node := dai.node(header.Symbol)
+	tx, err := node.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = dai.saveLocalBlock(tx, header)
+	if err != nil {
+		return err
+	}
+
+	head := &openwallet.BlockHeader{
+		Hash:   header.Hash,
+		Height: header.Height,
+		Symbol: header.Symbol,
+	}
+	err = tx.Set(blockchainBucket, currentBlockHeaderKey, head)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//saveLocalBlock 在事务中保存本地区块头，超出缓存数量的旧区块被删除
+func (dai *LocalBlockchainDAI) saveLocalBlock(tx storm.Node, header *openwallet.BlockHeader) error {
+	err := tx.Set(localBlockBucket, header.Height, header)
+	if err != nil {
+		return err
+	}
+
+	max := dai.maxBlockCache(header.Symbol)
+	if header.Height > max {
+		err = tx.Delete(localBlockBucket, header.Height-max)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+//GetLocalBlockHeadByHeight 获取本地区块头
+func (dai *LocalBlockchainDAI) GetLocalBlockHeadByHeight(height uint64, symbol string) (*openwallet.BlockHeader, error) {
+	var header openwallet.BlockHeader
+	err := dai.node(symbol).Get(localBlockBucket, height, &header)
+	if err != nil {
+		return nil, fmt.Errorf("local block %d not found, err: %v", height, err)
+	}
+	return &header, nil
+}
+
+//SaveUnscanRecord 保存未扫记录
+func (dai *LocalBlockchainDAI) SaveUnscanRecord(record *openwallet.UnscanRecord) error {
+	if record == nil {
+		return fmt.Errorf("the unscan record to save is nil")
+	}
+	return dai.node(record.Symbol).Save(record)
+}
+
+//DeleteUnscanRecordByHeight 删除指定高度的未扫记录
+func (dai *LocalBlockchainDAI) DeleteUnscanRecordByHeight(height uint64, symbol string) error {
+	err := dai.node(symbol).Select(q.Eq("BlockHeight", height)).Delete(new(openwallet.UnscanRecord))
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+//DeleteUnscanRecordByID 删除指定ID的未扫记录
+func (dai *LocalBlockchainDAI) DeleteUnscanRecordByID(id string, symbol string) error {
+	err := dai.node(symbol).DeleteStruct(&openwallet.UnscanRecord{ID: id})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+//GetTransactionsByTxID 本地数据库不保存交易
+func (dai *LocalBlockchainDAI) GetTransactionsByTxID(txid, symbol string) ([]*openwallet.Transaction, error) {
+	return nil, fmt.Errorf("GetTransactionsByTxID is not implemented")
+}
+
+//GetUnscanRecords 获取全部未扫记录
+func (dai *LocalBlockchainDAI) GetUnscanRecords(symbol string) ([]*openwallet.UnscanRecord, error) {
+	records := make([]*openwallet.UnscanRecord, 0)
+	err := dai.node(symbol).All(&records)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return records, nil
+}
+
+//deadLetterRecord 本地数据库保存的死信记录
+type deadLetterRecord struct {
+	ID    string `storm:"id"` //未扫记录ID
+	State *UnscanRetryState
+}
+
+//SaveDeadLetter 保存死信记录
+func (dai *LocalBlockchainDAI) SaveDeadLetter(state *UnscanRetryState, symbol string) error {
+	if state == nil || state.Record == nil {
+		return fmt.Errorf("the dead letter to save is nil")
+	}
+	return dai.node(symbol).Save(&deadLetterRecord{ID: state.Record.ID, State: state})
+}
+
+//DeleteDeadLetter 删除死信记录
+func (dai *LocalBlockchainDAI) DeleteDeadLetter(id, symbol string) error {
+	err := dai.node(symbol).DeleteStruct(&deadLetterRecord{ID: id})
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+//GetDeadLetters 获取全部死信记录
+func (dai *LocalBlockchainDAI) GetDeadLetters(symbol string) ([]*UnscanRetryState, error) {
+	var records []*deadLetterRecord
+	err := dai.node(symbol).All(&records)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	states := make([]*UnscanRetryState, 0, len(records))
+	for _, record := range records {
+		states = append(states, record.State)
+	}
+	return states, nil
+}
+
+//SaveUnroutableDeposit 保存无法路由的充值，已存在时保留首次记录
+func (dai *LocalBlockchainDAI) SaveUnroutableDeposit(deposit *UnroutableDeposit, symbol string) error {
+	if deposit == nil {
+		return fmt.Errorf("the unroutable deposit to save is nil")
+	}
+	var exist UnroutableDeposit
+	err := dai.node(symbol).One("ID", deposit.ID, &exist)
+	if err == nil {
+		return nil
+	}
+	if err != storm.ErrNotFound {
+		return err
+	}
+	return dai.node(symbol).Save(deposit)
+}
+
+//DeleteUnroutableDeposit 删除无法路由的充值
+func (dai *LocalBlockchainDAI) DeleteUnroutableDeposit(id, symbol string) error {
+	err := dai.node(symbol).DeleteStruct(&UnroutableDeposit{ID: id})
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+//GetUnroutableDeposits 获取全部无法路由的充值
+func (dai *LocalBlockchainDAI) GetUnroutableDeposits(symbol string) ([]*UnroutableDeposit, error) {
+	deposits := make([]*UnroutableDeposit, 0)
+	err := dai.node(symbol).All(&deposits)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return deposits, nil
+}
+
+//RestoreScannerState 在同一事务中写入快照中的未扫记录、本地区块、死信、无法路由的充值和已扫区块头
+func (dai *LocalBlockchainDAI) RestoreScannerState(snapshot *ScannerSnapshot) error {
+	if snapshot == nil {
+		return fmt.Errorf("the snapshot to restore is nil")
+	}
+
+	tx, err := dai.node(snapshot.Symbol).Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, record := range snapshot.UnscanRecords {
+		if err := tx.Save(record); err != nil {
+			return fmt.Errorf("save unscan record %s failed, err: %v", record.ID, err)
+		}
+	}
+
+	for _, block := range snapshot.Blocks {
+		if err := dai.saveLocalBlock(tx, block); err != nil {
+			return fmt.Errorf("save local block %d failed, err: %v", block.Height, err)
+		}
+	}
+
+	for _, state := range snapshot.DeadLetters {
+		if err := tx.Save(&deadLetterRecord{ID: state.Record.ID, State: state}); err != nil {
+			return fmt.Errorf("save dead letter %s failed, err: %v", state.Record.ID, err)
+		}
+	}
+
+	for _, deposit := range snapshot.UnroutableDeposits {
+		if err := tx.Save(deposit); err != nil {
+			return fmt.Errorf("save unroutable deposit %s failed, err: %v", deposit.ID, err)
+		}
+	}
+
+	if snapshot.CurrentBlock != nil {
+		if err := tx.Set(blockchainBucket, currentBlockHeaderKey, snapshot.CurrentBlock); err != nil {
+			return fmt.Errorf("save current block head failed, err: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+//SetMaxBlockCache 设置保留的本地区块数，0为使用默认值
+func (dai *LocalBlockchainDAI) SetMaxBlockCache(max uint64, symbol string) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	dai.blockCaches[symbol] = max
+	return nil
+}
+
+func (dai *LocalBlockchainDAI) maxBlockCache(symbol string) uint64 {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	if max := dai.blockCaches[symbol]; max > 0 {
+		return max
+	}
+	return defaultLocalBlockCache
+}
+
+//localBlockchain 扫描器内置的本地数据库，首次使用时打开
+type localBlockchain struct {
+	mu  sync.Mutex
+	dai *LocalBlockchainDAI
+}
+
+func newLocalBlockchain() *localBlockchain {
+	return &localBlockchain{}
+}
+
+//localBlockCacheSize 本地保留的区块数，至少覆盖分叉最大回滚深度
+func (bs *PIABlockScanner) localBlockCacheSize() uint64 {
+	size := uint64(defaultLocalBlockCache)
+	if depth := bs.maxReorgDepth(); depth >= size {
+		size = depth + 1
+	}
+	return size
+}
+
+//localBlockchainDAI 打开dbPath下的本地区块链数据库
+func (bs *PIABlockScanner) localBlockchainDAI() (*LocalBlockchainDAI, error) {
+	bs.local.mu.Lock()
+	defer bs.local.mu.Unlock()
+
+	if bs.local.dai != nil {
+		return bs.local.dai, nil
+	}
+
+	err := os.MkdirAll(bs.wm.Config.dbPath, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	dai, err := NewLocalBlockchainDAI(filepath.Join(bs.wm.Config.dbPath, bs.wm.Config.BlockchainFile))
+	if err != nil {
+		return nil, err
+	}
+	dai.SetMaxBlockCache(bs.localBlockCacheSize(), bs.wm.Symbol())
+	bs.local.dai = dai
+	return dai, nil
+}
+
+//closeLocalBlockchain 关闭本地区块链数据库
+func (bs *PIABlockScanner) closeLocalBlockchain() {
+	bs.local.mu.Lock()
+	defer bs.local.mu.Unlock()
+	if bs.local.dai != nil {
+		bs.local.dai.Close()
+		bs.local.dai = nil
+	}
+}
+
+//blockchainDAI 外部注入的区块链数据访问接口，未注入时使用本地数据库
+func (bs *PIABlockScanner) blockchainDAI() (openwallet.BlockchainDAI, error) {
+	if bs.BlockchainDAI != nil {
+		return bs.BlockchainDAI, nil
+	}
+	return bs.localBlockchainDAI()
+}
+
+//ImportBlockchainState 把外部数据访问接口中的已扫区块头、最近的本地区块和未扫记录导入本地数据库
+func (bs *PIABlockScanner) ImportBlockchainState(src openwallet.BlockchainDAI) error {
+	local, err := bs.localBlockchainDAI()
+	if err != nil {
+		return err
+	}
+	return CopyBlockchainState(src, local, bs.wm.Symbol(), bs.localBlockCacheSize())
+}
+
+//ExportBlockchainState 把本地数据库的状态导出到外部数据访问接口，之后可通过SetBlockchainDAI切换
+func (bs *PIABlockScanner) ExportBlockchainState(dst openwallet.BlockchainDAI) error {
+	local, err := bs.localBlockchainDAI()
+	if err != nil {
+		return err
+	}
+	return CopyBlockchainState(local, dst, bs.wm.Symbol(), bs.localBlockCacheSize())
+}
+
+//CopyBlockchainState 复制币种的已扫区块头、已扫高度往前blocks个本地区块和全部未扫记录
+//src中不存在的本地区块被跳过，src没有已扫区块头时只复制未扫记录
+func CopyBlockchainState(src, dst openwallet.BlockchainDAI, symbol string, blocks uint64) error {
+
+	records, err := src.GetUnscanRecords(symbol)
+	if err != nil {
+		return fmt.Errorf("get unscan records failed, err: %v", err)
+	}
+	for _, record := range records {
+		if err := dst.SaveUnscanRecord(record); err != nil {
+			return fmt.Errorf("save unscan record %s failed, err: %v", record.ID, err)
+		}
+	}
+
+	head, err := src.GetCurrentBlockHead(symbol)
+	if err != nil || head == nil || head.Height == 0 {
+		return nil
+	}
+
+	from := uint64(1)
+	if head.Height > blocks {
+		from = head.Height - blocks + 1
+	}
+	for height := from; height <= head.Height; height++ {
+		header, err := src.GetLocalBlockHeadByHeight(height, symbol)
+		if err != nil || header == nil {
+			continue
+		}
+		if err := dst.SaveLocalBlockHead(header); err != nil {
+			return fmt.Errorf("save local block %d failed, err: %v", height, err)
+		}
+	}
+
+	if err := dst.SaveCurrentBlockHead(head); err != nil {
+		return fmt.Errorf("save current block head failed, err: %v", err)
+	}
+	return nil
+}
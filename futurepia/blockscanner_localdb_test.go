@@ -0,0 +1,223 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func testLocalBlockchainDAI(t *testing.T) *LocalBlockchainDAI {
+	dir, err := ioutil.TempDir("", "localdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dai, err := NewLocalBlockchainDAI(filepath.Join(dir, "blockchain.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dai.Close()
+		os.RemoveAll(dir)
+	})
+	return dai
+}
+
+func TestLocalBlockchainDAI(t *testing.T) {
+	dai := testLocalBlockchainDAI(t)
+
+	head, err := dai.GetCurrentBlockHead("PIA")
+	if err != nil || head.Height != 0 {
+		t.Fatalf("expected empty head, got %+v, err: %v", head, err)
+	}
+
+	dai.SaveCurrentBlockHead(&openwallet.BlockHeader{Height: 10, Hash: "a10", Symbol: "PIA"})
+	dai.SaveCurrentBlockHead(&openwallet.BlockHeader{Height: 99, Hash: "b99", Symbol: "OTHER"})
+	head, err = dai.GetCurrentBlockHead("PIA")
+	if err != nil || head.Height != 10 || head.Hash != "a10" {
+		t.Errorf("unexpected head: %+v, err: %v", head, err)
+	}
+
+	//只保留最近3个区块
+	dai.SetMaxBlockCache(3, "PIA")
+	for h := uint64(1); h <= 5; h++ {
+		if err := dai.SaveLocalBlockHead(&openwallet.BlockHeader{Height: h, Hash: "h", Symbol: "PIA"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	for h := uint64(1); h <= 5; h++ {
+		_, err := dai.GetLocalBlockHeadByHeight(h, "PIA")
+		if (h > 2) != (err == nil) {
+			t.Errorf("unexpected block %d, err: %v", h, err)
+		}
+	}
+	if _, err := dai.GetLocalBlockHeadByHeight(5, "OTHER"); err == nil {
+		t.Errorf("expected blocks separated by symbol")
+	}
+
+	//本地区块和已扫区块头同时保存
+	if err := dai.SaveScannedBlock(&openwallet.BlockHeader{Height: 6, Hash: "h6", Previousblockhash: "h", Symbol: "PIA"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if head, _ := dai.GetCurrentBlockHead("PIA"); head.Height != 6 || head.Hash != "h6" {
+		t.Errorf("unexpected scanned head: %+v", head)
+	}
+	if block, err := dai.GetLocalBlockHeadByHeight(6, "PIA"); err != nil || block.Previousblockhash != "h" {
+		t.Errorf("unexpected scanned block: %+v, err: %v", block, err)
+	}
+
+	dai.SaveUnscanRecord(openwallet.NewUnscanRecord(7, "tx1", "timeout", "PIA"))
+	dai.SaveUnscanRecord(openwallet.NewUnscanRecord(7, "tx2", "timeout", "PIA"))
+	dai.SaveUnscanRecord(openwallet.NewUnscanRecord(8, "", "timeout", "PIA"))
+	other := openwallet.NewUnscanRecord(7, "", "timeout", "OTHER")
+	dai.SaveUnscanRecord(other)
+
+	if err := dai.DeleteUnscanRecordByHeight(7, "PIA"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	records, err := dai.GetUnscanRecords("PIA")
+	if err != nil || len(records) != 1 || records[0].BlockHeight != 8 {
+		t.Fatalf("unexpected records: %+v, err: %v", records, err)
+	}
+	if err := dai.DeleteUnscanRecordByID(records[0].ID, "PIA"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	//删除不存在的记录不报错
+	if err := dai.DeleteUnscanRecordByID(records[0].ID, "PIA"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := dai.DeleteUnscanRecordByHeight(100, "PIA"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if records, _ := dai.GetUnscanRecords("OTHER"); len(records) != 1 || records[0].ID != other.ID {
+		t.Errorf("unexpected records of other symbol: %+v", records)
+	}
+}
+
+func TestScannerLocalBlockchain(t *testing.T) {
+	node := newFakeNode(t, 30)
+	node.addTransfer(25, "alice", "bob", "1.00000000 PIA", "")
+
+	wm, _, observer := testScanWalletManager(t, node, "bob")
+	dir, err := ioutil.TempDir("", "localdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wm.Config.dbPath = dir
+	bs := wm.Blockscanner
+	bs.BlockchainDAI = nil
+
+	node.setLocalHead(wm, 20)
+	bs.SaveUnscanRecord(openwallet.NewUnscanRecord(5, "", "timeout", wm.Symbol()))
+	bs.setScanning(true)
+	bs.ScanBlockTask()
+
+	if height, hash, err := bs.GetLocalBlockHead(); err != nil || height != 29 || hash != node.blockHash(29) {
+		t.Fatalf("unexpected local head: %d %s, err: %v", height, hash, err)
+	}
+	if len(observer.extractedData()) != 1 {
+		t.Errorf("expected extracted transfer")
+	}
+
+	//重新打开后状态仍在
+	bs.closeLocalBlockchain()
+	if height := bs.GetScannedBlockHeight(); height != 29 {
+		t.Errorf("expected persisted head, got %d", height)
+	}
+
+	//导出到外部数据访问接口
+	external := newMemBlockchainDAI()
+	if err := bs.ExportBlockchainState(external); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if head, err := external.GetCurrentBlockHead(wm.Symbol()); err != nil || head.Height != 29 {
+		t.Fatalf("unexpected exported head: %+v, err: %v", head, err)
+	}
+	if block, err := external.GetLocalBlockHeadByHeight(25, wm.Symbol()); err != nil || block.Hash != node.blockHash(25) {
+		t.Errorf("unexpected exported block: %+v, err: %v", block, err)
+	}
+	if records, _ := external.GetUnscanRecords(wm.Symbol()); len(records) != 1 {
+		t.Errorf("unexpected exported records: %+v", records)
+	}
+
+	//导入到另一个实例的本地数据库
+	wm2, _, _ := testScanWalletManager(t, node)
+	dir2, err := ioutil.TempDir("", "localdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir2)
+	wm2.Config.dbPath = dir2
+	bs2 := wm2.Blockscanner
+	bs2.BlockchainDAI = nil
+	defer bs2.closeLocalBlockchain()
+
+	if err := bs2.ImportBlockchainState(external); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if height, hash, _ := bs2.GetLocalBlockHead(); height != 29 || hash != node.blockHash(29) {
+		t.Errorf("unexpected imported head: %d %s", height, hash)
+	}
+	if block, err := bs2.GetLocalBlock(25); err != nil || block.Hash != node.blockHash(25) {
+		t.Errorf("unexpected imported block: %+v, err: %v", block, err)
+	}
+	if records, _ := bs2.GetUnscanRecords(); len(records) != 1 {
+		t.Errorf("unexpected imported records: %+v", records)
+	}
+
+	if err := bs.CloseBlockScanner(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+//failingBlockDAI 保存指定高度的本地区块时失败
+type failingBlockDAI struct {
+	*memBlockchainDAI
+	failAt uint64
+}
+
+func (dai *failingBlockDAI) SaveLocalBlockHead(header *openwallet.BlockHeader) error {
+	if header.Height == dai.failAt {
+		return fmt.Errorf("disk full")
+	}
+	return dai.memBlockchainDAI.SaveLocalBlockHead(header)
+}
+
+func TestScannerHeadNotAheadOfLocalBlock(t *testing.T) {
+	node := newFakeNode(t, 30)
+	wm, mem, _ := testScanWalletManager(t, node)
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(&failingBlockDAI{memBlockchainDAI: mem, failAt: 25})
+
+	node.setLocalHead(wm, 20)
+	bs.setScanning(true)
+	bs.ScanBlockTask()
+
+	//保存区块25失败时已扫高度停在24，不会留下没有本地区块的高度
+	height, hash, err := bs.GetLocalBlockHead()
+	if err != nil || height != 24 || hash != node.blockHash(24) {
+		t.Fatalf("unexpected local head: %d %s, err: %v", height, hash, err)
+	}
+	if block, err := bs.GetLocalBlock(24); err != nil || block.Hash != node.blockHash(24) {
+		t.Errorf("unexpected local block: %+v, err: %v", block, err)
+	}
+}
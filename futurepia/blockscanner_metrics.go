@@ -0,0 +1,108 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//ScanMetrics 扫描吞吐统计快照
+type ScanMetrics struct {
+	BlocksFetched   uint64        //已抓取区块数
+	FetchErrors     uint64        //抓取失败次数
+	BlocksScanned   uint64        //已完成提取的区块数
+	TxExtracted     uint64        //已提取的交易数
+	ForksDetected   uint64        //发现分叉次数
+	FetchTime       time.Duration //抓取区块累计耗时（多线程累加）
+	ScanTime        time.Duration //扫描区间的累计耗时
+	BlocksPerSecond float64       //扫描速度
+}
+
+//scanMetrics 扫描计数器，并发安全
+//扫描器的指标只通过它记录，同时转发到钱包管理器的指标注册表
+type scanMetrics struct {
+	blocksFetched uint64
+	fetchErrors   uint64
+	blocksScanned uint64
+	txExtracted   uint64
+	forksDetected uint64
+	fetchNanos    int64
+	scanNanos     int64
+	adapter       func() *adapterMetrics //当前注册表上的指标，为nil时不转发
+}
+
+//adapterMetrics 转发的目标，未设置时返回nil
+func (m *scanMetrics) adapterMetrics() *adapterMetrics {
+	if m.adapter == nil {
+		return nil
+	}
+	return m.adapter()
+}
+
+func (m *scanMetrics) addFetch(d time.Duration, err error) {
+	atomic.AddInt64(&m.fetchNanos, int64(d))
+	if err != nil {
+		atomic.AddUint64(&m.fetchErrors, 1)
+		return
+	}
+	atomic.AddUint64(&m.blocksFetched, 1)
+}
+
+func (m *scanMetrics) addScanned(txCount int) {
+	atomic.AddUint64(&m.blocksScanned, 1)
+	atomic.AddUint64(&m.txExtracted, uint64(txCount))
+	m.adapterMetrics().addBlockScanned()
+}
+
+func (m *scanMetrics) addFork() {
+	atomic.AddUint64(&m.forksDetected, 1)
+	m.adapterMetrics().addFork()
+}
+
+func (m *scanMetrics) addExtractFailure() {
+	m.adapterMetrics().addExtractFailure()
+}
+
+func (m *scanMetrics) addNotifyError(kind string) {
+	m.adapterMetrics().addNotifyError(kind)
+}
+
+func (m *scanMetrics) addScanTime(d time.Duration) {
+	atomic.AddInt64(&m.scanNanos, int64(d))
+}
+
+//snapshot 生成统计快照
+func (m *scanMetrics) snapshot() ScanMetrics {
+	s := ScanMetrics{
+		BlocksFetched: atomic.LoadUint64(&m.blocksFetched),
+		FetchErrors:   atomic.LoadUint64(&m.fetchErrors),
+		BlocksScanned: atomic.LoadUint64(&m.blocksScanned),
+		TxExtracted:   atomic.LoadUint64(&m.txExtracted),
+		ForksDetected: atomic.LoadUint64(&m.forksDetected),
+		FetchTime:     time.Duration(atomic.LoadInt64(&m.fetchNanos)),
+		ScanTime:      time.Duration(atomic.LoadInt64(&m.scanNanos)),
+	}
+	if s.ScanTime > 0 {
+		s.BlocksPerSecond = float64(s.BlocksScanned) / s.ScanTime.Seconds()
+	}
+	return s
+}
+
+//Metrics 获取扫描吞吐统计
+func (bs *PIABlockScanner) Metrics() ScanMetrics {
+	return bs.metrics.snapshot()
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//SetOperationHandler 设置操作处理器，为nil时使用DefaultOperationHandler
+func (bs *PIABlockScanner) SetOperationHandler(handler OperationHandler) {
+	bs.operationHandler = handler
+}
+
+//handleBlockOperations 用扫描器的操作处理器重新生成区块的交易单和合约回执
+func (bs *PIABlockScanner) handleBlockOperations(block *ApiBlock) {
+	if bs.operationHandler == nil {
+		return
+	}
+	block.LocalTransactions, block.OperationReceipts = handleOperations(bs.operationHandler, block.Operations)
+}
+
+//extractBlock 提取区块的交易单和合约回执
+func (bs *PIABlockScanner) extractBlock(block *ApiBlock) error {
+
+	err := bs.BatchExtractTransactions(uint64(block.Height), block.Hash, block.Timestamp, block.LocalTransactions)
+
+	receiptErr := bs.extractOperationReceipts(block)
+	if err == nil {
+		err = receiptErr
+	}
+
+	bs.reconcilePendingTransactions(block)
+
+	return err
+}
+
+//extractOperationReceipts 关联账户被订阅的操作生成合约回执，通知观测者
+func (bs *PIABlockScanner) extractOperationReceipts(block *ApiBlock) error {
+
+	if len(block.OperationReceipts) == 0 {
+		return nil
+	}
+
+	if bs.ScanTargetFunc == nil {
+		bs.wm.Log.Std.Error("scanTargetFunc is not configurated")
+		return fmt.Errorf("scanTargetFunc is not configurated")
+	}
+
+	failed := 0
+	for _, receipt := range block.OperationReceipts {
+
+		watched := false
+		for _, account := range receipt.Accounts {
+			if _, ok := bs.ScanTargetFunc(openwallet.ScanTarget{Alias: account, Symbol: bs.wm.Symbol(), BalanceModelType: openwallet.BalanceModelTypeAccount}); ok {
+				watched = true
+				break
+			}
+		}
+		if !watched {
+			continue
+		}
+
+		contractReceipt := bs.newSmartContractReceipt(block, receipt)
+		notifyFailed := false
+		for o := range bs.Observers {
+			err := o.BlockExtractSmartContractDataNotify(contractReceipt.Coin.ContractID, contractReceipt)
+			if err != nil {
+				notifyFailed = true
+				failed++
+				bs.metrics.addNotifyError(NotifyKindContract)
+				bs.wm.Log.Std.Error("BlockExtractSmartContractDataNotify unexpected error: %v", err)
+			}
+		}
+
+		if notifyFailed {
+			//记录未扫交易，重试时只重新提取该交易
+			unscanRecord := openwallet.NewUnscanRecord(uint64(block.Height), receipt.Operation.TxId, "ExtractSmartContractData Notify failed.", bs.wm.Symbol())
+			bs.SaveUnscanRecord(unscanRecord)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("block height: %d, %d smart contract receipt notify failed", block.Height, failed)
+	}
+
+	return nil
+}
+
+//newSmartContractReceipt 操作转为合约回执，合约地址为操作类型
+func (bs *PIABlockScanner) newSmartContractReceipt(block *ApiBlock, receipt *OperationReceipt) *openwallet.SmartContractReceipt {
+
+	op := receipt.Operation
+	contractID := openwallet.GenContractID(bs.wm.Symbol(), op.Type)
+	contract := &openwallet.SmartContract{
+		ContractID: contractID,
+		Symbol:     bs.wm.Symbol(),
+		Address:    op.Type,
+		Name:       op.Type,
+	}
+
+	contractReceipt := &openwallet.SmartContractReceipt{
+		Coin: openwallet.Coin{
+			Symbol:     bs.wm.Symbol(),
+			IsContract: true,
+			ContractID: contractID,
+			Contract:   *contract,
+		},
+		TxID:        op.TxId,
+		From:        receipt.Accounts[0],
+		To:          op.Type,
+		Value:       "0",
+		Fees:        "0",
+		RawReceipt:  string(op.Raw),
+		BlockHash:   block.Hash,
+		BlockHeight: uint64(block.Height),
+		ConfirmTime: block.Timestamp,
+		Status:      openwallet.TxStatusSuccess,
+		Events: []*openwallet.SmartContractEvent{
+			{
+				Contract: contract,
+				Event:    op.Type,
+				Value:    string(op.Raw),
+			},
+		},
+	}
+	contractReceipt.GenWxID()
+
+	return contractReceipt
+}
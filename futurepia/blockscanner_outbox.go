@@ -0,0 +1,665 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	outboxFile                 = "outbox.db"      //待投递记录数据库文件
+	defaultOutboxMaxPending    = 10000            //默认待投递记录上限，达到后扫描器暂停推进
+	defaultOutboxRetryInterval = 10 * time.Second //默认重新投递间隔
+)
+
+//OutboxObserver 观测者可实现此接口提供稳定的标识，用于重启后继续投递
+//未实现时使用观测者的类型名，此时同类型的观测者只能注册一个，否则拒绝写入待投递队列
+type OutboxObserver interface {
+	OutboxKey() string
+}
+
+//OutboxRecord 待投递给观测者的提取记录
+type OutboxRecord struct {
+	ID          string `storm:"id"` //observerKey_sourceKey_WxID，幂等键
+	ObserverKey string `storm:"index"`
+	SourceKey   string
+	WxID        string
+	BlockHeight uint64
+	Data        *openwallet.TxExtractData
+	Attempts    int       //投递失败次数
+	NextRetry   time.Time //下次投递时间
+	LastError   string    //最后一次失败原因
+	Dead        bool      //观测者未注册，不再投递也不计入待投递数，同一标识的观测者重新注册后恢复投递
+	CreateTime  int64
+}
+
+//OutboxDelivery 观测者已确认的提取记录，补扫时跳过，只记录已确认交易
+type OutboxDelivery struct {
+	ID          string `storm:"id"` //observerKey_sourceKey_WxID，与待投递记录相同
+	ObserverKey string `storm:"index"`
+	BlockHeight uint64
+	DeliverTime int64
+}
+
+//deliveryOutbox 持久化的待投递队列，观测者确认（通知返回nil）后删除并记录已确认
+type deliveryOutbox struct {
+	mu       sync.Mutex
+	db       *storm.DB
+	pending  int64           //队列中未转为死信的记录数，打开数据库时统计，之后随写入和删除更新，原子读写
+	inflight map[string]bool //投递中的记录，值为true表示投递期间记录被更新
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newDeliveryOutbox() *deliveryOutbox {
+	return &deliveryOutbox{inflight: make(map[string]bool)}
+}
+
+//observerKey 观测者的投递标识
+func observerKey(o openwallet.BlockScanNotificationObject) string {
+	if keyer, ok := o.(OutboxObserver); ok {
+		return keyer.OutboxKey()
+	}
+	return fmt.Sprintf("%T", o)
+}
+
+//outboxObservers 按投递标识索引已注册的观测者，标识重复时返回错误
+func (bs *PIABlockScanner) outboxObservers() (map[string]openwallet.BlockScanNotificationObject, error) {
+	observers := make(map[string]openwallet.BlockScanNotificationObject)
+	for o := range bs.Observers {
+		key := observerKey(o)
+		if _, exist := observers[key]; exist {
+			return nil, fmt.Errorf("outbox observer key %s is not unique, implement OutboxObserver to give each observer its own key", key)
+		}
+		observers[key] = o
+	}
+	return observers, nil
+}
+
+func outboxRecordID(observer, sourceKey, wxID string) string {
+	return observer + "_" + sourceKey + "_" + wxID
+}
+
+//outboxMaxPending 待投递记录上限
+func (bs *PIABlockScanner) outboxMaxPending() int {
+	if bs.wm.Config.OutboxMaxPending > 0 {
+		return bs.wm.Config.OutboxMaxPending
+	}
+	return defaultOutboxMaxPending
+}
+
+//outboxRetryInterval 重新投递间隔
+func (bs *PIABlockScanner) outboxRetryInterval() time.Duration {
+	if bs.wm.Config.OutboxRetryInterval > 0 {
+		return bs.wm.Config.OutboxRetryInterval
+	}
+	return defaultOutboxRetryInterval
+}
+
+//outboxDB 打开待投递数据库，调用者需持有outbox.mu
+func (bs *PIABlockScanner) outboxDB() (*storm.DB, error) {
+	if bs.outbox.db != nil {
+		return bs.outbox.db, nil
+	}
+
+	err := os.MkdirAll(bs.wm.Config.dbPath, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	db, err := storm.Open(filepath.Join(bs.wm.Config.dbPath, outboxFile))
+	if err != nil {
+		return nil, err
+	}
+	pending, err := db.Select(q.Eq("Dead", false)).Count(&OutboxRecord{})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	bs.outbox.db = db
+	atomic.StoreInt64(&bs.outbox.pending, int64(pending))
+	return db, nil
+}
+
+//outboxExists 待投递数据库是否已打开或已存在，调用者需持有outbox.mu
+func (bs *PIABlockScanner) outboxExists() bool {
+	if bs.outbox.db != nil {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(bs.wm.Config.dbPath, outboxFile))
+	return err == nil
+}
+
+//closeOutbox 关闭待投递数据库
+func (bs *PIABlockScanner) closeOutbox() {
+	bs.outbox.mu.Lock()
+	defer bs.outbox.mu.Unlock()
+	if bs.outbox.db != nil {
+		bs.outbox.db.Close()
+		bs.outbox.db = nil
+	}
+}
+
+//enqueueOutbox 提取结果写入全部观测者的待投递队列后立即投递，失败的记录等待重新投递
+func (bs *PIABlockScanner) enqueueOutbox(height uint64, extractData map[string][]*openwallet.TxExtractData) error {
+
+	observers, err := bs.outboxObservers()
+	if err != nil {
+		return err
+	}
+
+	_, err = bs.enqueueOutboxRecords(height, extractData, observers, false)
+	return err
+}
+
+//enqueueOutboxRecords 提取结果写入observers的待投递队列后立即投递，返回写入的记录数
+//skipDelivered为true时跳过观测者已确认或已在队列中的记录，用于补扫；
+//实时扫描不跳过，未确认交易的通知与确认后的通知使用相同的WxID
+func (bs *PIABlockScanner) enqueueOutboxRecords(height uint64, extractData map[string][]*openwallet.TxExtractData, observers map[string]openwallet.BlockScanNotificationObject, skipDelivered bool) (int, error) {
+
+	bs.outbox.mu.Lock()
+
+	db, err := bs.outboxDB()
+	if err != nil {
+		bs.outbox.mu.Unlock()
+		return 0, err
+	}
+
+	now := time.Now()
+	queued := 0
+	records := make(map[openwallet.BlockScanNotificationObject][]*OutboxRecord)
+	for key, o := range observers {
+		for sourceKey, array := range extractData {
+			for _, item := range array {
+				record := &OutboxRecord{
+					ID:          outboxRecordID(key, sourceKey, item.Transaction.WxID),
+					ObserverKey: key,
+					SourceKey:   sourceKey,
+					WxID:        item.Transaction.WxID,
+					BlockHeight: height,
+					Data:        item,
+					CreateTime:  now.Unix(),
+				}
+				var exist OutboxRecord
+				found := db.One("ID", record.ID, &exist) == nil
+				if skipDelivered {
+					if found {
+						continue
+					}
+					err = db.One("ID", record.ID, &OutboxDelivery{})
+					if err == nil {
+						continue
+					}
+					if err != storm.ErrNotFound {
+						bs.outbox.mu.Unlock()
+						return queued, err
+					}
+				}
+				//相同幂等键的记录已在队列中，更新为最新数据
+				if found {
+					record.Attempts = exist.Attempts
+					record.CreateTime = exist.CreateTime
+				}
+				err = db.Save(record)
+				if err != nil {
+					bs.outbox.mu.Unlock()
+					return queued, err
+				}
+				queued++
+				if !found || exist.Dead {
+					atomic.AddInt64(&bs.outbox.pending, 1)
+				}
+				//正在投递的记录由投递方处理更新
+				if _, delivering := bs.outbox.inflight[record.ID]; delivering {
+					bs.outbox.inflight[record.ID] = true
+					continue
+				}
+				bs.outbox.inflight[record.ID] = false
+				records[o] = append(records[o], record)
+			}
+		}
+	}
+
+	bs.outbox.mu.Unlock()
+
+	//在锁外投递，慢速观测者不阻塞队列的其他操作
+	for o, list := range records {
+		for _, record := range list {
+			bs.deliverOutboxRecord(o, record, now)
+		}
+	}
+
+	return queued, nil
+}
+
+//deliverOutboxRecord 投递一条记录（调用者已标记为投递中），成功后删除，失败后按退避时间等待重新投递
+func (bs *PIABlockScanner) deliverOutboxRecord(o openwallet.BlockScanNotificationObject, record *OutboxRecord, now time.Time) bool {
+
+	err := o.BlockExtractDataNotify(record.SourceKey, record.Data)
+
+	bs.outbox.mu.Lock()
+	defer bs.outbox.mu.Unlock()
+
+	updated := bs.outbox.inflight[record.ID]
+	delete(bs.outbox.inflight, record.ID)
+
+	db, dbErr := bs.outboxDB()
+	if dbErr != nil {
+		bs.wm.Log.Std.Error("outbox record: %s update failed, unexpected error: %v", record.ID, dbErr)
+		return err == nil
+	}
+
+	if err == nil {
+		if saveErr := bs.markOutboxDelivered(db, record, now); saveErr != nil {
+			bs.wm.Log.Std.Error("outbox record: %s mark delivered failed, unexpected error: %v", record.ID, saveErr)
+		}
+		if updated {
+			//投递期间记录被更新，保留最新数据并立即重新投递
+			var latest OutboxRecord
+			if db.One("ID", record.ID, &latest) == nil {
+				latest.NextRetry = time.Time{}
+				if saveErr := db.Save(&latest); saveErr != nil {
+					bs.wm.Log.Std.Error("outbox record: %s save failed, unexpected error: %v", record.ID, saveErr)
+				}
+			}
+			return true
+		}
+		delErr := db.DeleteStruct(record)
+		if delErr == nil {
+			atomic.AddInt64(&bs.outbox.pending, -1)
+		} else if delErr != storm.ErrNotFound {
+			bs.wm.Log.Std.Error("outbox record: %s delete failed, unexpected error: %v", record.ID, delErr)
+		}
+		return true
+	}
+
+	bs.metrics.addNotifyError(NotifyKindExtract)
+	if updated {
+		//以投递期间写入的最新数据为准
+		var latest OutboxRecord
+		if db.One("ID", record.ID, &latest) == nil {
+			record = &latest
+		}
+	}
+	record.Attempts++
+	record.LastError = err.Error()
+	record.NextRetry = now.Add(bs.outboxBackoff(record.Attempts))
+	bs.wm.Log.Std.Error("outbox record: %s deliver failed %d times, unexpected error: %v", record.ID, record.Attempts, err)
+	if saveErr := db.Save(record); saveErr != nil {
+		bs.wm.Log.Std.Error("outbox record: %s save failed, unexpected error: %v", record.ID, saveErr)
+	}
+	return false
+}
+
+//markOutboxDelivered 记录观测者已确认的提取记录，未确认交易（高度为0）不记录，调用者需持有outbox.mu
+func (bs *PIABlockScanner) markOutboxDelivered(db *storm.DB, record *OutboxRecord, now time.Time) error {
+	if record.BlockHeight == 0 {
+		return nil
+	}
+	return db.Save(&OutboxDelivery{
+		ID:          record.ID,
+		ObserverKey: record.ObserverKey,
+		BlockHeight: record.BlockHeight,
+		DeliverTime: now.Unix(),
+	})
+}
+
+//saveOutboxDeliveries 记录未经待投递队列、直接通知成功的提取记录
+func (bs *PIABlockScanner) saveOutboxDeliveries(deliveries []*OutboxDelivery) error {
+
+	bs.outbox.mu.Lock()
+	defer bs.outbox.mu.Unlock()
+
+	db, err := bs.outboxDB()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, delivery := range deliveries {
+		if err := tx.Save(delivery); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//outboxBackoff 第attempts次失败后的退避时间
+func (bs *PIABlockScanner) outboxBackoff(attempts int) time.Duration {
+	factor := 1
+	for i := 1; i < attempts && factor < maxUnscanRetryBackoffFactor; i++ {
+		factor *= 2
+	}
+	return bs.outboxRetryInterval() * time.Duration(factor)
+}
+
+//RetryOutbox 重新投递到期的记录，返回仍在队列中的记录数
+//观测者已不再注册的记录转为死信，不计入返回值和待投递上限；同一标识的观测者重新注册后恢复投递
+func (bs *PIABlockScanner) RetryOutbox() (int, error) {
+
+	observers, err := bs.outboxObservers()
+	if err != nil {
+		return 0, err
+	}
+
+	bs.outbox.mu.Lock()
+
+	//未开启待投递队列且没有补扫写入的记录时不创建数据库
+	if !bs.outboxExists() {
+		bs.outbox.mu.Unlock()
+		return 0, nil
+	}
+
+	db, err := bs.outboxDB()
+	if err != nil {
+		bs.outbox.mu.Unlock()
+		return 0, err
+	}
+
+	var records []*OutboxRecord
+	err = db.All(&records)
+	if err != nil {
+		bs.outbox.mu.Unlock()
+		return 0, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].BlockHeight < records[j].BlockHeight
+	})
+
+	now := time.Now()
+	pending := 0
+	due := make([]*OutboxRecord, 0)
+	for _, record := range records {
+		if _, ok := observers[record.ObserverKey]; !ok {
+			if !record.Dead {
+				if err := bs.setOutboxRecordDead(db, record, true); err != nil {
+					bs.wm.Log.Std.Error("outbox record: %s save failed, unexpected error: %v", record.ID, err)
+				}
+			}
+			continue
+		}
+		if record.Dead {
+			if err := bs.setOutboxRecordDead(db, record, false); err != nil {
+				bs.wm.Log.Std.Error("outbox record: %s save failed, unexpected error: %v", record.ID, err)
+				continue
+			}
+		}
+		_, delivering := bs.outbox.inflight[record.ID]
+		if delivering || record.NextRetry.After(now) {
+			pending++
+			continue
+		}
+		bs.outbox.inflight[record.ID] = false
+		due = append(due, record)
+	}
+
+	bs.outbox.mu.Unlock()
+
+	for _, record := range due {
+		if !bs.deliverOutboxRecord(observers[record.ObserverKey], record, now) {
+			pending++
+		}
+	}
+
+	return pending, nil
+}
+
+//setOutboxRecordDead 观测者注销时记录转为死信，重新注册时恢复并立即投递，调用者需持有outbox.mu
+func (bs *PIABlockScanner) setOutboxRecordDead(db *storm.DB, record *OutboxRecord, dead bool) error {
+	record.Dead = dead
+	if dead {
+		record.LastError = fmt.Sprintf("observer %s is not registered", record.ObserverKey)
+		bs.wm.Log.Std.Warning("outbox record: %s moved to dead letters, observer %s is not registered", record.ID, record.ObserverKey)
+	} else {
+		record.NextRetry = time.Time{}
+	}
+	if err := db.Save(record); err != nil {
+		record.Dead = !dead
+		return err
+	}
+	if dead {
+		atomic.AddInt64(&bs.outbox.pending, -1)
+	} else {
+		atomic.AddInt64(&bs.outbox.pending, 1)
+	}
+	return nil
+}
+
+//DeleteOutboxRecord 删除待投递记录，用于丢弃不再需要投递的死信
+func (bs *PIABlockScanner) DeleteOutboxRecord(id string) error {
+
+	bs.outbox.mu.Lock()
+	defer bs.outbox.mu.Unlock()
+
+	db, err := bs.outboxDB()
+	if err != nil {
+		return err
+	}
+	if _, delivering := bs.outbox.inflight[id]; delivering {
+		return fmt.Errorf("outbox record: %s is being delivered", id)
+	}
+
+	var record OutboxRecord
+	err = db.One("ID", id, &record)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = db.DeleteStruct(&record)
+	if err != nil {
+		return err
+	}
+	if !record.Dead {
+		atomic.AddInt64(&bs.outbox.pending, -1)
+	}
+	return nil
+}
+
+//GetOutboxRecords 获取待投递的记录
+func (bs *PIABlockScanner) GetOutboxRecords() ([]*OutboxRecord, error) {
+
+	bs.outbox.mu.Lock()
+	defer bs.outbox.mu.Unlock()
+
+	db, err := bs.outboxDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*OutboxRecord
+	err = db.All(&records)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].BlockHeight < records[j].BlockHeight
+	})
+	return records, nil
+}
+
+//outboxState 全部待投递记录和已确认记录，用于快照
+func (bs *PIABlockScanner) outboxState() ([]*OutboxRecord, []*OutboxDelivery, error) {
+
+	bs.outbox.mu.Lock()
+	defer bs.outbox.mu.Unlock()
+
+	//没有待投递数据库时不创建
+	if !bs.outboxExists() {
+		return nil, nil, nil
+	}
+
+	db, err := bs.outboxDB()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var records []*OutboxRecord
+	err = db.All(&records)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].BlockHeight < records[j].BlockHeight
+	})
+	var deliveries []*OutboxDelivery
+	err = db.All(&deliveries)
+	if err != nil {
+		return nil, nil, err
+	}
+	return records, deliveries, nil
+}
+
+//restoreOutbox 写入快照中的待投递记录和已确认记录
+func (bs *PIABlockScanner) restoreOutbox(records []*OutboxRecord, deliveries []*OutboxDelivery) error {
+
+	bs.outbox.mu.Lock()
+	defer bs.outbox.mu.Unlock()
+
+	db, err := bs.outboxDB()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	added := 0
+	for _, record := range records {
+		var exist OutboxRecord
+		if err := tx.One("ID", record.ID, &exist); err == nil && !exist.Dead {
+			added--
+		}
+		if !record.Dead {
+			added++
+		}
+		if err := tx.Save(record); err != nil {
+			return err
+		}
+	}
+	for _, delivery := range deliveries {
+		if err := tx.Save(delivery); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	atomic.AddInt64(&bs.outbox.pending, int64(added))
+	return nil
+}
+
+//outboxSaturated 待投递记录达到上限时，扫描器不再推进
+func (bs *PIABlockScanner) outboxSaturated() bool {
+
+	if !bs.wm.Config.OutboxEnabled {
+		return false
+	}
+
+	count, err := bs.outboxCount()
+	if err != nil {
+		bs.wm.Log.Std.Error("outbox count failed, unexpected error: %v", err)
+		return true
+	}
+
+	if count >= bs.outboxMaxPending() {
+		bs.wm.Log.Std.Warning("outbox is saturated with %d pending records, scanner holds at current height", count)
+		return true
+	}
+	return false
+}
+
+//outboxCount 待投递记录数，使用内存中的计数
+func (bs *PIABlockScanner) outboxCount() (int, error) {
+
+	bs.outbox.mu.Lock()
+	defer bs.outbox.mu.Unlock()
+
+	if _, err := bs.outboxDB(); err != nil {
+		return 0, err
+	}
+	return bs.outboxPending(), nil
+}
+
+//outboxPending 最近一次统计的待投递记录数，不打开数据库也不等待outbox.mu，供状态查询使用
+func (bs *PIABlockScanner) outboxPending() int {
+	return int(atomic.LoadInt64(&bs.outbox.pending))
+}
+
+//startOutbox 启动定时重新投递，未开启待投递队列时只投递补扫写入的记录
+func (bs *PIABlockScanner) startOutbox() {
+
+	bs.outbox.mu.Lock()
+	defer bs.outbox.mu.Unlock()
+
+	if bs.outbox.quit != nil {
+		return
+	}
+
+	bs.outbox.quit = make(chan struct{})
+	bs.outbox.wg.Add(1)
+	go bs.outboxLoop(bs.outbox.quit)
+}
+
+//stopOutbox 停止定时重新投递并关闭数据库
+func (bs *PIABlockScanner) stopOutbox() {
+	bs.outbox.mu.Lock()
+	quit := bs.outbox.quit
+	bs.outbox.quit = nil
+	bs.outbox.mu.Unlock()
+
+	if quit != nil {
+		close(quit)
+		bs.outbox.wg.Wait()
+	}
+	bs.closeOutbox()
+}
+
+func (bs *PIABlockScanner) outboxLoop(quit chan struct{}) {
+	defer bs.outbox.wg.Done()
+
+	ticker := time.NewTicker(bs.outboxRetryInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			if _, err := bs.RetryOutbox(); err != nil {
+				bs.wm.Log.Std.Error("retry outbox failed, unexpected error: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func testOutboxWalletManager(t *testing.T, node *fakeNode, failures int) (*WalletManager, *memBlockchainDAI, *flakyObserver) {
+	wm, dai, observer := testScanWalletManager(t, node, "bob")
+	wm.Blockscanner.RemoveObserver(observer)
+
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		wm.Blockscanner.stopOutbox()
+		os.RemoveAll(dir)
+	})
+	wm.Config.dbPath = dir
+	wm.Config.OutboxEnabled = true
+	wm.Config.OutboxRetryInterval = 20 * time.Millisecond
+
+	flaky := &flakyObserver{failures: failures}
+	wm.Blockscanner.AddObserver(flaky)
+	return wm, dai, flaky
+}
+
+func TestOutboxRedelivery(t *testing.T) {
+	node := newFakeNode(t, 20)
+	txid := node.addTransfer(12, "alice", "bob", "1.00000000 PIA", "")
+
+	wm, dai, observer := testOutboxWalletManager(t, node, 2)
+	bs := wm.Blockscanner
+
+	//观测者失败时不产生未扫记录，记录保存在待投递队列
+	if err := bs.ScanBlock(12); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if records, _ := dai.GetUnscanRecords(wm.Symbol()); len(records) != 0 {
+		t.Errorf("unexpected unscan records: %d", len(records))
+	}
+	records, err := bs.GetOutboxRecords()
+	if err != nil || len(records) != 1 || records[0].Attempts != 1 || records[0].Data.Transaction.TxID != txid {
+		t.Fatalf("unexpected outbox: %+v, err: %v", records, err)
+	}
+
+	//重扫相同区块不产生重复记录
+	bs.ScanBlock(12)
+	if records, _ = bs.GetOutboxRecords(); len(records) != 1 || records[0].Attempts != 2 {
+		t.Fatalf("unexpected outbox after rescan: %+v", records)
+	}
+
+	//退避时间内不投递
+	if pending, _ := bs.RetryOutbox(); pending != 1 {
+		t.Errorf("expected record waiting for backoff")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if pending, err := bs.RetryOutbox(); err != nil || pending != 0 {
+		t.Fatalf("expected outbox drained, pending: %d, err: %v", pending, err)
+	}
+	extracted := observer.extractedData()
+	if len(extracted) != 1 || extracted[0].Transaction.TxID != txid {
+		t.Fatalf("expected record delivered once, got %d", len(extracted))
+	}
+
+	//持久化：关闭后重新打开仍能读取
+	bs.ScanBlock(12)
+	bs.stopOutbox()
+	if records, _ = bs.GetOutboxRecords(); len(records) != 0 {
+		t.Errorf("acknowledged record was kept")
+	}
+}
+
+func TestOutboxHoldsHead(t *testing.T) {
+	node := newFakeNode(t, 20)
+	node.addTransfer(3, "alice", "bob", "1.00000000 PIA", "")
+	node.addTransfer(5, "alice", "bob", "2.00000000 PIA", "")
+
+	wm, _, observer := testOutboxWalletManager(t, node, 100)
+	wm.Config.OutboxMaxPending = 1
+	bs := wm.Blockscanner
+	bs.setScanning(true)
+
+	block, err := wm.Api.GetGetBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	height, _, err := bs.scanBlockRange(1, block.Hash, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if height != 3 {
+		t.Fatalf("expected scanner to hold at height 3, got %d", height)
+	}
+
+	//观测者恢复后继续推进
+	observer.mu.Lock()
+	observer.failures = 0
+	observer.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	bs.RetryOutbox()
+
+	block, _ = wm.Api.GetGetBlock(3)
+	height, _, err = bs.scanBlockRange(3, block.Hash, 10)
+	if err != nil || height != 10 {
+		t.Fatalf("expected scanner to reach height 10, got %d, err: %v", height, err)
+	}
+	if len(observer.extractedData()) != 2 {
+		t.Errorf("expected 2 delivered records, got %d", len(observer.extractedData()))
+	}
+}
+
+func TestOutboxObserverKeys(t *testing.T) {
+	node := newFakeNode(t, 20)
+	node.addTransfer(12, "alice", "bob", "1.00000000 PIA", "")
+
+	wm, _, observer := testOutboxWalletManager(t, node, 1)
+	bs := wm.Blockscanner
+
+	//同类型的观测者没有各自的标识时拒绝写入队列，退回直接通知
+	other := &flakyObserver{}
+	bs.AddObserver(other)
+	if _, err := bs.RetryOutbox(); err == nil {
+		t.Errorf("expected error for duplicate observer keys")
+	}
+	bs.ScanBlock(12)
+	if count, _ := bs.outboxCount(); count != 0 {
+		t.Errorf("expected no outbox records, got %d", count)
+	}
+	if len(other.extractedData()) != 1 {
+		t.Errorf("expected direct delivery to the second observer")
+	}
+	bs.FlushBlockNotify(context.Background())
+	bs.RemoveObserver(other)
+
+	//待投递记录数随写入和投递更新
+	observer.mu.Lock()
+	observer.failures = 1
+	observer.mu.Unlock()
+	bs.ScanBlock(12)
+	if count, _ := bs.outboxCount(); count != 1 {
+		t.Fatalf("expected 1 outbox record, got %d", count)
+	}
+	bs.stopOutbox()
+	if count, _ := bs.outboxCount(); count != 1 {
+		t.Errorf("expected count restored from db, got %d", count)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if pending, err := bs.RetryOutbox(); err != nil || pending != 0 {
+		t.Fatalf("expected outbox drained, pending: %d, err: %v", pending, err)
+	}
+	if count, _ := bs.outboxCount(); count != 0 {
+		t.Errorf("expected 0 outbox records, got %d", count)
+	}
+}
+
+func TestOutboxRemovedObserver(t *testing.T) {
+	node := newFakeNode(t, 20)
+	node.addTransfer(12, "alice", "bob", "1.00000000 PIA", "")
+
+	wm, _, observer := testOutboxWalletManager(t, node, 1)
+	wm.Config.OutboxMaxPending = 1
+	bs := wm.Blockscanner
+	bs.ScanBlock(12)
+	if !bs.outboxSaturated() {
+		t.Fatalf("expected outbox to be saturated")
+	}
+
+	//观测者注销后记录转为死信，不再占用待投递上限
+	bs.FlushBlockNotify(context.Background())
+	bs.RemoveObserver(observer)
+	if pending, err := bs.RetryOutbox(); err != nil || pending != 0 {
+		t.Fatalf("expected no pending records, pending: %d, err: %v", pending, err)
+	}
+	if bs.outboxSaturated() {
+		t.Errorf("dead letters should not saturate the outbox")
+	}
+	records, _ := bs.GetOutboxRecords()
+	if len(records) != 1 || !records[0].Dead {
+		t.Fatalf("expected a dead outbox record, got %+v", records)
+	}
+
+	//计数在重新打开后不包含死信
+	bs.stopOutbox()
+	if count, _ := bs.outboxCount(); count != 0 {
+		t.Errorf("expected dead letters excluded from count, got %d", count)
+	}
+
+	//同一标识的观测者重新注册后恢复投递
+	observer.mu.Lock()
+	observer.failures = 0
+	observer.mu.Unlock()
+	bs.AddObserver(observer)
+	if pending, err := bs.RetryOutbox(); err != nil || pending != 0 {
+		t.Fatalf("expected revived record delivered, pending: %d, err: %v", pending, err)
+	}
+	if records, _ := bs.GetOutboxRecords(); len(records) != 0 {
+		t.Errorf("expected empty outbox, got %+v", records)
+	}
+	if len(observer.extractedData()) != 1 {
+		t.Errorf("expected revived record delivered")
+	}
+
+	//死信可以直接删除
+	observer.mu.Lock()
+	observer.failures = 1
+	observer.mu.Unlock()
+	bs.ScanBlock(12)
+	bs.FlushBlockNotify(context.Background())
+	bs.RemoveObserver(observer)
+	bs.RetryOutbox()
+	records, _ = bs.GetOutboxRecords()
+	if len(records) != 1 {
+		t.Fatalf("expected 1 dead record, got %d", len(records))
+	}
+	if err := bs.DeleteOutboxRecord(records[0].ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if records, _ := bs.GetOutboxRecords(); len(records) != 0 {
+		t.Errorf("expected dead record deleted")
+	}
+	if count, _ := bs.outboxCount(); count != 0 {
+		t.Errorf("unexpected count after delete: %d", count)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"sync"
+)
+
+const (
+	defaultPrefetchWorkers = 4  //默认预取线程数
+	defaultPrefetchDepth   = 16 //默认预取深度
+)
+
+//blockFetchResult 预取区块结果
+type blockFetchResult struct {
+	height uint64
+	block  *ApiBlock
+	err    error
+}
+
+//prefetchJob 预取任务，结果写入对应高度的槽位
+type prefetchJob struct {
+	height uint64
+	slot   chan *blockFetchResult
+}
+
+//blockPrefetcher 区块预取流水线
+//多个工作线程并发抓取区块，Next按高度顺序返回结果，最多领先消费者depth个区块
+type blockPrefetcher struct {
+	fetch    func(height uint64) (*ApiBlock, error)
+	slots    chan chan *blockFetchResult //按高度排列的结果槽位
+	jobs     chan prefetchJob
+	quit     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+//newBlockPrefetcher 创建并启动[from, to]区间的区块预取
+func newBlockPrefetcher(fetch func(height uint64) (*ApiBlock, error), from, to uint64, workers, depth int) *blockPrefetcher {
+
+	if workers <= 0 {
+		workers = defaultPrefetchWorkers
+	}
+
+	if depth <= 0 {
+		depth = defaultPrefetchDepth
+	}
+
+	p := &blockPrefetcher{
+		fetch: fetch,
+		slots: make(chan chan *blockFetchResult, depth),
+		jobs:  make(chan prefetchJob, depth),
+		quit:  make(chan struct{}),
+	}
+
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+
+	p.wg.Add(1)
+	go p.dispatch(from, to)
+
+	return p
+}
+
+//dispatch 按高度顺序分派任务，槽位通道满时阻塞，以此限制预取深度
+func (p *blockPrefetcher) dispatch(from, to uint64) {
+	defer p.wg.Done()
+	defer close(p.jobs)
+	defer close(p.slots)
+
+	for height := from; height <= to; height++ {
+		slot := make(chan *blockFetchResult, 1)
+
+		select {
+		case p.slots <- slot:
+		case <-p.quit:
+			return
+		}
+
+		select {
+		case p.jobs <- prefetchJob{height: height, slot: slot}:
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+//work 预取工作线程
+func (p *blockPrefetcher) work() {
+	defer p.wg.Done()
+
+	for job := range p.jobs {
+
+		select {
+		case <-p.quit:
+			return
+		default:
+		}
+
+		block, err := p.fetch(job.height)
+		//槽位有1个缓冲，写入不会阻塞
+		job.slot <- &blockFetchResult{height: job.height, block: block, err: err}
+	}
+}
+
+//Next 返回下一个高度的区块，全部区块已返回或已停止时返回false
+func (p *blockPrefetcher) Next() (*blockFetchResult, bool) {
+
+	var slot chan *blockFetchResult
+
+	//已停止时不再返回已预取的区块
+	select {
+	case <-p.quit:
+		return nil, false
+	default:
+	}
+
+	select {
+	case s, ok := <-p.slots:
+		if !ok {
+			return nil, false
+		}
+		slot = s
+	case <-p.quit:
+		return nil, false
+	}
+
+	select {
+	case result := <-slot:
+		return result, true
+	case <-p.quit:
+		return nil, false
+	}
+}
+
+//Stop 停止预取，等待所有工作线程退出
+func (p *blockPrefetcher) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.quit)
+	})
+	p.wg.Wait()
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBlockPrefetcherOrder(t *testing.T) {
+	var inflight, maxInflight int32
+	fetch := func(height uint64) (*ApiBlock, error) {
+		n := atomic.AddInt32(&inflight, 1)
+		for {
+			m := atomic.LoadInt32(&maxInflight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInflight, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+		atomic.AddInt32(&inflight, -1)
+		if height == 77 {
+			return nil, fmt.Errorf("fetch failed")
+		}
+		return &ApiBlock{Height: int64(height)}, nil
+	}
+
+	p := newBlockPrefetcher(fetch, 1, 100, 4, 8)
+	defer p.Stop()
+
+	for want := uint64(1); want <= 100; want++ {
+		result, ok := p.Next()
+		if !ok {
+			t.Fatalf("prefetcher closed early at height %d", want)
+		}
+		if result.height != want {
+			t.Fatalf("expected height %d, got %d", want, result.height)
+		}
+		if want == 77 && result.err == nil {
+			t.Fatalf("expected fetch error on height 77")
+		}
+	}
+	if _, ok := p.Next(); ok {
+		t.Fatalf("expected prefetcher to be drained")
+	}
+	if maxInflight > 4 {
+		t.Errorf("expected at most 4 concurrent fetches, got %d", maxInflight)
+	}
+}
+
+func TestBlockPrefetcherStop(t *testing.T) {
+	fetch := func(height uint64) (*ApiBlock, error) {
+		return &ApiBlock{Height: int64(height)}, nil
+	}
+	p := newBlockPrefetcher(fetch, 1, 1000000, 2, 4)
+	for i := 0; i < 10; i++ {
+		p.Next()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("prefetcher did not stop")
+	}
+	if _, ok := p.Next(); ok {
+		t.Errorf("expected no block after stop")
+	}
+}
+
+func TestScanBlockTaskPrefetch(t *testing.T) {
+	node := newFakeNode(t, 60)
+	txid := node.addTransfer(25, "alice", "bob", "1.50000000 PIA", "hi")
+	node.addTransfer(40, "bob", "carol", "0.20000000 PIA", "")
+	node.addTransfer(41, "dave", "erin", "3.00000000 PIA", "")
+
+	wm, dai, observer := testScanWalletManager(t, node, "bob")
+	wm.Config.PrefetchWorkers = 4
+	wm.Config.PrefetchDepth = 8
+	node.setLocalHead(wm, 10)
+
+	bs := wm.Blockscanner
+	bs.setScanning(true)
+	bs.ScanBlockTask()
+
+	//扫描器以head-1作为最高高度
+	head, err := dai.GetCurrentBlockHead(wm.Symbol())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if head.Height != 59 {
+		t.Errorf("expected local head 59, got %d", head.Height)
+	}
+
+	headers := observer.waitHeaders(t, 49)
+	for i, header := range headers {
+		if header.Height != uint64(11+i) {
+			t.Fatalf("block notify out of order: index %d height %d", i, header.Height)
+		}
+	}
+
+	extracted := observer.extractedData()
+	if len(extracted) != 2 {
+		t.Fatalf("expected 2 extracted transactions, got %d", len(extracted))
+	}
+	if extracted[0].Transaction.TxID != txid || extracted[0].Transaction.BlockHeight != 25 {
+		t.Errorf("unexpected first transaction: %+v", extracted[0].Transaction)
+	}
+	if extracted[1].Transaction.BlockHeight != 40 {
+		t.Errorf("unexpected second transaction: %+v", extracted[1].Transaction)
+	}
+
+	metrics := bs.Metrics()
+	if metrics.BlocksScanned != 49 || metrics.BlocksFetched != 49 {
+		t.Errorf("unexpected metrics: %+v", metrics)
+	}
+	if metrics.TxExtracted != 3 {
+		t.Errorf("expected 3 transactions extracted, got %d", metrics.TxExtracted)
+	}
+	if metrics.BlocksPerSecond <= 0 {
+		t.Errorf("expected positive throughput, got %v", metrics.BlocksPerSecond)
+	}
+	t.Logf("scanned %d blocks at %.1f blocks/s", metrics.BlocksScanned, metrics.BlocksPerSecond)
+}
+
+func TestScanBlockTaskPrefetchFork(t *testing.T) {
+	node := newFakeNode(t, 30)
+	wm, dai, observer := testScanWalletManager(t, node)
+	node.setLocalHead(wm, 10)
+
+	//本地记录的区块被替换
+	for h := uint64(9); h <= 10; h++ {
+		node.mu.Lock()
+		b := node.blocks[h]
+		node.mu.Unlock()
+		local := &Block{Height: uint32(h)}
+		local.Hash = b.ID
+		wm.Blockscanner.SaveLocalBlock(local)
+	}
+	node.reorg(10, "fork")
+
+	bs := wm.Blockscanner
+	bs.setScanning(true)
+	bs.ScanBlockTask()
+
+	head, _ := dai.GetCurrentBlockHead(wm.Symbol())
+	if head.Height != 29 {
+		t.Errorf("expected local head 29 after fork recovery, got %d", head.Height)
+	}
+	if bs.Metrics().ForksDetected != 1 {
+		t.Errorf("expected 1 fork, got %d", bs.Metrics().ForksDetected)
+	}
+
+	forks := 0
+	for _, header := range observer.waitHeaders(t, 21) {
+		if header.Fork {
+			forks++
+		}
+	}
+	if forks != 1 {
+		t.Errorf("expected 1 fork notification, got %d", forks)
+	}
+}
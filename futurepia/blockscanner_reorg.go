@@ -0,0 +1,172 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultMaxReorgDepth = 100 //默认最大回滚深度
+)
+
+//ReorgAlert 分叉深度超过最大回滚深度的告警
+type ReorgAlert struct {
+	ForkHeight uint64 //发现分叉的区块高度
+	Depth      uint64 //已回溯的孤块数量
+	MaxDepth   uint64 //配置的最大回滚深度
+	LocalHash  string //本地记录的区块hash
+	ChainHash  string //链上的区块hash
+	Reason     string //挂起原因
+	Time       int64  //告警时间
+}
+
+//ReorgAlertFunc 分叉深度超限的告警回调
+type ReorgAlertFunc func(alert *ReorgAlert)
+
+//SetReorgAlertFunc 设置分叉深度超限的告警回调
+func (bs *PIABlockScanner) SetReorgAlertFunc(f ReorgAlertFunc) {
+	bs.reorgAlertFunc = f
+}
+
+//maxReorgDepth 分叉最大回滚深度
+func (bs *PIABlockScanner) maxReorgDepth() uint64 {
+	if bs.wm.Config.MaxReorgDepth > 0 {
+		return bs.wm.Config.MaxReorgDepth
+	}
+	return defaultMaxReorgDepth
+}
+
+//haltScan 分叉无法自动回滚时挂起扫描，不再由定时任务触发
+//需要人工处理后调用Resume(如调大MaxReorgDepth或SetRescanBlockHeight重设扫描高度)
+func (bs *PIABlockScanner) haltScan() {
+	lc := bs.lifecycle
+	lc.mu.Lock()
+	lc.paused = true
+	lc.halted = true
+	bs.setScanning(false)
+	lc.mu.Unlock()
+}
+
+//haltReorg 分叉无法自动回滚，挂起扫描并告警
+func (bs *PIABlockScanner) haltReorg(forkHeight uint32, depth int, localHash, chainHash, reason string) {
+	bs.wm.Log.Std.Error("block fork on height: %d %s, scanner is halted", forkHeight, reason)
+	bs.haltScan()
+	if bs.reorgAlertFunc != nil {
+		bs.reorgAlertFunc(&ReorgAlert{
+			ForkHeight: uint64(forkHeight),
+			Depth:      uint64(depth),
+			MaxDepth:   bs.maxReorgDepth(),
+			LocalHash:  localHash,
+			ChainHash:  chainHash,
+			Reason:     reason,
+			Time:       time.Now().Unix(),
+		})
+	}
+}
+
+//rollbackForkBlock 区块previous与本地hash不一致，沿本地区块记录回溯到与链上一致的共同祖先
+//通知所有被孤立的区块，并返回共同祖先作为新的扫描起点；
+//只有本地区块hash与链上一致才确认为共同祖先，本地区块缺失或读取失败时无法确认孤块范围，挂起扫描
+func (bs *PIABlockScanner) rollbackForkBlock(currentHeight uint32, currentHash string, block *ApiBlock) (uint32, string, error) {
+
+	bs.metrics.addFork()
+
+	forkHeight := currentHeight - 1
+
+	bs.wm.Log.Std.Info("block has been fork on height: %d.", currentHeight)
+	bs.wm.Log.Std.Info("block height: %d local hash = %s ", forkHeight, currentHash)
+	bs.wm.Log.Std.Info("block height: %d mainnet hash = %s ", forkHeight, block.PreviousHash)
+
+	maxDepth := bs.maxReorgDepth()
+
+	//上一个区块已确认被孤立
+	orphan, err := bs.GetLocalBlock(forkHeight)
+	if err != nil {
+		orphan = &Block{Height: forkHeight}
+		orphan.Hash = currentHash
+		orphan.BlockHeader.Height = uint64(forkHeight)
+		orphan.Symbol = bs.wm.Symbol()
+	}
+	orphans := []*Block{orphan}
+
+	var (
+		ancestorHeight = forkHeight
+		ancestorHash   string
+	)
+
+	//向前回溯，直到本地区块与链上区块一致
+	for {
+		if ancestorHeight <= 1 {
+			//高度0表示从未扫描，不能作为扫描起点，找不到共同祖先时挂起扫描
+			bs.haltReorg(forkHeight, len(orphans), currentHash, block.PreviousHash, "has no common ancestor in local blocks")
+			return currentHeight - 1, currentHash, fmt.Errorf("block fork on height: %d has no common ancestor", forkHeight)
+		}
+
+		ancestorHeight--
+
+		chainBlock, err := bs.wm.Api.GetGetBlock(uint64(ancestorHeight))
+		if err != nil {
+			bs.wm.Log.Std.Error("block scanner can not get prev block by rpc; unexpected error: %v", err)
+			return currentHeight - 1, currentHash, err
+		}
+
+		localBlock, err := bs.GetLocalBlock(ancestorHeight)
+		if err != nil {
+			//本地没有区块记录，无法确认该高度以下是否还有孤块
+			bs.wm.Log.Std.Error("block scanner can not get local block on height: %d; unexpected error: %v", ancestorHeight, err)
+			bs.haltReorg(forkHeight, len(orphans), currentHash, block.PreviousHash, fmt.Sprintf("can not read local block on height: %d", ancestorHeight))
+			return currentHeight - 1, currentHash, fmt.Errorf("block fork on height: %d can not read local block on height: %d, err: %v", forkHeight, ancestorHeight, err)
+		}
+
+		if localBlock.Hash == chainBlock.Hash {
+			ancestorHash = chainBlock.Hash
+			break
+		}
+
+		orphans = append(orphans, localBlock)
+
+		if uint64(len(orphans)) > maxDepth {
+			bs.haltReorg(forkHeight, len(orphans), currentHash, block.PreviousHash, fmt.Sprintf("is deeper than max reorg depth: %d", maxDepth))
+			return currentHeight - 1, currentHash, fmt.Errorf("block fork is deeper than max reorg depth: %d", maxDepth)
+		}
+	}
+
+	bs.wm.Log.Std.Info("block fork common ancestor on height: %d, hash: %s, orphaned blocks: %d", ancestorHeight, ancestorHash, len(orphans))
+
+	for _, orphan := range orphans {
+		bs.wm.Log.Std.Info("delete recharge records on block height: %d.", orphan.Height)
+		bs.DeleteUnscanRecord(orphan.Height)
+	}
+
+	bs.wm.Log.Std.Info("rescan block on height: %d, hash: %s .", ancestorHeight+1, ancestorHash)
+
+	//重新记录一个新扫描起点
+	bs.SaveLocalBlockHead(ancestorHeight, ancestorHash)
+
+	if bs.IsSafeScanMode() {
+		//只扫描不可逆区块时不应发生分叉，不通知观测者
+		bs.wm.Log.Std.Error("block fork detected on height: %d in safe scan mode, fork notification is skipped", forkHeight)
+	} else {
+		//从高到低通知分叉区块给观测者，异步处理
+		for _, orphan := range orphans {
+			bs.forkBlockNotify(orphan)
+		}
+	}
+
+	return ancestorHeight, ancestorHash, nil
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestScanBlockTaskDeepReorg(t *testing.T) {
+	node := newFakeNode(t, 40)
+	node.addTransfer(36, "alice", "bob", "1.00000000 PIA", "")
+
+	wm, dai, observer := testScanWalletManager(t, node, "bob")
+	node.setLocalHead(wm, 20)
+
+	bs := wm.Blockscanner
+	bs.setScanning(true)
+	bs.ScanBlockTask()
+	observer.waitHeaders(t, 19)
+
+	//未扫记录位于孤块上，回滚时应删除
+	dai.SaveUnscanRecord(openwallet.NewUnscanRecord(35, "", "test", wm.Symbol()))
+
+	//高度33~39被新的分支替换
+	node.reorg(33, "fork")
+	node.addTransfer(36, "alice", "bob", "2.00000000 PIA", "")
+	node.addBlocks(5)
+	bs.ScanBlockTask()
+
+	//19个新区块 + 7个孤块 + 12个新分支区块
+	headers := observer.waitHeaders(t, 38)
+	orphaned := make(map[uint64]bool)
+	for _, header := range headers[19:26] {
+		if !header.Fork {
+			t.Fatalf("expected fork notification, got %+v", header)
+		}
+		orphaned[header.Height] = true
+	}
+	for h := uint64(33); h <= 39; h++ {
+		if !orphaned[h] {
+			t.Errorf("missing fork notification on height %d", h)
+		}
+	}
+	for i, header := range headers[26:] {
+		if header.Fork || header.Height != uint64(33+i) {
+			t.Fatalf("unexpected rescan notification: %+v", header)
+		}
+	}
+
+	head, _ := dai.GetCurrentBlockHead(wm.Symbol())
+	if head.Height != 44 {
+		t.Errorf("expected local head 44, got %d", head.Height)
+	}
+	local, _ := bs.GetLocalBlock(36)
+	node.mu.Lock()
+	chainHash := node.blocks[36].ID
+	node.mu.Unlock()
+	if local.Hash != chainHash {
+		t.Errorf("local block 36 was not replaced by the new branch")
+	}
+	if records, _ := dai.GetUnscanRecords(wm.Symbol()); len(records) != 0 {
+		t.Errorf("expected unscan records of orphaned blocks to be deleted, got %d", len(records))
+	}
+
+	extracted := observer.extractedData()
+	if len(extracted) != 2 || extracted[1].Transaction.Amount != "2.00000000" {
+		t.Errorf("expected transfer of new branch to be extracted, got %d records", len(extracted))
+	}
+}
+
+func TestScanBlockTaskReorgTooDeep(t *testing.T) {
+	node := newFakeNode(t, 40)
+	wm, dai, observer := testScanWalletManager(t, node)
+	wm.Config.MaxReorgDepth = 3
+	node.setLocalHead(wm, 20)
+
+	bs := wm.Blockscanner
+	bs.setScanning(true)
+	bs.ScanBlockTask()
+	observer.waitHeaders(t, 19)
+
+	var alert *ReorgAlert
+	bs.SetReorgAlertFunc(func(a *ReorgAlert) {
+		alert = a
+	})
+
+	node.reorg(30, "fork")
+	node.addBlocks(2)
+	bs.ScanBlockTask()
+
+	if alert == nil {
+		t.Fatalf("expected reorg alert")
+	}
+	if alert.ForkHeight != 39 || alert.MaxDepth != 3 || alert.Depth != 4 {
+		t.Errorf("unexpected alert: %+v", alert)
+	}
+
+	//超限时不移动扫描高度，也不通知分叉
+	head, _ := dai.GetCurrentBlockHead(wm.Symbol())
+	if head.Height != 39 {
+		t.Errorf("expected local head to stay at 39, got %d", head.Height)
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, header := range observer.blockHeaders() {
+		if header.Fork {
+			t.Fatalf("unexpected fork notification on height %d", header.Height)
+		}
+	}
+
+	//扫描被挂起，再次触发也不会继续
+	if bs.isScanning() {
+		t.Fatalf("expected scanner to be halted")
+	}
+	if !bs.ScannerStatus().Halted {
+		t.Errorf("expected status to report halted scanner")
+	}
+	calls := node.callCount("get_block")
+	bs.ScanBlockTask()
+	if node.callCount("get_block") != calls {
+		t.Errorf("halted scanner kept fetching blocks")
+	}
+}
+
+func TestScanBlockTaskReorgWithoutAncestor(t *testing.T) {
+	node := newFakeNode(t, 5)
+	wm, dai, _ := testScanWalletManager(t, node)
+	node.setLocalHead(wm, 1)
+
+	bs := wm.Blockscanner
+	local := &Block{Height: 1}
+	node.mu.Lock()
+	local.Hash = node.blocks[1].ID
+	node.mu.Unlock()
+	bs.SaveLocalBlock(local)
+
+	bs.setScanning(true)
+	bs.ScanBlockTask()
+
+	//本地所有区块都被替换，找不到共同祖先
+	node.reorg(1, "fork")
+	node.addBlocks(1)
+	bs.ScanBlockTask()
+
+	//不能退回高度0，否则会被当作从未扫描而跳到最新高度
+	head, _ := dai.GetCurrentBlockHead(wm.Symbol())
+	if head.Height != 4 {
+		t.Errorf("expected local head to stay at 4, got %d", head.Height)
+	}
+	if bs.isScanning() {
+		t.Errorf("expected scanner to be halted")
+	}
+}
+
+func TestScanBlockTaskReorgMissingLocalBlock(t *testing.T) {
+	node := newFakeNode(t, 40)
+	wm, dai, observer := testScanWalletManager(t, node)
+	node.setLocalHead(wm, 20)
+
+	bs := wm.Blockscanner
+	bs.setScanning(true)
+	bs.ScanBlockTask()
+	observer.waitHeaders(t, 19)
+
+	var alert *ReorgAlert
+	bs.SetReorgAlertFunc(func(a *ReorgAlert) {
+		alert = a
+	})
+
+	//回溯路径上的本地区块缺失，不能当作共同祖先
+	dai.mu.Lock()
+	delete(dai.blocks[wm.Symbol()], 35)
+	dai.mu.Unlock()
+
+	node.reorg(34, "fork")
+	node.addBlocks(1)
+	bs.ScanBlockTask()
+
+	if alert == nil || alert.ForkHeight != 39 || alert.Reason == "" {
+		t.Fatalf("unexpected reorg alert: %+v", alert)
+	}
+	head, _ := dai.GetCurrentBlockHead(wm.Symbol())
+	if head.Height != 39 {
+		t.Errorf("expected local head to stay at 39, got %d", head.Height)
+	}
+	if bs.isScanning() {
+		t.Errorf("expected scanner to be halted")
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, header := range observer.blockHeaders() {
+		if header.Fork {
+			t.Fatalf("unexpected fork notification on height %d", header.Height)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	defaultUnscanRetryInterval    = 30 * time.Second //默认重试间隔
+	defaultUnscanRetryMaxAttempts = 10               //默认最大重试次数，超过后转入死信列表
+	maxUnscanRetryBackoffFactor   = 64               //退避时间最多为重试间隔的倍数
+)
+
+//UnscanRetryState 未扫记录的重试状态
+type UnscanRetryState struct {
+	Record    *openwallet.UnscanRecord `json:"record"`
+	Attempts  int                      `json:"attempts"`  //已重试次数
+	NextRetry time.Time                `json:"nextRetry"` //下次重试时间
+	LastError string                   `json:"lastError"` //最后一次失败原因
+}
+
+//DeadLetterDAI 死信记录的数据访问接口
+//注入的BlockchainDAI实现该接口时死信记录保存在其中，否则保存在本地数据库
+type DeadLetterDAI interface {
+	SaveDeadLetter(state *UnscanRetryState, symbol string) error
+	DeleteDeadLetter(id, symbol string) error
+	GetDeadLetters(symbol string) ([]*UnscanRetryState, error)
+}
+
+//unscanRetrier 未扫记录重试任务
+type unscanRetrier struct {
+	mu     sync.Mutex
+	states map[string]*UnscanRetryState //重试中的记录
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newUnscanRetrier() *unscanRetrier {
+	return &unscanRetrier{
+		states: make(map[string]*UnscanRetryState),
+	}
+}
+
+//deadLetterDAI 死信记录的数据访问接口
+func (bs *PIABlockScanner) deadLetterDAI() (DeadLetterDAI, error) {
+	if dai, ok := bs.BlockchainDAI.(DeadLetterDAI); ok {
+		return dai, nil
+	}
+	return bs.localBlockchainDAI()
+}
+
+//retryInterval 重试间隔
+func (bs *PIABlockScanner) retryInterval() time.Duration {
+	if bs.wm.Config.UnscanRetryInterval > 0 {
+		return bs.wm.Config.UnscanRetryInterval
+	}
+	return defaultUnscanRetryInterval
+}
+
+//retryBackoff 第attempts次失败后的退避时间，按重试间隔指数增长
+func (bs *PIABlockScanner) retryBackoff(attempts int) time.Duration {
+	factor := 1
+	for i := 1; i < attempts && factor < maxUnscanRetryBackoffFactor; i++ {
+		factor *= 2
+	}
+	return bs.retryInterval() * time.Duration(factor)
+}
+
+//startUnscanRetry 启动未扫记录的定时重试
+func (bs *PIABlockScanner) startUnscanRetry() {
+	r := bs.retrier
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.quit != nil {
+		return
+	}
+
+	r.quit = make(chan struct{})
+	r.wg.Add(1)
+	go bs.unscanRetryLoop(r.quit)
+}
+
+//stopUnscanRetry 停止未扫记录的定时重试，等待正在进行的重试结束
+func (bs *PIABlockScanner) stopUnscanRetry() {
+	r := bs.retrier
+	r.mu.Lock()
+	quit := r.quit
+	r.quit = nil
+	r.mu.Unlock()
+
+	if quit == nil {
+		return
+	}
+	close(quit)
+	r.wg.Wait()
+}
+
+func (bs *PIABlockScanner) unscanRetryLoop(quit chan struct{}) {
+	defer bs.retrier.wg.Done()
+
+	ticker := time.NewTicker(bs.retryInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			if err := bs.RetryUnscanRecords(); err != nil {
+				bs.wm.Log.Std.Error("retry unscan records failed, unexpected error: %v", err)
+			}
+		}
+	}
+}
+
+//RetryUnscanRecords 重扫到期的未扫记录，成功后删除记录，多次失败的记录转入死信列表
+func (bs *PIABlockScanner) RetryUnscanRecords() error {
+
+	records, err := bs.GetUnscanRecords()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].BlockHeight < records[j].BlockHeight
+	})
+
+	r := bs.retrier
+	maxAttempts := bs.wm.Config.UnscanRetryMaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultUnscanRetryMaxAttempts
+	}
+
+	deadDAI, err := bs.deadLetterDAI()
+	if err != nil {
+		return err
+	}
+	deadLetters, err := deadDAI.GetDeadLetters(bs.wm.Symbol())
+	if err != nil {
+		return err
+	}
+	deadIDs := make(map[string]bool, len(deadLetters))
+	for _, state := range deadLetters {
+		deadIDs[state.Record.ID] = true
+	}
+
+	now := time.Now()
+	exist := make(map[string]bool)
+
+	for _, record := range records {
+		exist[record.ID] = true
+
+		r.mu.Lock()
+		dead := deadIDs[record.ID]
+		state, ok := r.states[record.ID]
+		if !ok {
+			state = &UnscanRetryState{Record: record}
+			r.states[record.ID] = state
+		}
+		r.mu.Unlock()
+
+		if dead || now.Before(state.NextRetry) {
+			continue
+		}
+
+		bs.wm.Log.Std.Info("retry unscan record on block height: %d, attempts: %d", record.BlockHeight, state.Attempts+1)
+
+		scanErr := bs.retryUnscanRecord(record)
+
+		r.mu.Lock()
+		state.Attempts++
+		if scanErr == nil {
+			delete(r.states, record.ID)
+			r.mu.Unlock()
+			if err := bs.DeleteUnscanRecordByID(record.ID); err != nil {
+				bs.wm.Log.Std.Error("delete unscan record on block height: %d failed, unexpected error: %v", record.BlockHeight, err)
+			}
+			continue
+		}
+
+		state.LastError = scanErr.Error()
+		state.NextRetry = time.Now().Add(bs.retryBackoff(state.Attempts))
+		if state.Attempts < maxAttempts {
+			r.mu.Unlock()
+			continue
+		}
+		delete(r.states, record.ID)
+		r.mu.Unlock()
+
+		bs.wm.Log.Std.Error("unscan record on block height: %d failed %d times, moved to dead letters", record.BlockHeight, state.Attempts)
+		if err := deadDAI.SaveDeadLetter(state, bs.wm.Symbol()); err != nil {
+			bs.wm.Log.Std.Error("save dead letter on block height: %d failed, unexpected error: %v", record.BlockHeight, err)
+		}
+	}
+
+	//清理已被删除的记录
+	r.mu.Lock()
+	for id := range r.states {
+		if !exist[id] {
+			delete(r.states, id)
+		}
+	}
+	r.mu.Unlock()
+
+	return nil
+}
+
+//retryUnscanRecord 重扫未扫记录
+//记录了交易id时只重新提取该交易，不再重复通知区块头和区块内已成功的交易；
+//没有交易id的记录是区块获取失败，整块重新提取交易，提取失败时保留记录；区块头不在重试时通知
+func (bs *PIABlockScanner) retryUnscanRecord(record *openwallet.UnscanRecord) error {
+
+	block, err := bs.fetchBlock(record.BlockHeight)
+	if err != nil {
+		return err
+	}
+
+	if record.TxID == "" {
+		return bs.extractBlock(block)
+	}
+
+	transactions := make([]*LocalTransaction, 0)
+	for _, tx := range block.LocalTransactions {
+		if tx.TxId == record.TxID {
+			transactions = append(transactions, tx)
+		}
+	}
+	receipts := make([]*OperationReceipt, 0)
+	for _, receipt := range block.OperationReceipts {
+		if receipt.Operation.TxId == record.TxID {
+			receipts = append(receipts, receipt)
+		}
+	}
+	if len(transactions) == 0 && len(receipts) == 0 {
+		return fmt.Errorf("transaction %s not found in block %d", record.TxID, record.BlockHeight)
+	}
+
+	err = bs.BatchExtractTransactions(uint64(block.Height), block.Hash, block.Timestamp, transactions)
+
+	txBlock := *block
+	txBlock.OperationReceipts = receipts
+	if receiptErr := bs.extractOperationReceipts(&txBlock); err == nil {
+		err = receiptErr
+	}
+	return err
+}
+
+//GetUnscanRetryStates 获取重试中的未扫记录状态
+func (bs *PIABlockScanner) GetUnscanRetryStates() []*UnscanRetryState {
+	r := bs.retrier
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return sortRetryStates(r.states)
+}
+
+//GetDeadLetterRecords 获取多次重试失败、不再自动重试的未扫记录
+func (bs *PIABlockScanner) GetDeadLetterRecords() []*UnscanRetryState {
+	dai, err := bs.deadLetterDAI()
+	if err != nil {
+		bs.wm.Log.Std.Error("get dead letters failed, unexpected error: %v", err)
+		return nil
+	}
+	states, err := dai.GetDeadLetters(bs.wm.Symbol())
+	if err != nil {
+		bs.wm.Log.Std.Error("get dead letters failed, unexpected error: %v", err)
+		return nil
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Record.BlockHeight < states[j].Record.BlockHeight
+	})
+	return states
+}
+
+//RequeueDeadLetter 将死信记录重新加入自动重试
+func (bs *PIABlockScanner) RequeueDeadLetter(id string) bool {
+	dai, err := bs.deadLetterDAI()
+	if err != nil {
+		bs.wm.Log.Std.Error("requeue dead letter failed, unexpected error: %v", err)
+		return false
+	}
+	states, err := dai.GetDeadLetters(bs.wm.Symbol())
+	if err != nil {
+		bs.wm.Log.Std.Error("requeue dead letter failed, unexpected error: %v", err)
+		return false
+	}
+	for _, state := range states {
+		if state.Record.ID != id {
+			continue
+		}
+		if err := dai.DeleteDeadLetter(id, bs.wm.Symbol()); err != nil {
+			bs.wm.Log.Std.Error("requeue dead letter failed, unexpected error: %v", err)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func sortRetryStates(states map[string]*UnscanRetryState) []*UnscanRetryState {
+	list := make([]*UnscanRetryState, 0, len(states))
+	for _, state := range states {
+		s := *state
+		list = append(list, &s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Record.BlockHeight < list[j].Record.BlockHeight
+	})
+	return list
+}
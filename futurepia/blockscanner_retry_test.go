@@ -0,0 +1,177 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//flakyObserver 前failures次提取通知返回错误
+type flakyObserver struct {
+	testObserver
+	failures int
+}
+
+func (o *flakyObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	if o.failures > 0 {
+		o.failures--
+		o.mu.Unlock()
+		return fmt.Errorf("observer is down")
+	}
+	o.mu.Unlock()
+	return o.testObserver.BlockExtractDataNotify(sourceKey, data)
+}
+
+func TestRetryUnscanRecords(t *testing.T) {
+	node := newFakeNode(t, 30)
+	txid := node.addTransfer(25, "alice", "bob", "1.00000000 PIA", "")
+	node.addTransfer(25, "alice", "bob", "2.00000000 PIA", "")
+
+	wm, dai, _ := testScanWalletManager(t, node, "bob")
+	wm.Config.UnscanRetryInterval = 20 * time.Millisecond
+	wm.Config.UnscanRetryMaxAttempts = 2
+	bs := wm.Blockscanner
+
+	observer := &flakyObserver{failures: 1}
+	bs.AddObserver(observer)
+
+	dai.SaveUnscanRecord(openwallet.NewUnscanRecord(25, txid, "ExtractData Notify failed.", wm.Symbol()))
+	dai.SaveUnscanRecord(openwallet.NewUnscanRecord(999, "", "rpc timeout", wm.Symbol()))
+
+	//第一次重试：观测者失败，高度999不存在
+	if err := bs.RetryUnscanRecords(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if records, _ := dai.GetUnscanRecords(wm.Symbol()); len(records) != 2 {
+		t.Fatalf("expected 2 unscan records, got %d", len(records))
+	}
+	states := bs.GetUnscanRetryStates()
+	if len(states) != 2 || states[0].Attempts != 1 || states[0].LastError == "" {
+		t.Fatalf("unexpected retry states: %+v", states)
+	}
+
+	//退避时间内不重试
+	bs.RetryUnscanRecords()
+	if states := bs.GetUnscanRetryStates(); states[0].Attempts != 1 {
+		t.Fatalf("expected retry to wait for backoff, attempts: %d", states[0].Attempts)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	bs.RetryUnscanRecords()
+
+	records, _ := dai.GetUnscanRecords(wm.Symbol())
+	if len(records) != 1 || records[0].BlockHeight != 999 {
+		t.Fatalf("expected only height 999 left, got %+v", records)
+	}
+
+	//只重新提取失败的交易，不通知区块头和同一区块的其他交易
+	extracted := observer.extractedData()
+	if len(extracted) != 1 || extracted[0].Transaction.TxID != txid {
+		t.Fatalf("expected only the failed deposit to be delivered, got %d", len(extracted))
+	}
+	if headers := observer.blockHeaders(); len(headers) != 0 {
+		t.Errorf("unexpected block notifications on retry: %d", len(headers))
+	}
+
+	dead := bs.GetDeadLetterRecords()
+	if len(dead) != 1 || dead[0].Record.BlockHeight != 999 || dead[0].Attempts != 2 {
+		t.Fatalf("unexpected dead letters: %+v", dead)
+	}
+	if len(bs.GetUnscanRetryStates()) != 0 {
+		t.Errorf("expected no pending retries")
+	}
+
+	//死信记录持久化，重启后仍然不再重试，重新入队后可以再次重试
+	bs.retrier = newUnscanRetrier()
+	calls := node.callCount("get_block")
+	time.Sleep(50 * time.Millisecond)
+	bs.RetryUnscanRecords()
+	if node.callCount("get_block") != calls {
+		t.Errorf("dead letter was retried")
+	}
+	if !bs.RequeueDeadLetter(dead[0].Record.ID) {
+		t.Fatalf("requeue dead letter failed")
+	}
+	if len(bs.GetDeadLetterRecords()) != 0 {
+		t.Errorf("expected requeued record to leave dead letters")
+	}
+	bs.RetryUnscanRecords()
+	if node.callCount("get_block") != calls+1 {
+		t.Errorf("requeued record was not retried")
+	}
+}
+
+func TestUnscanRetryLoop(t *testing.T) {
+	node := newFakeNode(t, 30)
+	node.addTransfer(12, "alice", "bob", "1.00000000 PIA", "")
+
+	wm, dai, observer := testScanWalletManager(t, node, "bob")
+	wm.Config.UnscanRetryInterval = 5 * time.Millisecond
+	bs := wm.Blockscanner
+	dai.SaveUnscanRecord(openwallet.NewUnscanRecord(12, "", "rpc timeout", wm.Symbol()))
+
+	bs.startUnscanRetry()
+	defer bs.stopUnscanRetry()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if records, _ := dai.GetUnscanRecords(wm.Symbol()); len(records) == 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if records, _ := dai.GetUnscanRecords(wm.Symbol()); len(records) != 0 {
+		t.Fatalf("unscan record was not retried")
+	}
+	if len(observer.extractedData()) != 1 {
+		t.Errorf("expected retried deposit to be delivered")
+	}
+	if headers := observer.blockHeaders(); len(headers) != 0 {
+		t.Errorf("unexpected block notifications on retry: %d", len(headers))
+	}
+}
+
+func TestRetryBlockRecordKeptOnFailure(t *testing.T) {
+	node := newFakeNode(t, 30)
+	node.addTransfer(12, "alice", "bob", "1.00000000 PIA", "")
+
+	wm, dai, _ := testScanWalletManager(t, node, "bob")
+	bs := wm.Blockscanner
+	observer := &flakyObserver{failures: 1}
+	bs.AddObserver(observer)
+	dai.SaveUnscanRecord(openwallet.NewUnscanRecord(12, "", "rpc timeout", wm.Symbol()))
+
+	//提取通知失败时不删除区块记录
+	bs.RetryUnscanRecords()
+	records, _ := dai.GetUnscanRecords(wm.Symbol())
+	kept := false
+	for _, record := range records {
+		if record.BlockHeight == 12 && record.TxID == "" {
+			kept = true
+		}
+	}
+	if !kept {
+		t.Fatalf("block unscan record was deleted after a failed extraction: %+v", records)
+	}
+	if states := bs.GetUnscanRetryStates(); len(states) == 0 || states[0].LastError == "" {
+		t.Errorf("expected failed retry state, got %+v", states)
+	}
+}
@@ -0,0 +1,411 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const scannerSnapshotVersion = 1 //扫描器状态快照格式版本
+
+//ScannerSnapshot 扫描器状态快照，用于迁移扫描服务
+type ScannerSnapshot struct {
+	Symbol             string                     `json:"symbol"`
+	ChainID            string                     `json:"chainId"`
+	CreateTime         int64                      `json:"createTime"`
+	CurrentBlock       *openwallet.BlockHeader    `json:"currentBlock"`                 //已扫区块头，未扫描过时为空
+	Blocks             []*openwallet.BlockHeader  `json:"blocks"`                       //已扫高度往前的本地区块，用于分叉检测
+	UnscanRecords      []*openwallet.UnscanRecord `json:"unscanRecords"`                //未扫记录
+	OutboxRecords      []*OutboxRecord            `json:"outboxRecords"`                //待投递记录
+	OutboxDeliveries   []*OutboxDelivery          `json:"outboxDeliveries,omitempty"`   //观测者已确认的记录，补扫时去重
+	HistoryCursors     []*AccountHistoryCursor    `json:"historyCursors"`               //账户历史补扫游标
+	BackfillJobs       []*BackfillJob             `json:"backfillJobs,omitempty"`       //区块区间补扫任务
+	DeadLetters        []*UnscanRetryState        `json:"deadLetters,omitempty"`        //多次重试失败、不再自动重试的未扫记录
+	UnroutableDeposits []*UnroutableDeposit       `json:"unroutableDeposits,omitempty"` //无法按备注路由的充值
+}
+
+//ScannerStateDAI 快照恢复的数据访问接口，在同一事务中写入未扫记录、本地区块、死信、无法路由的充值和已扫区块头
+//注入的BlockchainDAI未实现该接口时逐项写入，已扫区块头最后写入
+type ScannerStateDAI interface {
+	DeadLetterDAI
+	UnroutableDepositDAI
+	RestoreScannerState(snapshot *ScannerSnapshot) error
+}
+
+//scannerSnapshotFile 快照文件，Checksum为Payload的sha256
+type scannerSnapshotFile struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+func snapshotChecksum(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+//Snapshot 收集扫描器当前状态
+func (bs *PIABlockScanner) Snapshot() (*ScannerSnapshot, error) {
+
+	dai, err := bs.blockchainDAI()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &ScannerSnapshot{
+		Symbol:         bs.wm.Symbol(),
+		ChainID:        bs.wm.Config.ChainId,
+		CreateTime:     time.Now().Unix(),
+		Blocks:         make([]*openwallet.BlockHeader, 0),
+		OutboxRecords:  make([]*OutboxRecord, 0),
+		HistoryCursors: make([]*AccountHistoryCursor, 0),
+	}
+
+	snapshot.UnscanRecords, err = dai.GetUnscanRecords(bs.wm.Symbol())
+	if err != nil {
+		return nil, fmt.Errorf("get unscan records failed, err: %v", err)
+	}
+
+	head, err := dai.GetCurrentBlockHead(bs.wm.Symbol())
+	if err == nil && head != nil && head.Height > 0 {
+		snapshot.CurrentBlock = head
+
+		from := uint64(1)
+		if depth := bs.maxReorgDepth(); head.Height > depth {
+			from = head.Height - depth
+		}
+		for height := from; height <= head.Height; height++ {
+			block, err := dai.GetLocalBlockHeadByHeight(height, bs.wm.Symbol())
+			if err != nil || block == nil {
+				continue
+			}
+			snapshot.Blocks = append(snapshot.Blocks, block)
+		}
+	}
+
+	//未开启待投递队列时，补扫写入的记录和直接通知的已确认记录也保存在待投递数据库
+	records, deliveries, err := bs.outboxState()
+	if err != nil {
+		return nil, fmt.Errorf("get outbox records failed, err: %v", err)
+	}
+	if records != nil {
+		snapshot.OutboxRecords = records
+	}
+	snapshot.OutboxDeliveries = deliveries
+
+	snapshot.HistoryCursors, err = bs.accountHistoryState()
+	if err != nil {
+		return nil, fmt.Errorf("get account history cursors failed, err: %v", err)
+	}
+
+	snapshot.BackfillJobs, err = bs.backfillState()
+	if err != nil {
+		return nil, fmt.Errorf("get backfill jobs failed, err: %v", err)
+	}
+
+	deadLetterDAI, err := bs.deadLetterDAI()
+	if err != nil {
+		return nil, err
+	}
+	snapshot.DeadLetters, err = deadLetterDAI.GetDeadLetters(bs.wm.Symbol())
+	if err != nil {
+		return nil, fmt.Errorf("get dead letters failed, err: %v", err)
+	}
+
+	snapshot.UnroutableDeposits, err = bs.GetUnroutableDeposits()
+	if err != nil {
+		return nil, fmt.Errorf("get unroutable deposits failed, err: %v", err)
+	}
+
+	return snapshot, nil
+}
+
+//ExportSnapshot 导出扫描器状态快照
+func (bs *PIABlockScanner) ExportSnapshot(w io.Writer) error {
+
+	snapshot, err := bs.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(&scannerSnapshotFile{
+		Version:  scannerSnapshotVersion,
+		Checksum: snapshotChecksum(payload),
+		Payload:  payload,
+	})
+}
+
+//ExportSnapshotFile 导出扫描器状态快照到文件，写入完成后才替换已有文件
+func (bs *PIABlockScanner) ExportSnapshotFile(path string) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = bs.ExportSnapshot(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+//ReadSnapshot 读取并校验快照文件
+func ReadSnapshot(r io.Reader) (*ScannerSnapshot, error) {
+
+	var file scannerSnapshotFile
+	err := json.NewDecoder(r).Decode(&file)
+	if err != nil {
+		return nil, fmt.Errorf("decode snapshot failed, err: %v", err)
+	}
+
+	if file.Version != scannerSnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version: %d", file.Version)
+	}
+
+	if snapshotChecksum(file.Payload) != file.Checksum {
+		return nil, fmt.Errorf("snapshot checksum mismatch")
+	}
+
+	var snapshot ScannerSnapshot
+	err = json.Unmarshal(file.Payload, &snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("decode snapshot payload failed, err: %v", err)
+	}
+	return &snapshot, nil
+}
+
+//ImportSnapshot 从快照恢复扫描器状态，扫描器需处于停止状态
+// 快照的币种或链ID与当前配置不一致时拒绝导入
+func (bs *PIABlockScanner) ImportSnapshot(r io.Reader) error {
+
+	snapshot, err := ReadSnapshot(r)
+	if err != nil {
+		return err
+	}
+
+	return bs.RestoreSnapshot(snapshot)
+}
+
+//ImportSnapshotFile 从快照文件恢复扫描器状态
+func (bs *PIABlockScanner) ImportSnapshotFile(path string) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return bs.ImportSnapshot(f)
+}
+
+//validateSnapshot 检查快照内容，任何一项不合法时不写入
+func (bs *PIABlockScanner) validateSnapshot(snapshot *ScannerSnapshot) error {
+
+	if snapshot == nil {
+		return fmt.Errorf("snapshot is nil")
+	}
+
+	symbol := bs.wm.Symbol()
+	if snapshot.Symbol != symbol {
+		return fmt.Errorf("snapshot symbol %s does not match %s", snapshot.Symbol, symbol)
+	}
+
+	if snapshot.ChainID != bs.wm.Config.ChainId {
+		return fmt.Errorf("snapshot chain ID %s does not match configured chain ID %s", snapshot.ChainID, bs.wm.Config.ChainId)
+	}
+
+	if head := snapshot.CurrentBlock; head != nil {
+		if head.Symbol != symbol || head.Height == 0 || head.Hash == "" {
+			return fmt.Errorf("snapshot current block %d is invalid", head.Height)
+		}
+	}
+
+	for _, block := range snapshot.Blocks {
+		if block == nil || block.Symbol != symbol || block.Height == 0 || block.Hash == "" {
+			return fmt.Errorf("snapshot contains an invalid local block")
+		}
+		if snapshot.CurrentBlock != nil && block.Height > snapshot.CurrentBlock.Height {
+			return fmt.Errorf("snapshot local block %d is above current block %d", block.Height, snapshot.CurrentBlock.Height)
+		}
+	}
+
+	for _, record := range snapshot.UnscanRecords {
+		if record == nil || record.ID == "" || record.Symbol != symbol {
+			return fmt.Errorf("snapshot contains an invalid unscan record")
+		}
+	}
+
+	for _, record := range snapshot.OutboxRecords {
+		if record == nil || record.Data == nil || record.ID != outboxRecordID(record.ObserverKey, record.SourceKey, record.WxID) {
+			return fmt.Errorf("snapshot contains an invalid outbox record")
+		}
+	}
+
+	for _, delivery := range snapshot.OutboxDeliveries {
+		if delivery == nil || delivery.ID == "" {
+			return fmt.Errorf("snapshot contains an invalid outbox delivery")
+		}
+	}
+
+	for _, cursor := range snapshot.HistoryCursors {
+		if cursor == nil || cursor.Symbol != symbol || cursor.ID != accountHistoryCursorID(symbol, cursor.Account) {
+			return fmt.Errorf("snapshot contains an invalid account history cursor")
+		}
+	}
+
+	for _, job := range snapshot.BackfillJobs {
+		if job == nil || job.ID == "" || job.Symbol != symbol || job.From == 0 || job.From > job.To {
+			return fmt.Errorf("snapshot contains an invalid backfill job")
+		}
+	}
+
+	for _, state := range snapshot.DeadLetters {
+		if state == nil || state.Record == nil || state.Record.ID == "" {
+			return fmt.Errorf("snapshot contains an invalid dead letter")
+		}
+	}
+
+	for _, deposit := range snapshot.UnroutableDeposits {
+		if deposit == nil || deposit.ID == "" {
+			return fmt.Errorf("snapshot contains an invalid unroutable deposit")
+		}
+	}
+
+	return nil
+}
+
+//RestoreSnapshot 检查全部内容后写入快照中的状态
+//待投递记录、账户历史游标和补扫任务保存在各自的数据库，先写入；区块链数据访问接口实现ScannerStateDAI时，
+//其余状态在同一事务中写入，否则逐项写入，已扫区块头最后写入
+func (bs *PIABlockScanner) RestoreSnapshot(snapshot *ScannerSnapshot) error {
+
+	if err := bs.validateSnapshot(snapshot); err != nil {
+		return err
+	}
+
+	if bs.isRunning() {
+		return fmt.Errorf("block scanner is running, stop it before importing snapshot")
+	}
+
+	dai, err := bs.blockchainDAI()
+	if err != nil {
+		return err
+	}
+
+	if len(snapshot.OutboxRecords) > 0 || len(snapshot.OutboxDeliveries) > 0 {
+		if err := bs.restoreOutbox(snapshot.OutboxRecords, snapshot.OutboxDeliveries); err != nil {
+			return fmt.Errorf("save outbox records failed, err: %v", err)
+		}
+	}
+
+	if len(snapshot.HistoryCursors) > 0 {
+		if err := bs.restoreAccountHistory(snapshot.HistoryCursors); err != nil {
+			return err
+		}
+	}
+
+	if len(snapshot.BackfillJobs) > 0 {
+		if err := bs.restoreBackfills(snapshot.BackfillJobs); err != nil {
+			return err
+		}
+	}
+
+	if stateDAI, ok := dai.(ScannerStateDAI); ok {
+		err = stateDAI.RestoreScannerState(snapshot)
+	} else {
+		err = bs.restoreScannerState(dai, snapshot)
+	}
+	if err != nil {
+		return err
+	}
+
+	var height uint64
+	if snapshot.CurrentBlock != nil {
+		height = snapshot.CurrentBlock.Height
+	}
+
+	bs.wm.Log.Std.Info("scanner snapshot restored, current height: %d, unscan records: %d, outbox records: %d, dead letters: %d",
+		height, len(snapshot.UnscanRecords), len(snapshot.OutboxRecords), len(snapshot.DeadLetters))
+	return nil
+}
+
+//restoreScannerState 逐项写入未扫记录、本地区块、死信和无法路由的充值，已扫区块头最后写入
+func (bs *PIABlockScanner) restoreScannerState(dai openwallet.BlockchainDAI, snapshot *ScannerSnapshot) error {
+
+	for _, record := range snapshot.UnscanRecords {
+		if err := dai.SaveUnscanRecord(record); err != nil {
+			return fmt.Errorf("save unscan record %s failed, err: %v", record.ID, err)
+		}
+	}
+
+	for _, block := range snapshot.Blocks {
+		if err := dai.SaveLocalBlockHead(block); err != nil {
+			return fmt.Errorf("save local block %d failed, err: %v", block.Height, err)
+		}
+	}
+
+	if len(snapshot.DeadLetters) > 0 {
+		deadLetterDAI, err := bs.deadLetterDAI()
+		if err != nil {
+			return err
+		}
+		for _, state := range snapshot.DeadLetters {
+			if err := deadLetterDAI.SaveDeadLetter(state, snapshot.Symbol); err != nil {
+				return fmt.Errorf("save dead letter %s failed, err: %v", state.Record.ID, err)
+			}
+		}
+	}
+
+	if len(snapshot.UnroutableDeposits) > 0 {
+		depositDAI, err := bs.unroutableDepositDAI()
+		if err != nil {
+			return err
+		}
+		for _, deposit := range snapshot.UnroutableDeposits {
+			if err := depositDAI.SaveUnroutableDeposit(deposit, snapshot.Symbol); err != nil {
+				return fmt.Errorf("save unroutable deposit %s failed, err: %v", deposit.ID, err)
+			}
+		}
+	}
+
+	if snapshot.CurrentBlock != nil {
+		if err := dai.SaveCurrentBlockHead(snapshot.CurrentBlock); err != nil {
+			return fmt.Errorf("save current block head failed, err: %v", err)
+		}
+	}
+	return nil
+}
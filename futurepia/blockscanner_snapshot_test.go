@@ -0,0 +1,214 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestScannerSnapshot(t *testing.T) {
+	node := newFakeNode(t, 30)
+	node.addTransfer(25, "alice", "bob", "1.00000000 PIA", "")
+
+	wm, _, _ := testOutboxWalletManager(t, node, 100)
+	node.setLocalHead(wm, 20)
+	bs := wm.Blockscanner
+	bs.SaveUnscanRecord(openwallet.NewUnscanRecord(5, "", "timeout", wm.Symbol()))
+	if err := bs.SetAccountHistoryCursor("bob", 7); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	deadLetterDAI, err := bs.deadLetterDAI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetterDAI.SaveDeadLetter(&UnscanRetryState{Record: openwallet.NewUnscanRecord(3, "", "timeout", wm.Symbol()), Attempts: 10}, wm.Symbol())
+	bs.saveUnroutableDeposit(&UnroutableDeposit{ID: unroutableDepositID("tx9", 0), TxID: "tx9", BlockHeight: 9, Alias: "bob"})
+	bs.setScanning(true)
+	bs.ScanBlockTask()
+
+	path := filepath.Join(wm.Config.dbPath, "snapshot.json")
+	if err := bs.ExportSnapshotFile(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wm2, dai2, _ := testOutboxWalletManager(t, node, 0)
+	bs2 := wm2.Blockscanner
+	if err := bs2.ImportSnapshotFile(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if height, hash, err := bs2.GetLocalBlockHead(); err != nil || height != 29 || hash != node.blockHash(29) {
+		t.Errorf("unexpected head: %d %s, err: %v", height, hash, err)
+	}
+	if block, err := bs2.GetLocalBlock(21); err != nil || block.Hash != node.blockHash(21) {
+		t.Errorf("unexpected local block: %+v, err: %v", block, err)
+	}
+	if records, _ := dai2.GetUnscanRecords(wm2.Symbol()); len(records) != 1 || records[0].BlockHeight != 5 {
+		t.Errorf("unexpected unscan records: %+v", records)
+	}
+	if records, _ := bs2.GetOutboxRecords(); len(records) != 1 || records[0].BlockHeight != 25 {
+		t.Errorf("unexpected outbox records: %+v", records)
+	}
+	if cursor, _ := bs2.GetAccountHistoryCursor("bob"); cursor.Sequence != 7 {
+		t.Errorf("unexpected history cursor: %+v", cursor)
+	}
+	if states := bs2.GetDeadLetterRecords(); len(states) != 1 || states[0].Record.BlockHeight != 3 || states[0].Attempts != 10 {
+		t.Errorf("unexpected dead letters: %+v", states)
+	}
+	if deposits, _ := bs2.GetUnroutableDeposits(); len(deposits) != 1 || deposits[0].TxID != "tx9" {
+		t.Errorf("unexpected unroutable deposits: %+v", deposits)
+	}
+
+	//导入的本地区块用于分叉检测
+	node.reorg(28, "fork")
+	node.addBlocks(1)
+	bs2.setScanning(true)
+	bs2.ScanBlockTask()
+	if metrics := bs2.Metrics(); metrics.ForksDetected != 1 {
+		t.Errorf("expected fork detected from imported blocks, got %+v", metrics)
+	}
+}
+
+func TestScannerSnapshotRejected(t *testing.T) {
+	node := newFakeNode(t, 20)
+	wm, _, _ := testScanWalletManager(t, node)
+	node.setLocalHead(wm, 15)
+
+	var buf bytes.Buffer
+	if err := wm.Blockscanner.ExportSnapshot(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data := buf.Bytes()
+
+	//导出快照不创建账户历史数据库
+	if _, err := os.Stat(filepath.Join(wm.Config.dbPath, accountHistoryFile)); !os.IsNotExist(err) {
+		t.Errorf("expected account history db not created, err: %v", err)
+	}
+
+	var file scannerSnapshotFile
+	json.Unmarshal(data, &file)
+
+	//内容被修改
+	tampered := bytes.Replace(data, []byte(`"height":15`), []byte(`"height":16`), 1)
+	if bytes.Equal(tampered, data) {
+		t.Fatalf("expected snapshot content changed")
+	}
+
+	//不支持的版本
+	file.Version = scannerSnapshotVersion + 1
+	unsupported, _ := json.Marshal(&file)
+
+	target, dai, _ := testScanWalletManager(t, node)
+	for name, input := range map[string][]byte{"tampered": tampered, "version": unsupported, "garbage": []byte("{")} {
+		if err := target.Blockscanner.ImportSnapshot(bytes.NewReader(input)); err == nil {
+			t.Errorf("expected %s snapshot rejected", name)
+		}
+	}
+
+	//链ID不一致
+	target.Config.ChainId = strings.Repeat("1", 64)
+	err := target.Blockscanner.ImportSnapshot(bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), "chain ID") {
+		t.Errorf("expected chain ID mismatch, got %v", err)
+	}
+	if _, err := dai.GetCurrentBlockHead(target.Symbol()); err == nil {
+		t.Errorf("expected nothing imported")
+	}
+
+	//扫描中不允许导入
+	target.Config.ChainId = wm.Config.ChainId
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target.Config.dbPath = dir
+	if err := target.Blockscanner.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = target.Blockscanner.ImportSnapshot(bytes.NewReader(data))
+	target.Blockscanner.Stop()
+	if err == nil {
+		t.Errorf("expected import refused while running")
+	}
+
+	if err := target.Blockscanner.ImportSnapshot(bytes.NewReader(data)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if height := target.Blockscanner.GetScannedBlockHeight(); height < 15 {
+		t.Errorf("unexpected height after import: %d", height)
+	}
+}
+
+func TestScannerSnapshotValidated(t *testing.T) {
+	node := newFakeNode(t, 20)
+	wm, _, _ := testScanWalletManager(t, node)
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(nil)
+	defer bs.closeLocalBlockchain()
+	node.setLocalHead(wm, 15)
+
+	snapshot, err := bs.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	snapshot.CurrentBlock = &openwallet.BlockHeader{Height: 18, Hash: node.blockHash(18), Symbol: wm.Symbol()}
+	snapshot.Blocks = []*openwallet.BlockHeader{{Height: 18, Hash: node.blockHash(18), Symbol: wm.Symbol()}}
+	snapshot.HistoryCursors = []*AccountHistoryCursor{{ID: accountHistoryCursorID(wm.Symbol(), "bob"), Symbol: wm.Symbol(), Account: "bob", Sequence: 7}}
+	snapshot.DeadLetters = []*UnscanRetryState{{Record: openwallet.NewUnscanRecord(3, "", "timeout", wm.Symbol())}}
+	snapshot.UnroutableDeposits = []*UnroutableDeposit{{ID: unroutableDepositID("tx9", 0), TxID: "tx9"}}
+
+	//任何一项不合法时不写入
+	invalid := *snapshot
+	invalid.DeadLetters = []*UnscanRetryState{{}}
+	if err := bs.RestoreSnapshot(&invalid); err == nil {
+		t.Fatalf("expected invalid dead letter rejected")
+	}
+	if height := bs.GetScannedBlockHeight(); height != 15 {
+		t.Errorf("expected head unchanged, got %d", height)
+	}
+	if _, err := os.Stat(filepath.Join(wm.Config.dbPath, accountHistoryFile)); !os.IsNotExist(err) {
+		t.Errorf("expected account history not written, err: %v", err)
+	}
+	if err := bs.RestoreSnapshot(nil); err == nil {
+		t.Errorf("expected nil snapshot rejected")
+	}
+
+	//本地数据库在同一事务中写入
+	if err := bs.RestoreSnapshot(snapshot); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if height := bs.GetScannedBlockHeight(); height != 18 {
+		t.Errorf("unexpected head: %d", height)
+	}
+	if block, err := bs.GetLocalBlock(18); err != nil || block.Hash != node.blockHash(18) {
+		t.Errorf("unexpected local block: %+v, err: %v", block, err)
+	}
+	if states := bs.GetDeadLetterRecords(); len(states) != 1 || states[0].Record.BlockHeight != 3 {
+		t.Errorf("unexpected dead letters: %+v", states)
+	}
+	if deposits, _ := bs.GetUnroutableDeposits(); len(deposits) != 1 {
+		t.Errorf("unexpected unroutable deposits: %+v", deposits)
+	}
+}
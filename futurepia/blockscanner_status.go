@@ -0,0 +1,264 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	defaultStatusHost           = "127.0.0.1"     //状态服务默认只监听本机
+	statusServerShutdownTimeout = 5 * time.Second //状态服务关闭等待时间
+)
+
+//ScannerStatus 扫描器运行状态快照
+type ScannerStatus struct {
+	Symbol              string  `json:"symbol"`
+	Running             bool    `json:"running"`             //扫描任务已启动
+	Paused              bool    `json:"paused"`              //扫描任务已暂停
+	Halted              bool    `json:"halted"`              //分叉深度超限被挂起，需要人工恢复
+	LocalHeight         uint64  `json:"localHeight"`         //本地已扫高度
+	LocalHash           string  `json:"localHash"`           //本地已扫区块hash
+	ChainHeight         uint64  `json:"chainHeight"`         //链上最新高度
+	IrreversibleHeight  uint64  `json:"irreversibleHeight"`  //链上最新不可逆高度
+	ScanLimitHeight     uint64  `json:"scanLimitHeight"`     //当前模式下允许扫描的最高高度
+	Lag                 uint64  `json:"lag"`                 //距离允许扫描的最高高度的区块数
+	ChainError          string  `json:"chainError"`          //获取链上状态失败的原因
+	BlocksScanned       uint64  `json:"blocksScanned"`       //已完成提取的区块数
+	BlocksPerSecond     float64 `json:"blocksPerSecond"`     //扫描速度
+	ForkCount           uint64  `json:"forkCount"`           //发现分叉次数
+	LastError           string  `json:"lastError"`           //最近一次扫描错误
+	LastErrorHeight     uint64  `json:"lastErrorHeight"`     //最近一次扫描错误的区块高度
+	LastErrorTime       int64   `json:"lastErrorTime"`       //最近一次扫描错误的时间
+	UnscanRecords       int     `json:"unscanRecords"`       //未扫记录数
+	DeadLetters         int     `json:"deadLetters"`         //转入死信列表的未扫记录数
+	ObserverBacklog     int     `json:"observerBacklog"`     //等待通知观测者的区块和提取记录数
+	PendingTransactions int     `json:"pendingTransactions"` //跟踪中的已广播未确认交易数
+	Time                int64   `json:"time"`
+}
+
+//scanErrorLog 最近一次扫描错误
+type scanErrorLog struct {
+	mu     sync.Mutex
+	err    string
+	height uint64
+	time   int64
+}
+
+//statusServer 状态查询HTTP服务
+type statusServer struct {
+	mu       sync.Mutex
+	server   *http.Server
+	listener net.Listener
+	done     chan struct{}
+}
+
+func newStatusServer() *statusServer {
+	return &statusServer{}
+}
+
+//recordScanError 记录扫描错误，用于状态查询
+func (bs *PIABlockScanner) recordScanError(height uint64, err error) {
+	if err == nil {
+		return
+	}
+	bs.scanErrors.mu.Lock()
+	defer bs.scanErrors.mu.Unlock()
+	bs.scanErrors.err = err.Error()
+	bs.scanErrors.height = height
+	bs.scanErrors.time = time.Now().Unix()
+}
+
+//ScannerStatus 获取扫描器运行状态，节点不可用时链上状态为空，原因记录在ChainError
+func (bs *PIABlockScanner) ScannerStatus() *ScannerStatus {
+
+	metrics := bs.Metrics()
+	status := &ScannerStatus{
+		Symbol:              bs.wm.Symbol(),
+		BlocksScanned:       metrics.BlocksScanned,
+		BlocksPerSecond:     metrics.BlocksPerSecond,
+		ForkCount:           metrics.ForksDetected,
+		PendingTransactions: len(bs.GetPendingTransactions()),
+		Time:                time.Now().Unix(),
+	}
+
+	lc := bs.lifecycle
+	lc.mu.Lock()
+	status.Running = lc.quit != nil
+	status.Paused = status.Running && lc.paused
+	status.Halted = lc.halted
+	lc.mu.Unlock()
+
+	bs.scanErrors.mu.Lock()
+	status.LastError = bs.scanErrors.err
+	status.LastErrorHeight = bs.scanErrors.height
+	status.LastErrorTime = bs.scanErrors.time
+	bs.scanErrors.mu.Unlock()
+
+	//状态查询不打开数据库，本地数据库未打开时本地状态为空
+	if dai := bs.statusBlockchainDAI(); dai != nil {
+		if header, err := dai.GetCurrentBlockHead(bs.wm.Symbol()); err == nil {
+			status.LocalHeight = header.Height
+			status.LocalHash = header.Hash
+		}
+		if records, err := dai.GetUnscanRecords(bs.wm.Symbol()); err == nil {
+			status.UnscanRecords = len(records)
+		}
+	}
+	if dai := bs.statusDeadLetterDAI(); dai != nil {
+		if states, err := dai.GetDeadLetters(bs.wm.Symbol()); err == nil {
+			status.DeadLetters = len(states)
+		}
+	}
+
+	status.ObserverBacklog = bs.notifier.backlog()
+	if bs.wm.Config.OutboxEnabled {
+		status.ObserverBacklog += bs.outboxPending()
+	}
+
+	head, err := bs.wm.Api.GetDynamicGlobal()
+	if err != nil {
+		status.ChainError = err.Error()
+		return status
+	}
+	status.ChainHeight = uint64(head.Height)
+	status.IrreversibleHeight = uint64(head.LastIrreversible)
+	status.ScanLimitHeight = bs.scanLimitHeight(head)
+	if status.ScanLimitHeight > status.LocalHeight {
+		status.Lag = status.ScanLimitHeight - status.LocalHeight
+	}
+
+	return status
+}
+
+//openedLocalBlockchainDAI 已打开的本地数据库，未打开时返回nil
+func (bs *PIABlockScanner) openedLocalBlockchainDAI() *LocalBlockchainDAI {
+	bs.local.mu.Lock()
+	defer bs.local.mu.Unlock()
+	return bs.local.dai
+}
+
+//statusBlockchainDAI 状态查询使用的数据访问接口，未注入且本地数据库未打开时返回nil
+func (bs *PIABlockScanner) statusBlockchainDAI() openwallet.BlockchainDAI {
+	if bs.BlockchainDAI != nil {
+		return bs.BlockchainDAI
+	}
+	if local := bs.openedLocalBlockchainDAI(); local != nil {
+		return local
+	}
+	return nil
+}
+
+//statusDeadLetterDAI 状态查询使用的死信数据访问接口，规则同statusBlockchainDAI
+func (bs *PIABlockScanner) statusDeadLetterDAI() DeadLetterDAI {
+	if dai, ok := bs.BlockchainDAI.(DeadLetterDAI); ok {
+		return dai
+	}
+	if local := bs.openedLocalBlockchainDAI(); local != nil {
+		return local
+	}
+	return nil
+}
+
+//StatusHandler 以JSON返回扫描器运行状态的HTTP处理器
+func (bs *PIABlockScanner) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bs.ScannerStatus())
+	})
+}
+
+//StatusAddr 状态服务实际监听的地址，未启动时为空
+func (bs *PIABlockScanner) StatusAddr() string {
+	bs.status.mu.Lock()
+	defer bs.status.mu.Unlock()
+	if bs.status.listener == nil {
+		return ""
+	}
+	return bs.status.listener.Addr().String()
+}
+
+//startStatusServer 按配置启动状态服务，端口为0时不启动
+func (bs *PIABlockScanner) startStatusServer() error {
+
+	if bs.wm.Config.StatusPort <= 0 {
+		return nil
+	}
+
+	s := bs.status
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server != nil {
+		return nil
+	}
+
+	addr := fmt.Sprintf("%s:%d", bs.wm.Config.StatusHost, bs.wm.Config.StatusPort)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("status server listen on %s failed, err: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/status", bs.StatusHandler())
+
+	s.server = &http.Server{Handler: mux}
+	s.listener = listener
+	s.done = make(chan struct{})
+
+	go func(server *http.Server, done chan struct{}) {
+		defer close(done)
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			bs.wm.Log.Std.Error("status server stopped, unexpected error: %v", err)
+		}
+	}(s.server, s.done)
+
+	bs.wm.Log.Std.Info("scanner status server is listening on %s", listener.Addr().String())
+	return nil
+}
+
+//stopStatusServer 关闭状态服务
+func (bs *PIABlockScanner) stopStatusServer() {
+	s := bs.status
+	s.mu.Lock()
+	server, done := s.server, s.done
+	s.server, s.listener, s.done = nil, nil, nil
+	s.mu.Unlock()
+
+	if server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusServerShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		server.Close()
+	}
+	<-done
+}
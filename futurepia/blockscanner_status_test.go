@@ -0,0 +1,174 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestScannerStatus(t *testing.T) {
+	node := newFakeNode(t, 40)
+	node.irreversible = 30
+
+	wm, dai, _ := testScanWalletManager(t, node, "bob")
+	node.setLocalHead(wm, 10)
+	bs := wm.Blockscanner
+
+	bs.setScanning(true)
+	bs.ScanBlockTask()
+	dai.SaveUnscanRecord(openwallet.NewUnscanRecord(25, "", "rpc timeout", wm.Symbol()))
+	bs.recordScanError(25, fmt.Errorf("extract failed"))
+	node.addBlocks(5)
+
+	status := bs.ScannerStatus()
+	if status.Running || status.Paused {
+		t.Errorf("expected scanner not running, got %+v", status)
+	}
+	if status.LocalHeight != 39 || status.ChainHeight != 45 || status.IrreversibleHeight != 30 {
+		t.Errorf("unexpected heights: %+v", status)
+	}
+	if status.ScanLimitHeight != 44 || status.Lag != 5 {
+		t.Errorf("unexpected lag: %+v", status)
+	}
+	if status.BlocksScanned != 29 || status.UnscanRecords != 1 {
+		t.Errorf("unexpected counters: %+v", status)
+	}
+	if status.LastError != "extract failed" || status.LastErrorHeight != 25 || status.LastErrorTime == 0 {
+		t.Errorf("unexpected last error: %+v", status)
+	}
+
+	//节点不可用时仍返回本地状态
+	node.server.Close()
+	status = bs.ScannerStatus()
+	if status.ChainError == "" || status.LocalHeight != 39 || status.ChainHeight != 0 {
+		t.Errorf("unexpected status without node: %+v", status)
+	}
+}
+
+func TestScannerStatusHandler(t *testing.T) {
+	node := newFakeNode(t, 20)
+	wm, _, _ := testScanWalletManager(t, node)
+	node.setLocalHead(wm, 19)
+	bs := wm.Blockscanner
+
+	server := httptest.NewServer(bs.StatusHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+	var status ScannerStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.Symbol != wm.Symbol() || status.LocalHeight != 19 || status.ChainHeight != 20 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	resp, err = http.Post(server.URL, "application/json", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestScannerStatusServer(t *testing.T) {
+	node := newFakeNode(t, 20)
+	wm, dai, _ := testScanWalletManager(t, node)
+	node.setLocalHead(wm, 10)
+	bs := wm.Blockscanner
+	bs.PeriodOfTask = 20 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wm.Config.StatusPort = listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	if err := bs.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitLocalHead(t, dai, wm.Symbol(), 19)
+
+	url := "http://" + bs.StatusAddr() + "/status"
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var status ScannerStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !status.Running || status.LocalHeight != 19 || status.Lag != 0 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	if err := bs.Stop(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bs.StatusAddr() != "" {
+		t.Errorf("expected status server to be stopped")
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Errorf("expected status endpoint to be closed")
+	}
+}
+
+func TestScannerStatusDoesNotOpenDB(t *testing.T) {
+	node := newFakeNode(t, 20)
+	node.addTransfer(12, "alice", "bob", "1.00000000 PIA", "")
+
+	wm, _, _ := testOutboxWalletManager(t, node, 1)
+	bs := wm.Blockscanner
+	bs.ScanBlock(12)
+	bs.FlushBlockNotify(context.Background())
+	bs.stopOutbox()
+
+	//停止后状态查询使用缓存的待投递记录数，不重新打开数据库
+	status := bs.ScannerStatus()
+	if status.ObserverBacklog != 1 {
+		t.Errorf("expected observer backlog 1, got %d", status.ObserverBacklog)
+	}
+	bs.outbox.mu.Lock()
+	reopened := bs.outbox.db != nil
+	bs.outbox.mu.Unlock()
+	if reopened {
+		t.Errorf("status reopened the outbox db")
+	}
+	if bs.openedLocalBlockchainDAI() != nil {
+		t.Errorf("status opened the local blockchain db")
+	}
+}
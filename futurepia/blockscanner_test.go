@@ -16,6 +16,8 @@
 package futurepia
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -23,8 +25,16 @@ import (
 func TestScanBlockTask(t *testing.T) {
 	wm := NewWalletManager()
 	wm.Config.ServerAPI = "https://node1.zbeos.com"
+	//本地数据库写入临时目录
+	dir, err := ioutil.TempDir("", "futurepia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wm.Config.dbPath = dir
+	defer wm.Blockscanner.CloseBlockScanner()
 	//wm.Api = eos.New(wm.Config.ServerAPI)
-	wm.Blockscanner.Scanning = true
+	wm.Blockscanner.setScanning(true)
 	wm.Blockscanner.ScanBlockTask()
 }
 
@@ -16,48 +16,259 @@
 package futurepia
 
 import (
+	"container/list"
 	"sync"
 	"time"
 
 	"github.com/blocktree/openwallet/v2/openwallet"
 )
 
+const (
+	defaultCacheMaxEntries      = 10000            //默认最多缓存条目数
+	defaultCacheJanitorInterval = 30 * time.Second //默认过期清理间隔
+	defaultCacheAccountTTL      = 3 * time.Second  //默认账户信息缓存时间
+	defaultCacheBlockTTL        = 10 * time.Minute //默认不可逆区块缓存时间
+	defaultCachePropertiesTTL   = 1 * time.Second  //默认链全局属性缓存时间
+)
+
+//CacheStats 缓存命中统计
+type CacheStats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`   //超出容量被淘汰的条目数
+	Expirations uint64 `json:"expirations"` //过期被清理的条目数
+	Entries     int    `json:"entries"`     //当前条目数
+}
+
+//CacheManager 带过期时间和LRU容量限制的缓存，实现openwallet.ICacheManager
+//复制的值共享同一份缓存数据，不再使用时调用Close停止后台清理
 type CacheManager struct {
-	bucket map[string]interface{}
-	mutex  *sync.RWMutex
+	*cacheStore
 }
 
+//cacheStore 缓存数据，后台清理协程只引用它，调用Close后清理协程退出
+type cacheStore struct {
+	mutex      sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List //队首为最近使用
+	stats      CacheStats
+	janitor    chan struct{}
+}
+
+//NewCacheManager 创建默认容量的缓存
 func NewCacheManager() CacheManager {
-	cm := CacheManager{
-		bucket: make(map[string]interface{}),
-		mutex:  new(sync.RWMutex),
+	return NewCacheManagerWithSize(defaultCacheMaxEntries)
+}
+
+//NewCacheManagerWithSize 创建缓存，maxEntries为最多条目数，<=0时使用默认值
+func NewCacheManagerWithSize(maxEntries int) CacheManager {
+	return NewCacheManagerWithJanitor(maxEntries, defaultCacheJanitorInterval)
+}
+
+//NewCacheManagerWithJanitor 创建缓存，每隔interval在后台清理过期条目，interval<=0时只在访问时清理
+func NewCacheManagerWithJanitor(maxEntries int, interval time.Duration) CacheManager {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheMaxEntries
+	}
+	store := &cacheStore{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+
+	if interval > 0 {
+		store.janitor = make(chan struct{})
+		go store.runJanitor(interval, store.janitor)
+	}
+	return CacheManager{store}
+}
+
+//Close 停止后台清理，之后过期条目只在访问时清理，可重复调用
+func (cs *cacheStore) Close() {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.janitor != nil {
+		close(cs.janitor)
+		cs.janitor = nil
+	}
+}
+
+func (cs *cacheStore) runJanitor(interval time.Duration, quit chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			cs.DeleteExpired()
+		}
 	}
-	return cm
 }
 
-func (cm *CacheManager) Add(key string, value interface{}, duration time.Duration) error {
-	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
-	cm.bucket[key] = value
+//cacheEntryExpired 条目是否已过期，Expiration为0时永不过期
+func cacheEntryExpired(entry *openwallet.CacheEntry, now int64) bool {
+	return entry.Expiration > 0 && now > entry.Expiration
+}
+
+//Add 添加缓存，duration<=0时永不过期，超出容量时淘汰最久未使用的条目
+func (cs *cacheStore) Add(key string, value interface{}, duration time.Duration) error {
+	var expiration int64
+	if duration > 0 {
+		expiration = time.Now().Add(duration).UnixNano()
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if elem, ok := cs.entries[key]; ok {
+		entry := elem.Value.(*openwallet.CacheEntry)
+		entry.Value = value
+		entry.Expiration = expiration
+		cs.lru.MoveToFront(elem)
+		return nil
+	}
+
+	entry := &openwallet.CacheEntry{Key: key, Value: value, Expiration: expiration}
+	cs.entries[key] = cs.lru.PushFront(entry)
+
+	for cs.lru.Len() > cs.maxEntries {
+		cs.removeElementLocked(cs.lru.Back())
+		cs.stats.Evictions++
+	}
 	return nil
 }
-func (cm *CacheManager) Get(key string) (interface{}, bool) {
-	cm.mutex.RLock()
-	defer cm.mutex.RUnlock()
 
-	value := cm.bucket[key]
-	if value == nil {
+//getLocked 获取未过期的条目并标记为最近使用，过期的条目被删除
+func (cs *cacheStore) getLocked(key string) (*openwallet.CacheEntry, bool) {
+	elem, ok := cs.entries[key]
+	if !ok {
+		cs.stats.Misses++
+		return nil, false
+	}
+	entry := elem.Value.(*openwallet.CacheEntry)
+	if cacheEntryExpired(entry, time.Now().UnixNano()) {
+		cs.removeElementLocked(elem)
+		cs.stats.Expirations++
+		cs.stats.Misses++
+		return nil, false
+	}
+	cs.lru.MoveToFront(elem)
+	cs.stats.Hits++
+	return entry, true
+}
+
+//Get 获取缓存值
+func (cs *cacheStore) Get(key string) (interface{}, bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	entry, ok := cs.getLocked(key)
+	if !ok {
+		return nil, false
+	}
+	return entry.Value, true
+}
+
+//GetCacheEntry 获取缓存条目的副本
+func (cs *cacheStore) GetCacheEntry(key string) (*openwallet.CacheEntry, bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	entry, ok := cs.getLocked(key)
+	if !ok {
 		return nil, false
 	}
-	return value, true
+	clone := *entry
+	return &clone, true
+}
+
+//Remove 删除缓存，返回删除前的值
+func (cs *cacheStore) Remove(key string) (interface{}, bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	elem, ok := cs.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := cs.removeElementLocked(elem)
+	if cacheEntryExpired(entry, time.Now().UnixNano()) {
+		cs.stats.Expirations++
+		return nil, false
+	}
+	return entry.Value, true
+}
+
+//Contains 是否存在未过期的缓存，不影响LRU顺序和命中统计
+func (cs *cacheStore) Contains(key string) bool {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	elem, ok := cs.entries[key]
+	if !ok {
+		return false
+	}
+	return !cacheEntryExpired(elem.Value.(*openwallet.CacheEntry), time.Now().UnixNano())
+}
+
+//Clear 清空缓存，统计不清零
+func (cs *cacheStore) Clear() {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.entries = make(map[string]*list.Element)
+	cs.lru.Init()
 }
-func (cm *CacheManager) GetCacheEntry(key string) (*openwallet.CacheEntry, bool) {
-	return nil, true
+
+//Len 当前条目数，包括尚未清理的过期条目
+func (cs *cacheStore) Len() int {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return cs.lru.Len()
 }
-func (cm *CacheManager) Remove(key string) (interface{}, bool) {
-	return nil, true
+
+//DeleteExpired 清理全部过期条目
+func (cs *cacheStore) DeleteExpired() {
+	now := time.Now().UnixNano()
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	for elem := cs.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if cacheEntryExpired(elem.Value.(*openwallet.CacheEntry), now) {
+			cs.removeElementLocked(elem)
+			cs.stats.Expirations++
+		}
+		elem = prev
+	}
 }
-func (cm *CacheManager) Contains(key string) bool {
-	return true
+
+//Stats 命中统计
+func (cs *cacheStore) Stats() CacheStats {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	stats := cs.stats
+	stats.Entries = cs.lru.Len()
+	return stats
+}
+
+func (cs *cacheStore) removeElementLocked(elem *list.Element) *openwallet.CacheEntry {
+	entry := cs.lru.Remove(elem).(*openwallet.CacheEntry)
+	delete(cs.entries, entry.Key)
+	return entry
+}
+
+//setupCache 按配置创建缓存并设置节点客户端的缓存时间，重新加载配置时先关闭旧缓存
+func (wm *WalletManager) setupCache() {
+	wm.closeCache()
+	cache := NewCacheManagerWithSize(wm.Config.CacheMaxEntries)
+	wm.cache = cache
+	wm.CacheManager = cache
+	wm.Api.Cache = cache
+	wm.Api.AccountCacheTTL = wm.Config.CacheAccountTTL
+	wm.Api.BlockCacheTTL = wm.Config.CacheBlockTTL
+	wm.Api.PropertiesCacheTTL = wm.Config.CachePropertiesTTL
+}
+
+//closeCache 停止setupCache创建的缓存的后台清理
+func (wm *WalletManager) closeCache() {
+	if wm.cache.cacheStore != nil {
+		wm.cache.Close()
+	}
 }
-func (cm *CacheManager) Clear() {}
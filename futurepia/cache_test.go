@@ -0,0 +1,218 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+var _ openwallet.ICacheManager = NewCacheManager()
+
+func TestCacheManagerTTL(t *testing.T) {
+	cm := NewCacheManagerWithJanitor(10, 0)
+	cm.Add("short", 1, 20*time.Millisecond)
+	cm.Add("forever", 2, 0)
+
+	if v, ok := cm.Get("short"); !ok || v != 1 {
+		t.Fatalf("expected cached value, got %v %v", v, ok)
+	}
+	time.Sleep(40 * time.Millisecond)
+
+	if cm.Contains("short") {
+		t.Errorf("expected entry expired")
+	}
+	if _, ok := cm.Get("short"); ok {
+		t.Errorf("expected entry expired")
+	}
+	if v, ok := cm.Get("forever"); !ok || v != 2 {
+		t.Errorf("expected entry without ttl kept, got %v %v", v, ok)
+	}
+
+	stats := cm.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Expirations != 1 || stats.Entries != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestCacheManagerLRU(t *testing.T) {
+	cm := NewCacheManagerWithJanitor(3, 0)
+	cm.Add("a", 1, 0)
+	cm.Add("b", 2, 0)
+	cm.Add("c", 3, 0)
+
+	//访问a后b成为最久未使用
+	cm.Get("a")
+	cm.Add("d", 4, 0)
+	if cm.Contains("b") {
+		t.Errorf("expected b evicted")
+	}
+	//Contains不影响LRU顺序，c被淘汰
+	cm.Contains("c")
+	cm.Add("e", 5, 0)
+	if cm.Contains("c") {
+		t.Errorf("expected c evicted")
+	}
+	for _, key := range []string{"a", "d", "e"} {
+		if !cm.Contains(key) {
+			t.Errorf("expected %s kept", key)
+		}
+	}
+	if stats := cm.Stats(); stats.Evictions != 2 || stats.Entries != 3 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestCacheManagerRemoveAndClear(t *testing.T) {
+	cm := NewCacheManagerWithJanitor(10, 0)
+	cm.Add("a", 1, time.Minute)
+	cm.Add("b", 2, time.Minute)
+
+	entry, ok := cm.GetCacheEntry("a")
+	if !ok || entry.Key != "a" || entry.Value != 1 || entry.Expiration == 0 {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+	entry.Value = 100
+	if v, _ := cm.Get("a"); v != 1 {
+		t.Errorf("expected entry copy, got %v", v)
+	}
+
+	if v, ok := cm.Remove("a"); !ok || v != 1 {
+		t.Errorf("unexpected remove result: %v %v", v, ok)
+	}
+	if _, ok := cm.Remove("a"); ok {
+		t.Errorf("expected removed entry missing")
+	}
+	if cm.Contains("a") || !cm.Contains("b") {
+		t.Errorf("unexpected contents after remove")
+	}
+
+	cm.Clear()
+	if cm.Len() != 0 || cm.Contains("b") {
+		t.Errorf("expected empty cache after clear")
+	}
+}
+
+func TestCacheManagerJanitor(t *testing.T) {
+	cm := NewCacheManagerWithJanitor(10, 10*time.Millisecond)
+	defer cm.Close()
+	cm.Add("a", 1, 10*time.Millisecond)
+	cm.Add("b", 2, time.Minute)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for cm.Len() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected expired entry cleaned, got %d entries", cm.Len())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := cm.Stats(); stats.Expirations != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestCacheManagerClose(t *testing.T) {
+	if cm := NewCacheManager(); cm.maxEntries != defaultCacheMaxEntries || cm.janitor == nil {
+		t.Errorf("unexpected default cache: %d entries", cm.maxEntries)
+	}
+
+	//重新加载配置时关闭旧缓存的后台清理
+	wm := NewWalletManager()
+	old := wm.cache
+	wm.Config.CacheMaxEntries = 5
+	wm.setupCache()
+	if old.janitor != nil {
+		t.Errorf("expected janitor of the replaced cache stopped")
+	}
+	if wm.cache.maxEntries != 5 || wm.CacheManager != openwallet.ICacheManager(wm.cache) {
+		t.Errorf("unexpected cache after reload")
+	}
+
+	wm.Close()
+	wm.Close()
+	if wm.cache.janitor != nil {
+		t.Errorf("expected janitor stopped on close")
+	}
+	wm.cache.Add("a", 1, 0)
+	if v, ok := wm.cache.Get("a"); !ok || v != 1 {
+		t.Errorf("expected closed cache still usable")
+	}
+}
+
+func TestClientCache(t *testing.T) {
+	node := newFakeNode(t, 30)
+	node.irreversible = 20
+	node.setBalance("alice", "10.00000000 PIA")
+
+	wm, _, _ := testScanWalletManager(t, node)
+	client := wm.Api
+	client.PropertiesCacheTTL = time.Minute
+	client.BlockCacheTTL = time.Minute
+	client.AccountCacheTTL = time.Minute
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetDynamicGlobal(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if n := node.callCount("get_dynamic_global_properties"); n != 1 {
+		t.Errorf("expected properties cached, got %d calls", n)
+	}
+
+	//不可逆区块缓存，可逆区块每次从节点获取
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetGetBlock(15); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := client.GetGetBlock(25); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if n := node.callCount("get_block"); n != 3 {
+		t.Errorf("expected only irreversible block cached, got %d calls", n)
+	}
+
+	//余额不缓存
+	balance, err := client.GetBalance("alice", "PIA")
+	if err != nil || balance.Balance != "10.00000000" {
+		t.Fatalf("unexpected balance: %+v %v", balance, err)
+	}
+	node.setBalance("alice", "5.00000000 PIA")
+	balance, _ = client.GetBalance("alice", "PIA")
+	if balance.Balance != "5.00000000" {
+		t.Errorf("expected fresh balance, got %s", balance.Balance)
+	}
+	if n := node.callCount("get_accounts"); n != 2 {
+		t.Errorf("expected 2 account lookups, got %d", n)
+	}
+
+	//账户是否存在缓存，删除缓存后重新查询
+	for i := 0; i < 2; i++ {
+		if exists, err := client.AccountExists("alice"); err != nil || !exists {
+			t.Fatalf("expected account exists, err: %v", err)
+		}
+	}
+	if n := node.callCount("get_accounts"); n != 3 {
+		t.Errorf("expected account existence cached, got %d lookups", n)
+	}
+	client.InvalidateAccount("alice")
+	client.AccountExists("alice")
+	if n := node.callCount("get_accounts"); n != 4 {
+		t.Errorf("expected account lookup after invalidate, got %d lookups", n)
+	}
+}
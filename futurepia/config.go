@@ -20,6 +20,7 @@ import (
 	"github.com/blocktree/openwallet/v2/common/file"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 const (
@@ -30,15 +31,71 @@ const (
 	//默认配置内容
 	defaultConfig = `
 
+# network preset: mainnet or testnet
+network = "mainnet"
+# override the chain ID of the network preset, required for testnet
+chainId = ""
+# override the public key prefix of the network preset
+addressPrefix = ""
+# override the asset symbol of the network preset
+feeString = ""
+# override the decimal places of the network preset, 0 = preset
+decimal = 0
 # RPC api url
 serverAPI = ""
+# block prefetch workers of scanner
+prefetchWorkers = 4
+# max blocks fetched ahead of the scanned height
+prefetchDepth = 16
+# only scan blocks up to the last irreversible block
+scanIrreversibleOnly = false
+# only scan blocks with at least N confirmations, 0 = disabled
+scanConfirmations = 0
+# max blocks rolled back on fork, deeper forks halt the scanner and raise an alert until Resume is called
+maxReorgDepth = 100
+# seconds between retries of unscanned block records
+unscanRetryInterval = 30
+# failed retries before an unscanned record is moved to dead letters
+unscanRetryMaxAttempts = 10
+# extract balance changes of virtual operations, the node must support get_ops_in_block
+scanVirtualOps = false
+# persist extracted records and redeliver them until observers acknowledge
+outboxEnabled = false
+# pending outbox records at which the scanner stops advancing
+outboxMaxPending = 10000
+# seconds between redeliveries of outbox records
+outboxRetryInterval = 10
+# comma separated urls receiving scan events by HTTP POST, empty = disabled
+webhookURLs = ""
+# HMAC-SHA256 secret for the X-PIA-Signature header
+webhookSecret = ""
+# delivery attempts per event and url, each url is retried in order by its own background worker
+webhookMaxAttempts = 5
+# seconds before the first webhook retry, doubled on each attempt
+webhookRetryInterval = 1
+# port of the scanner status HTTP endpoint (GET /status), 0 = disabled
+statusPort = 0
+# listen host of the scanner status endpoint
+statusHost = "127.0.0.1"
+# max entries of the node data cache
+cacheMaxEntries = 10000
+# seconds account existence and authority lookups are cached, balances are never cached, 0 = disabled
+cacheAccountTTL = 3
+# seconds irreversible blocks are cached, 0 = disabled
+cacheBlockTTL = 600
+# seconds chain properties are cached, 0 = disabled
+cachePropertiesTTL = 1
+# AddressVerify also checks that account names are registered on chain
+verifyAccountOnChain = false
+# sign transactions with keys imported by WIF or account password instead of HD derived keys
+signWithImportedKeys = false
 
 `
 )
 
 type WalletConfig struct {
-	//币种
-	Symbol string
+	//网络参数，包括币种、曲线类型、链ID、公钥前缀、资产符号和精度
+	NetworkProfile
 	//配置文件路径
 	configFilePath string
 	//配置文件名
@@ -51,26 +108,63 @@ type WalletConfig struct {
 	ServerAPI string
 	//默认配置内容
 	DefaultConfig string
-	//曲线类型
-	CurveType uint32
-	//链ID
-	//ChainID uint64
-
-	AddressPrefix string
-	FeeString     string
-	Decimal int64
-	ChainId string //链ID
 	//数据目录
 	DataDir string
+	//区块预取线程数
+	PrefetchWorkers int
+	//区块预取深度，最多领先已扫高度的区块数
+	PrefetchDepth int
+	//只扫描不可逆区块
+	ScanIrreversibleOnly bool
+	//只扫描确认数达到N的区块，0为不限制
+	ScanConfirmations uint64
+	//分叉最大回滚深度，超过时停止扫描并告警
+	MaxReorgDepth uint64
+	//未扫记录重试间隔
+	UnscanRetryInterval time.Duration
+	//未扫记录最大重试次数，超过后转入死信列表
+	UnscanRetryMaxAttempts int
+	//扫描区块时提取虚拟操作（利息、储蓄取出、奖励等），节点需支持get_ops_in_block
+	ScanVirtualOps bool
+	//提取记录持久化到待投递队列，观测者确认后删除
+	OutboxEnabled bool
+	//待投递记录上限，达到后扫描器暂停推进
+	OutboxMaxPending int
+	//待投递记录重新投递间隔
+	OutboxRetryInterval time.Duration
+	//接收扫描事件的webhook地址
+	WebhookURLs []string
+	//webhook签名密钥
+	WebhookSecret string
+	//webhook每个事件的最大投递次数
+	WebhookMaxAttempts int
+	//webhook首次重试间隔
+	WebhookRetryInterval time.Duration
+	//扫描器状态查询服务端口，0为不启动
+	StatusPort int
+	//扫描器状态查询服务监听地址
+	StatusHost string
+	//节点数据缓存最多条目数
+	CacheMaxEntries int
+	//账户信息缓存时间，0为不缓存
+	CacheAccountTTL time.Duration
+	//不可逆区块缓存时间，0为不缓存
+	CacheBlockTTL time.Duration
+	//链全局属性缓存时间，0为不缓存
+	CachePropertiesTTL time.Duration
+	//地址校验时查询账户是否已在链上注册
+	VerifyAccountOnChain bool
+	//用导入的私钥签名交易单，而不是HD衍生的私钥
+	SignWithImportedKeys bool
 }
 
 func NewConfig(symbol string) *WalletConfig {
 
 	c := WalletConfig{}
 
-	//币种
+	//网络参数，默认主网
+	c.NetworkProfile, _ = NetworkPreset(NetworkMainnet)
 	c.Symbol = symbol
-	c.CurveType = CurveType
 
 	//区块链数据
 	//blockchainDir = filepath.Join("data", strings.ToLower(Symbol), "blockchain")
@@ -84,7 +178,27 @@ func NewConfig(symbol string) *WalletConfig {
 	c.dbPath = filepath.Join("data", strings.ToLower(c.Symbol), "db")
 	//钱包服务API
 	c.ServerAPI = ""
-
+	//区块预取
+	c.PrefetchWorkers = defaultPrefetchWorkers
+	c.PrefetchDepth = defaultPrefetchDepth
+	//分叉最大回滚深度
+	c.MaxReorgDepth = defaultMaxReorgDepth
+	//未扫记录重试
+	c.UnscanRetryInterval = defaultUnscanRetryInterval
+	c.UnscanRetryMaxAttempts = defaultUnscanRetryMaxAttempts
+	//待投递队列
+	c.OutboxMaxPending = defaultOutboxMaxPending
+	c.OutboxRetryInterval = defaultOutboxRetryInterval
+	//webhook
+	c.WebhookMaxAttempts = defaultWebhookMaxAttempts
+	c.WebhookRetryInterval = defaultWebhookRetryInterval
+	//状态查询服务
+	c.StatusHost = defaultStatusHost
+	//节点数据缓存
+	c.CacheMaxEntries = defaultCacheMaxEntries
+	c.CacheAccountTTL = defaultCacheAccountTTL
+	c.CacheBlockTTL = defaultCacheBlockTTL
+	c.CachePropertiesTTL = defaultCachePropertiesTTL
 
 
 	//创建目录
@@ -101,8 +215,11 @@ func (wc *WalletConfig) makeDataDir() {
 		wc.DataDir = "data"
 	}
 
-	//本地数据库文件路径
+	//本地数据库文件路径，主网以外的网络使用独立目录
 	wc.dbPath = filepath.Join(wc.DataDir, strings.ToLower(wc.Symbol), "db")
+	if wc.Network != NetworkMainnet {
+		wc.dbPath = filepath.Join(wc.DataDir, strings.ToLower(wc.Symbol), wc.Network, "db")
+	}
 
 	//创建目录
 	file.MkdirAll(wc.dbPath)
@@ -0,0 +1,547 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//fakeNode 本地模拟的futurepia节点，用于离线测试扫描器
+type fakeNode struct {
+	mu           sync.Mutex
+	blocks       map[uint64]*fakeBlock
+	salt         map[uint64]string
+	head         uint64
+	irreversible uint64
+	virtualOps   map[uint64][][]interface{}
+	calls        map[string]int
+	balances     map[string]string
+	authorities  map[string]map[string]string
+	server       *httptest.Server
+}
+
+type fakeBlock struct {
+	Height       uint64
+	ID           string
+	Previous     string
+	Timestamp    string
+	Transactions []*fakeTx
+}
+
+type fakeTx struct {
+	ID         string
+	Operations [][]interface{}
+}
+
+//newFakeNode 创建高度为1~head的模拟链
+func newFakeNode(t *testing.T, head uint64) *fakeNode {
+	n := &fakeNode{
+		blocks:      make(map[uint64]*fakeBlock),
+		salt:        make(map[uint64]string),
+		virtualOps:  make(map[uint64][][]interface{}),
+		calls:       make(map[string]int),
+		balances:    make(map[string]string),
+		authorities: make(map[string]map[string]string),
+	}
+	n.mu.Lock()
+	for h := uint64(1); h <= head; h++ {
+		n.appendBlockLocked()
+	}
+	n.irreversible = head
+	n.mu.Unlock()
+
+	n.server = httptest.NewServer(http.HandlerFunc(n.handle))
+	t.Cleanup(n.server.Close)
+	return n
+}
+
+func (n *fakeNode) URL() string {
+	return n.server.URL
+}
+
+func (n *fakeNode) blockHash(height uint64) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%d-%s", height, n.salt[height])))
+	return fmt.Sprintf("%08x", height) + hex.EncodeToString(sum[:])[:32]
+}
+
+func (n *fakeNode) appendBlockLocked() *fakeBlock {
+	height := n.head + 1
+	previous := ""
+	if parent, ok := n.blocks[height-1]; ok {
+		previous = parent.ID
+	}
+	b := &fakeBlock{
+		Height:    height,
+		ID:        n.blockHash(height),
+		Previous:  previous,
+		Timestamp: time.Unix(1560000000+int64(height)*3, 0).UTC().Format("2006-01-02T15:04:05"),
+	}
+	n.blocks[height] = b
+	n.head = height
+	return b
+}
+
+//addBlocks 链上追加区块
+func (n *fakeNode) addBlocks(count int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i := 0; i < count; i++ {
+		n.appendBlockLocked()
+	}
+}
+
+//addOperation 在指定区块打包一笔交易，返回txid
+func (n *fakeNode) addOperation(height uint64, ops ...[]interface{}) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	b := n.blocks[height]
+	txid := fmt.Sprintf("%040x", height*1000+uint64(len(b.Transactions)))
+	b.Transactions = append(b.Transactions, &fakeTx{ID: txid, Operations: ops})
+	return txid
+}
+
+//addTransfer 在指定区块打包一笔转账
+func (n *fakeNode) addTransfer(height uint64, from, to, amount, memo string) string {
+	return n.addOperation(height, transferOp(from, to, amount, memo))
+}
+
+//addVirtualOp 在指定区块产生一个虚拟操作
+func (n *fakeNode) addVirtualOp(height uint64, op []interface{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.virtualOps[height] = append(n.virtualOps[height], op)
+}
+
+func transferOp(from, to, amount, memo string) []interface{} {
+	return []interface{}{"transfer", map[string]interface{}{
+		"from":   from,
+		"to":     to,
+		"amount": amount,
+		"memo":   memo,
+	}}
+}
+
+//reorg 从指定高度开始替换为新的分支
+func (n *fakeNode) reorg(from uint64, salt string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for h := from; h <= n.head; h++ {
+		n.salt[h] = salt
+		b := n.blocks[h]
+		b.ID = n.blockHash(h)
+		b.Transactions = nil
+		if parent, ok := n.blocks[h-1]; ok {
+			b.Previous = parent.ID
+		}
+	}
+}
+
+func (n *fakeNode) callCount(method string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.calls[method]
+}
+
+//setBalance 设置账户余额
+func (n *fakeNode) setBalance(account, balance string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.balances[account] = balance
+}
+
+//setAuthority 设置账户各角色的公钥，role为owner、active、posting或memo
+func (n *fakeNode) setAuthority(account string, keys map[string]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.authorities[account] = keys
+}
+
+func (n *fakeNode) handle(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ID     int64         `json:"id"`
+		Params []interface{} `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Params) < 3 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	method, _ := body.Params[1].(string)
+	args, _ := body.Params[2].([]interface{})
+
+	n.mu.Lock()
+	n.calls[method]++
+	result, rpcErr := n.dispatchLocked(method, args)
+	n.mu.Unlock()
+
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": body.ID}
+	if rpcErr != nil {
+		resp["error"] = map[string]interface{}{"code": -32000, "message": rpcErr.Error()}
+	} else {
+		resp["result"] = result
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (n *fakeNode) dispatchLocked(method string, args []interface{}) (interface{}, error) {
+	switch method {
+	case "get_dynamic_global_properties":
+		return map[string]interface{}{
+			"head_block_number":           n.head,
+			"head_block_id":               n.blocks[n.head].ID,
+			"last_irreversible_block_num": n.irreversible,
+		}, nil
+	case "get_block":
+		height := uint64(args[0].(float64))
+		b, ok := n.blocks[height]
+		if !ok {
+			return nil, nil
+		}
+		return n.blockJSONLocked(b), nil
+	case "get_ops_in_block":
+		height := uint64(args[0].(float64))
+		ops := make([]interface{}, 0)
+		for i, op := range n.virtualOps[height] {
+			ops = append(ops, map[string]interface{}{
+				"trx_id":       emptyTrxID,
+				"block":        height,
+				"trx_in_block": 0,
+				"op_in_trx":    0,
+				"virtual_op":   i + 1,
+				"timestamp":    n.blocks[height].Timestamp,
+				"op":           op,
+			})
+		}
+		return ops, nil
+	case "get_accounts":
+		accounts := make([]interface{}, 0)
+		names, _ := args[0].([]interface{})
+		for _, name := range names {
+			if balance, ok := n.balances[name.(string)]; ok {
+				account := map[string]interface{}{"name": name, "balance": balance}
+				for role, key := range n.authorities[name.(string)] {
+					if role == "memo" {
+						account["memo_key"] = key
+						continue
+					}
+					account[role] = map[string]interface{}{
+						"weight_threshold": 1,
+						"key_auths":        [][]interface{}{{key, 1}},
+					}
+				}
+				accounts = append(accounts, account)
+			}
+		}
+		return accounts, nil
+	case "get_account_history":
+		account := args[0].(string)
+		from := int64(args[1].(float64))
+		limit := int64(args[2].(float64))
+		history := n.accountHistoryLocked(account)
+		if from < 0 || from >= int64(len(history)) {
+			from = int64(len(history)) - 1
+		}
+		result := make([]interface{}, 0)
+		for seq := from - limit; seq <= from; seq++ {
+			if seq >= 0 {
+				result = append(result, []interface{}{seq, history[seq]})
+			}
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("method %s not found", method)
+}
+
+//accountHistoryLocked 按区块顺序列出参数中包含该账户的操作
+func (n *fakeNode) accountHistoryLocked(account string) []map[string]interface{} {
+	involved := func(op []interface{}) bool {
+		params, _ := op[1].(map[string]interface{})
+		for _, v := range params {
+			if v == account {
+				return true
+			}
+		}
+		return false
+	}
+
+	history := make([]map[string]interface{}, 0)
+	for h := uint64(1); h <= n.head; h++ {
+		b := n.blocks[h]
+		for i, tx := range b.Transactions {
+			for j, op := range tx.Operations {
+				if involved(op) {
+					history = append(history, map[string]interface{}{
+						"trx_id": tx.ID, "block": h, "trx_in_block": i, "op_in_trx": j,
+						"virtual_op": 0, "timestamp": b.Timestamp, "op": op,
+					})
+				}
+			}
+		}
+		for i, op := range n.virtualOps[h] {
+			if involved(op) {
+				history = append(history, map[string]interface{}{
+					"trx_id": emptyTrxID, "block": h, "trx_in_block": 0, "op_in_trx": 0,
+					"virtual_op": i + 1, "timestamp": b.Timestamp, "op": op,
+				})
+			}
+		}
+	}
+	return history
+}
+
+func (n *fakeNode) blockJSONLocked(b *fakeBlock) map[string]interface{} {
+	txs := make([]interface{}, 0)
+	ids := make([]string, 0)
+	for _, tx := range b.Transactions {
+		txs = append(txs, map[string]interface{}{"operations": tx.Operations})
+		ids = append(ids, tx.ID)
+	}
+	return map[string]interface{}{
+		"block_id":        b.ID,
+		"previous":        b.Previous,
+		"timestamp":       b.Timestamp,
+		"transactions":    txs,
+		"transaction_ids": ids,
+	}
+}
+
+//memBlockchainDAI 内存实现的区块链数据访问接口
+type memBlockchainDAI struct {
+	mu       sync.Mutex
+	heads    map[string]*openwallet.BlockHeader
+	blocks   map[string]map[uint64]*openwallet.BlockHeader
+	unscans  map[string]*openwallet.UnscanRecord
+	maxCache uint64
+}
+
+func newMemBlockchainDAI() *memBlockchainDAI {
+	return &memBlockchainDAI{
+		heads:   make(map[string]*openwallet.BlockHeader),
+		blocks:  make(map[string]map[uint64]*openwallet.BlockHeader),
+		unscans: make(map[string]*openwallet.UnscanRecord),
+	}
+}
+
+func (dai *memBlockchainDAI) SaveCurrentBlockHead(header *openwallet.BlockHeader) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	h := *header
+	dai.heads[header.Symbol] = &h
+	return nil
+}
+
+func (dai *memBlockchainDAI) GetCurrentBlockHead(symbol string) (*openwallet.BlockHeader, error) {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	h, ok := dai.heads[symbol]
+	if !ok {
+		return nil, fmt.Errorf("current block head not found")
+	}
+	c := *h
+	return &c, nil
+}
+
+func (dai *memBlockchainDAI) SaveLocalBlockHead(header *openwallet.BlockHeader) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	if dai.blocks[header.Symbol] == nil {
+		dai.blocks[header.Symbol] = make(map[uint64]*openwallet.BlockHeader)
+	}
+	h := *header
+	dai.blocks[header.Symbol][header.Height] = &h
+	return nil
+}
+
+func (dai *memBlockchainDAI) GetLocalBlockHeadByHeight(height uint64, symbol string) (*openwallet.BlockHeader, error) {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	h, ok := dai.blocks[symbol][height]
+	if !ok {
+		return nil, fmt.Errorf("block %d not found", height)
+	}
+	c := *h
+	return &c, nil
+}
+
+func (dai *memBlockchainDAI) SaveUnscanRecord(record *openwallet.UnscanRecord) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	r := *record
+	dai.unscans[record.ID] = &r
+	return nil
+}
+
+func (dai *memBlockchainDAI) DeleteUnscanRecordByHeight(height uint64, symbol string) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	for id, r := range dai.unscans {
+		if r.BlockHeight == height && r.Symbol == symbol {
+			delete(dai.unscans, id)
+		}
+	}
+	return nil
+}
+
+func (dai *memBlockchainDAI) DeleteUnscanRecordByID(id string, symbol string) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	delete(dai.unscans, id)
+	return nil
+}
+
+func (dai *memBlockchainDAI) GetTransactionsByTxID(txid, symbol string) ([]*openwallet.Transaction, error) {
+	return nil, fmt.Errorf("GetTransactionsByTxID is not implemented")
+}
+
+func (dai *memBlockchainDAI) GetUnscanRecords(symbol string) ([]*openwallet.UnscanRecord, error) {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	records := make([]*openwallet.UnscanRecord, 0)
+	for _, r := range dai.unscans {
+		if r.Symbol == symbol {
+			c := *r
+			records = append(records, &c)
+		}
+	}
+	return records, nil
+}
+
+func (dai *memBlockchainDAI) SetMaxBlockCache(max uint64, symbol string) error {
+	dai.maxCache = max
+	return nil
+}
+
+//testObserver 记录扫描通知的观测者
+type testObserver struct {
+	mu        sync.Mutex
+	headers   []*openwallet.BlockHeader
+	extracted []*openwallet.TxExtractData
+	keys      []string
+	receipts  []*openwallet.SmartContractReceipt
+}
+
+func (o *testObserver) BlockScanNotify(header *openwallet.BlockHeader) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.headers = append(o.headers, header)
+	return nil
+}
+
+func (o *testObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.keys = append(o.keys, sourceKey)
+	o.extracted = append(o.extracted, data)
+	return nil
+}
+
+func (o *testObserver) BlockExtractSmartContractDataNotify(sourceKey string, data *openwallet.SmartContractReceipt) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.receipts = append(o.receipts, data)
+	return nil
+}
+
+func (o *testObserver) extractedData() []*openwallet.TxExtractData {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]*openwallet.TxExtractData(nil), o.extracted...)
+}
+
+func (o *testObserver) contractReceipts() []*openwallet.SmartContractReceipt {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]*openwallet.SmartContractReceipt(nil), o.receipts...)
+}
+
+func (o *testObserver) blockHeaders() []*openwallet.BlockHeader {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]*openwallet.BlockHeader(nil), o.headers...)
+}
+
+//waitHeaders 等待异步区块通知达到指定数量
+func (o *testObserver) waitHeaders(t *testing.T, count int) []*openwallet.BlockHeader {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if headers := o.blockHeaders(); len(headers) >= count {
+			return headers
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	headers := o.blockHeaders()
+	t.Fatalf("expected %d block notifications, got %d", count, len(headers))
+	return headers
+}
+
+//testScanWalletManager 创建连接模拟节点的钱包管理者，watched为订阅的账户别名
+func testScanWalletManager(t *testing.T, node *fakeNode, watched ...string) (*WalletManager, *memBlockchainDAI, *testObserver) {
+	wm := NewWalletManager()
+	wm.Config.ServerAPI = node.URL()
+	wm.Api.BaseURL = node.URL()
+	//模拟链在测试中随时变化，关闭节点数据缓存
+	wm.Api.AccountCacheTTL = 0
+	wm.Api.BlockCacheTTL = 0
+	wm.Api.PropertiesCacheTTL = 0
+
+	//扫描器内置的本地数据库写入临时目录
+	dir, err := ioutil.TempDir("", "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		wm.Blockscanner.closeLocalBlockchain()
+		os.RemoveAll(dir)
+	})
+	wm.Config.dbPath = dir
+
+	dai := newMemBlockchainDAI()
+	wm.Blockscanner.SetBlockchainDAI(dai)
+
+	targets := make(map[string]bool)
+	for _, alias := range watched {
+		targets[alias] = true
+	}
+	wm.Blockscanner.SetBlockScanTargetFunc(func(target openwallet.ScanTarget) (string, bool) {
+		if targets[target.Alias] {
+			return "account-" + target.Alias, true
+		}
+		return "", false
+	})
+
+	observer := &testObserver{}
+	wm.Blockscanner.AddObserver(observer)
+	return wm, dai, observer
+}
+
+//setLocalHead 设置扫描起点为模拟链上的指定高度
+func (n *fakeNode) setLocalHead(wm *WalletManager, height uint64) {
+	n.mu.Lock()
+	hash := n.blocks[height].ID
+	n.mu.Unlock()
+	wm.Blockscanner.SaveLocalBlockHead(uint32(height), hash)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"sort"
+	"sync"
+)
+
+//KeyRing 导入的签名私钥，按公钥地址索引，只保存在内存中
+//配置SignWithImportedKeys时交易单用这里的私钥签名，而不是HD衍生的私钥
+type KeyRing struct {
+	mu   sync.RWMutex
+	keys map[string][]byte
+}
+
+//NewKeyRing 创建空的私钥环
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[string][]byte)}
+}
+
+//Add 添加地址对应的私钥，已存在时覆盖
+func (kr *KeyRing) Add(address string, priv []byte) {
+	key := make([]byte, len(priv))
+	copy(key, priv)
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys[address] = key
+}
+
+//Get 获取地址对应私钥的副本
+func (kr *KeyRing) Get(address string) ([]byte, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	priv, ok := kr.keys[address]
+	if !ok {
+		return nil, false
+	}
+	key := make([]byte, len(priv))
+	copy(key, priv)
+	return key, true
+}
+
+//Remove 删除地址对应的私钥
+func (kr *KeyRing) Remove(address string) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	delete(kr.keys, address)
+}
+
+//Addresses 全部已导入私钥的地址，按字典序排列
+func (kr *KeyRing) Addresses() []string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	addresses := make([]string, 0, len(kr.keys))
+	for address := range kr.keys {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
@@ -18,6 +18,7 @@ package futurepia
 import (
 	"github.com/blocktree/openwallet/v2/log"
 	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type WalletManager struct {
@@ -31,21 +32,37 @@ type WalletManager struct {
 	ContractDecoder openwallet.SmartContractDecoder //智能合约解析器
 	Blockscanner    *PIABlockScanner                //区块扫描器
 	CacheManager    openwallet.ICacheManager        //缓存管理器
+	cache           CacheManager                    //按配置创建的缓存，重新加载配置或Close时关闭
+	KeyRing         *KeyRing                        //导入的签名私钥
+	metricsRegistry prometheus.Registerer           //指标注册表
+	metrics         *adapterMetrics                 //适配器指标
+	operations      *OperationRegistry              //操作类型注册表
 }
 
 func NewWalletManager() *WalletManager {
 	wm := WalletManager{}
 	wm.Config = NewConfig(Symbol)
 	wm.Api = new(Client)
+	wm.operations = NewOperationRegistry()
+	wm.Api.operations = wm.operations
 	wm.Blockscanner = NewPIABlockScanner(&wm)
 	wm.Decoder = NewAddressDecoder(&wm)
 	wm.TxDecoder = NewTransactionDecoder(&wm)
 	wm.Log = log.NewOWLogger(wm.Symbol())
 	wm.DecoderV2 = NewAddressDecoder2(&wm)
 	wm.ContractDecoder = NewContractDecoder(&wm)
+	wm.KeyRing = NewKeyRing()
+	wm.SetMetricsRegistry(prometheus.NewRegistry())
+	wm.setupCache()
 	return &wm
 }
 
+//Close 停止钱包管理器的后台任务，区块扫描器需单独停止
+func (wm *WalletManager) Close() error {
+	wm.closeCache()
+	return nil
+}
+
 
 
 //GetAddressDecode 地址解析器
@@ -15,9 +15,15 @@
 
 package futurepia
 
+import (
+	"io/ioutil"
+)
+
 func testNewWalletManager() *WalletManager {
 	wm := NewWalletManager()
 	wm.Config.ServerAPI = "http://localhost:8888"
+	//本地数据库写入临时目录
+	wm.Config.dbPath, _ = ioutil.TempDir("", "futurepia")
 	//wm.Api = eos.New(wm.Config.ServerAPI)
 	return wm
 }
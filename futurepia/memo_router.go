@@ -0,0 +1,235 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+//memoPatternRoute 备注正则路由
+type memoPatternRoute struct {
+	pattern   *regexp.Regexp
+	accountID string //目标账户，可使用$1等引用分组
+}
+
+//UnroutableDeposit 无法按备注路由的充值
+type UnroutableDeposit struct {
+	ID          string `json:"id" storm:"id"` //交易ID和操作序号
+	TxID        string `json:"txid"`
+	OpIndex     int    `json:"opIndex"`
+	BlockHeight uint64 `json:"blockHeight"`
+	Alias       string `json:"alias"`
+	Memo        string `json:"memo"`
+	Amount      string `json:"amount"`
+	AccountID   string `json:"accountID"` //实际入账的账户，回退账户或共享账户本身
+	Time        int64  `json:"time"`
+}
+
+//MemoRouter 共享充值账户按备注路由到不同的openwallet账户
+//路由只作用于已订阅的共享账户的收款，匹配顺序：精确备注、正则（按添加顺序）、回退账户
+type MemoRouter struct {
+	mu       sync.RWMutex
+	exact    map[string]map[string]string //alias -> memo -> accountID
+	patterns map[string][]*memoPatternRoute
+	fallback map[string]string //alias -> accountID
+}
+
+//NewMemoRouter 创建备注路由
+func NewMemoRouter() *MemoRouter {
+	return &MemoRouter{
+		exact:    make(map[string]map[string]string),
+		patterns: make(map[string][]*memoPatternRoute),
+		fallback: make(map[string]string),
+	}
+}
+
+//AddRoute 共享账户alias收到备注为memo的充值时，入账到accountID
+func (r *MemoRouter) AddRoute(alias, memo, accountID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.exact[alias] == nil {
+		r.exact[alias] = make(map[string]string)
+	}
+	r.exact[alias][memo] = accountID
+}
+
+//AddPatternRoute 备注匹配正则pattern时入账到accountID，accountID可用$1引用分组
+func (r *MemoRouter) AddPatternRoute(alias, pattern, accountID string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("memo pattern %s compile failed, err: %v", pattern, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.patterns[alias] = append(r.patterns[alias], &memoPatternRoute{pattern: re, accountID: accountID})
+	return nil
+}
+
+//SetFallback 备注无法匹配时入账的账户，为空时入账到共享账户本身
+func (r *MemoRouter) SetFallback(alias, accountID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if accountID == "" {
+		delete(r.fallback, alias)
+		return
+	}
+	r.fallback[alias] = accountID
+}
+
+//hasRoutes alias是否配置了路由
+func (r *MemoRouter) hasRoutes(alias string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, fallback := r.fallback[alias]
+	return len(r.exact[alias]) > 0 || len(r.patterns[alias]) > 0 || fallback
+}
+
+//Route 按备注查找目标账户，matched为false时返回回退账户（可能为空）
+func (r *MemoRouter) Route(alias, memo string) (accountID string, matched bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if accountID, ok := r.exact[alias][memo]; ok {
+		return accountID, true
+	}
+
+	for _, route := range r.patterns[alias] {
+		match := route.pattern.FindStringSubmatchIndex(memo)
+		if match == nil {
+			continue
+		}
+		return string(route.pattern.ExpandString(nil, route.accountID, memo, match)), true
+	}
+
+	return r.fallback[alias], false
+}
+
+//UnroutableDepositDAI 无法路由充值报告的数据访问接口
+//注入的BlockchainDAI实现该接口时报告保存在其中，否则保存在本地数据库
+type UnroutableDepositDAI interface {
+	SaveUnroutableDeposit(deposit *UnroutableDeposit, symbol string) error
+	DeleteUnroutableDeposit(id, symbol string) error
+	GetUnroutableDeposits(symbol string) ([]*UnroutableDeposit, error)
+}
+
+//unroutableDepositID 同一操作只记录一次
+func unroutableDepositID(txid string, opIndex int) string {
+	return fmt.Sprintf("%s_%d", txid, opIndex)
+}
+
+//unroutableDepositDAI 无法路由充值报告的数据访问接口
+func (bs *PIABlockScanner) unroutableDepositDAI() (UnroutableDepositDAI, error) {
+	if dai, ok := bs.BlockchainDAI.(UnroutableDepositDAI); ok {
+		return dai, nil
+	}
+	return bs.localBlockchainDAI()
+}
+
+//GetUnroutableDeposits 无法路由的充值报告，按区块高度排序
+func (bs *PIABlockScanner) GetUnroutableDeposits() ([]*UnroutableDeposit, error) {
+	dai, err := bs.unroutableDepositDAI()
+	if err != nil {
+		return nil, err
+	}
+	list, err := dai.GetUnroutableDeposits(bs.wm.Symbol())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].BlockHeight != list[j].BlockHeight {
+			return list[i].BlockHeight < list[j].BlockHeight
+		}
+		return list[i].OpIndex < list[j].OpIndex
+	})
+	return list, nil
+}
+
+//DeleteUnroutableDeposit 删除已处理的无法路由充值
+func (bs *PIABlockScanner) DeleteUnroutableDeposit(id string) error {
+	dai, err := bs.unroutableDepositDAI()
+	if err != nil {
+		return err
+	}
+	return dai.DeleteUnroutableDeposit(id, bs.wm.Symbol())
+}
+
+//ClearUnroutableDeposits 清空无法路由的充值报告
+func (bs *PIABlockScanner) ClearUnroutableDeposits() error {
+	list, err := bs.GetUnroutableDeposits()
+	if err != nil {
+		return err
+	}
+	for _, deposit := range list {
+		if err := bs.DeleteUnroutableDeposit(deposit.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//saveUnroutableDeposit 记录无法路由的充值，同一操作只记录一次
+func (bs *PIABlockScanner) saveUnroutableDeposit(deposit *UnroutableDeposit) {
+	dai, err := bs.unroutableDepositDAI()
+	if err == nil {
+		err = dai.SaveUnroutableDeposit(deposit, bs.wm.Symbol())
+	}
+	if err != nil {
+		bs.wm.Log.Std.Error("save unroutable deposit %s failed, unexpected error: %v", deposit.ID, err)
+	}
+}
+
+//SetMemoRouter 设置充值备注路由，为nil时关闭
+func (bs *PIABlockScanner) SetMemoRouter(router *MemoRouter) {
+	bs.memoRouter = router
+}
+
+//routeDeposit 查找收款方的订阅账户，共享账户按备注路由
+func (bs *PIABlockScanner) routeDeposit(blockHeight uint64, transaction *LocalTransaction, accountID string, confirmed bool) string {
+
+	router := bs.memoRouter
+	if router == nil || !router.hasRoutes(transaction.To) {
+		return accountID
+	}
+
+	routed, matched := router.Route(transaction.To, transaction.Memo)
+	if matched && routed != "" {
+		return routed
+	}
+	if routed == "" {
+		routed = accountID
+	}
+
+	//未确认交易不记录，打包后再记录
+	if confirmed {
+		bs.saveUnroutableDeposit(&UnroutableDeposit{
+			ID:          unroutableDepositID(transaction.TxId, transaction.Index),
+			TxID:        transaction.TxId,
+			OpIndex:     transaction.Index,
+			BlockHeight: blockHeight,
+			Alias:       transaction.To,
+			Memo:        transaction.Memo,
+			Amount:      transaction.Amount,
+			AccountID:   routed,
+			Time:        time.Now().Unix(),
+		})
+	}
+
+	return routed
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoRouterRoute(t *testing.T) {
+	router := NewMemoRouter()
+	router.AddRoute("exchange", "vip", "account-vip")
+	if err := router.AddPatternRoute("exchange", `^uid-(\d+)$`, "user-$1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.AddPatternRoute("exchange", `(`, "x"); err == nil {
+		t.Errorf("expected pattern compile error")
+	}
+
+	tests := []struct {
+		memo      string
+		accountID string
+		matched   bool
+	}{
+		{"vip", "account-vip", true},
+		{"uid-42", "user-42", true},
+		{"uid-x", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		accountID, matched := router.Route("exchange", test.memo)
+		if accountID != test.accountID || matched != test.matched {
+			t.Errorf("memo %q: got (%s, %v), want (%s, %v)", test.memo, accountID, matched, test.accountID, test.matched)
+		}
+	}
+
+	router.SetFallback("exchange", "account-unknown")
+	if accountID, matched := router.Route("exchange", "nope"); accountID != "account-unknown" || matched {
+		t.Errorf("unexpected fallback route: %s, %v", accountID, matched)
+	}
+	if router.hasRoutes("other") {
+		t.Errorf("unexpected routes for other alias")
+	}
+}
+
+func TestScanBlockMemoRouting(t *testing.T) {
+	node := newFakeNode(t, 20)
+	node.addTransfer(12, "alice", "exchange", "1.00000000 PIA", "uid-7")
+	node.addTransfer(12, "alice", "exchange", "2.00000000 PIA", "who?")
+	node.addTransfer(13, "alice", "exchange", "3.00000000 PIA", "")
+
+	wm, _, observer := testScanWalletManager(t, node, "exchange")
+	router := NewMemoRouter()
+	router.AddPatternRoute("exchange", `^uid-(\d+)$`, "user-$1")
+	wm.Blockscanner.SetMemoRouter(router)
+
+	//没有回退账户时入账到共享账户本身
+	if err := wm.Blockscanner.ScanBlock(12); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	router.SetFallback("exchange", "account-suspense")
+	if err := wm.Blockscanner.ScanBlock(13); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	observer.mu.Lock()
+	keys := make(map[string]string)
+	for i, data := range observer.extracted {
+		keys[data.Transaction.Amount] = observer.keys[i]
+	}
+	observer.mu.Unlock()
+
+	expected := map[string]string{
+		"1.00000000": "user-7",
+		"2.00000000": "account-exchange",
+		"3.00000000": "account-suspense",
+	}
+	for amount, key := range expected {
+		if keys[amount] != key {
+			t.Errorf("deposit %s: expected source key %s, got %s", amount, key, keys[amount])
+		}
+	}
+
+	report, err := wm.Blockscanner.GetUnroutableDeposits()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(report) != 2 {
+		t.Fatalf("expected 2 unroutable deposits, got %d", len(report))
+	}
+	if report[0].Memo != "who?" || report[0].AccountID != "account-exchange" || report[0].BlockHeight != 12 {
+		t.Errorf("unexpected report: %+v", report[0])
+	}
+	if report[1].AccountID != "account-suspense" || report[1].BlockHeight != 13 {
+		t.Errorf("unexpected report: %+v", report[1])
+	}
+
+	//重扫不重复记录
+	wm.Blockscanner.ScanBlock(13)
+	if report, _ := wm.Blockscanner.GetUnroutableDeposits(); len(report) != 2 {
+		t.Errorf("unroutable deposit recorded twice")
+	}
+
+	//报告保存在本地数据库，重启后仍存在
+	wm.Blockscanner.closeLocalBlockchain()
+	report, err = wm.Blockscanner.GetUnroutableDeposits()
+	if err != nil || len(report) != 2 {
+		t.Fatalf("expected 2 unroutable deposits after reopen, got %d, err: %v", len(report), err)
+	}
+
+	if err := wm.Blockscanner.DeleteUnroutableDeposit(report[0].ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report, _ := wm.Blockscanner.GetUnroutableDeposits(); len(report) != 1 {
+		t.Errorf("expected 1 unroutable deposit after delete, got %d", len(report))
+	}
+	if err := wm.Blockscanner.ClearUnroutableDeposits(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report, _ := wm.Blockscanner.GetUnroutableDeposits(); len(report) != 0 {
+		t.Errorf("report not cleared")
+	}
+}
+
+func TestPendingDepositNotRecordedUnroutable(t *testing.T) {
+	node := newFakeNode(t, 20)
+	txid := node.addTransfer(12, "alice", "exchange", "1.00000000 PIA", "who?")
+
+	wm, _, observer := testScanWalletManager(t, node, "exchange")
+	router := NewMemoRouter()
+	router.AddPatternRoute("exchange", `^uid-(\d+)$`, "user-$1")
+	wm.Blockscanner.SetMemoRouter(router)
+
+	//未确认交易按路由通知，但不记录无法路由的充值
+	wm.Blockscanner.AddPendingTransaction(txid, time.Time{}, []*LocalTransaction{
+		{TxId: txid, From: "alice", To: "exchange", Amount: "1.00000000", CoinTag: "PIA", Memo: "who?", Type: "transfer"}})
+	if len(observer.extractedData()) != 1 {
+		t.Fatalf("expected pending deposit notification")
+	}
+	if report, err := wm.Blockscanner.GetUnroutableDeposits(); err != nil || len(report) != 0 {
+		t.Fatalf("pending deposit recorded as unroutable: %+v, err: %v", report, err)
+	}
+
+	//打包后只记录一次
+	if err := wm.Blockscanner.ScanBlock(12); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	report, err := wm.Blockscanner.GetUnroutableDeposits()
+	if err != nil || len(report) != 1 || report[0].BlockHeight != 12 || report[0].TxID != txid {
+		t.Fatalf("unexpected unroutable deposits: %+v, err: %v", report, err)
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "pia"
+
+	//交易单处理阶段
+	TxStageBuild  = "build"
+	TxStageSign   = "sign"
+	TxStageVerify = "verify"
+	TxStageSubmit = "submit"
+
+	//区块扫描的通知类型
+	NotifyKindBlock    = "block"
+	NotifyKindExtract  = "extract"
+	NotifyKindContract = "contract"
+)
+
+//DefaultRPCDurationBuckets RPC耗时直方图的默认分桶（秒），每次返回新的切片
+func DefaultRPCDurationBuckets() []float64 {
+	return []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+}
+
+//adapterMetrics 适配器的全部指标，nil时不记录
+type adapterMetrics struct {
+	rpcRequests     *prometheus.CounterVec
+	rpcErrors       *prometheus.CounterVec
+	rpcDuration     *prometheus.HistogramVec
+	blocksScanned   prometheus.Counter
+	forks           prometheus.Counter
+	extractFailures prometheus.Counter
+	notifyErrors    *prometheus.CounterVec
+	transactions    *prometheus.CounterVec
+}
+
+//newAdapterMetrics 在注册表上注册适配器的指标，注册表上已有相同的指标时使用已注册的
+//任一指标注册失败时撤销本次注册的指标并返回错误
+func newAdapterMetrics(r prometheus.Registerer) (*adapterMetrics, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	m := &adapterMetrics{
+		rpcRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_requests_total",
+			Help:      "RPC requests sent to the node.",
+		}, []string{"method"}),
+		rpcErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_errors_total",
+			Help:      "RPC requests failed by transport or node error.",
+		}, []string{"method"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_request_duration_seconds",
+			Help:      "RPC request latency.",
+			Buckets:   DefaultRPCDurationBuckets(),
+		}, []string{"method"}),
+		blocksScanned: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "scanner_blocks_scanned_total",
+			Help:      "Blocks extracted and saved by the block scanner.",
+		}),
+		forks: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "scanner_forks_total",
+			Help:      "Forks detected by the block scanner.",
+		}),
+		extractFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "scanner_extract_failures_total",
+			Help:      "Transactions the block scanner failed to extract.",
+		}),
+		notifyErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "scanner_notify_errors_total",
+			Help:      "Observer notifications returning an error.",
+		}, []string{"kind"}),
+		transactions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "transactions_total",
+			Help:      "Raw transactions processed by the transaction decoder.",
+		}, []string{"stage", "result"}),
+	}
+
+	registered := make([]prometheus.Collector, 0)
+	register := func(c prometheus.Collector) (prometheus.Collector, error) {
+		err := r.Register(c)
+		if err == nil {
+			registered = append(registered, c)
+			return c, nil
+		}
+		//多个钱包管理器共用一个注册表时，使用先注册的指标
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector, nil
+		}
+		return nil, err
+	}
+
+	var err error
+	fields := []interface{}{&m.rpcRequests, &m.rpcErrors, &m.rpcDuration, &m.blocksScanned,
+		&m.forks, &m.extractFailures, &m.notifyErrors, &m.transactions}
+	for _, field := range fields {
+		var (
+			c  prometheus.Collector
+			ok bool
+		)
+		switch p := field.(type) {
+		case **prometheus.CounterVec:
+			if c, err = register(*p); err == nil {
+				*p, ok = c.(*prometheus.CounterVec)
+			}
+		case **prometheus.HistogramVec:
+			if c, err = register(*p); err == nil {
+				*p, ok = c.(*prometheus.HistogramVec)
+			}
+		case *prometheus.Counter:
+			if c, err = register(*p); err == nil {
+				*p, ok = c.(prometheus.Counter)
+			}
+		}
+		if err == nil && !ok {
+			err = fmt.Errorf("metric has been registered as %T", c)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		for _, c := range registered {
+			r.Unregister(c)
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *adapterMetrics) observeRPC(method string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.rpcRequests.WithLabelValues(method).Inc()
+	m.rpcDuration.WithLabelValues(method).Observe(d.Seconds())
+	if err != nil {
+		m.rpcErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func (m *adapterMetrics) addBlockScanned() {
+	if m == nil {
+		return
+	}
+	m.blocksScanned.Inc()
+}
+
+func (m *adapterMetrics) addFork() {
+	if m == nil {
+		return
+	}
+	m.forks.Inc()
+}
+
+func (m *adapterMetrics) addExtractFailure() {
+	if m == nil {
+		return
+	}
+	m.extractFailures.Inc()
+}
+
+func (m *adapterMetrics) addNotifyError(kind string) {
+	if m == nil {
+		return
+	}
+	m.notifyErrors.WithLabelValues(kind).Inc()
+}
+
+//observeTx 记录交易单处理结果，用于defer
+func (m *adapterMetrics) observeTx(stage string, err *error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if *err != nil {
+		result = "error"
+	}
+	m.transactions.WithLabelValues(stage, result).Inc()
+}
+
+//SetMetricsRegistry 设置指标注册表，需在扫描和交易前设置，为nil时不记录指标
+//可传入宿主程序的prometheus.Registerer（如prometheus.DefaultRegisterer），注册失败时返回错误，继续使用之前的注册表
+//更换注册表时不从旧注册表注销已注册的指标
+func (wm *WalletManager) SetMetricsRegistry(r prometheus.Registerer) error {
+	metrics, err := newAdapterMetrics(r)
+	if err != nil {
+		return err
+	}
+	wm.metricsRegistry = r
+	wm.metrics = metrics
+	wm.Api.metrics = wm.metrics
+	return nil
+}
+
+//MetricsRegistry 当前的指标注册表，默认为钱包管理器自己的prometheus.Registry
+func (wm *WalletManager) MetricsRegistry() prometheus.Registerer {
+	return wm.metricsRegistry
+}
+
+//MetricsHandler 输出指标的HTTP处理器，注册表同时实现prometheus.Gatherer时可用，否则返回404
+func (wm *WalletManager) MetricsHandler() http.Handler {
+	if g, ok := wm.metricsRegistry.(prometheus.Gatherer); ok {
+		return promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+	}
+	return http.NotFoundHandler()
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//metricValue 从注册表读取指标的值，直方图返回样本数，labels为标签名和值交替排列
+func metricValue(t *testing.T, g prometheus.Gatherer, name string, labels ...string) float64 {
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range family.GetMetric() {
+			values := make(map[string]string)
+			for _, pair := range m.GetLabel() {
+				values[pair.GetName()] = pair.GetValue()
+			}
+			for i := 0; i+1 < len(labels); i += 2 {
+				if values[labels[i]] != labels[i+1] {
+					continue metrics
+				}
+			}
+			switch {
+			case m.Counter != nil:
+				return m.GetCounter().GetValue()
+			case m.Histogram != nil:
+				return float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return 0
+}
+
+func TestWalletManagerMetrics(t *testing.T) {
+	node := newFakeNode(t, 30)
+	node.addTransfer(15, "alice", "bob", "1.00000000 PIA", "")
+
+	wm, _, _ := testScanWalletManager(t, node, "bob")
+	node.setLocalHead(wm, 10)
+	registry := prometheus.NewRegistry()
+	if err := wm.SetMetricsRegistry(registry); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bs := wm.Blockscanner
+	bs.AddObserver(&flakyObserver{failures: 1})
+
+	bs.setScanning(true)
+	bs.ScanBlockTask()
+
+	if v := metricValue(t, registry, "pia_scanner_blocks_scanned_total"); v != 19 {
+		t.Errorf("expected 19 blocks scanned, got %v", v)
+	}
+
+	//分叉回滚
+	node.reorg(25, "fork")
+	node.addBlocks(1)
+	bs.ScanBlockTask()
+	if v := metricValue(t, registry, "pia_scanner_forks_total"); v != 1 || bs.Metrics().ForksDetected != 1 {
+		t.Errorf("expected 1 fork, got %v/%d", v, bs.Metrics().ForksDetected)
+	}
+	if v := metricValue(t, registry, "pia_scanner_notify_errors_total", "kind", NotifyKindExtract); v != 1 {
+		t.Errorf("expected 1 extract notify error, got %v", v)
+	}
+	if v := metricValue(t, registry, "pia_rpc_requests_total", "method", "get_block"); v < 19 {
+		t.Errorf("expected get_block requests, got %v", v)
+	}
+	if v := metricValue(t, registry, "pia_rpc_request_duration_seconds", "method", "get_block"); v != metricValue(t, registry, "pia_rpc_requests_total", "method", "get_block") {
+		t.Errorf("expected latency observed for every request, got %v", v)
+	}
+
+	if _, err := wm.Api.Call("unknown_method", 1, nil); err == nil {
+		t.Fatalf("expected rpc error")
+	}
+	if v := metricValue(t, registry, "pia_rpc_errors_total", "method", "unknown_method"); v != 1 {
+		t.Errorf("expected 1 rpc error, got %v", v)
+	}
+
+	//交易单签名失败
+	err := wm.TxDecoder.SignRawTransaction(nil, &openwallet.RawTransaction{})
+	if err == nil {
+		t.Fatalf("expected sign error")
+	}
+	if v := metricValue(t, registry, "pia_transactions_total", "stage", TxStageSign, "result", "error"); v != 1 {
+		t.Errorf("expected 1 failed sign, got %v", v)
+	}
+
+	server := httptest.NewServer(wm.MetricsHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), fmt.Sprintf(`pia_transactions_total{result="error",stage="%s"} 1`, TxStageSign)) {
+		t.Errorf("unexpected metrics output:\n%s", body)
+	}
+}
+
+//gatherlessRegisterer 宿主程序提供的注册表，不提供Gather
+type gatherlessRegisterer struct {
+	prometheus.Registerer
+	registered int
+}
+
+func (r *gatherlessRegisterer) Register(c prometheus.Collector) error {
+	r.registered++
+	return r.Registerer.Register(c)
+}
+
+func TestPluggableMetricsRegistry(t *testing.T) {
+	wm := NewWalletManager()
+	stub := &gatherlessRegisterer{Registerer: prometheus.NewRegistry()}
+	if err := wm.SetMetricsRegistry(stub); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stub.registered == 0 || wm.MetricsRegistry() != stub {
+		t.Fatalf("expected metrics registered on the pluggable registry")
+	}
+
+	rec := httptest.NewRecorder()
+	wm.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without gatherer, got %d", rec.Code)
+	}
+
+	//关闭指标
+	wm.SetMetricsRegistry(nil)
+	wm.Blockscanner.metrics.addFork()
+	wm.Api.metrics.observeRPC("get_block", 0, nil)
+
+	//同名不同说明的指标注册失败时保留之前的注册表
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: metricsNamespace + "_rpc_errors_total",
+		Help: "Conflict.",
+	}))
+	if err := wm.SetMetricsRegistry(registry); err == nil {
+		t.Errorf("expected error for conflicting registry")
+	}
+	if wm.MetricsRegistry() != nil {
+		t.Errorf("expected previous registry kept")
+	}
+
+	//同名同标签但类型不同的指标返回错误，并撤销本次注册的指标
+	registry = prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_errors_total",
+		Help:      "RPC requests failed by transport or node error.",
+	}, []string{"method"}))
+	if err := wm.SetMetricsRegistry(registry); err == nil {
+		t.Errorf("expected error for metric type mismatch")
+	}
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_requests_total",
+		Help:      "RPC requests sent to the node.",
+	}, []string{"method"})
+	if err := registry.Register(requests); err != nil {
+		t.Errorf("expected metrics of the failed registration unregistered: %v", err)
+	}
+
+	//默认分桶每次返回新的切片
+	buckets := DefaultRPCDurationBuckets()
+	buckets[0] = 100
+	if DefaultRPCDurationBuckets()[0] == 100 {
+		t.Errorf("default buckets modified through returned slice")
+	}
+}
+
+func TestSharedMetricsRegistry(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	wm1 := NewWalletManager()
+	wm2 := NewWalletManager()
+	for _, wm := range []*WalletManager{wm1, wm2} {
+		if err := wm.SetMetricsRegistry(registry); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	wm1.Api.metrics.observeRPC("get_block", 0, nil)
+	wm2.Api.metrics.observeRPC("get_block", 0, nil)
+	if v := metricValue(t, registry, "pia_rpc_requests_total", "method", "get_block"); v != 2 {
+		t.Errorf("expected 2 requests on the shared registry, got %v", v)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	NetworkMainnet = "mainnet" //主网
+	NetworkTestnet = "testnet" //测试网
+
+	defaultDecimal       = 8                                                                  //默认小数位精度
+	mainnetChainID       = "0000000000000000000000000000000000000000000000000000000000000000" //主网链ID
+	testnetAddressPrefix = "TST"                                                              //测试网公钥前缀
+)
+
+//NetworkProfile 网络参数，每个WalletManager持有自己的一份
+type NetworkProfile struct {
+	//网络名称
+	Network string
+	//币种
+	Symbol string
+	//曲线类型
+	CurveType uint32
+	//链ID
+	ChainId string
+	//公钥前缀
+	AddressPrefix string
+	//资产符号
+	FeeString string
+	//小数位精度
+	Decimal int64
+}
+
+//NetworkPreset 内置的网络参数，每次调用返回新的副本
+//测试网没有固定的链ID，需在配置文件中设置chainId
+func NetworkPreset(network string) (NetworkProfile, error) {
+	switch strings.ToLower(network) {
+	case NetworkMainnet:
+		return NetworkProfile{
+			Network:       NetworkMainnet,
+			Symbol:        Symbol,
+			CurveType:     CurveType,
+			ChainId:       mainnetChainID,
+			AddressPrefix: defaultAddressPrefix,
+			FeeString:     Symbol,
+			Decimal:       defaultDecimal,
+		}, nil
+	case NetworkTestnet:
+		return NetworkProfile{
+			Network:       NetworkTestnet,
+			Symbol:        Symbol,
+			CurveType:     CurveType,
+			AddressPrefix: testnetAddressPrefix,
+			FeeString:     Symbol,
+			Decimal:       defaultDecimal,
+		}, nil
+	}
+	return NetworkProfile{}, fmt.Errorf("unknown network: %s", network)
+}
+
+//validate 检查网络参数是否完整
+func (p *NetworkProfile) validate() error {
+	if p.ChainId == "" {
+		return fmt.Errorf("chainId of network %s is not configured", p.Network)
+	}
+	if p.AddressPrefix == "" {
+		return fmt.Errorf("addressPrefix of network %s is empty", p.Network)
+	}
+	if p.Decimal <= 0 {
+		return fmt.Errorf("decimal of network %s must be positive", p.Network)
+	}
+	return nil
+}
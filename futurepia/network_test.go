@@ -0,0 +1,174 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/astaxie/beego/config"
+)
+
+//testNetworkConfig 生成指向模拟节点的配置，extra为额外的ini内容
+func testNetworkConfig(t *testing.T, node *fakeNode, extra string) config.Configer {
+	dir, err := ioutil.TempDir("", "network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	ini := fmt.Sprintf("serverAPI = %s\ndataDir = %s\ncacheAccountTTL = 0\ncacheBlockTTL = 0\ncachePropertiesTTL = 0\n%s", node.URL(), dir, extra)
+	c, err := config.NewConfigData("ini", []byte(ini))
+	if err != nil {
+		t.Fatalf("parse config failed: %v", err)
+	}
+	return c
+}
+
+func TestNetworkPreset(t *testing.T) {
+	mainnet, err := NetworkPreset("Mainnet")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mainnet.AddressPrefix != "FPA" || mainnet.Decimal != 8 || mainnet.ChainId != mainnetChainID || mainnet.FeeString != "PIA" {
+		t.Errorf("unexpected mainnet profile: %+v", mainnet)
+	}
+
+	testnet, _ := NetworkPreset(NetworkTestnet)
+	if testnet.AddressPrefix != "TST" || testnet.validate() == nil {
+		t.Errorf("expected testnet without chain ID invalid: %+v", testnet)
+	}
+
+	if _, err := NetworkPreset("devnet"); err == nil {
+		t.Errorf("expected unknown network error")
+	}
+}
+
+func TestLoadNetworkProfile(t *testing.T) {
+	node := newFakeNode(t, 1)
+
+	wm := NewWalletManager()
+	if err := wm.LoadAssetsConfig(testNetworkConfig(t, node, "")); err != nil {
+		t.Fatalf("load config failed: %v", err)
+	}
+	if wm.Config.Network != NetworkMainnet || wm.Decimal() != 8 || wm.Config.AddressPrefix != "FPA" {
+		t.Errorf("unexpected default network: %+v", wm.Config.NetworkProfile)
+	}
+
+	wm = NewWalletManager()
+	err := wm.LoadAssetsConfig(testNetworkConfig(t, node, "network = testnet\n"))
+	if err == nil || !strings.Contains(err.Error(), "chainId") {
+		t.Errorf("expected missing chain ID error, got %v", err)
+	}
+
+	wm = NewWalletManager()
+	err = wm.LoadAssetsConfig(testNetworkConfig(t, node, "network = testnet\nchainId = 01\ndecimal = 3\nfeeString = TPIA\n"))
+	if err != nil {
+		t.Fatalf("load config failed: %v", err)
+	}
+	if wm.Config.ChainId != "01" || wm.Decimal() != 3 || wm.Config.FeeString != "TPIA" || wm.Config.AddressPrefix != "TST" || wm.Symbol() != Symbol {
+		t.Errorf("unexpected testnet profile: %+v", wm.Config.NetworkProfile)
+	}
+	if !strings.Contains(wm.Config.dbPath, NetworkTestnet) {
+		t.Errorf("expected testnet db path, got %s", wm.Config.dbPath)
+	}
+
+	if err := NewWalletManager().LoadAssetsConfig(testNetworkConfig(t, node, "network = devnet\n")); err == nil {
+		t.Errorf("expected unknown network error")
+	}
+}
+
+func TestConcurrentNetworks(t *testing.T) {
+	networks := []struct {
+		extra   string
+		prefix  string
+		decimal int32
+		amount  string
+	}{
+		{"network = mainnet\n", "FPA", 8, "1.00000000 PIA"},
+		{"network = testnet\nchainId = 01\ndecimal = 3\nfeeString = TPIA\n", "TST", 3, "1.000 TPIA"},
+	}
+
+	type instance struct {
+		wm       *WalletManager
+		observer *testObserver
+		node     *fakeNode
+	}
+	instances := make([]*instance, len(networks))
+	for i, network := range networks {
+		node := newFakeNode(t, 20)
+		for h := uint64(1); h <= 20; h++ {
+			node.addTransfer(h, "alice", "bob", network.amount, "")
+		}
+		wm, _, observer := testScanWalletManager(t, node, "bob")
+		if err := wm.LoadAssetsConfig(testNetworkConfig(t, node, network.extra)); err != nil {
+			t.Fatalf("load config failed: %v", err)
+		}
+		instances[i] = &instance{wm: wm, observer: observer, node: node}
+	}
+
+	keys := make([][]byte, 21)
+	for h := 1; h <= 20; h++ {
+		keys[h] = testPublicKey(t, byte(h))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(networks)*20)
+	for i := range networks {
+		network, inst := networks[i], instances[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h := uint64(1); h <= 20; h++ {
+				if err := inst.wm.Blockscanner.ScanBlock(h); err != nil {
+					errs <- err
+					return
+				}
+				address, _ := inst.wm.DecoderV2.AddressEncode(keys[h])
+				if !strings.HasPrefix(address, network.prefix) {
+					errs <- fmt.Errorf("address %s should start with %s", address, network.prefix)
+				}
+				if _, err := inst.wm.DecoderV2.AddressDecode(address); err != nil {
+					errs <- err
+				}
+				if inst.wm.Decimal() != network.decimal {
+					errs <- fmt.Errorf("decimal of %s changed to %d", inst.wm.Config.Network, inst.wm.Decimal())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for i, inst := range instances {
+		extracted := inst.observer.extractedData()
+		if len(extracted) != 20 {
+			t.Fatalf("%s: expected 20 extracted transactions, got %d", inst.wm.Config.Network, len(extracted))
+		}
+		for _, data := range extracted {
+			if data.Transaction.Decimal != networks[i].decimal {
+				t.Errorf("%s: unexpected transaction decimal %d", inst.wm.Config.Network, data.Transaction.Decimal)
+			}
+		}
+	}
+}
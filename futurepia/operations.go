@@ -0,0 +1,422 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+//Operation 已解码的链上操作
+type Operation interface {
+	//Accounts 操作涉及的账户
+	Accounts() []string
+}
+
+//Authority 账户权限
+type Authority struct {
+	WeightThreshold uint32          `json:"weight_threshold"`
+	AccountAuths    [][]interface{} `json:"account_auths"`
+	KeyAuths        [][]interface{} `json:"key_auths"`
+}
+
+//Keys 权限中的全部公钥，key_auths的元素为[公钥, 权重]
+func (a *Authority) Keys() []string {
+	keys := make([]string, 0, len(a.KeyAuths))
+	for _, auth := range a.KeyAuths {
+		if len(auth) == 0 {
+			continue
+		}
+		if key, ok := auth[0].(string); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+//AccountCreateOperation account_create
+type AccountCreateOperation struct {
+	Fee            string     `json:"fee"`
+	Creator        string     `json:"creator"`
+	NewAccountName string     `json:"new_account_name"`
+	Owner          *Authority `json:"owner"`
+	Active         *Authority `json:"active"`
+	MemoKey        string     `json:"memo_key"`
+	JsonMetadata   string     `json:"json_metadata"`
+}
+
+func (op *AccountCreateOperation) Accounts() []string {
+	return []string{op.Creator, op.NewAccountName}
+}
+
+//AccountUpdateOperation account_update
+type AccountUpdateOperation struct {
+	Account      string     `json:"account"`
+	Owner        *Authority `json:"owner,omitempty"`
+	Active       *Authority `json:"active,omitempty"`
+	MemoKey      string     `json:"memo_key"`
+	JsonMetadata string     `json:"json_metadata"`
+}
+
+func (op *AccountUpdateOperation) Accounts() []string {
+	return []string{op.Account}
+}
+
+//TransferOperation transfer
+type TransferOperation struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount string `json:"amount"`
+	Memo   string `json:"memo"`
+}
+
+func (op *TransferOperation) Accounts() []string {
+	return []string{op.From, op.To}
+}
+
+//TransferSavingsOperation transfer_savings，转入储蓄
+type TransferSavingsOperation struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Amount    string `json:"amount"`
+	Memo      string `json:"memo"`
+	RequestID uint32 `json:"request_id"`
+}
+
+func (op *TransferSavingsOperation) Accounts() []string {
+	return []string{op.From, op.To}
+}
+
+//ConclusionTransferSavingsOperation conclusion_transfer_savings，储蓄到期
+type ConclusionTransferSavingsOperation struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Amount    string `json:"amount"`
+	Memo      string `json:"memo"`
+	RequestID uint32 `json:"request_id"`
+}
+
+func (op *ConclusionTransferSavingsOperation) Accounts() []string {
+	return []string{op.From, op.To}
+}
+
+//CancelTransferSavingsOperation cancel_transfer_savings，取消转入储蓄
+type CancelTransferSavingsOperation struct {
+	From      string `json:"from"`
+	RequestID uint32 `json:"request_id"`
+}
+
+func (op *CancelTransferSavingsOperation) Accounts() []string {
+	return []string{op.From}
+}
+
+//StakingFundOperation staking_fund，质押到基金
+type StakingFundOperation struct {
+	From      string `json:"from"`
+	FundName  string `json:"fund_name"`
+	RequestID uint32 `json:"request_id"`
+	Amount    string `json:"amount"`
+	Memo      string `json:"memo"`
+	UserType  uint8  `json:"usertype"`
+	Month     uint8  `json:"month"`
+}
+
+func (op *StakingFundOperation) Accounts() []string {
+	return []string{op.From}
+}
+
+//ConclusionStakingOperation conclusion_staking，质押到期
+type ConclusionStakingOperation struct {
+	From      string `json:"from"`
+	FundName  string `json:"fund_name"`
+	RequestID uint32 `json:"request_id"`
+}
+
+func (op *ConclusionStakingOperation) Accounts() []string {
+	return []string{op.From}
+}
+
+//TransferFundOperation transfer_fund，转入基金
+type TransferFundOperation struct {
+	From     string `json:"from"`
+	FundName string `json:"fund_name"`
+	Amount   string `json:"amount"`
+	Memo     string `json:"memo"`
+}
+
+func (op *TransferFundOperation) Accounts() []string {
+	return []string{op.From}
+}
+
+//CreateTokenOperation create_token
+type CreateTokenOperation struct {
+	Publisher  string `json:"publisher"`
+	Name       string `json:"name"`
+	Symbol     string `json:"symbol_name"`
+	InitSupply string `json:"init_supply_amount"`
+	Url        string `json:"url"`
+}
+
+func (op *CreateTokenOperation) Accounts() []string {
+	return []string{op.Publisher}
+}
+
+//IssueTokenOperation issue_token
+type IssueTokenOperation struct {
+	Publisher string `json:"publisher"`
+	Name      string `json:"name"`
+	Amount    string `json:"reissue_amount"`
+}
+
+func (op *IssueTokenOperation) Accounts() []string {
+	return []string{op.Publisher}
+}
+
+//TransferTokenOperation transfer_token
+type TransferTokenOperation struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount string `json:"amount"`
+	Memo   string `json:"memo"`
+}
+
+func (op *TransferTokenOperation) Accounts() []string {
+	return []string{op.From, op.To}
+}
+
+//BurnTokenOperation burn_token
+type BurnTokenOperation struct {
+	Account string `json:"account"`
+	Amount  string `json:"amount"`
+}
+
+func (op *BurnTokenOperation) Accounts() []string {
+	return []string{op.Account}
+}
+
+//CustomJsonOperation custom_json
+type CustomJsonOperation struct {
+	RequiredAuths        []string `json:"required_auths"`
+	RequiredPostingAuths []string `json:"required_posting_auths"`
+	ID                   string   `json:"id"`
+	Json                 string   `json:"json"`
+}
+
+func (op *CustomJsonOperation) Accounts() []string {
+	accounts := make([]string, 0, len(op.RequiredAuths)+len(op.RequiredPostingAuths))
+	accounts = append(accounts, op.RequiredAuths...)
+	accounts = append(accounts, op.RequiredPostingAuths...)
+	return accounts
+}
+
+//OperationRegistry 操作类型注册表，决定区块中的操作解码成哪种结构体，每个WalletManager独立
+//未注册的操作保留原始参数，不生成交易单和合约回执；
+//cancel_transfer_savings、conclusion_staking不带金额，无法提取为交易单，只生成合约回执
+type OperationRegistry struct {
+	mu         sync.RWMutex
+	operations map[string]func() Operation //操作类型 -> 操作结构体构造函数
+}
+
+//NewOperationRegistry 创建注册了默认Futurepia操作的注册表
+func NewOperationRegistry() *OperationRegistry {
+	return &OperationRegistry{
+		operations: map[string]func() Operation{
+			"account_create":              func() Operation { return &AccountCreateOperation{} },
+			"account_update":              func() Operation { return &AccountUpdateOperation{} },
+			"transfer":                    func() Operation { return &TransferOperation{} },
+			"transfer_savings":            func() Operation { return &TransferSavingsOperation{} },
+			"conclusion_transfer_savings": func() Operation { return &ConclusionTransferSavingsOperation{} },
+			"cancel_transfer_savings":     func() Operation { return &CancelTransferSavingsOperation{} },
+			"staking_fund":                func() Operation { return &StakingFundOperation{} },
+			"conclusion_staking":          func() Operation { return &ConclusionStakingOperation{} },
+			"transfer_fund":               func() Operation { return &TransferFundOperation{} },
+			"create_token":                func() Operation { return &CreateTokenOperation{} },
+			"issue_token":                 func() Operation { return &IssueTokenOperation{} },
+			"transfer_token":              func() Operation { return &TransferTokenOperation{} },
+			"burn_token":                  func() Operation { return &BurnTokenOperation{} },
+			"custom_json":                 func() Operation { return &CustomJsonOperation{} },
+		},
+	}
+}
+
+//defaultOperationRegistry 未关联WalletManager的客户端使用的注册表，不可修改
+var defaultOperationRegistry = NewOperationRegistry()
+
+//Register 注册操作类型，已存在时覆盖
+func (r *OperationRegistry) Register(opType string, newOperation func() Operation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.operations[opType] = newOperation
+}
+
+//RegisterOperation 注册操作类型，只影响当前WalletManager的区块解码
+func (wm *WalletManager) RegisterOperation(opType string, newOperation func() Operation) {
+	wm.operations.Register(opType, newOperation)
+}
+
+//BlockOperation 区块中的操作
+type BlockOperation struct {
+	TxId      string          //所属交易id
+	TxIndex   int             //交易在区块中的序号
+	OpIndex   int             //操作在交易中的序号
+	Type      string          //操作类型
+	Operation Operation       //已注册类型的解码结果，未注册时为nil
+	Raw       json.RawMessage //操作原始参数
+}
+
+//decodeOperation 解码[type, {params}]格式的操作
+func (r *OperationRegistry) decodeOperation(raw interface{}) (*BlockOperation, error) {
+
+	pair, ok := raw.([]interface{})
+	if !ok || len(pair) != 2 {
+		return nil, fmt.Errorf("operation format error")
+	}
+
+	opType, ok := pair[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("operation type error")
+	}
+
+	params, err := json.Marshal(pair[1])
+	if err != nil {
+		return nil, err
+	}
+
+	blockOperation := &BlockOperation{
+		Type: opType,
+		Raw:  params,
+	}
+
+	r.mu.RLock()
+	newOperation, ok := r.operations[opType]
+	r.mu.RUnlock()
+	if !ok {
+		return blockOperation, nil
+	}
+
+	operation := newOperation()
+	err = json.Unmarshal(params, operation)
+	if err != nil {
+		return blockOperation, fmt.Errorf("decode operation %s failed, err: %v", opType, err)
+	}
+	blockOperation.Operation = operation
+
+	return blockOperation, nil
+}
+
+//parseAsset 解析"1.00000000 PIA"格式的资产
+func parseAsset(asset string) (amount, symbol string, ok bool) {
+	list := strings.Split(asset, " ")
+	if len(list) != 2 || list[0] == "" || list[1] == "" {
+		return "", "", false
+	}
+	return list[0], list[1], true
+}
+
+//assetDecimals 金额的小数位数，即资产精度
+func assetDecimals(amount string) int32 {
+	if i := strings.Index(amount, "."); i >= 0 {
+		return int32(len(amount) - i - 1)
+	}
+	return 0
+}
+
+//OperationReceipt 非转账操作的提取结果，关联账户被订阅时生成合约回执
+type OperationReceipt struct {
+	Operation *BlockOperation
+	Accounts  []string //需要检查订阅的账户
+}
+
+//OperationHandler 决定操作的提取方式
+type OperationHandler interface {
+	//HandleOperation 返回操作产生的余额变动（生成TxExtractData），以及需要生成合约回执的账户
+	HandleOperation(op *BlockOperation) (transfers []*LocalTransaction, receiptAccounts []string)
+}
+
+//DefaultOperationHandler 默认处理：主币和代币转账、储蓄和质押提取为交易单，其余已注册操作生成合约回执
+type DefaultOperationHandler struct{}
+
+func (h *DefaultOperationHandler) HandleOperation(op *BlockOperation) ([]*LocalTransaction, []string) {
+
+	if op.Operation == nil {
+		return nil, nil
+	}
+
+	localTransaction := &LocalTransaction{
+		Type:  op.Type,
+		TxId:  op.TxId,
+		Index: op.OpIndex,
+	}
+
+	var asset string
+
+	switch operation := op.Operation.(type) {
+	case *TransferOperation:
+		localTransaction.From, localTransaction.To, localTransaction.Memo = operation.From, operation.To, operation.Memo
+		asset = operation.Amount
+	case *TransferTokenOperation:
+		localTransaction.From, localTransaction.To, localTransaction.Memo = operation.From, operation.To, operation.Memo
+		localTransaction.Token = true
+		asset = operation.Amount
+	case *TransferSavingsOperation:
+		//转入储蓄只减少付款方可用余额，储蓄到期时再增加接收方可用余额
+		localTransaction.From, localTransaction.To, localTransaction.Memo = operation.From, operation.To, operation.Memo
+		localTransaction.FromOnly = true
+		asset = operation.Amount
+	case *ConclusionTransferSavingsOperation:
+		localTransaction.From, localTransaction.To, localTransaction.Memo = operation.From, operation.To, operation.Memo
+		localTransaction.ToOnly = true
+		asset = operation.Amount
+	case *StakingFundOperation:
+		localTransaction.From, localTransaction.To, localTransaction.Memo = operation.From, operation.FundName, operation.Memo
+		localTransaction.FromOnly = true
+		asset = operation.Amount
+	case *TransferFundOperation:
+		localTransaction.From, localTransaction.To, localTransaction.Memo = operation.From, operation.FundName, operation.Memo
+		localTransaction.FromOnly = true
+		asset = operation.Amount
+	default:
+		return nil, op.Operation.Accounts()
+	}
+
+	amount, symbol, ok := parseAsset(asset)
+	if !ok || localTransaction.From == "" || localTransaction.To == "" {
+		return nil, nil
+	}
+	localTransaction.Amount = amount
+	localTransaction.CoinTag = symbol
+
+	return []*LocalTransaction{localTransaction}, nil
+}
+
+//handleOperations 用handler处理区块中的全部操作，生成交易单和合约回执
+func handleOperations(handler OperationHandler, operations []*BlockOperation) ([]*LocalTransaction, []*OperationReceipt) {
+
+	localTransactions := make([]*LocalTransaction, 0)
+	receipts := make([]*OperationReceipt, 0)
+
+	for _, op := range operations {
+		transfers, accounts := handler.HandleOperation(op)
+		localTransactions = append(localTransactions, transfers...)
+		if len(accounts) > 0 {
+			receipts = append(receipts, &OperationReceipt{Operation: op, Accounts: accounts})
+		}
+	}
+
+	return localTransactions, receipts
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestDecodeOperation(t *testing.T) {
+	registry := NewOperationRegistry()
+
+	//缺少memo不应panic
+	op, err := registry.decodeOperation([]interface{}{"transfer", map[string]interface{}{
+		"from": "alice", "to": "bob", "amount": "1.00000000 PIA"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	transfer, ok := op.Operation.(*TransferOperation)
+	if !ok || transfer.From != "alice" || transfer.To != "bob" || transfer.Memo != "" {
+		t.Fatalf("unexpected transfer: %+v", op.Operation)
+	}
+
+	op, err = registry.decodeOperation([]interface{}{"custom_json", map[string]interface{}{
+		"required_auths": []interface{}{}, "required_posting_auths": []interface{}{"carol"}, "id": "follow", "json": "{}"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if accounts := op.Operation.Accounts(); len(accounts) != 1 || accounts[0] != "carol" {
+		t.Errorf("unexpected custom_json accounts: %v", accounts)
+	}
+
+	//不带金额的储蓄和质押操作只生成合约回执
+	for opType, account := range map[string]string{"cancel_transfer_savings": "dave", "conclusion_staking": "erin"} {
+		op, err = registry.decodeOperation([]interface{}{opType, map[string]interface{}{"from": account, "fund_name": "fund", "request_id": 1}})
+		if err != nil || op.Operation == nil {
+			t.Fatalf("unexpected %s: %+v, err: %v", opType, op, err)
+		}
+		transfers, accounts := (&DefaultOperationHandler{}).HandleOperation(op)
+		if len(transfers) != 0 || len(accounts) != 1 || accounts[0] != account {
+			t.Errorf("unexpected %s result: %v, %v", opType, transfers, accounts)
+		}
+	}
+
+	op, err = registry.decodeOperation([]interface{}{"unknown_op", map[string]interface{}{"x": 1}})
+	if err != nil || op.Operation != nil || op.Type != "unknown_op" || string(op.Raw) != `{"x":1}` {
+		t.Errorf("unexpected unknown operation: %+v, err: %v", op, err)
+	}
+
+	if _, err = registry.decodeOperation([]interface{}{"transfer"}); err == nil {
+		t.Errorf("expected format error")
+	}
+}
+
+func TestScanBlockOperations(t *testing.T) {
+	node := newFakeNode(t, 20)
+	node.addOperation(12,
+		[]interface{}{"transfer", map[string]interface{}{"from": "alice", "to": "bob", "amount": "1.00000000 PIA"}},
+		[]interface{}{"transfer_savings", map[string]interface{}{"from": "bob", "to": "bob", "amount": "2.00000000 PIA", "memo": "", "request_id": 1}},
+		[]interface{}{"account_update", map[string]interface{}{"account": "carol", "memo_key": "FPA1"}},
+		[]interface{}{"transfer_token", map[string]interface{}{"from": "bob", "to": "dave", "amount": "3.000 ABC", "memo": ""}},
+		[]interface{}{"custom_json", map[string]interface{}{"required_auths": []interface{}{}, "required_posting_auths": []interface{}{"bob"}, "id": "follow", "json": "{}"}},
+	)
+
+	wm, _, observer := testScanWalletManager(t, node, "bob")
+	if err := wm.Blockscanner.ScanBlock(12); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	extracted := observer.extractedData()
+	if len(extracted) != 3 {
+		t.Fatalf("expected transfer, savings and token records, got %d", len(extracted))
+	}
+	byAction := make(map[string]*openwallet.TxExtractData)
+	for _, data := range extracted {
+		byAction[data.Transaction.TxAction] = data
+	}
+
+	//转入储蓄只减少付款方余额
+	savings := byAction["transfer_savings"]
+	if savings == nil || len(savings.TxInputs) != 1 || len(savings.TxOutputs) != 0 || savings.Transaction.Amount != "2.00000000" {
+		t.Fatalf("unexpected savings record: %+v", savings)
+	}
+
+	//代币转账按合约资产提取
+	var token *openwallet.TxExtractData
+	for _, data := range extracted {
+		if data.Transaction.Coin.IsContract {
+			token = data
+		}
+	}
+	if token == nil || token.Transaction.Coin.Contract.Address != "ABC" || token.Transaction.Decimal != 3 {
+		t.Fatalf("unexpected token record: %+v", token.Transaction)
+	}
+	if len(token.TxInputs) != 1 || token.TxInputs[0].Recharge.Coin.ContractID == "" {
+		t.Errorf("token transfer should debit the sender")
+	}
+
+	receipts := observer.contractReceipts()
+	if len(receipts) != 1 || receipts[0].To != "custom_json" || receipts[0].From != "bob" || receipts[0].TxID == "" {
+		t.Fatalf("unexpected receipts: %+v", receipts)
+	}
+
+	//自定义handler：忽略全部操作
+	wm.Blockscanner.SetOperationHandler(ignoreOperationHandler{})
+	observer.mu.Lock()
+	observer.extracted, observer.receipts = nil, nil
+	observer.mu.Unlock()
+	if err := wm.Blockscanner.ScanBlock(12); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(observer.extractedData()) != 0 || len(observer.contractReceipts()) != 0 {
+		t.Errorf("custom handler was not applied")
+	}
+}
+
+func TestRegisterOperationPerWalletManager(t *testing.T) {
+	node := newFakeNode(t, 20)
+	node.addOperation(12,
+		[]interface{}{"custom_op", map[string]interface{}{"account": "bob"}},
+	)
+
+	wm, _, observer := testScanWalletManager(t, node, "bob")
+	other := NewWalletManager()
+	wm.RegisterOperation("custom_op", func() Operation { return &BurnTokenOperation{} })
+
+	if err := wm.Blockscanner.ScanBlock(12); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if receipts := observer.contractReceipts(); len(receipts) != 1 || receipts[0].To != "custom_op" {
+		t.Fatalf("registered operation was not decoded: %+v", receipts)
+	}
+
+	//注册只影响当前WalletManager
+	op, err := other.operations.decodeOperation([]interface{}{"custom_op", map[string]interface{}{"account": "bob"}})
+	if err != nil || op.Operation != nil {
+		t.Errorf("registration leaked to another wallet manager: %+v", op)
+	}
+}
+
+type ignoreOperationHandler struct{}
+
+func (ignoreOperationHandler) HandleOperation(op *BlockOperation) ([]*LocalTransaction, []string) {
+	return nil, nil
+}
+
+func TestScanBlockMultipleTransfers(t *testing.T) {
+	node := newFakeNode(t, 20)
+	txid := node.addOperation(12,
+		transferOp("alice", "bob", "1.00000000 PIA", "a"),
+		transferOp("alice", "bob", "2.00000000 PIA", "b"),
+	)
+
+	wm, _, observer := testScanWalletManager(t, node, "bob")
+	if err := wm.Blockscanner.ScanBlock(12); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	extracted := observer.extractedData()
+	if len(extracted) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(extracted))
+	}
+
+	byIndex := make(map[uint64]*openwallet.TxExtractData)
+	for _, data := range extracted {
+		byIndex[data.TxOutputs[0].Recharge.Index] = data
+	}
+	first, second := byIndex[0], byIndex[1]
+	if first == nil || second == nil {
+		t.Fatalf("expected records for operation 0 and 1")
+	}
+
+	//第一个操作与之前的WxID和SID一致
+	if first.Transaction.WxID != openwallet.GenTransactionWxID2(txid, "PIA", "") {
+		t.Errorf("first operation WxID changed")
+	}
+	if first.TxOutputs[0].Recharge.Sid != openwallet.GenTxOutPutSID(txid, "PIA", "", 0) {
+		t.Errorf("first operation SID changed")
+	}
+
+	if first.Transaction.WxID == second.Transaction.WxID {
+		t.Errorf("operations share WxID")
+	}
+	if first.TxOutputs[0].Recharge.Sid == second.TxOutputs[0].Recharge.Sid {
+		t.Errorf("operations share SID")
+	}
+	if second.Transaction.Amount != "2.00000000" || second.Transaction.TxID != txid {
+		t.Errorf("unexpected second record: %+v", second.Transaction)
+	}
+}
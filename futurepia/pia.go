@@ -16,12 +16,18 @@
 package futurepia
 
 import (
+	"strings"
+	"time"
+
 	"github.com/astaxie/beego/config"
 	"github.com/blocktree/openwallet/v2/log"
 	"github.com/blocktree/openwallet/v2/openwallet"
 )
 
-var Decimal int32 = 8
+//Decimal 主网默认精度
+//Deprecated: 精度按网络配置，使用WalletManager.Decimal()
+const Decimal int32 = defaultDecimal
+
 //CurveType 曲线类型
 func (wm *WalletManager) CurveType() uint32 {
 	return wm.Config.CurveType
@@ -39,7 +45,7 @@ func (wm *WalletManager) Symbol() string {
 
 //Decimal 小数位精度
 func (wm *WalletManager) Decimal() int32 {
-	return Decimal
+	return int32(wm.Config.Decimal)
 }
 
 //BalanceModelType 余额模型类型
@@ -69,27 +75,97 @@ func (wm *WalletManager) LoadAssetsConfig(c config.Configer) error {
 	wm.Config.ServerAPI = c.String("serverAPI")
 	wm.Api.BaseURL = wm.Config.ServerAPI
 	wm.Api.DelayTime, _ = c.Int64("delayTime")
-	wm.Config.ChainId = c.String("chainId")
-	if wm.Config.ChainId == "" {
-		wm.Config.ChainId = "0000000000000000000000000000000000000000000000000000000000000000"
+	err := wm.loadNetworkProfile(c)
+	if err != nil {
+		return err
+	}
+
+	wm.Config.PrefetchWorkers, _ = c.Int("prefetchWorkers")
+	if wm.Config.PrefetchWorkers <= 0 {
+		wm.Config.PrefetchWorkers = defaultPrefetchWorkers
 	}
-	wm.Config.AddressPrefix = c.String("addressPrefix")
-	if wm.Config.AddressPrefix == "" {
-		wm.Config.AddressPrefix = "FPA"
+
+	wm.Config.PrefetchDepth, _ = c.Int("prefetchDepth")
+	if wm.Config.PrefetchDepth <= 0 {
+		wm.Config.PrefetchDepth = defaultPrefetchDepth
 	}
 
-	wm.Config.FeeString = c.String("feeString")
-	if wm.Config.FeeString == "" {
-		wm.Config.FeeString = "PIA"
+	wm.Config.ScanIrreversibleOnly, _ = c.Bool("scanIrreversibleOnly")
+	scanConfirmations, _ := c.Int64("scanConfirmations")
+	if scanConfirmations > 0 {
+		wm.Config.ScanConfirmations = uint64(scanConfirmations)
 	}
 
-	wm.Config.Decimal, _ = c.Int64("decimal")
-	if wm.Config.Decimal == 0 {
-		Decimal = 8
+	maxReorgDepth, _ := c.Int64("maxReorgDepth")
+	if maxReorgDepth > 0 {
+		wm.Config.MaxReorgDepth = uint64(maxReorgDepth)
 	} else {
-		Decimal = int32(wm.Config.Decimal)
+		wm.Config.MaxReorgDepth = defaultMaxReorgDepth
 	}
 
+	unscanRetryInterval, _ := c.Int64("unscanRetryInterval")
+	if unscanRetryInterval > 0 {
+		wm.Config.UnscanRetryInterval = time.Duration(unscanRetryInterval) * time.Second
+	} else {
+		wm.Config.UnscanRetryInterval = defaultUnscanRetryInterval
+	}
+
+	wm.Config.UnscanRetryMaxAttempts, _ = c.Int("unscanRetryMaxAttempts")
+	if wm.Config.UnscanRetryMaxAttempts <= 0 {
+		wm.Config.UnscanRetryMaxAttempts = defaultUnscanRetryMaxAttempts
+	}
+
+	wm.Config.ScanVirtualOps, _ = c.Bool("scanVirtualOps")
+
+	wm.Config.OutboxEnabled, _ = c.Bool("outboxEnabled")
+	wm.Config.OutboxMaxPending, _ = c.Int("outboxMaxPending")
+	if wm.Config.OutboxMaxPending <= 0 {
+		wm.Config.OutboxMaxPending = defaultOutboxMaxPending
+	}
+
+	outboxRetryInterval, _ := c.Int64("outboxRetryInterval")
+	if outboxRetryInterval > 0 {
+		wm.Config.OutboxRetryInterval = time.Duration(outboxRetryInterval) * time.Second
+	} else {
+		wm.Config.OutboxRetryInterval = defaultOutboxRetryInterval
+	}
+
+	wm.Config.WebhookURLs = make([]string, 0)
+	for _, url := range strings.Split(c.String("webhookURLs"), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			wm.Config.WebhookURLs = append(wm.Config.WebhookURLs, url)
+		}
+	}
+	wm.Config.WebhookSecret = c.String("webhookSecret")
+	wm.Config.WebhookMaxAttempts, _ = c.Int("webhookMaxAttempts")
+	if wm.Config.WebhookMaxAttempts <= 0 {
+		wm.Config.WebhookMaxAttempts = defaultWebhookMaxAttempts
+	}
+	webhookRetryInterval, _ := c.Int64("webhookRetryInterval")
+	if webhookRetryInterval > 0 {
+		wm.Config.WebhookRetryInterval = time.Duration(webhookRetryInterval) * time.Second
+	} else {
+		wm.Config.WebhookRetryInterval = defaultWebhookRetryInterval
+	}
+	wm.Blockscanner.setupWebhookNotifier()
+	wm.Config.StatusPort, _ = c.Int("statusPort")
+	wm.Config.StatusHost = c.String("statusHost")
+	if wm.Config.StatusHost == "" {
+		wm.Config.StatusHost = defaultStatusHost
+	}
+
+	wm.Config.CacheMaxEntries, _ = c.Int("cacheMaxEntries")
+	if wm.Config.CacheMaxEntries <= 0 {
+		wm.Config.CacheMaxEntries = defaultCacheMaxEntries
+	}
+	wm.Config.CacheAccountTTL = loadSecondsConfig(c, "cacheAccountTTL", defaultCacheAccountTTL)
+	wm.Config.CacheBlockTTL = loadSecondsConfig(c, "cacheBlockTTL", defaultCacheBlockTTL)
+	wm.Config.CachePropertiesTTL = loadSecondsConfig(c, "cachePropertiesTTL", defaultCachePropertiesTTL)
+	wm.setupCache()
+
+	wm.Config.VerifyAccountOnChain, _ = c.Bool("verifyAccountOnChain")
+	wm.Config.SignWithImportedKeys, _ = c.Bool("signWithImportedKeys")
+
 	wm.Config.DataDir = c.String("dataDir")
 
 	//数据文件夹
@@ -97,6 +173,50 @@ func (wm *WalletManager) LoadAssetsConfig(c config.Configer) error {
 	return nil
 }
 
+//loadNetworkProfile 按network选择内置网络参数，chainId、addressPrefix、feeString和decimal可覆盖预设值
+func (wm *WalletManager) loadNetworkProfile(c config.Configer) error {
+
+	network := c.String("network")
+	if network == "" {
+		network = NetworkMainnet
+	}
+	profile, err := NetworkPreset(network)
+	if err != nil {
+		return err
+	}
+
+	if chainId := c.String("chainId"); chainId != "" {
+		profile.ChainId = chainId
+	}
+	if prefix := c.String("addressPrefix"); prefix != "" {
+		profile.AddressPrefix = prefix
+	}
+	if feeString := c.String("feeString"); feeString != "" {
+		profile.FeeString = feeString
+	}
+	if decimal, _ := c.Int64("decimal"); decimal > 0 {
+		profile.Decimal = decimal
+	}
+	//币种在创建WalletManager时确定
+	profile.Symbol = wm.Config.Symbol
+
+	err = profile.validate()
+	if err != nil {
+		return err
+	}
+	wm.Config.NetworkProfile = profile
+	return nil
+}
+
+//loadSecondsConfig 读取以秒为单位的时长，未配置时使用默认值，配置为0时返回0
+func loadSecondsConfig(c config.Configer, key string, defaultValue time.Duration) time.Duration {
+	seconds, err := c.Int64(key)
+	if err != nil || seconds < 0 {
+		return defaultValue
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 //InitAssetsConfig 初始化默认配置
 func (wm *WalletManager) InitAssetsConfig() (config.Configer, error) {
 	return config.NewConfigData("ini", []byte(wm.Config.DefaultConfig))
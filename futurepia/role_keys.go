@@ -0,0 +1,193 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/blocktree/go-owcrypt"
+)
+
+const (
+	RoleOwner   = "owner"   //owner权限，可修改其他权限
+	RoleActive  = "active"  //active权限，用于转账
+	RolePosting = "posting" //posting权限，用于发帖和投票
+	RoleMemo    = "memo"    //memo公钥，用于加密备注
+)
+
+//accountRoles 官方钱包由密码生成的全部角色
+var accountRoles = []string{RoleOwner, RoleActive, RolePosting, RoleMemo}
+
+//AccountRoles 官方钱包由密码生成的全部角色，返回副本
+func AccountRoles() []string {
+	return append([]string(nil), accountRoles...)
+}
+
+//RoleKey 由账户名、角色和密码生成的密钥
+type RoleKey struct {
+	Account    string
+	Role       string
+	PrivateKey []byte
+	PublicKey  []byte //33字节压缩公钥
+	Address    string //带前缀的公钥
+}
+
+//DeriveRoleKey 与官方钱包一致，私钥为sha256(账户名+角色+密码)
+func (wm *WalletManager) DeriveRoleKey(account, role, password string) (*RoleKey, error) {
+
+	if err := ValidateAccountName(account); err != nil {
+		return nil, fmt.Errorf("invalid account name %s: %v", account, err)
+	}
+	if !isAccountRole(role) {
+		return nil, fmt.Errorf("unknown account role: %s", role)
+	}
+	if password == "" {
+		return nil, fmt.Errorf("password is empty")
+	}
+
+	priv := sha256.Sum256([]byte(account + role + password))
+	pub, ret := owcrypt.GenPubkey(priv[:], wm.CurveType())
+	if ret != owcrypt.SUCCESS {
+		return nil, fmt.Errorf("generate %s public key failed", role)
+	}
+	pub = owcrypt.PointCompress(pub, wm.CurveType())
+
+	address, err := wm.DecoderV2.AddressEncode(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RoleKey{
+		Account:    account,
+		Role:       role,
+		PrivateKey: priv[:],
+		PublicKey:  pub,
+		Address:    address,
+	}, nil
+}
+
+//DeriveRoleKeys 生成账户的角色密钥，未指定角色时生成全部角色
+func (wm *WalletManager) DeriveRoleKeys(account, password string, roles ...string) ([]*RoleKey, error) {
+	if len(roles) == 0 {
+		roles = accountRoles
+	}
+	keys := make([]*RoleKey, 0, len(roles))
+	for _, role := range roles {
+		key, err := wm.DeriveRoleKey(account, role, password)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+//VerifyRoleKeys 校验角色密钥是否在账户的链上权限中，返回不一致的角色
+func (wm *WalletManager) VerifyRoleKeys(keys []*RoleKey) error {
+
+	authorities := make(map[string]*ApiAccountAuthority)
+	mismatched := make([]string, 0)
+	for _, key := range keys {
+		authority, ok := authorities[key.Account]
+		if !ok {
+			var err error
+			authority, err = wm.Api.GetAccountAuthority(key.Account)
+			if err != nil {
+				return fmt.Errorf("get account %s authority failed, err: %v", key.Account, err)
+			}
+			authorities[key.Account] = authority
+		}
+		if !authority.hasRoleKey(key.Role, key.Address) {
+			mismatched = append(mismatched, key.Account+"/"+key.Role)
+		}
+	}
+
+	if len(mismatched) > 0 {
+		return fmt.Errorf("role keys do not match on-chain authorities: %s", strings.Join(mismatched, ", "))
+	}
+	return nil
+}
+
+//ImportRoleAccount 用官方钱包的账户名和密码导入链上账户
+//生成的角色密钥须与链上权限一致，全部加入KeyRing，返回的资产账户和地址使用active公钥，ExtParam记录为active角色
+func (wm *WalletManager) ImportRoleAccount(account, password string) (*ImportedAccount, []*RoleKey, error) {
+
+	keys, err := wm.DeriveRoleKeys(account, password)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = wm.VerifyRoleKeys(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var active *RoleKey
+	for _, key := range keys {
+		if key.Role == RoleActive {
+			active = key
+		}
+		wm.KeyRing.Add(key.Address, key.PrivateKey)
+	}
+
+	imported, err := wm.importAccount(account, active.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return imported, keys, nil
+}
+
+//roleOf 公钥在账户权限中的角色，按active、owner、posting、memo的顺序查找，不在权限中时返回空
+func (a *ApiAccountAuthority) roleOf(address string) string {
+	for _, role := range []string{RoleActive, RoleOwner, RolePosting, RoleMemo} {
+		if a.hasRoleKey(role, address) {
+			return role
+		}
+	}
+	return ""
+}
+
+//hasRoleKey 角色权限中是否包含公钥
+func (a *ApiAccountAuthority) hasRoleKey(role, address string) bool {
+	var keys []string
+	switch role {
+	case RoleOwner:
+		keys = a.Owner.Keys()
+	case RoleActive:
+		keys = a.Active.Keys()
+	case RolePosting:
+		keys = a.Posting.Keys()
+	case RoleMemo:
+		keys = []string{a.MemoKey}
+	}
+	for _, key := range keys {
+		if key == address {
+			return true
+		}
+	}
+	return false
+}
+
+func isAccountRole(role string) bool {
+	for _, r := range accountRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
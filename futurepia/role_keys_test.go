@@ -0,0 +1,199 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+)
+
+//testRoleAccount 注册账户并把由密码生成的角色公钥设置为链上权限
+func testRoleAccount(t *testing.T, node *fakeNode, wm *WalletManager, account, password string) []*RoleKey {
+	keys, err := wm.DeriveRoleKeys(account, password)
+	if err != nil {
+		t.Fatalf("derive role keys failed: %v", err)
+	}
+	authority := make(map[string]string)
+	for _, key := range keys {
+		authority[key.Role] = key.Address
+	}
+	node.setBalance(account, "1.00000000 PIA")
+	node.setAuthority(account, authority)
+	return keys
+}
+
+func TestDeriveRoleKey(t *testing.T) {
+	wm := testNewWalletManager()
+
+	key, err := wm.DeriveRoleKey("alice", RoleActive, "secret")
+	if err != nil {
+		t.Fatalf("derive role key failed: %v", err)
+	}
+	priv := sha256.Sum256([]byte("aliceactivesecret"))
+	if !bytes.Equal(key.PrivateKey, priv[:]) {
+		t.Errorf("unexpected private key: %x", key.PrivateKey)
+	}
+	decoded, err := wm.DecoderV2.AddressDecode(key.Address)
+	if err != nil || !bytes.Equal(decoded, key.PublicKey) {
+		t.Errorf("unexpected address %s, err: %v", key.Address, err)
+	}
+
+	keys, err := wm.DeriveRoleKeys("alice", "secret")
+	if err != nil || len(keys) != len(accountRoles) {
+		t.Fatalf("unexpected role keys: %d, err: %v", len(keys), err)
+	}
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		seen[k.Address] = true
+	}
+	if len(seen) != len(accountRoles) || !seen[key.Address] {
+		t.Errorf("expected distinct role keys including active")
+	}
+
+	//修改返回的角色列表不影响其他实例
+	AccountRoles()[0] = RolePosting
+	HDRoles()[0] = RolePosting
+	if accountRoles[0] != RoleOwner || hdRoles[0] != RoleActive {
+		t.Errorf("role lists should be copied")
+	}
+
+	if _, err := wm.DeriveRoleKey("alice", "admin", "secret"); err == nil {
+		t.Errorf("expected unknown role error")
+	}
+	if _, err := wm.DeriveRoleKey("Alice", RoleActive, "secret"); err == nil {
+		t.Errorf("expected invalid account name error")
+	}
+	if _, err := wm.DeriveRoleKey("alice", RoleActive, ""); err == nil {
+		t.Errorf("expected empty password error")
+	}
+}
+
+func TestVerifyRoleKeys(t *testing.T) {
+	node := newFakeNode(t, 10)
+	wm, _, _ := testScanWalletManager(t, node)
+	keys := testRoleAccount(t, node, wm, "alice", "secret")
+
+	if err := wm.VerifyRoleKeys(keys); err != nil {
+		t.Fatalf("expected role keys valid, got %v", err)
+	}
+
+	other, _ := wm.DeriveRoleKey("alice", RolePosting, "other")
+	err := wm.VerifyRoleKeys([]*RoleKey{keys[0], other})
+	if err == nil || !strings.Contains(err.Error(), "alice/posting") {
+		t.Errorf("expected posting mismatch, got %v", err)
+	}
+
+	missing, _ := wm.DeriveRoleKeys("carol", "secret")
+	if err := wm.VerifyRoleKeys(missing); err == nil {
+		t.Errorf("expected unregistered account error")
+	}
+}
+
+func TestImportRoleAccount(t *testing.T) {
+	node := newFakeNode(t, 10)
+	wm, _, _ := testScanWalletManager(t, node)
+	keys := testRoleAccount(t, node, wm, "alice", "secret")
+
+	imported, roleKeys, err := wm.ImportRoleAccount("alice", "secret")
+	if err != nil {
+		t.Fatalf("import role account failed: %v", err)
+	}
+	if len(roleKeys) != len(keys) {
+		t.Errorf("unexpected role keys: %d", len(roleKeys))
+	}
+	if imported.Address.Address != keys[1].Address || imported.Account.Alias != "alice" {
+		t.Errorf("expected active key address, got %s", imported.Address.Address)
+	}
+	if got := wm.KeyRing.Addresses(); len(got) != len(keys) {
+		t.Errorf("unexpected imported keys: %v", got)
+	}
+
+	if _, _, err := wm.ImportRoleAccount("alice", "wrong"); err == nil {
+		t.Errorf("expected wrong password error")
+	}
+}
+
+func TestSignWithImportedKeys(t *testing.T) {
+	node := newFakeNode(t, 10)
+	wm, _, _ := testScanWalletManager(t, node)
+	testRoleAccount(t, node, wm, "alice", "secret")
+	wm.Config.SignWithImportedKeys = true
+
+	imported, _, err := wm.ImportRoleAccount("alice", "secret")
+	if err != nil {
+		t.Fatalf("import role account failed: %v", err)
+	}
+
+	bin, _ := eos.MarshalBinary(&TransConMain{})
+	hash := sha256.Sum256(bin)
+	newRawTx := func(address *openwallet.Address) *openwallet.RawTransaction {
+		return &openwallet.RawTransaction{
+			Account: imported.Account,
+			RawHex:  hex.EncodeToString(bin),
+			Signatures: map[string][]*openwallet.KeySignature{
+				imported.Account.AccountID: {{
+					EccType: CurveType,
+					Address: address,
+					Message: hex.EncodeToString(hash[:]),
+				}},
+			},
+		}
+	}
+
+	//未注入钱包时也能签名，不需要HD密钥
+	rawTx := newRawTx(imported.Address)
+	if err := wm.TxDecoder.SignRawTransaction(nil, rawTx); err != nil {
+		t.Fatalf("sign with imported key failed: %v", err)
+	}
+	if err := wm.TxDecoder.VerifyRawTransaction(nil, rawTx); err != nil {
+		t.Fatalf("verify signature failed: %v", err)
+	}
+
+	wm.KeyRing.Remove(imported.Address.Address)
+	if err := wm.TxDecoder.SignRawTransaction(nil, newRawTx(imported.Address)); err == nil {
+		t.Errorf("expected missing imported key error")
+	}
+}
+
+func TestKeyRing(t *testing.T) {
+	kr := NewKeyRing()
+	priv := []byte{1, 2, 3}
+	kr.Add("b", priv)
+	kr.Add("a", priv)
+	priv[0] = 9
+
+	got, ok := kr.Get("b")
+	if !ok || !bytes.Equal(got, []byte{1, 2, 3}) {
+		t.Fatalf("unexpected key: %x", got)
+	}
+	got[0] = 9
+	if got, _ := kr.Get("b"); got[0] != 1 {
+		t.Errorf("expected key copy")
+	}
+	if addresses := kr.Addresses(); strings.Join(addresses, ",") != "a,b" {
+		t.Errorf("unexpected addresses: %v", addresses)
+	}
+	kr.Remove("b")
+	if _, ok := kr.Get("b"); ok {
+		t.Errorf("expected key removed")
+	}
+}
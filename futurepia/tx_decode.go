@@ -16,6 +16,7 @@
 package futurepia
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -24,6 +25,7 @@ import (
 	"github.com/pkg/errors"
 	"time"
 
+	"github.com/blocktree/openwallet/v2/hdkeystore"
 	"github.com/blocktree/openwallet/v2/openwallet"
 	"github.com/shopspring/decimal"
 )
@@ -42,7 +44,8 @@ func NewTransactionDecoder(wm *WalletManager) *TransactionDecoder {
 }
 
 //CreateRawTransaction 创建交易单
-func (decoder *TransactionDecoder) CreateRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+func (decoder *TransactionDecoder) CreateRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (err error) {
+	defer decoder.wm.metrics.observeTx(TxStageBuild, &err)
 
 	var (
 		accountID      = rawTx.Account.AccountID
@@ -107,24 +110,27 @@ func (decoder *TransactionDecoder) CreateRawTransaction(wrapper openwallet.Walle
 }
 
 //SignRawTransaction 签名交易单
-func (decoder *TransactionDecoder) SignRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+func (decoder *TransactionDecoder) SignRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (err error) {
+	defer decoder.wm.metrics.observeTx(TxStageSign, &err)
 
 	if rawTx.Signatures == nil || len(rawTx.Signatures) == 0 {
 		//this.wm.Log.Std.Error("len of signatures error. ")
 		return fmt.Errorf("transaction signature is empty")
 	}
 
-	key, err := wrapper.HDKey()
-	if err != nil {
-		return err
+	var key *hdkeystore.HDKey
+	if !decoder.wm.Config.SignWithImportedKeys {
+		key, err = wrapper.HDKey()
+		if err != nil {
+			return err
+		}
 	}
 
 	keySignatures := rawTx.Signatures[rawTx.Account.AccountID]
 	if keySignatures != nil {
 		for _, keySignature := range keySignatures {
 
-			childKey, err := key.DerivedKeyWithPath(keySignature.Address.HDPath, keySignature.EccType)
-			keyBytes, err := childKey.GetPrivateKeyBytes()
+			keyBytes, err := decoder.signingKey(key, keySignature)
 			if err != nil {
 				return err
 			}
@@ -157,8 +163,30 @@ func (decoder *TransactionDecoder) SignRawTransaction(wrapper openwallet.WalletD
 	return nil
 }
 
+//signingKey 签名私钥，配置SignWithImportedKeys时从KeyRing按地址获取，否则按HD路径衍生
+func (decoder *TransactionDecoder) signingKey(key *hdkeystore.HDKey, keySignature *openwallet.KeySignature) ([]byte, error) {
+	if keySignature.Address == nil {
+		return nil, fmt.Errorf("signing address is empty")
+	}
+
+	if decoder.wm.Config.SignWithImportedKeys {
+		priv, ok := decoder.wm.KeyRing.Get(keySignature.Address.Address)
+		if !ok {
+			return nil, fmt.Errorf("no imported key for address %s", keySignature.Address.Address)
+		}
+		return priv, nil
+	}
+
+	childKey, err := key.DerivedKeyWithPath(keySignature.Address.HDPath, keySignature.EccType)
+	if err != nil {
+		return nil, err
+	}
+	return childKey.GetPrivateKeyBytes()
+}
+
 //VerifyRawTransaction 验证交易单，验证交易单并返回加入签名后的交易单
-func (decoder *TransactionDecoder) VerifyRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+func (decoder *TransactionDecoder) VerifyRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (err error) {
+	defer decoder.wm.metrics.observeTx(TxStageVerify, &err)
 
 	if rawTx.Signatures == nil || len(rawTx.Signatures) == 0 {
 		//this.wm.Log.Std.Error("len of signatures error. ")
@@ -183,11 +211,19 @@ func (decoder *TransactionDecoder) VerifyRawTransaction(wrapper openwallet.Walle
 			messsage, _ := hex.DecodeString(keySignature.Message)
 			signature, _ := hex.DecodeString(keySignature.Signature)
 
-			_, valid := owcrypt.RecoverPubkey(signature, messsage, decoder.wm.CurveType())
+			pubkey, valid := owcrypt.RecoverPubkey(signature, messsage, decoder.wm.CurveType())
 			if valid == owcrypt.FAILURE {
 				return fmt.Errorf("transaction verify failed: %v", err)
 			}
 
+			//签名恢复的公钥须与提供签名的地址一致
+			if keySignature.Address != nil && keySignature.Address.Address != "" {
+				err = decoder.verifySigningKey(pubkey, keySignature.Address.Address)
+				if err != nil {
+					return fmt.Errorf("transaction verify failed: %v", err)
+				}
+			}
+
 			v := signature[len(signature)-1] //签名最后一字节是v
 
 			//验签通过后处理V值，符合节点验签
@@ -212,8 +248,24 @@ func (decoder *TransactionDecoder) VerifyRawTransaction(wrapper openwallet.Walle
 	return nil
 }
 
+//verifySigningKey 比较签名恢复的公钥和地址解码出的公钥
+func (decoder *TransactionDecoder) verifySigningKey(recovered []byte, address string) error {
+	expected, err := decoder.wm.DecoderV2.AddressDecode(address)
+	if err != nil {
+		return fmt.Errorf("signing address %s is invalid: %v", address, err)
+	}
+	if len(recovered) != publicKeyLength {
+		recovered = owcrypt.PointCompress(recovered, decoder.wm.CurveType())
+	}
+	if !bytes.Equal(recovered, expected) {
+		return fmt.Errorf("signature was not made by the key of address %s", address)
+	}
+	return nil
+}
+
 // SubmitRawTransaction 广播交易单
-func (decoder *TransactionDecoder) SubmitRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
+func (decoder *TransactionDecoder) SubmitRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (_ *openwallet.Transaction, err error) {
+	defer decoder.wm.metrics.observeTx(TxStageSubmit, &err)
 
 	var stx *TransConMain
 	txHex, err := hex.DecodeString(rawTx.RawHex)
@@ -250,6 +302,17 @@ func (decoder *TransactionDecoder) SubmitRawTransaction(wrapper openwallet.Walle
 	rawTx.TxID = resultee.Id
 	rawTx.IsSubmit = true
 
+	//余额已变动，删除账户信息缓存
+	if rawTx.Account != nil {
+		decoder.wm.Api.InvalidateAccount(rawTx.Account.Alias)
+	}
+	for to := range rawTx.To {
+		decoder.wm.Api.InvalidateAccount(to)
+	}
+
+	//广播成功的交易加入交易池跟踪，打包或过期后对账
+	decoder.wm.Blockscanner.AddPendingTransaction(resultee.Id, stx.Expiration.Time, pendingTransfers(stx))
+
 	decimals := int32(rawTx.Coin.Contract.Decimals)
 	fees := "0"
 
@@ -272,6 +335,32 @@ func (decoder *TransactionDecoder) SubmitRawTransaction(wrapper openwallet.Walle
 	return tx, nil
 }
 
+//pendingTransfers 已签名交易中的转账操作
+func pendingTransfers(stx *TransConMain) []*LocalTransaction {
+	transfers := make([]*LocalTransaction, 0)
+	for i, operation := range stx.Operations {
+		for _, data := range operation {
+			if data == nil {
+				continue
+			}
+			amount, symbol, ok := parseAsset(data.Amount.String())
+			if !ok {
+				continue
+			}
+			transfers = append(transfers, &LocalTransaction{
+				From:    data.From,
+				To:      data.To,
+				Amount:  amount,
+				CoinTag: symbol,
+				Memo:    data.Memo,
+				Type:    "transfer",
+				Index:   i,
+			})
+		}
+	}
+	return transfers
+}
+
 //GetRawTransactionFeeRate 获取交易单的费率
 func (decoder *TransactionDecoder) GetRawTransactionFeeRate() (feeRate string, unit string, err error) {
 	return "0", "pia", nil
@@ -476,8 +565,10 @@ func (decoder *TransactionDecoder) createRawTransaction(
 	for _, v := range txdata {
 		sigDigest = append(sigDigest, v)
 	}
+	//只构建transfer，只需要active密钥签名，owner和memo地址不参与签名
+	addresses = FilterRoleAddresses(addresses, RequiredRole("transfer"))
 	if len(addresses) == 0 {
-		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "[%s] have not PIA public key", accountID)
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "[%s] have not PIA active public key", accountID)
 	}
 	sig256 := sha256.Sum256(sigDigest)
 	sigDigest2 := make([]byte, 0)
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+//virtualOpFields 影响余额的虚拟操作字段
+type virtualOpFields struct {
+	from   string //资金来源账户字段，可为空
+	to     string //余额增加的账户字段
+	amount string //金额字段
+	memo   string //备注字段，可为空
+}
+
+//virtualBalanceOperations 会改变账户可用余额的虚拟操作
+//只收录以可用余额资产支付的虚拟操作；以VESTS支付的奖励(producer_reward、curation_reward等)不改变可用余额，
+//claim_reward_balance是用户签名的操作，随区块交易提取，不在此列
+var virtualBalanceOperations = map[string]virtualOpFields{
+	"interest":                   {to: "owner", amount: "interest"},
+	"fill_transfer_from_savings": {from: "from", to: "to", amount: "amount", memo: "memo"},
+	"fill_vesting_withdraw":      {from: "from_account", to: "to_account", amount: "deposited"},
+	"author_reward":              {to: "author", amount: "pia_payout"},
+}
+
+//emptyTrxID 虚拟操作没有所属交易时的txid
+const emptyTrxID = "0000000000000000000000000000000000000000"
+
+//virtualOperationTxID 虚拟操作没有交易id时，用区块高度、操作类型和序号生成唯一标识
+func virtualOperationTxID(height uint64, opType string, index int) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d_%s_%d", height, opType, index)))
+	return hex.EncodeToString(hash[:20])
+}
+
+//parseVirtualOperations 把影响余额的虚拟操作转为本地交易
+func parseVirtualOperations(height uint64, operations []*ApiOperation) []*LocalTransaction {
+
+	localTransactions := make([]*LocalTransaction, 0)
+
+	for i, operation := range operations {
+		if operation == nil || len(operation.Op) < 2 {
+			continue
+		}
+
+		opType, _ := operation.Op[0].(string)
+		fields, ok := virtualBalanceOperations[opType]
+		if !ok {
+			continue
+		}
+
+		mapTemp, ok := operation.Op[1].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		to, _ := mapTemp[fields.to].(string)
+		amount, _ := mapTemp[fields.amount].(string)
+		amountList := strings.Split(amount, " ")
+		if to == "" || len(amountList) != 2 {
+			continue
+		}
+
+		localTransaction := &LocalTransaction{
+			To:      to,
+			Amount:  amountList[0],
+			CoinTag: amountList[1],
+			Type:    opType,
+			TxId:    operation.TrxId,
+			Index:   i,
+			Virtual: true,
+		}
+		if fields.from != "" {
+			localTransaction.From, _ = mapTemp[fields.from].(string)
+		}
+		if fields.memo != "" {
+			localTransaction.Memo, _ = mapTemp[fields.memo].(string)
+		}
+		if localTransaction.TxId == "" || localTransaction.TxId == emptyTrxID {
+			localTransaction.TxId = virtualOperationTxID(height, opType, i)
+		}
+
+		localTransactions = append(localTransactions, localTransaction)
+	}
+
+	return localTransactions
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+//virtualOpsFixture get_ops_in_block(100, true)返回格式的虚拟操作
+const virtualOpsFixture = `[
+	{"trx_id":"0000000000000000000000000000000000000000","block":100,"trx_in_block":4294967295,"op_in_trx":0,"virtual_op":1,"timestamp":"2019-07-01T08:00:00",
+	 "op":["interest",{"owner":"bob","interest":"0.01000000 PIA"}]},
+	{"trx_id":"0000000000000000000000000000000000000000","block":100,"trx_in_block":4294967295,"op_in_trx":0,"virtual_op":2,"timestamp":"2019-07-01T08:00:00",
+	 "op":["producer_reward",{"producer":"bob","vesting_shares":"1.000000 VESTS"}]},
+	{"trx_id":"abcd","block":100,"trx_in_block":1,"op_in_trx":0,"virtual_op":3,"timestamp":"2019-07-01T08:00:00",
+	 "op":["fill_transfer_from_savings",{"from":"alice","to":"bob","amount":"5.00000000 PIA","request_id":1,"memo":"savings"}]},
+	{"trx_id":"0000000000000000000000000000000000000000","block":100,"trx_in_block":4294967295,"op_in_trx":0,"virtual_op":4,"timestamp":"2019-07-01T08:00:00",
+	 "op":["interest",{"owner":"bob"}]},
+	{"trx_id":"0000000000000000000000000000000000000000","block":100,"trx_in_block":4294967295,"op_in_trx":0,"virtual_op":5,"timestamp":"2019-07-01T08:00:00",
+	 "op":["author_reward",{"author":"carol","permlink":"post","snac_payout":"0.00000000 SNAC","pia_payout":"3.00000000 PIA","vesting_payout":"0.000000 VESTS"}]},
+	{"trx_id":"ef01","block":100,"trx_in_block":2,"op_in_trx":0,"virtual_op":6,"timestamp":"2019-07-01T08:00:00",
+	 "op":["claim_reward_balance",{"account":"bob","reward_pia":"1.00000000 PIA"}]}
+]`
+
+func TestParseVirtualOperations(t *testing.T) {
+	var operations []*ApiOperation
+	if err := json.Unmarshal([]byte(virtualOpsFixture), &operations); err != nil {
+		t.Fatalf("decode fixture failed: %v", err)
+	}
+
+	txs := parseVirtualOperations(100, operations)
+	if len(txs) != 3 {
+		t.Fatalf("expected 3 balance changes, got %d", len(txs))
+	}
+
+	interest := txs[0]
+	if interest.To != "bob" || interest.From != "" || interest.Amount != "0.01000000" || interest.CoinTag != "PIA" || !interest.Virtual {
+		t.Errorf("unexpected interest: %+v", interest)
+	}
+	if interest.TxId == emptyTrxID || interest.TxId != virtualOperationTxID(100, "interest", 0) {
+		t.Errorf("expected generated txid, got %s", interest.TxId)
+	}
+
+	savings := txs[1]
+	if savings.From != "alice" || savings.To != "bob" || savings.Memo != "savings" || savings.TxId != "abcd" || savings.Index != 2 {
+		t.Errorf("unexpected savings withdraw: %+v", savings)
+	}
+
+	reward := txs[2]
+	if reward.To != "carol" || reward.Amount != "3.00000000" || reward.CoinTag != "PIA" || reward.Type != "author_reward" {
+		t.Errorf("unexpected author reward: %+v", reward)
+	}
+}
+
+func TestScanBlockVirtualOps(t *testing.T) {
+	node := newFakeNode(t, 20)
+	node.addVirtualOp(12, []interface{}{"interest", map[string]interface{}{"owner": "bob", "interest": "0.01000000 PIA"}})
+	node.addVirtualOp(12, []interface{}{"interest", map[string]interface{}{"owner": "carol", "interest": "0.02000000 PIA"}})
+	node.addVirtualOp(12, []interface{}{"fill_transfer_from_savings", map[string]interface{}{
+		"from": "bob", "to": "bob", "amount": "5.00000000 PIA", "memo": ""}})
+
+	wm, _, observer := testScanWalletManager(t, node, "bob")
+
+	//未开启时只提取普通交易
+	if err := wm.Blockscanner.ScanBlock(12); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(observer.extractedData()) != 0 {
+		t.Fatalf("virtual operations extracted while disabled")
+	}
+
+	wm.Config.ScanVirtualOps = true
+	if err := wm.Blockscanner.ScanBlock(12); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	extracted := observer.extractedData()
+	if len(extracted) != 2 {
+		t.Fatalf("expected 2 virtual balance changes, got %d", len(extracted))
+	}
+	for _, data := range extracted {
+		if len(data.TxInputs) != 0 || len(data.TxOutputs) != 1 {
+			t.Errorf("virtual operation should only credit the receiver: %+v", data)
+		}
+		if data.TxOutputs[0].Recharge.Address != "bob" {
+			t.Errorf("unexpected receiver: %s", data.TxOutputs[0].Recharge.Address)
+		}
+	}
+	if extracted[0].Transaction.TxID == extracted[1].Transaction.TxID {
+		t.Errorf("virtual operations must have distinct txid")
+	}
+	for _, data := range extracted {
+		tx := data.Transaction
+		switch tx.TxAction {
+		case "interest":
+			if len(tx.From) != 0 || tx.Amount != "0.01000000" {
+				t.Errorf("unexpected interest transaction: %+v", tx)
+			}
+		case "fill_transfer_from_savings":
+			if tx.Amount != "5.00000000" {
+				t.Errorf("unexpected savings transaction: %+v", tx)
+			}
+		default:
+			t.Errorf("unexpected transaction action: %s", tx.TxAction)
+		}
+	}
+}
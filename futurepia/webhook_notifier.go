@@ -0,0 +1,328 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	defaultWebhookMaxAttempts   = 5               //默认每个事件的最大投递次数
+	defaultWebhookRetryInterval = 1 * time.Second //默认首次重试间隔，之后指数增长
+	defaultWebhookTimeout       = 10 * time.Second
+	defaultWebhookQueueSize     = 1000 //默认每个地址的待投递事件数
+
+	WebhookEventBlock    = "block"    //新区块
+	WebhookEventFork     = "fork"     //分叉回滚的区块
+	WebhookEventExtract  = "extract"  //提取的交易记录
+	WebhookEventContract = "contract" //提取的合约回执
+
+	WebhookHeaderSignature = "X-PIA-Signature" //sha256=hex(HMAC-SHA256(secret, body))
+	WebhookHeaderSequence  = "X-PIA-Sequence"
+	WebhookHeaderEvent     = "X-PIA-Event"
+)
+
+//WebhookEvent 推送的事件内容
+type WebhookEvent struct {
+	Session   string      `json:"session"`  //每次启动随机生成，序号在会话内连续
+	Sequence  uint64      `json:"sequence"` //事件序号，接收方据此发现丢失的事件
+	Type      string      `json:"type"`
+	Symbol    string      `json:"symbol"`
+	SourceKey string      `json:"sourceKey,omitempty"`
+	Time      int64       `json:"time"`
+	Data      interface{} `json:"data"`
+}
+
+//webhookDelivery 待投递到一个地址的事件
+type webhookDelivery struct {
+	event   *WebhookEvent
+	payload []byte
+}
+
+//webhookPending 未能进入全部地址队列的事件，再次通知时沿用序号，只投递到剩余的地址
+type webhookPending struct {
+	delivery *webhookDelivery
+	urls     []string
+}
+
+//WebhookNotifier 通过HTTP POST推送扫描结果的观测者
+//事件写入每个地址的队列后立即返回，由后台任务按序号顺序投递和重试
+type WebhookNotifier struct {
+	URLs          []string
+	Secret        string        //HMAC签名密钥，为空时不签名
+	MaxAttempts   int           //每个地址的最大投递次数
+	RetryInterval time.Duration //首次重试间隔
+	QueueSize     int           //每个地址的待投递事件数，队列满时通知返回错误
+	Client        *http.Client
+
+	symbol   string
+	session  string
+	mu       sync.Mutex
+	sequence uint64
+	queues   map[string]chan *webhookDelivery
+	pending  map[string]*webhookPending //事件标识 -> 未进入队列的地址
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+//NewWebhookNotifier 创建webhook观测者
+func NewWebhookNotifier(symbol string, urls []string, secret string) *WebhookNotifier {
+	session := make([]byte, 8)
+	io.ReadFull(rand.Reader, session)
+
+	return &WebhookNotifier{
+		URLs:          urls,
+		Secret:        secret,
+		MaxAttempts:   defaultWebhookMaxAttempts,
+		RetryInterval: defaultWebhookRetryInterval,
+		QueueSize:     defaultWebhookQueueSize,
+		Client:        &http.Client{Timeout: defaultWebhookTimeout},
+		symbol:        symbol,
+		session:       hex.EncodeToString(session),
+	}
+}
+
+//OutboxKey 待投递队列中的观测者标识
+func (n *WebhookNotifier) OutboxKey() string {
+	return "webhook:" + strings.Join(n.URLs, ",")
+}
+
+//BlockScanNotify 新区块扫描完成通知，分叉区块以fork事件推送
+func (n *WebhookNotifier) BlockScanNotify(header *openwallet.BlockHeader) error {
+	eventType := WebhookEventBlock
+	if header.Fork {
+		eventType = WebhookEventFork
+	}
+	return n.post(eventType, "", eventType+"_"+header.Hash, header)
+}
+
+//BlockExtractDataNotify 区块提取结果通知
+func (n *WebhookNotifier) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	return n.post(WebhookEventExtract, sourceKey, WebhookEventExtract+"_"+sourceKey+"_"+data.Transaction.WxID, data)
+}
+
+//BlockExtractSmartContractDataNotify 区块提取智能合约交易结果通知
+func (n *WebhookNotifier) BlockExtractSmartContractDataNotify(sourceKey string, data *openwallet.SmartContractReceipt) error {
+	return n.post(WebhookEventContract, sourceKey, WebhookEventContract+"_"+sourceKey+"_"+data.TxID, data)
+}
+
+//Sign 计算payload的签名
+func (n *WebhookNotifier) Sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(n.Secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+//post 事件分配序号后写入每个地址的队列，任一地址的队列已满时返回错误
+//再次通知相同的事件时沿用之前的序号，只写入之前未能写入的地址
+func (n *WebhookNotifier) post(eventType, sourceKey, eventKey string, data interface{}) error {
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.start()
+
+	pending, retry := n.pending[eventKey]
+	if !retry {
+		n.sequence++
+		event := &WebhookEvent{
+			Session:   n.session,
+			Sequence:  n.sequence,
+			Type:      eventType,
+			Symbol:    n.symbol,
+			SourceKey: sourceKey,
+			Time:      time.Now().Unix(),
+			Data:      data,
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		pending = &webhookPending{
+			delivery: &webhookDelivery{event: event, payload: payload},
+			urls:     n.URLs,
+		}
+	}
+
+	full := make([]string, 0)
+	for _, url := range pending.urls {
+		select {
+		case n.queues[url] <- pending.delivery:
+		default:
+			full = append(full, url)
+		}
+	}
+
+	if len(full) > 0 {
+		pending.urls = full
+		n.pending[eventKey] = pending
+		return fmt.Errorf("webhook event %d queue is full, %s", pending.delivery.event.Sequence, strings.Join(full, ", "))
+	}
+	delete(n.pending, eventKey)
+	return nil
+}
+
+//start 为每个地址启动投递任务，调用者需持有n.mu
+func (n *WebhookNotifier) start() {
+	if n.quit != nil {
+		return
+	}
+
+	size := n.QueueSize
+	if size <= 0 {
+		size = defaultWebhookQueueSize
+	}
+
+	n.quit = make(chan struct{})
+	n.queues = make(map[string]chan *webhookDelivery)
+	n.pending = make(map[string]*webhookPending)
+	for _, url := range n.URLs {
+		if _, exist := n.queues[url]; exist {
+			continue
+		}
+		queue := make(chan *webhookDelivery, size)
+		n.queues[url] = queue
+		n.wg.Add(1)
+		go n.deliverLoop(url, queue, n.quit)
+	}
+}
+
+//Close 停止投递任务，队列中未投递的事件被丢弃
+func (n *WebhookNotifier) Close() {
+	n.mu.Lock()
+	quit := n.quit
+	n.quit = nil
+	n.mu.Unlock()
+
+	if quit != nil {
+		close(quit)
+		n.wg.Wait()
+	}
+}
+
+func (n *WebhookNotifier) deliverLoop(url string, queue chan *webhookDelivery, quit chan struct{}) {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case delivery := <-queue:
+			err := n.postWithRetry(url, delivery, quit)
+			if err != nil {
+				log.Std.Error("webhook event %d deliver to %s failed, unexpected error: %v", delivery.event.Sequence, url, err)
+			}
+		}
+	}
+}
+
+//postWithRetry 投递到一个地址，失败后按退避时间重试，序号保持不变
+func (n *WebhookNotifier) postWithRetry(url string, delivery *webhookDelivery, quit chan struct{}) error {
+
+	maxAttempts := n.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+
+	var err error
+	backoff := n.RetryInterval
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = n.postOnce(url, delivery.event, delivery.payload)
+		if err == nil {
+			return nil
+		}
+		if attempt < maxAttempts {
+			select {
+			case <-quit:
+				return err
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+func (n *WebhookNotifier) postOnce(url string, event *WebhookEvent, payload []byte) error {
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookHeaderEvent, event.Type)
+	req.Header.Set(WebhookHeaderSequence, strconv.FormatUint(event.Sequence, 10))
+	if n.Secret != "" {
+		req.Header.Set(WebhookHeaderSignature, n.Sign(payload))
+	}
+
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+//setupWebhookNotifier 按配置注册webhook观测者，替换之前注册的
+func (bs *PIABlockScanner) setupWebhookNotifier() {
+
+	if bs.webhook != nil {
+		bs.RemoveObserver(bs.webhook)
+		bs.webhook.Close()
+		bs.webhook = nil
+	}
+
+	if len(bs.wm.Config.WebhookURLs) == 0 {
+		return
+	}
+
+	notifier := NewWebhookNotifier(bs.wm.Symbol(), bs.wm.Config.WebhookURLs, bs.wm.Config.WebhookSecret)
+	if bs.wm.Config.WebhookMaxAttempts > 0 {
+		notifier.MaxAttempts = bs.wm.Config.WebhookMaxAttempts
+	}
+	if bs.wm.Config.WebhookRetryInterval > 0 {
+		notifier.RetryInterval = bs.wm.Config.WebhookRetryInterval
+	}
+
+	bs.webhook = notifier
+	bs.AddObserver(notifier)
+}
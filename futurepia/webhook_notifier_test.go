@@ -0,0 +1,285 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package futurepia
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//webhookReceiver 记录收到的事件，前failures次请求返回500
+type webhookReceiver struct {
+	t        *testing.T
+	secret   string
+	mu       sync.Mutex
+	failures int
+	requests int
+	events   []*WebhookEvent
+}
+
+func (rv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.requests++
+	if rv.failures > 0 {
+		rv.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	mac := hmac.New(sha256.New, []byte(rv.secret))
+	mac.Write(body)
+	if r.Header.Get(WebhookHeaderSignature) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		rv.t.Errorf("invalid signature")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		rv.t.Errorf("invalid payload: %v", err)
+	}
+	if r.Header.Get(WebhookHeaderEvent) != event.Type {
+		rv.t.Errorf("event header mismatch")
+	}
+	rv.events = append(rv.events, &event)
+}
+
+//waitRequests 等待接收方收到n个请求
+func (rv *webhookReceiver) waitRequests(t *testing.T, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		rv.mu.Lock()
+		requests := rv.requests
+		rv.mu.Unlock()
+		if requests >= n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d webhook requests", n)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	receiver := &webhookReceiver{t: t, secret: "s3cret"}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	notifier := NewWebhookNotifier("PIA", []string{server.URL}, "s3cret")
+	notifier.RetryInterval = time.Millisecond
+	defer notifier.Close()
+
+	if err := notifier.BlockScanNotify(&openwallet.BlockHeader{Height: 10, Hash: "h10"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	receiver.waitRequests(t, 1)
+
+	//失败后在后台重试，通知立即返回
+	receiver.mu.Lock()
+	receiver.failures = 2
+	receiver.mu.Unlock()
+	data := &openwallet.TxExtractData{Transaction: &openwallet.Transaction{TxID: "tx1", WxID: "wx1"}}
+	if err := notifier.BlockExtractDataNotify("account-bob", data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	receiver.waitRequests(t, 1+3)
+
+	//超过最大次数后丢弃，序号被占用
+	receiver.mu.Lock()
+	receiver.failures = notifier.MaxAttempts
+	receiver.mu.Unlock()
+	if err := notifier.BlockScanNotify(&openwallet.BlockHeader{Height: 11, Hash: "h11"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	receiver.waitRequests(t, 1+3+notifier.MaxAttempts)
+
+	if err := notifier.BlockScanNotify(&openwallet.BlockHeader{Height: 9, Hash: "h9", Fork: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	receiver.waitRequests(t, 1+3+notifier.MaxAttempts+1)
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if receiver.requests != 1+3+notifier.MaxAttempts+1 {
+		t.Errorf("unexpected request count: %d", receiver.requests)
+	}
+	if len(receiver.events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(receiver.events))
+	}
+
+	expected := []struct {
+		sequence  uint64
+		eventType string
+	}{
+		{1, WebhookEventBlock},
+		{2, WebhookEventExtract},
+		{4, WebhookEventFork},
+	}
+	for i, e := range expected {
+		event := receiver.events[i]
+		if event.Sequence != e.sequence || event.Type != e.eventType || event.Symbol != "PIA" || event.Session == "" {
+			t.Errorf("event %d: unexpected %+v", i, event)
+		}
+	}
+	if receiver.events[1].SourceKey != "account-bob" {
+		t.Errorf("unexpected source key: %s", receiver.events[1].SourceKey)
+	}
+	if receiver.events[2].Sequence-receiver.events[1].Sequence != 2 {
+		t.Errorf("expected gap in sequence for the lost event")
+	}
+}
+
+func TestSetupWebhookNotifier(t *testing.T) {
+	wm := NewWalletManager()
+	wm.Config.WebhookURLs = []string{"http://127.0.0.1:1/hook"}
+	wm.Blockscanner.setupWebhookNotifier()
+	wm.Blockscanner.setupWebhookNotifier()
+
+	count := 0
+	for o := range wm.Blockscanner.Observers {
+		if _, ok := o.(*WebhookNotifier); ok {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected 1 webhook observer, got %d", count)
+	}
+
+	wm.Config.WebhookURLs = nil
+	wm.Blockscanner.setupWebhookNotifier()
+	if len(wm.Blockscanner.Observers) != 0 {
+		t.Errorf("webhook observer not removed")
+	}
+}
+
+//blockingReceiver 阻塞请求直到release关闭
+type blockingReceiver struct {
+	release chan struct{}
+	mu      sync.Mutex
+	started int
+	events  []*WebhookEvent
+}
+
+func (rv *blockingReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rv.mu.Lock()
+	rv.started++
+	rv.mu.Unlock()
+	<-rv.release
+	body, _ := ioutil.ReadAll(r.Body)
+	var event WebhookEvent
+	json.Unmarshal(body, &event)
+	rv.mu.Lock()
+	rv.events = append(rv.events, &event)
+	rv.mu.Unlock()
+}
+
+func (rv *blockingReceiver) waitStarted(t *testing.T, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		rv.mu.Lock()
+		started := rv.started
+		rv.mu.Unlock()
+		if started >= n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d blocked requests", n)
+}
+
+func TestWebhookNotifierQueue(t *testing.T) {
+	slow := &blockingReceiver{release: make(chan struct{})}
+	slowServer := httptest.NewServer(slow)
+	defer slowServer.Close()
+	var release sync.Once
+	defer release.Do(func() { close(slow.release) })
+	receiver := &webhookReceiver{t: t, secret: "s3cret"}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	notifier := NewWebhookNotifier("PIA", []string{server.URL, slowServer.URL}, "s3cret")
+	notifier.QueueSize = 1
+	defer notifier.Close()
+
+	//慢速地址不阻塞通知，也不影响其他地址
+	for i := 1; i <= 2; i++ {
+		header := &openwallet.BlockHeader{Height: uint64(i), Hash: fmt.Sprintf("h%d", i)}
+		if err := notifier.BlockScanNotify(header); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		receiver.waitRequests(t, i)
+		slow.waitStarted(t, 1)
+	}
+
+	//慢速地址的队列已满，重新通知时沿用序号，只写入该地址
+	header := &openwallet.BlockHeader{Height: 3, Hash: "h3"}
+	if err := notifier.BlockScanNotify(header); err == nil {
+		t.Fatalf("expected queue full error")
+	}
+	receiver.waitRequests(t, 3)
+	release.Do(func() { close(slow.release) })
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		err := notifier.BlockScanNotify(header)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		slow.mu.Lock()
+		count := len(slow.events)
+		slow.mu.Unlock()
+		if count == 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	slow.mu.Lock()
+	defer slow.mu.Unlock()
+	if receiver.requests != 3 {
+		t.Errorf("expected 3 requests on the healthy url, got %d", receiver.requests)
+	}
+	if len(slow.events) != 3 {
+		t.Fatalf("expected 3 events on the slow url, got %d", len(slow.events))
+	}
+	for i, event := range slow.events {
+		if event.Sequence != uint64(i+1) || receiver.events[i].Sequence != uint64(i+1) {
+			t.Errorf("event %d: unexpected sequence %d/%d", i, event.Sequence, receiver.events[i].Sequence)
+		}
+	}
+}
@@ -9,12 +9,15 @@ require (
 	github.com/blocktree/go-owcrypt v1.1.1
 	github.com/blocktree/openwallet/v2 v2.0.10
 	github.com/eoscanada/eos-go v0.8.10
+	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/imroc/req v0.2.4
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.12.2
 	github.com/shopspring/decimal v0.0.0-20200105231215-408a2507e114
 	github.com/tidwall/gjson v1.3.5
-	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b // indirect
-
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	google.golang.org/protobuf v1.27.1 // indirect
 )
 
 //replace github.com/blocktree/openwallet => ../../openwallet